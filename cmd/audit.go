@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kfsoftware/hlf-sync/pkg/audit"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/spf13/cobra"
+)
+
+type auditOptions struct {
+	includeUnknown bool
+	all            bool
+}
+
+func NewAuditCmd() *cobra.Command {
+	c := auditOptions{}
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Lists the transactions whose endorsements don't satisfy the endorsement policy",
+		Long: `Lists the endorsement policy audit results recorded by the sync command when audit.enabled is set.
+The sync command must be stopped since the local data store can only be opened by one process.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := badger.Open(badger.DefaultOptions(DataStoreDirectory).WithReadOnly(true))
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			store := audit.NewBadgerStore(db)
+			results, err := store.Results()
+			if err != nil {
+				return err
+			}
+			summary := map[audit.Status]int{}
+			var anomalies []*audit.Result
+			for _, result := range results {
+				summary[result.Status]++
+				switch {
+				case c.all,
+					result.Status == audit.Unsatisfied,
+					result.Status == audit.Unknown && c.includeUnknown:
+					anomalies = append(anomalies, result)
+				}
+			}
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(
+				out,
+				"Transactions audited=%d satisfied=%d unsatisfied=%d unknown=%d\n\n",
+				len(results),
+				summary[audit.Satisfied],
+				summary[audit.Unsatisfied],
+				summary[audit.Unknown],
+			)
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "BLOCK\tTXID\tCHAINCODE\tSTATUS\tVALIDATION\tPOLICY\tENDORSING ORGS")
+			for _, result := range anomalies {
+				fmt.Fprintf(
+					w,
+					"%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					result.BlockNumber,
+					result.TXID,
+					result.ChaincodeID,
+					result.Status,
+					result.ValidationCode,
+					result.Policy,
+					strings.Join(result.EndorsingOrgs, ","),
+				)
+			}
+			return w.Flush()
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolVarP(&c.includeUnknown, "include-unknown", "", false, "Also list transactions whose policy couldn't be determined")
+	flags.BoolVarP(&c.all, "all", "", false, "List every audited transaction")
+	return cmd
+}
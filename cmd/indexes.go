@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/kfsoftware/hlf-sync/pkg/chaincode"
+	"github.com/kfsoftware/hlf-sync/pkg/listener"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/resmgmt"
+	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type indexesOptions struct {
+	configPath  string
+	channelName string
+	org         string
+	chaincode   string
+	packagePath string
+	packageID   string
+	peer        string
+	sink        string
+}
+
+func NewIndexesCmd() *cobra.Command {
+	c := indexesOptions{}
+	cmd := &cobra.Command{
+		Use:   "indexes",
+		Short: "Creates the indexes defined in the META-INF directory of a chaincode package",
+		Long: `Reads the CouchDB index definitions of a chaincode package and creates the equivalent indexes in the database.
+The package is read from a file with --package or fetched from a peer with --package-id, which requires --config, --org and --peer.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			packageBytes, err := c.readPackage()
+			if err != nil {
+				return err
+			}
+			indexes, err := chaincode.ReadIndexes(packageBytes)
+			if err != nil {
+				return err
+			}
+			if len(indexes) == 0 {
+				log.Infof("The package has no index definitions")
+				return nil
+			}
+			storage, err := newStorage(c.channelName, c.sink)
+			if err != nil {
+				return err
+			}
+			indexer, ok := storage.(listener.Indexer)
+			if !ok {
+				return errors.New("the database doesn't support indexes")
+			}
+			err = indexer.CreateIndexes(c.chaincode, indexes)
+			if err != nil {
+				return err
+			}
+			log.Infof("Created %d indexes of chaincode %s", len(indexes), c.chaincode)
+			return nil
+		},
+	}
+	persistentFlags := cmd.PersistentFlags()
+	persistentFlags.StringVarP(&c.configPath, "config", "", "", "Configuration file for the SDK")
+	persistentFlags.StringVarP(&c.channelName, "channel", "", "", "Channel name")
+	persistentFlags.StringVarP(&c.org, "org", "", "", "Organization of the peer holding the installed package")
+	persistentFlags.StringVarP(&c.chaincode, "chaincode", "", "", "Chaincode name")
+	persistentFlags.StringVarP(&c.packagePath, "package", "", "", "Chaincode package file")
+	persistentFlags.StringVarP(&c.packageID, "package-id", "", "", "ID of the package installed in the peer")
+	persistentFlags.StringVarP(&c.peer, "peer", "", "", "Peer holding the installed package, as named in the SDK configuration")
+	persistentFlags.StringVarP(&c.sink, "sink", "", "", "Sink of the configuration file, the primary sink by default")
+	cmd.MarkPersistentFlagRequired("channel")
+	cmd.MarkPersistentFlagRequired("chaincode")
+	return cmd
+}
+
+func (c indexesOptions) readPackage() ([]byte, error) {
+	switch {
+	case c.packagePath != "":
+		return ioutil.ReadFile(c.packagePath)
+	case c.packageID != "":
+		if c.configPath == "" || c.org == "" || c.peer == "" {
+			return nil, errors.New("--config, --org and --peer are required to fetch an installed package")
+		}
+		sdk, err := fabsdk.New(config.FromFile(c.configPath))
+		if err != nil {
+			return nil, err
+		}
+		defer sdk.Close()
+		resClient, err := resmgmt.New(sdk.Context(fabsdk.WithUser("admin"), fabsdk.WithOrg(c.org)))
+		if err != nil {
+			return nil, err
+		}
+		return resClient.LifecycleGetInstalledCCPackage(c.packageID, resmgmt.WithTargetEndpoints(c.peer))
+	}
+	return nil, errors.New("either --package or --package-id is required")
+}
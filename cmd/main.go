@@ -18,6 +18,11 @@ var rootCmd = &cobra.Command{
 
 func Execute() {
 	rootCmd.AddCommand(NewSyncCmd())
+	rootCmd.AddCommand(NewAuditCmd())
+	rootCmd.AddCommand(NewMigrateCmd())
+	rootCmd.AddCommand(NewIndexesCmd())
+	rootCmd.AddCommand(NewReindexCmd())
+	rootCmd.AddCommand(NewWebhookReplayCmd())
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
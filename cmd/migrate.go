@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"github.com/kfsoftware/hlf-sync/pkg/listener"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type migrateOptions struct {
+	channelName string
+	sink        string
+}
+
+func NewMigrateCmd() *cobra.Command {
+	c := migrateOptions{}
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrates the documents stored by previous versions to the current format",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := newStorage(c.channelName, c.sink)
+			if err != nil {
+				return err
+			}
+			migrator, ok := storage.(listener.Migrator)
+			if !ok {
+				log.Infof("Nothing to migrate")
+				return nil
+			}
+			err = migrator.Migrate()
+			if err != nil {
+				return err
+			}
+			log.Infof("Migration finished")
+			return nil
+		},
+	}
+	persistentFlags := cmd.PersistentFlags()
+	persistentFlags.StringVarP(&c.channelName, "channel", "", "", "Channel name")
+	persistentFlags.StringVarP(&c.sink, "sink", "", "", "Sink of the configuration file, the primary sink by default")
+	cmd.MarkPersistentFlagRequired("channel")
+	return cmd
+}
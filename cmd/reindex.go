@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"github.com/kfsoftware/hlf-sync/pkg/listener"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/context"
+	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type reindexOptions struct {
+	configPath  string
+	channelName string
+	org         string
+	batchSize   int
+	deleteOld   bool
+	sink        string
+}
+
+func NewReindexCmd() *cobra.Command {
+	c := reindexOptions{}
+	cmd := &cobra.Command{
+		Use:   "reindex",
+		Short: "Rebuilds the indexes of a channel from the ledger and switches to them atomically",
+		Long: `Builds a new generation of the indexes of the channel from the first block, with the current index templates,
+while the sync keeps writing to the current ones. Once it has caught up the aliases are switched to the new indexes in one request,
+and the blocks written by the sync in the meantime are stored again.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := newStorage(c.channelName, c.sink)
+			if err != nil {
+				return err
+			}
+			reindexer, ok := storage.(listener.Reindexer)
+			if !ok {
+				return errors.New("the database doesn't support reindexing")
+			}
+			sdk, err := fabsdk.New(config.FromFile(c.configPath))
+			if err != nil {
+				return err
+			}
+			defer sdk.Close()
+			channelCtx := sdk.ChannelContext(
+				c.channelName,
+				fabsdk.WithUser("admin"),
+				fabsdk.WithOrg(c.org),
+			)
+			ledgerClient, err := ledger.New(channelCtx)
+			if err != nil {
+				return err
+			}
+			chCtx, err := channelCtx()
+			if err != nil {
+				return err
+			}
+			targetPeers, err := getTargetPeers(chCtx)
+			if err != nil {
+				return err
+			}
+			source := ledgerSource{client: ledgerClient, targets: targetPeers}
+			generation, err := reindexer.Reindex()
+			if err != nil {
+				return err
+			}
+			blockNumber, err := reindexBlocks(generation, source, chCtx, 0, c.batchSize)
+			if err != nil {
+				return err
+			}
+			err = generation.Publish(c.deleteOld)
+			if err != nil {
+				return err
+			}
+			// the sync may have stored newer blocks in the previous indexes until the switch,
+			// storing them again is a no-op for the documents already written
+			_, err = reindexBlocks(generation, source, chCtx, blockNumber, c.batchSize)
+			if err != nil {
+				return err
+			}
+			log.Infof("Reindex of channel %s finished", c.channelName)
+			return nil
+		},
+	}
+	persistentFlags := cmd.PersistentFlags()
+	persistentFlags.StringVarP(&c.configPath, "config", "", "", "Configuration file for the SDK")
+	persistentFlags.StringVarP(&c.channelName, "channel", "", "", "Channel name")
+	persistentFlags.StringVarP(&c.org, "org", "", "", "Organization of the user querying the blocks")
+	persistentFlags.IntVarP(&c.batchSize, "batch-size", "", BatchBlockIndexing, "Number of blocks per batch")
+	persistentFlags.BoolVarP(&c.deleteOld, "delete-old", "", false, "Delete the previous indexes once the aliases are switched")
+	persistentFlags.StringVarP(&c.sink, "sink", "", "", "Sink of the configuration file, the primary sink by default")
+	cmd.MarkPersistentFlagRequired("config")
+	cmd.MarkPersistentFlagRequired("channel")
+	cmd.MarkPersistentFlagRequired("org")
+	return cmd
+}
+
+// reindexBlocks stores the blocks from blockNumber up to the last block of the channel in batches,
+// returning the next block to store
+func reindexBlocks(
+	storage listener.BlockStorage,
+	source listener.BlockSource,
+	chCtx context.Channel,
+	blockNumber int,
+	batchSize int,
+) (int, error) {
+	for {
+		lastBlock, err := getChannelHeight(chCtx)
+		if err != nil {
+			return blockNumber, err
+		}
+		if blockNumber > lastBlock {
+			return blockNumber, nil
+		}
+		batchEnd := lastBlock
+		if batchSize > 0 && blockNumber+batchSize-1 < batchEnd {
+			batchEnd = blockNumber + batchSize - 1
+		}
+		blocks, err := source.Blocks(blockNumber, batchEnd)
+		if err != nil {
+			return blockNumber, err
+		}
+		err = storage.StoreBulk(blocks)
+		if err != nil {
+			return blockNumber, errors.Wrapf(err, "failed storing blocks %d..%d", blockNumber, batchEnd)
+		}
+		log.Infof("Reindexed blocks %d..%d of %d", blockNumber, batchEnd, lastBlock)
+		blockNumber = batchEnd + 1
+	}
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/kfsoftware/hlf-sync/pkg/listener"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// DefaultSinkName is the name of the sink of the database section, its checkpoint is stored in CurrentBlockKey
+const DefaultSinkName = "default"
+
+type sinkConfig struct {
+	Name     string
+	Primary  bool
+	Database map[string]interface{}
+}
+
+// newSinks creates the storages of the sinks section of the configuration file, or of the database
+// section when there are no sinks
+func newSinks(channelName string) ([]listener.Sink, error) {
+	transformOpts := transformOptions()
+	if !viper.IsSet("sinks") {
+		storage, err := listener.NewStorage(viper.GetString("database.type"), channelName, func(config interface{}) error {
+			return viper.UnmarshalKey("database", config)
+		}, transformOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return []listener.Sink{{Name: DefaultSinkName, Storage: storage, Primary: true}}, nil
+	}
+	var configs []sinkConfig
+	err := viper.UnmarshalKey("sinks", &configs)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sinks configuration")
+	}
+	var sinks []listener.Sink
+	for _, sinkConfig := range configs {
+		if sinkConfig.Name == "" {
+			return nil, errors.New("every sink needs a name")
+		}
+		databaseType, _ := sinkConfig.Database["type"].(string)
+		storage, err := listener.NewStorage(databaseType, channelName, decodeSection(sinkConfig.Database), transformOpts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sink %q", sinkConfig.Name)
+		}
+		sinks = append(sinks, listener.Sink{Name: sinkConfig.Name, Storage: storage, Primary: sinkConfig.Primary})
+	}
+	return sinks, nil
+}
+
+// transformOptions returns the options decoding the blocks, from the documents section of the configuration file
+func transformOptions() []transformation.Option {
+	return []transformation.Option{
+		transformation.WithCreator(viper.GetBool("documents.stampCreator")),
+		transformation.WithPrivateDataHashes(viper.GetBool("documents.privateDataHashes")),
+	}
+}
+
+// newStorage creates the storage of the sink with the given name, or of the primary sink when the name is empty
+func newStorage(channelName string, sinkName string) (listener.BlockStorage, error) {
+	sinks, err := newSinks(channelName)
+	if err != nil {
+		return nil, err
+	}
+	for _, sink := range sinks {
+		if sink.Name == sinkName {
+			return sink.Storage, nil
+		}
+	}
+	if sinkName != "" {
+		return nil, errors.Errorf("sink %q not found", sinkName)
+	}
+	for _, sink := range sinks {
+		if sink.Primary {
+			return sink.Storage, nil
+		}
+	}
+	return sinks[0].Storage, nil
+}
+
+// sinkSection returns the database type and the decoder of the configuration of the sink with the given name,
+// or of the primary sink when the name is empty, without creating its storage
+func sinkSection(sinkName string) (string, listener.ConfigDecoder, error) {
+	if !viper.IsSet("sinks") {
+		if sinkName != "" && sinkName != DefaultSinkName {
+			return "", nil, errors.Errorf("sink %q not found", sinkName)
+		}
+		return viper.GetString("database.type"), func(config interface{}) error {
+			return viper.UnmarshalKey("database", config)
+		}, nil
+	}
+	var configs []sinkConfig
+	err := viper.UnmarshalKey("sinks", &configs)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid sinks configuration")
+	}
+	if len(configs) == 0 {
+		return "", nil, errors.New("no sinks configured")
+	}
+	selected := &configs[0]
+	for i, sinkConfig := range configs {
+		if (sinkName == "" && sinkConfig.Primary) || (sinkName != "" && sinkConfig.Name == sinkName) {
+			selected = &configs[i]
+			break
+		}
+	}
+	if sinkName != "" && selected.Name != sinkName {
+		return "", nil, errors.Errorf("sink %q not found", sinkName)
+	}
+	databaseType, _ := selected.Database["type"].(string)
+	return databaseType, decodeSection(selected.Database), nil
+}
+
+// decodeSection decodes a section read from a list of the configuration file, with the same conversions as viper
+func decodeSection(section map[string]interface{}) listener.ConfigDecoder {
+	return func(config interface{}) error {
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			DecodeHook: mapstructure.ComposeDecodeHookFunc(
+				mapstructure.StringToTimeDurationHookFunc(),
+				mapstructure.StringToSliceHookFunc(","),
+			),
+			WeaklyTypedInput: true,
+			Result:           config,
+		})
+		if err != nil {
+			return err
+		}
+		return decoder.Decode(section)
+	}
+}
+
+// badgerCheckpoints stores the last block stored by every sink in the badger database
+type badgerCheckpoints struct {
+	db *badger.DB
+}
+
+func checkpointKey(sink string) []byte {
+	if sink == DefaultSinkName {
+		return []byte(CurrentBlockKey)
+	}
+	return []byte(CurrentBlockKey + "." + sink)
+}
+
+func (c badgerCheckpoints) LoadCheckpoint(sink string) (int, bool, error) {
+	var blockNumber int
+	var found bool
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(checkpointKey(sink))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		blockNumber, err = strconv.Atoi(string(val))
+		if err != nil {
+			log.Warnf("Invalid block number of sink %s, listening from first block: %v", sink, err)
+			return nil
+		}
+		found = true
+		return nil
+	})
+	return blockNumber, found, err
+}
+
+func (c badgerCheckpoints) SaveCheckpoint(sink string, blockNumber int) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(checkpointKey(sink), []byte(strconv.Itoa(blockNumber)))
+	})
+}
+
+// ledgerSource fetches the blocks from the peers of the channel
+type ledgerSource struct {
+	client  *ledger.Client
+	targets []fab.Peer
+}
+
+func (s ledgerSource) Blocks(from int, to int) ([]*common.Block, error) {
+	var blocks []*common.Block
+	for i := from; i <= to; i++ {
+		block, err := s.client.QueryBlock(uint64(i), ledger.WithTargets(s.targets...))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed getting block %d", i)
+		}
+		if i%100 == 0 {
+			log.Infof("Fetching %d from %d", i, to)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
@@ -1,34 +1,24 @@
 package cmd
 
 import (
-	"strconv"
 	"time"
 
+	"github.com/kfsoftware/hlf-sync/pkg/audit"
 	"github.com/kfsoftware/hlf-sync/pkg/listener"
 
 	"github.com/dgraph-io/badger/v2"
-	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/hyperledger/fabric-protos-go/common"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/context"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
 	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
 	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
-	"github.com/meilisearch/meilisearch-go"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-type Provider string
-
-const (
-	MeiliSearch   Provider = "meilisearch"
-	ElasticSearch Provider = "elasticsearch"
-	Database      Provider = "sql"
-)
-
 type options struct {
 	configPath     string
 	channelName    string
@@ -88,6 +78,43 @@ func getChannelHeight(ctxChannel context.Channel) (int, error) {
 	log.Infof("Ledger height= %d", ledgerHeight)
 	return ledgerHeight, nil
 }
+
+// auditBlocks audits the blocks and saves the results along with the state of the auditor
+func auditBlocks(auditor *audit.Auditor, auditStore *audit.BadgerStore, blocks []*common.Block) error {
+	results, err := auditor.AuditBlocks(blocks)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Status == audit.Unsatisfied {
+			log.Warnf("Endorsement policy %s not satisfied by tx %s in block %d", result.Policy, result.TXID, result.BlockNumber)
+		}
+	}
+	return auditStore.Save(auditor.State(), results)
+}
+
+// catchUpAudit audits the blocks from the height of the auditor up to lastBlock, e.g. the blocks
+// stored before the audit was enabled
+func catchUpAudit(auditor *audit.Auditor, auditStore *audit.BadgerStore, source listener.BlockSource, lastBlock int, batchSize int) error {
+	for blockNumber := auditor.State().Height; blockNumber <= lastBlock; {
+		batchEnd := lastBlock
+		if batchSize > 0 && blockNumber+batchSize-1 < batchEnd {
+			batchEnd = blockNumber + batchSize - 1
+		}
+		blocks, err := source.Blocks(blockNumber, batchEnd)
+		if err != nil {
+			return err
+		}
+		err = auditBlocks(auditor, auditStore, blocks)
+		if err != nil {
+			return errors.Wrapf(err, "failed auditing blocks %d..%d", blockNumber, batchEnd)
+		}
+		log.Infof("Audited blocks %d..%d stored before", blockNumber, batchEnd)
+		blockNumber = batchEnd + 1
+	}
+	return nil
+}
+
 func NewSyncCmd() *cobra.Command {
 	c := options{}
 	cmd := &cobra.Command{
@@ -99,63 +126,21 @@ func NewSyncCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			provider := viper.GetString("database.type")
-			var storage listener.BlockStorage
-			switch provider {
-			case string(MeiliSearch):
-				databaseURL := viper.GetString("database.url")
-				password := viper.GetString("database.apiKey")
-				meiliClient := meilisearch.NewClient(meilisearch.Config{
-					Host:   databaseURL,
-					APIKey: password,
-				})
-				_, err := meiliClient.Indexes().List()
-				if err != nil {
-					return err
-				}
-				storage, err = listener.NewMeilisearchStorage(meiliClient, c.channelName)
-				if err != nil {
-					return err
-				}
-			case string(ElasticSearch):
-				databaseURLs := viper.GetStringSlice("database.urls")
-				user := viper.GetString("database.user")
-				password := viper.GetString("database.password")
-				cfg := elasticsearch.Config{
-					Addresses: databaseURLs,
-					Username:  user,
-					Password:  password,
-				}
-				esClient, err := elasticsearch.NewClient(
-					cfg,
-				)
+			sinks, err := newSinks(c.channelName)
+			if err != nil {
+				return err
+			}
+			var auditor *audit.Auditor
+			auditStore := audit.NewBadgerStore(db)
+			if viper.GetBool("audit.enabled") {
+				auditState, err := auditStore.LoadState()
 				if err != nil {
-					log.Fatalf("Error creating the client: %s", err)
 					return err
 				}
-				storage = listener.NewElasticStorage(esClient)
-			case string(Database):
-				driverName := viper.GetString("database.driver")
-				dataSource := viper.GetString("database.dataSource")
-				var drName listener.DriverName
-				switch driverName {
-				case listener.PostgresqlDriver:
-					drName = listener.PostgresqlDriver
-				case listener.MySQLDriver:
-					drName = listener.MySQLDriver
-				default:
-					return errors.Errorf("Driver %s not supported", driverName)
-				}
-				storage, err = listener.NewPostgresStorage(
-					drName,
-					dataSource,
-					c.channelName,
-				)
+				auditor, err = audit.NewAuditor(auditState)
 				if err != nil {
 					return err
 				}
-			default:
-				return errors.Errorf("No valid provider: %s", provider)
 			}
 			configBackend := config.FromFile(c.configPath)
 			sdk, err := fabsdk.New(configBackend)
@@ -167,33 +152,6 @@ func NewSyncCmd() *cobra.Command {
 				fabsdk.WithUser("admin"),
 				fabsdk.WithOrg(c.org),
 			)
-			var blockNumber int
-			err = db.View(func(txn *badger.Txn) error {
-				item, err := txn.Get([]byte(CurrentBlockKey))
-				if err != nil {
-					log.Warnf("Entry, listening from first block: %v", err)
-					blockNumber = 0
-					return err
-				}
-				val, err := item.ValueCopy(nil)
-				if err != nil {
-					log.Warnf("Block number not found, listening from first block: %v", err)
-					blockNumber = 0
-					return err
-				}
-				blockNumberStored, err := strconv.Atoi(string(val))
-				if err != nil {
-					log.Warnf("Block number not found, listening from first block: %v", err)
-					blockNumber = 0
-				} else {
-					blockNumber = blockNumberStored + 1
-					log.Infof("Block number found: %d", blockNumber)
-				}
-				return nil
-			})
-			if c.blockNumber >= 0 {
-				blockNumber = c.blockNumber
-			}
 			ledgerClient, err := ledger.New(channelCtx)
 			if err != nil {
 				return err
@@ -207,6 +165,26 @@ func NewSyncCmd() *cobra.Command {
 				return err
 			}
 			log.Infof("Peers %v", targetPeers)
+			source := ledgerSource{client: ledgerClient, targets: targetPeers}
+			policy := listener.FanOutPolicy(viper.GetString("fanout.policy"))
+			if policy == "" {
+				policy = listener.WaitAll
+			}
+			fanOut, err := listener.NewFanOut(sinks, policy, badgerCheckpoints{db: db}, source, transformOptions()...)
+			if err != nil {
+				return err
+			}
+			if c.blockNumber >= 0 {
+				fanOut.Rewind(c.blockNumber)
+			}
+			blockNumber := fanOut.Next()
+			if auditor != nil {
+				// the blocks the sinks already have are audited first, so every transaction is audited
+				err = catchUpAudit(auditor, auditStore, source, blockNumber-1, c.batchIndexStep)
+				if err != nil {
+					return err
+				}
+			}
 			chHeightBlock, err := getChannelHeight(chCtx)
 			if err != nil {
 				return err
@@ -266,41 +244,44 @@ func NewSyncCmd() *cobra.Command {
 						log.Fatalf("Failed getting blockchain info: %v", err)
 						return
 					}
-					if currHeight == blockNumber {
+					blockNumber := fanOut.Next()
+					if blockNumber > currHeight {
+						// the writes of the last blocks may have been applied since
+						err = fanOut.Checkpoint()
+						if err != nil {
+							log.Fatalf("Failed storing blocks: %v", err)
+							return
+						}
 						log.Infof("There are no blocks created, sleeping for %s", pause)
 						time.Sleep(pause)
 						continue
 					}
-					var blocks []*common.Block
-					for i := blockNumber; i <= currHeight; i++ {
-						block, err := ledgerClient.QueryBlock(uint64(i), ledger.WithTargets(targetPeers...))
+					lastBlock := currHeight
+					if c.batchIndexStep > 0 && blockNumber+c.batchIndexStep-1 < lastBlock {
+						lastBlock = blockNumber + c.batchIndexStep - 1
+					}
+					blocks, err := source.Blocks(blockNumber, lastBlock)
+					if err != nil {
+						log.Fatalf("Failed getting blocks: %v", err)
+						return
+					}
+					log.Debugf("Blocks in bulk=%d", len(blocks))
+					if auditor != nil {
+						// the audit is saved before the checkpoints of the sinks move past the blocks
+						err = auditBlocks(auditor, auditStore, blocks)
 						if err != nil {
-							log.Fatalf("Failed getting block %d: %v", i, err)
+							log.Fatalf("Failed auditing %d blocks: %v", len(blocks), err)
 							return
 						}
-						if i%100 == 0 {
-							log.Infof("Fetching %d from %d", i, currHeight)
-						}
-						blocks = append(blocks, block)
 					}
-					log.Debugf("Blocks in bulk=%d", len(blocks))
-					err = storage.StoreBulk(blocks)
+					err = fanOut.Deliver(blocks)
 					if err != nil {
 						log.Fatalf("Failed storing %d blocks: %v", len(blocks), err)
 						return
 					}
-					log.Debugf("Updating database for block numbers=%d..%d", blockNumber, currHeight)
-					blockNumber = currHeight
-					err = db.Update(func(txn *badger.Txn) error {
-						val := []byte(strconv.Itoa(blockNumber))
-						err = txn.Set([]byte(CurrentBlockKey), val)
-						if err != nil {
-							log.Errorf("Failed to set current block key=%v", err)
-						}
-						return err
-					})
-					if err != nil {
-						log.Errorf("Failed to update Badger Database %v", err)
+					log.Debugf("Stored block numbers=%d..%d", blockNumber, lastBlock)
+					if lastBlock < currHeight {
+						continue
 					}
 					log.Infof("Sleeping for %s..", pause)
 					time.Sleep(pause)
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"github.com/kfsoftware/hlf-sync/pkg/listener"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/ledger"
+	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type webhookReplayOptions struct {
+	configPath  string
+	channelName string
+	org         string
+	sink        string
+	endpoints   []string
+	from        int
+	to          int
+	batchSize   int
+	attempts    int
+}
+
+func NewWebhookReplayCmd() *cobra.Command {
+	c := webhookReplayOptions{}
+	cmd := &cobra.Command{
+		Use:   "webhook-replay",
+		Short: "Posts a range of blocks to the endpoints of a webhook sink again",
+		Long: `Posts the items of the blocks from --from to --to to the endpoints of a webhook sink, directly and without
+the outbox of the sync, which can keep running. The command fails when a POST is still rejected after --attempts tries.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if c.from < 0 || c.to < c.from {
+				return errors.Errorf("invalid block range %d-%d", c.from, c.to)
+			}
+			if c.batchSize <= 0 {
+				return errors.Errorf("invalid batch size %d, it must be positive", c.batchSize)
+			}
+			databaseType, decode, err := sinkSection(c.sink)
+			if err != nil {
+				return err
+			}
+			if databaseType != "webhook" {
+				return errors.Errorf("the sink is a %s sink, not a webhook sink", databaseType)
+			}
+			webhookConfig := &listener.WebhookStorageConfig{}
+			err = decode(webhookConfig)
+			if err != nil {
+				return errors.Wrap(err, "invalid webhook configuration")
+			}
+			err = webhookConfig.Validate()
+			if err != nil {
+				return errors.Wrap(err, "invalid webhook configuration")
+			}
+			replayer, err := listener.NewWebhookReplayer(*webhookConfig, c.channelName, c.endpoints, c.attempts, transformOptions()...)
+			if err != nil {
+				return err
+			}
+			defer replayer.Close()
+			sdk, err := fabsdk.New(config.FromFile(c.configPath))
+			if err != nil {
+				return err
+			}
+			defer sdk.Close()
+			channelCtx := sdk.ChannelContext(
+				c.channelName,
+				fabsdk.WithUser("admin"),
+				fabsdk.WithOrg(c.org),
+			)
+			ledgerClient, err := ledger.New(channelCtx)
+			if err != nil {
+				return err
+			}
+			chCtx, err := channelCtx()
+			if err != nil {
+				return err
+			}
+			targetPeers, err := getTargetPeers(chCtx)
+			if err != nil {
+				return err
+			}
+			source := ledgerSource{client: ledgerClient, targets: targetPeers}
+			for blockNumber := c.from; blockNumber <= c.to; blockNumber += c.batchSize {
+				batchEnd := blockNumber + c.batchSize - 1
+				if batchEnd > c.to {
+					batchEnd = c.to
+				}
+				blocks, err := source.Blocks(blockNumber, batchEnd)
+				if err != nil {
+					return err
+				}
+				err = replayer.StoreBulk(blocks)
+				if err != nil {
+					return errors.Wrapf(err, "failed to replay blocks %d-%d", blockNumber, batchEnd)
+				}
+				log.Infof("Blocks %d-%d replayed", blockNumber, batchEnd)
+			}
+			return nil
+		},
+	}
+	persistentFlags := cmd.PersistentFlags()
+	persistentFlags.StringVarP(&c.configPath, "config", "", "", "Configuration file for the SDK")
+	persistentFlags.StringVarP(&c.channelName, "channel", "", "", "Channel name")
+	persistentFlags.StringVarP(&c.org, "org", "", "", "Organization of the user querying the blocks")
+	persistentFlags.StringVarP(&c.sink, "sink", "", "", "Webhook sink of the configuration file, the primary sink by default")
+	persistentFlags.StringSliceVarP(&c.endpoints, "endpoint", "", nil, "Endpoints to post to, all the endpoints of the sink by default")
+	persistentFlags.IntVarP(&c.from, "from", "", 0, "First block to replay")
+	persistentFlags.IntVarP(&c.to, "to", "", 0, "Last block to replay")
+	persistentFlags.IntVarP(&c.batchSize, "batch-size", "", 100, "Number of blocks per batch")
+	persistentFlags.IntVarP(&c.attempts, "attempts", "", 5, "Tries of every POST before failing")
+	cmd.MarkPersistentFlagRequired("config")
+	cmd.MarkPersistentFlagRequired("channel")
+	cmd.MarkPersistentFlagRequired("org")
+	cmd.MarkPersistentFlagRequired("from")
+	cmd.MarkPersistentFlagRequired("to")
+	return cmd
+}
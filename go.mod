@@ -3,31 +3,41 @@ module github.com/kfsoftware/hlf-sync
 go 1.15
 
 require (
+	github.com/ClickHouse/clickhouse-go v1.5.4
 	github.com/Knetic/govaluate v3.0.0+incompatible
+	github.com/Shopify/sarama v1.29.1
+	github.com/alicebob/miniredis/v2 v2.23.0
 	github.com/cloudflare/cfssl v1.4.1
 	github.com/dgraph-io/badger/v2 v2.2007.2
 	github.com/elastic/go-elasticsearch/v7 v7.10.0
 	github.com/go-kit/kit v0.8.0
-	github.com/gogo/protobuf v1.2.1
-	github.com/golang/protobuf v1.3.3
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/gogo/protobuf v1.3.2
+	github.com/golang/protobuf v1.5.2
 	github.com/hyperledger/fabric-lib-go v1.0.0
 	github.com/hyperledger/fabric-protos-go v0.0.0-20200707132912-fee30f3ccd23
 	github.com/hyperledger/fabric-sdk-go v1.0.0-rc1
-	github.com/meilisearch/meilisearch-go v0.13.1
+	github.com/mattn/go-sqlite3 v1.14.16 // indirect
 	github.com/miekg/pkcs11 v1.0.3
+	github.com/minio/minio-go/v7 v7.0.16
 	github.com/mitchellh/mapstructure v1.3.2
+	github.com/nats-io/nats-server/v2 v2.6.0
+	github.com/nats-io/nats.go v1.12.3
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.1.0
-	github.com/sirupsen/logrus v1.7.0
+	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/viper v1.7.0
-	github.com/stretchr/testify v1.6.1
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
-	google.golang.org/grpc v1.29.1
-	gopkg.in/yaml.v2 v2.3.0
+	github.com/stretchr/testify v1.7.0
+	github.com/xitongsys/parquet-go v1.6.1
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	go.mongodb.org/mongo-driver v1.12.1
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
+	google.golang.org/grpc v1.33.1
+	gopkg.in/yaml.v2 v2.4.0
 	gorm.io/datatypes v1.0.0
 	gorm.io/driver/mysql v1.0.5
 	gorm.io/driver/postgres v1.0.8
-	gorm.io/driver/sqlite v1.1.4 // indirect
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.3
 )
@@ -0,0 +1,320 @@
+package audit
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	lb "github.com/hyperledger/fabric-protos-go/peer/lifecycle"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/common/channelconfig"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/core/common/ccprovider"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/msp"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/protoutil"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/sdkinternal/pkg/txflags"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Status string
+
+const (
+	Satisfied   Status = "satisfied"
+	Unsatisfied Status = "unsatisfied"
+	// Unknown is used when the policy in effect can't be determined, e.g. when the
+	// chaincode was defined before the first block that was audited
+	Unknown Status = "unknown"
+)
+
+const (
+	LifecycleNamespace = "_lifecycle"
+	LSCCNamespace      = "lscc"
+
+	lifecycleFieldsPrefix      = "namespaces/fields/"
+	lifecycleValidationInfoKey = "/ValidationInfo"
+	lifecycleEndorsementPolicy = "/Channel/Application/LifecycleEndorsement"
+)
+
+type Result struct {
+	TXID           string   `json:"txid"`
+	BlockNumber    int      `json:"blockNumber"`
+	TXIndex        int      `json:"txIndex"`
+	TXDate         int      `json:"tx_date"`
+	ChannelID      string   `json:"channelId"`
+	ChaincodeID    string   `json:"chaincodeId"`
+	ValidationCode string   `json:"validationCode"`
+	Policy         string   `json:"policy"`
+	Status         Status   `json:"status"`
+	EndorsingOrgs  []string `json:"endorsingOrgs"`
+}
+
+// ChaincodePolicy is the endorsement policy of a chaincode as defined in the ledger
+type ChaincodePolicy struct {
+	// Policy is a marshaled peer.ApplicationPolicy
+	Policy      []byte `json:"policy"`
+	Namespace   string `json:"namespace"`
+	BlockNumber int    `json:"blockNumber"`
+}
+
+// State holds everything needed to evaluate the endorsement policies of the next block
+type State struct {
+	Policies map[string]*ChaincodePolicy `json:"policies"`
+	// Config is the marshaled cb.Config of the last config block
+	Config []byte `json:"config"`
+	// Height is the number of the next block to audit, the blocks below were audited with the policies in
+	// effect at their time and are skipped when they're delivered again
+	Height int `json:"height"`
+}
+
+type Auditor struct {
+	state  *State
+	config *cb.Config
+	// deserializer holds the MSPs of the config, it's nil when they can't be loaded
+	deserializer msp.IdentityDeserializer
+}
+
+func NewAuditor(state *State) (*Auditor, error) {
+	if state == nil {
+		state = &State{}
+	}
+	if state.Policies == nil {
+		state.Policies = map[string]*ChaincodePolicy{}
+	}
+	auditor := &Auditor{
+		state: state,
+	}
+	if len(state.Config) > 0 {
+		config := &cb.Config{}
+		err := proto.Unmarshal(state.Config, config)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal stored channel config")
+		}
+		auditor.loadConfig(config)
+	}
+	return auditor, nil
+}
+
+func (a *Auditor) State() *State {
+	return a.state
+}
+
+func (a *Auditor) AuditBlocks(blocks []*cb.Block) ([]*Result, error) {
+	var results []*Result
+	for _, block := range blocks {
+		r, err := a.AuditBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+	return results, nil
+}
+
+// AuditBlock evaluates the endorsements of every endorser transaction in the block against the
+// policy in effect, then applies the chaincode definitions and config updates found in the block.
+// The blocks must be audited in order, a block after the height fails since the policies defined
+// in the blocks missing would be unknown
+func (a *Auditor) AuditBlock(block *cb.Block) ([]*Result, error) {
+	var results []*Result
+	blockNumber := int(block.Header.Number)
+	if blockNumber < a.state.Height {
+		log.Debugf("Block %d already audited", blockNumber)
+		return nil, nil
+	}
+	if blockNumber > a.state.Height {
+		return nil, errors.Errorf("block %d can't be audited before block %d", blockNumber, a.state.Height)
+	}
+	txFilter := txflags.ValidationFlags(nil)
+	if block.Metadata != nil && len(block.Metadata.Metadata) > int(cb.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		txFilter = block.Metadata.Metadata[cb.BlockMetadataIndex_TRANSACTIONS_FILTER]
+	}
+	for txIndex, txData := range block.Data.Data {
+		env, err := protoutil.GetEnvelopeFromBlock(txData)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := protoutil.UnmarshalPayload(env.Payload)
+		if err != nil {
+			return nil, err
+		}
+		chdr, err := protoutil.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+		if err != nil {
+			return nil, err
+		}
+		txDate, err := ptypes.Timestamp(chdr.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		valid := txIndex >= len(txFilter) || txFilter.IsValid(txIndex)
+		switch cb.HeaderType(chdr.Type) {
+		case cb.HeaderType_CONFIG:
+			configEnvelope := &cb.ConfigEnvelope{}
+			err = proto.Unmarshal(payload.Data, configEnvelope)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to unmarshal config envelope in block %d", blockNumber)
+			}
+			err = a.setConfig(configEnvelope.Config)
+			if err != nil {
+				return nil, err
+			}
+		case cb.HeaderType_ENDORSER_TRANSACTION:
+			tx, err := protoutil.UnmarshalTransaction(payload.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, txAction := range tx.Actions {
+				ccActionPayload, ccAction, err := protoutil.GetPayloads(txAction)
+				if err != nil {
+					log.Debugf("Failed to get payloads of tx %s: %v", chdr.TxId, err)
+					continue
+				}
+				var endorsers []*transformation.Identity
+				var serializedEndorsers [][]byte
+				for _, endorsement := range ccActionPayload.Action.Endorsements {
+					serializedEndorsers = append(serializedEndorsers, endorsement.Endorser)
+					endorser, err := transformation.DecodeIdentity(endorsement.Endorser)
+					if err != nil {
+						log.Debugf("Failed to decode endorser of tx %s: %v", chdr.TxId, err)
+						continue
+					}
+					endorsers = append(endorsers, endorser)
+				}
+				result := &Result{
+					TXID:          chdr.TxId,
+					BlockNumber:   blockNumber,
+					TXIndex:       txIndex,
+					TXDate:        int(txDate.UnixNano() / int64(time.Millisecond)),
+					ChannelID:     chdr.ChannelId,
+					EndorsingOrgs: endorsingOrgs(endorsers),
+				}
+				if ccAction.ChaincodeId != nil {
+					result.ChaincodeID = ccAction.ChaincodeId.Name
+				}
+				if txIndex < len(txFilter) {
+					result.ValidationCode = txFilter.Flag(txIndex).String()
+				}
+				result.Policy, result.Status, err = a.evaluate(result.ChaincodeID, serializedEndorsers)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to evaluate endorsement policy of tx %s", chdr.TxId)
+				}
+				results = append(results, result)
+				if valid {
+					err = a.applyWrites(ccAction.Results, blockNumber)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	a.state.Height = blockNumber + 1
+	return results, nil
+}
+
+func (a *Auditor) setConfig(config *cb.Config) error {
+	if config == nil {
+		return nil
+	}
+	configBytes, err := proto.Marshal(config)
+	if err != nil {
+		return err
+	}
+	a.loadConfig(config)
+	a.state.Config = configBytes
+	return nil
+}
+
+// loadConfig sets the config in effect and loads its MSPs, the policies can't be evaluated without them
+func (a *Auditor) loadConfig(config *cb.Config) {
+	a.config = config
+	a.deserializer = nil
+	suite, err := newCryptoSuite()
+	if err != nil {
+		log.Warnf("Failed to create the crypto suite of the MSPs: %v", err)
+		return
+	}
+	channelConfig, err := channelconfig.NewChannelConfig(config.ChannelGroup, suite)
+	if err != nil {
+		log.Warnf("Failed to load the MSPs of the channel config: %v", err)
+		return
+	}
+	a.deserializer = channelConfig.MSPManager()
+}
+
+// applyWrites records the chaincode definitions written by _lifecycle or lscc
+func (a *Auditor) applyWrites(results []byte, blockNumber int) error {
+	txRWSet := &rwsetutil.TxRwSet{}
+	err := txRWSet.FromProtoBytes(results)
+	if err != nil {
+		return err
+	}
+	for _, set := range txRWSet.NsRwSets {
+		switch set.NameSpace {
+		case LifecycleNamespace:
+			for _, write := range set.KvRwSet.Writes {
+				if write.IsDelete || !strings.HasPrefix(write.Key, lifecycleFieldsPrefix) || !strings.HasSuffix(write.Key, lifecycleValidationInfoKey) {
+					continue
+				}
+				chaincodeID := strings.TrimSuffix(strings.TrimPrefix(write.Key, lifecycleFieldsPrefix), lifecycleValidationInfoKey)
+				stateData := &lb.StateData{}
+				err = proto.Unmarshal(write.Value, stateData)
+				if err != nil {
+					return errors.Wrapf(err, "failed to unmarshal validation info of %s", chaincodeID)
+				}
+				validationInfo := &lb.ChaincodeValidationInfo{}
+				err = proto.Unmarshal(stateData.GetBytes(), validationInfo)
+				if err != nil {
+					return errors.Wrapf(err, "failed to unmarshal validation info of %s", chaincodeID)
+				}
+				a.state.Policies[chaincodeID] = &ChaincodePolicy{
+					Policy:      validationInfo.ValidationParameter,
+					Namespace:   set.NameSpace,
+					BlockNumber: blockNumber,
+				}
+			}
+		case LSCCNamespace:
+			for _, write := range set.KvRwSet.Writes {
+				if write.IsDelete {
+					continue
+				}
+				chaincodeData := &ccprovider.ChaincodeData{}
+				err = proto.Unmarshal(write.Value, chaincodeData)
+				if err != nil || chaincodeData.Name != write.Key {
+					// lscc also stores collection configs under other keys
+					continue
+				}
+				envelope := &cb.SignaturePolicyEnvelope{}
+				err = proto.Unmarshal(chaincodeData.Policy, envelope)
+				if err != nil {
+					return errors.Wrapf(err, "failed to unmarshal policy of %s", chaincodeData.Name)
+				}
+				policyBytes, err := signaturePolicyToApplicationPolicy(envelope)
+				if err != nil {
+					return err
+				}
+				a.state.Policies[chaincodeData.Name] = &ChaincodePolicy{
+					Policy:      policyBytes,
+					Namespace:   set.NameSpace,
+					BlockNumber: blockNumber,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func endorsingOrgs(endorsers []*transformation.Identity) []string {
+	orgs := map[string]bool{}
+	for _, endorser := range endorsers {
+		orgs[endorser.MSPID] = true
+	}
+	var mspIDs []string
+	for mspID := range orgs {
+		mspIDs = append(mspIDs, mspID)
+	}
+	sort.Strings(mspIDs)
+	return mspIDs
+}
@@ -0,0 +1,205 @@
+package audit
+
+import (
+	"github.com/dgraph-io/badger/v2"
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	lb "github.com/hyperledger/fabric-protos-go/peer/lifecycle"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/common/policydsl"
+	"github.com/kfsoftware/hlf-sync/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func lifecycleDefinition(t *testing.T, chaincodeID string, policy *pb.ApplicationPolicy) *mocks.TXInfo {
+	policyBytes, err := proto.Marshal(policy)
+	assert.NoError(t, err)
+	validationInfoBytes, err := proto.Marshal(&lb.ChaincodeValidationInfo{
+		ValidationPlugin:    "vscc",
+		ValidationParameter: policyBytes,
+	})
+	assert.NoError(t, err)
+	stateDataBytes, err := proto.Marshal(&lb.StateData{
+		Type: &lb.StateData_Bytes{Bytes: validationInfoBytes},
+	})
+	assert.NoError(t, err)
+	return &mocks.TXInfo{
+		TxID:             "define_" + chaincodeID,
+		TxValidationCode: pb.TxValidationCode_VALID,
+		HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+		ChaincodeID:      LifecycleNamespace,
+		Results: mocks.GetTxResults(
+			LifecycleNamespace,
+			[]*kvrwset.KVWrite{
+				{
+					Key:   "namespaces/fields/" + chaincodeID + "/ValidationInfo",
+					Value: stateDataBytes,
+				},
+			},
+		),
+	}
+}
+
+func invoke(txID string, chaincodeID string, endorsers ...[]byte) *mocks.TXInfo {
+	return &mocks.TXInfo{
+		TxID:             txID,
+		TxValidationCode: pb.TxValidationCode_VALID,
+		HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+		ChaincodeID:      chaincodeID,
+		Results:          mocks.GetTxResults(chaincodeID, []*kvrwset.KVWrite{{Key: "K1", Value: []byte("{}")}}),
+		Endorsers:        endorsers,
+	}
+}
+
+// block returns a block of mychannel with the given number
+func block(number uint64, txs ...*mocks.TXInfo) *cb.Block {
+	blk := mocks.NewBlock("mychannel", txs...)
+	blk.Header.Number = number
+	return blk
+}
+
+func TestSignaturePolicy(t *testing.T) {
+	envelope, err := policydsl.FromString("AND('Org1MSP.peer', 'Org2MSP.peer')")
+	assert.NoError(t, err)
+	org1 := mocks.NewCA("Org1MSP")
+	org2 := mocks.NewCA("Org2MSP")
+	org1Peer := org1.Identity("peer0", "peer")
+	org1Client := org1.Identity("user1", "client")
+	org2Peer := org2.Identity("peer0", "peer")
+	// a certificate claiming to be of Org2MSP but not issued by its CA
+	forgedPeer := mocks.NewCA("Org2MSP").Identity("peer0", "peer")
+	definition := lifecycleDefinition(t, "fabcar", &pb.ApplicationPolicy{
+		Type: &pb.ApplicationPolicy_SignaturePolicy{SignaturePolicy: envelope},
+	})
+
+	auditor, err := NewAuditor(nil)
+	assert.NoError(t, err)
+	results, err := auditor.AuditBlocks([]*cb.Block{
+		mocks.NewConfigBlock("mychannel", 0, mocks.NewConfig(org1, org2)),
+		block(1, definition),
+		block(
+			2,
+			invoke("tx1", "fabcar", org1Peer),
+			invoke("tx2", "fabcar", org1Peer, org2Peer),
+			invoke("tx3", "fabcar", org1Client, org2Peer),
+			invoke("tx4", "other", org1Peer),
+			invoke("tx5", "fabcar", org1Peer, forgedPeer),
+		),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 6)
+	assert.Equal(t, "/Channel/Application/LifecycleEndorsement", results[0].Policy)
+	assert.Equal(t, Unsatisfied, results[0].Status)
+	assert.Equal(t, "tx1", results[1].TXID)
+	assert.Equal(t, Unsatisfied, results[1].Status)
+	assert.Equal(t, []string{"Org1MSP"}, results[1].EndorsingOrgs)
+	assert.Equal(t, "AND('Org1MSP.peer', 'Org2MSP.peer')", results[1].Policy)
+	assert.Equal(t, Satisfied, results[2].Status)
+	assert.Equal(t, []string{"Org1MSP", "Org2MSP"}, results[2].EndorsingOrgs)
+	assert.Equal(t, Unsatisfied, results[3].Status)
+	assert.Equal(t, Unknown, results[4].Status)
+	assert.Equal(t, Unsatisfied, results[5].Status)
+	assert.Contains(t, auditor.State().Policies, "fabcar")
+
+	// without the config of the channel the MSPs aren't known
+	auditor, err = NewAuditor(&State{Height: 1})
+	assert.NoError(t, err)
+	results, err = auditor.AuditBlocks([]*cb.Block{block(1, definition), block(2, invoke("tx2", "fabcar", org1Peer, org2Peer))})
+	assert.NoError(t, err)
+	assert.Equal(t, Unknown, results[1].Status)
+}
+
+func TestImplicitMetaPolicy(t *testing.T) {
+	org1 := mocks.NewCA("Org1MSP")
+	org2 := mocks.NewCA("Org2MSP")
+	org3 := mocks.NewCA("Org3MSP")
+	auditor, err := NewAuditor(&State{Config: protoMarshal(t, mocks.NewConfig(org1, org2, org3))})
+	assert.NoError(t, err)
+	org1Peer := org1.Identity("peer0", "peer")
+	org2Peer := org2.Identity("peer0", "peer")
+	results, err := auditor.AuditBlocks([]*cb.Block{
+		block(
+			0,
+			lifecycleDefinition(t, "fabcar", &pb.ApplicationPolicy{
+				Type: &pb.ApplicationPolicy_ChannelConfigPolicyReference{
+					ChannelConfigPolicyReference: "/Channel/Application/Endorsement",
+				},
+			}),
+		),
+		block(
+			1,
+			invoke("tx1", "fabcar", org1Peer),
+			invoke("tx2", "fabcar", org1Peer, org2Peer),
+		),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	assert.Equal(t, Unsatisfied, results[1].Status)
+	assert.Equal(t, "/Channel/Application/Endorsement", results[1].Policy)
+	assert.Equal(t, Satisfied, results[2].Status)
+}
+
+func TestAuditedBlocksSkipped(t *testing.T) {
+	org1 := mocks.NewCA("Org1MSP")
+	org2 := mocks.NewCA("Org2MSP")
+	and, err := policydsl.FromString("AND('Org1MSP.peer', 'Org2MSP.peer')")
+	assert.NoError(t, err)
+	or, err := policydsl.FromString("OR('Org1MSP.peer', 'Org2MSP.peer')")
+	assert.NoError(t, err)
+	auditor, err := NewAuditor(&State{Config: protoMarshal(t, mocks.NewConfig(org1, org2))})
+	assert.NoError(t, err)
+	invokeBlock := block(1, invoke("tx1", "fabcar", org1.Identity("peer0", "peer")))
+	results, err := auditor.AuditBlocks([]*cb.Block{
+		block(0, lifecycleDefinition(t, "fabcar", &pb.ApplicationPolicy{Type: &pb.ApplicationPolicy_SignaturePolicy{SignaturePolicy: and}})),
+		invokeBlock,
+		block(2, lifecycleDefinition(t, "fabcar", &pb.ApplicationPolicy{Type: &pb.ApplicationPolicy_SignaturePolicy{SignaturePolicy: or}})),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Unsatisfied, results[1].Status)
+	assert.Equal(t, 3, auditor.State().Height)
+
+	// the block delivered again after a rewind isn't evaluated against the policy of block 2
+	results, err = auditor.AuditBlock(invokeBlock)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+	assert.Equal(t, 3, auditor.State().Height)
+
+	// a block after a gap isn't audited against the policies of the blocks before the gap
+	_, err = auditor.AuditBlock(block(4, invoke("tx4", "fabcar", org1.Identity("peer0", "peer"))))
+	assert.EqualError(t, err, "block 4 can't be audited before block 3")
+	assert.Equal(t, 3, auditor.State().Height)
+}
+
+func TestBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	assert.NoError(t, err)
+	defer db.Close()
+	store := NewBadgerStore(db)
+	state, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Empty(t, state.Policies)
+	state.Policies = map[string]*ChaincodePolicy{"fabcar": {Namespace: LifecycleNamespace, BlockNumber: 3}}
+	err = store.Save(state, []*Result{
+		{TXID: "tx2", BlockNumber: 10, Status: Satisfied},
+		{TXID: "tx1", BlockNumber: 9, Status: Unsatisfied},
+	})
+	assert.NoError(t, err)
+	state, err = store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, state.Policies["fabcar"].BlockNumber)
+	results, err := store.Results()
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, "tx1", results[0].TXID)
+	results, err = store.Results(Unsatisfied)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+}
+
+func protoMarshal(t *testing.T, msg proto.Message) []byte {
+	b, err := proto.Marshal(msg)
+	assert.NoError(t, err)
+	return b
+}
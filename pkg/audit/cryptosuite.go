@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/core"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/bccsp"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/bccsp/sw"
+	"hash"
+)
+
+// cryptoSuite adapts the vendored software BCCSP to the crypto suite of the MSPs. The suite of the SDK can't be used,
+// it doesn't recognize the key import options of the vendored bccsp package the MSPs pass to it
+type cryptoSuite struct {
+	csp bccsp.BCCSP
+}
+
+func newCryptoSuite() (core.CryptoSuite, error) {
+	csp, err := sw.NewDefaultSecurityLevelWithKeystore(sw.NewDummyKeyStore())
+	if err != nil {
+		return nil, err
+	}
+	return &cryptoSuite{csp: csp}, nil
+}
+
+func (c *cryptoSuite) KeyGen(opts core.KeyGenOpts) (core.Key, error) {
+	return suiteKey(c.csp.KeyGen(opts))
+}
+
+func (c *cryptoSuite) KeyImport(raw interface{}, opts core.KeyImportOpts) (core.Key, error) {
+	return suiteKey(c.csp.KeyImport(raw, opts))
+}
+
+func (c *cryptoSuite) GetKey(ski []byte) (core.Key, error) {
+	return suiteKey(c.csp.GetKey(ski))
+}
+
+func (c *cryptoSuite) Hash(msg []byte, opts core.HashOpts) ([]byte, error) {
+	return c.csp.Hash(msg, opts)
+}
+
+func (c *cryptoSuite) GetHash(opts core.HashOpts) (hash.Hash, error) {
+	return c.csp.GetHash(opts)
+}
+
+func (c *cryptoSuite) Sign(k core.Key, digest []byte, opts core.SignerOpts) ([]byte, error) {
+	return c.csp.Sign(k.(*key).key, digest, opts)
+}
+
+func (c *cryptoSuite) Verify(k core.Key, signature, digest []byte, opts core.SignerOpts) (bool, error) {
+	return c.csp.Verify(k.(*key).key, signature, digest, opts)
+}
+
+type key struct {
+	key bccsp.Key
+}
+
+func suiteKey(k bccsp.Key, err error) (core.Key, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &key{key: k}, nil
+}
+
+func (k *key) Bytes() ([]byte, error) {
+	return k.key.Bytes()
+}
+
+func (k *key) SKI() []byte {
+	return k.key.SKI()
+}
+
+func (k *key) Symmetric() bool {
+	return k.key.Symmetric()
+}
+
+func (k *key) Private() bool {
+	return k.key.Private()
+}
+
+func (k *key) PublicKey() (core.Key, error) {
+	return suiteKey(k.key.PublicKey())
+}
@@ -0,0 +1,72 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// The evaluator of the signature policies is the one of common/cauthdsl in Hyperledger Fabric, evaluating
+// identities already deserialized instead of signed data
+
+package audit
+
+import (
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	mb "github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/msp"
+	"github.com/pkg/errors"
+)
+
+// signatureEvaluator tells whether the identities satisfy a signature policy, used marks the identities
+// already matched by a principal so every identity satisfies one principal at most
+type signatureEvaluator func(identities []msp.Identity, used []bool) bool
+
+// compileSignaturePolicy builds the evaluator of the rule of a signature policy, the identities must be
+// deduplicated before being evaluated
+func compileSignaturePolicy(policy *cb.SignaturePolicy, principals []*mb.MSPPrincipal) (signatureEvaluator, error) {
+	if policy == nil {
+		return nil, errors.New("empty policy element")
+	}
+	switch t := policy.Type.(type) {
+	case *cb.SignaturePolicy_NOutOf_:
+		rules := make([]signatureEvaluator, len(t.NOutOf.Rules))
+		for i, rule := range t.NOutOf.Rules {
+			compiled, err := compileSignaturePolicy(rule, principals)
+			if err != nil {
+				return nil, err
+			}
+			rules[i] = compiled
+		}
+		return func(identities []msp.Identity, used []bool) bool {
+			verified := int32(0)
+			ruleUsed := make([]bool, len(used))
+			for _, rule := range rules {
+				copy(ruleUsed, used)
+				if rule(identities, ruleUsed) {
+					verified++
+					copy(used, ruleUsed)
+				}
+			}
+			return verified >= t.NOutOf.N
+		}, nil
+	case *cb.SignaturePolicy_SignedBy:
+		if t.SignedBy < 0 || t.SignedBy >= int32(len(principals)) {
+			return nil, errors.Errorf("identity index out of range, requested %d, but identities length is %d", t.SignedBy, len(principals))
+		}
+		principal := principals[t.SignedBy]
+		return func(identities []msp.Identity, used []bool) bool {
+			for i, identity := range identities {
+				if used[i] {
+					continue
+				}
+				if identity.SatisfiesPrincipal(principal) != nil {
+					continue
+				}
+				used[i] = true
+				return true
+			}
+			return false
+		}, nil
+	default:
+		return nil, errors.Errorf("unknown signature policy type %T", t)
+	}
+}
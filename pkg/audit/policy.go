@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	mb "github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/msp"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// evaluate checks the endorsers against the policy in effect for the chaincode with the cauthdsl evaluator, the
+// endorsers are deserialized with the MSPs of the channel config. Signatures are not verified, the peers already
+// did that when validating the block
+func (a *Auditor) evaluate(chaincodeID string, endorsers [][]byte) (string, Status, error) {
+	var appPolicy *pb.ApplicationPolicy
+	if chaincodeID == LifecycleNamespace {
+		appPolicy = &pb.ApplicationPolicy{
+			Type: &pb.ApplicationPolicy_ChannelConfigPolicyReference{
+				ChannelConfigPolicyReference: lifecycleEndorsementPolicy,
+			},
+		}
+	} else {
+		chaincodePolicy, ok := a.state.Policies[chaincodeID]
+		if !ok {
+			return "", Unknown, nil
+		}
+		appPolicy = &pb.ApplicationPolicy{}
+		err := proto.Unmarshal(chaincodePolicy.Policy, appPolicy)
+		if err != nil {
+			return "", Unknown, errors.Wrapf(err, "failed to unmarshal policy of %s", chaincodeID)
+		}
+	}
+	switch policy := appPolicy.Type.(type) {
+	case *pb.ApplicationPolicy_SignaturePolicy:
+		description := describeSignaturePolicy(policy.SignaturePolicy)
+		if a.deserializer == nil {
+			return description, Unknown, nil
+		}
+		satisfied, err := a.evaluateSignaturePolicy(policy.SignaturePolicy, a.identities(endorsers))
+		if err != nil {
+			return description, Unknown, err
+		}
+		return description, statusOf(satisfied), nil
+	case *pb.ApplicationPolicy_ChannelConfigPolicyReference:
+		reference := policy.ChannelConfigPolicyReference
+		if a.config == nil || a.deserializer == nil {
+			return reference, Unknown, nil
+		}
+		group, configPolicy, err := resolvePolicyReference(a.config.ChannelGroup, reference)
+		if err != nil {
+			log.Warnf("Failed to resolve policy of %s: %v", chaincodeID, err)
+			return reference, Unknown, nil
+		}
+		satisfied, err := a.evaluateConfigPolicy(group, configPolicy, a.identities(endorsers))
+		if err != nil {
+			return reference, Unknown, err
+		}
+		return reference, statusOf(satisfied), nil
+	default:
+		return "", Unknown, errors.Errorf("unsupported application policy type %T", policy)
+	}
+}
+
+func statusOf(satisfied bool) Status {
+	if satisfied {
+		return Satisfied
+	}
+	return Unsatisfied
+}
+
+// identities deserializes the endorsers with the MSPs of the channel, every identity is kept once like
+// the peers do before evaluating a policy
+func (a *Auditor) identities(endorsers [][]byte) []msp.Identity {
+	seen := map[string]bool{}
+	var identities []msp.Identity
+	for _, endorser := range endorsers {
+		identity, err := a.deserializer.DeserializeIdentity(endorser)
+		if err != nil {
+			log.Debugf("Failed to deserialize endorser: %v", err)
+			continue
+		}
+		key := identity.GetIdentifier().Mspid + identity.GetIdentifier().Id
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		identities = append(identities, identity)
+	}
+	return identities
+}
+
+// resolvePolicyReference finds a policy such as /Channel/Application/Endorsement in the channel config
+func resolvePolicyReference(channelGroup *cb.ConfigGroup, reference string) (*cb.ConfigGroup, *cb.Policy, error) {
+	path := strings.Split(strings.TrimPrefix(reference, "/"), "/")
+	if len(path) < 2 || path[0] != "Channel" {
+		return nil, nil, errors.Errorf("invalid policy reference %s", reference)
+	}
+	group := channelGroup
+	for _, groupName := range path[1 : len(path)-1] {
+		subGroup, ok := group.Groups[groupName]
+		if !ok {
+			return nil, nil, errors.Errorf("group %s of policy reference %s not found", groupName, reference)
+		}
+		group = subGroup
+	}
+	configPolicy, ok := group.Policies[path[len(path)-1]]
+	if !ok || configPolicy.Policy == nil {
+		return nil, nil, errors.Errorf("policy reference %s not found", reference)
+	}
+	return group, configPolicy.Policy, nil
+}
+
+// evaluateConfigPolicy evaluates a policy of the channel config, the implicit meta policies are evaluated
+// on the sub policies of the groups below like the policy manager of the peers
+func (a *Auditor) evaluateConfigPolicy(group *cb.ConfigGroup, policy *cb.Policy, identities []msp.Identity) (bool, error) {
+	switch cb.Policy_PolicyType(policy.Type) {
+	case cb.Policy_SIGNATURE:
+		envelope := &cb.SignaturePolicyEnvelope{}
+		err := proto.Unmarshal(policy.Value, envelope)
+		if err != nil {
+			return false, err
+		}
+		return a.evaluateSignaturePolicy(envelope, identities)
+	case cb.Policy_IMPLICIT_META:
+		implicitMeta := &cb.ImplicitMetaPolicy{}
+		err := proto.Unmarshal(policy.Value, implicitMeta)
+		if err != nil {
+			return false, err
+		}
+		total := 0
+		satisfied := 0
+		for _, subGroup := range group.Groups {
+			subPolicy, ok := subGroup.Policies[implicitMeta.SubPolicy]
+			if !ok || subPolicy.Policy == nil {
+				continue
+			}
+			total++
+			ok, err := a.evaluateConfigPolicy(subGroup, subPolicy.Policy, identities)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				satisfied++
+			}
+		}
+		switch implicitMeta.Rule {
+		case cb.ImplicitMetaPolicy_ANY:
+			return satisfied > 0, nil
+		case cb.ImplicitMetaPolicy_ALL:
+			return satisfied == total, nil
+		case cb.ImplicitMetaPolicy_MAJORITY:
+			return satisfied > total/2, nil
+		}
+		return false, errors.Errorf("unknown implicit meta rule %s", implicitMeta.Rule)
+	default:
+		return false, errors.Errorf("unsupported policy type %d", policy.Type)
+	}
+}
+
+func (a *Auditor) evaluateSignaturePolicy(envelope *cb.SignaturePolicyEnvelope, identities []msp.Identity) (bool, error) {
+	if envelope.Version != 0 {
+		return false, errors.Errorf("unsupported signature policy version %d", envelope.Version)
+	}
+	evaluator, err := compileSignaturePolicy(envelope.Rule, envelope.Identities)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to compile signature policy")
+	}
+	return evaluator(identities, make([]bool, len(identities))), nil
+}
+
+// describeSignaturePolicy renders a signature policy using the policy DSL syntax
+func describeSignaturePolicy(envelope *cb.SignaturePolicyEnvelope) string {
+	if envelope.Rule == nil {
+		return ""
+	}
+	return describeRule(envelope.Rule, envelope.Identities)
+}
+
+func describeRule(policy *cb.SignaturePolicy, principals []*mb.MSPPrincipal) string {
+	switch t := policy.Type.(type) {
+	case *cb.SignaturePolicy_SignedBy:
+		if t.SignedBy < 0 || int(t.SignedBy) >= len(principals) {
+			return "?"
+		}
+		return describePrincipal(principals[t.SignedBy])
+	case *cb.SignaturePolicy_NOutOf_:
+		var rules []string
+		for _, rule := range t.NOutOf.Rules {
+			rules = append(rules, describeRule(rule, principals))
+		}
+		switch {
+		case int(t.NOutOf.N) == len(rules):
+			return fmt.Sprintf("AND(%s)", strings.Join(rules, ", "))
+		case t.NOutOf.N == 1:
+			return fmt.Sprintf("OR(%s)", strings.Join(rules, ", "))
+		default:
+			return fmt.Sprintf("OutOf(%d, %s)", t.NOutOf.N, strings.Join(rules, ", "))
+		}
+	}
+	return "?"
+}
+
+func describePrincipal(principal *mb.MSPPrincipal) string {
+	switch principal.PrincipalClassification {
+	case mb.MSPPrincipal_ROLE:
+		role := &mb.MSPRole{}
+		if err := proto.Unmarshal(principal.Principal, role); err == nil {
+			return fmt.Sprintf("'%s.%s'", role.MspIdentifier, strings.ToLower(role.Role.String()))
+		}
+	case mb.MSPPrincipal_ORGANIZATION_UNIT:
+		ou := &mb.OrganizationUnit{}
+		if err := proto.Unmarshal(principal.Principal, ou); err == nil {
+			return fmt.Sprintf("'%s.%s'", ou.MspIdentifier, ou.OrganizationalUnitIdentifier)
+		}
+	case mb.MSPPrincipal_IDENTITY:
+		identity, err := transformation.DecodeIdentity(principal.Principal)
+		if err == nil {
+			return fmt.Sprintf("'%s.%s'", identity.MSPID, identity.CommonName)
+		}
+	}
+	return "?"
+}
+
+func signaturePolicyToApplicationPolicy(envelope *cb.SignaturePolicyEnvelope) ([]byte, error) {
+	return proto.Marshal(&pb.ApplicationPolicy{
+		Type: &pb.ApplicationPolicy_SignaturePolicy{
+			SignaturePolicy: envelope,
+		},
+	})
+}
@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v2"
+)
+
+const (
+	stateKey     = "audit_state"
+	resultPrefix = "audit_result_"
+)
+
+// BadgerStore keeps the auditor state and the audit results next to the sync checkpoint
+type BadgerStore struct {
+	db *badger.DB
+}
+
+func NewBadgerStore(db *badger.DB) *BadgerStore {
+	return &BadgerStore{
+		db: db,
+	}
+}
+
+func (s *BadgerStore) LoadState() (*State, error) {
+	state := &State{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(stateKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, state)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save stores the results and the state the auditor reached after producing them
+func (s *BadgerStore) Save(state *State, results []*Result) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, result := range results {
+		val, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s%020d_%06d_%s", resultPrefix, result.BlockNumber, result.TXIndex, result.ChaincodeID)
+		err = wb.Set([]byte(key), val)
+		if err != nil {
+			return err
+		}
+	}
+	val, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = wb.Set([]byte(stateKey), val)
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// Results returns the stored results in ledger order, filtered by status if any status is given
+func (s *BadgerStore) Results(statuses ...Status) ([]*Result, error) {
+	var results []*Result
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(resultPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			result := &Result{}
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, result)
+			})
+			if err != nil {
+				return err
+			}
+			if len(statuses) > 0 && !hasStatus(result, statuses) {
+				continue
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func hasStatus(result *Result, statuses []Status) bool {
+	for _, status := range statuses {
+		if result.Status == status {
+			return true
+		}
+	}
+	return false
+}
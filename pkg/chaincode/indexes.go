@@ -0,0 +1,158 @@
+package chaincode
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/sdkinternal/ccmetadata"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	couchDBDir     = "META-INF/statedb/couchdb/"
+	collectionsDir = "META-INF/statedb/couchdb/collections/"
+	codePackage    = "code.tar.gz"
+)
+
+// Index is a CouchDB index definition shipped in META-INF/statedb/couchdb by a chaincode package
+type Index struct {
+	Name      string
+	DesignDoc string
+	// Collection is set for the indexes of a private data collection
+	Collection string
+	Fields     []IndexField
+}
+
+type IndexField struct {
+	// Name is the path of the field, nested fields are separated by dots
+	Name string
+	Desc bool
+}
+
+// Path returns the segments of the field path
+func (f IndexField) Path() []string {
+	return strings.Split(f.Name, ".")
+}
+
+type indexDefinition struct {
+	Index struct {
+		Fields []interface{} `json:"fields"`
+	} `json:"index"`
+	DesignDoc string `json:"ddoc"`
+	Name      string `json:"name"`
+}
+
+// ReadIndexes returns the index definitions of a chaincode package. It accepts a lifecycle package
+// (a tar.gz holding metadata.json and code.tar.gz), a code package or a legacy deployment spec
+func ReadIndexes(packageBytes []byte) ([]*Index, error) {
+	if !isGzip(packageBytes) {
+		cds := &pb.ChaincodeDeploymentSpec{}
+		err := proto.Unmarshal(packageBytes, cds)
+		if err != nil || !isGzip(cds.CodePackage) {
+			return nil, errors.New("package is neither a tar.gz nor a chaincode deployment spec")
+		}
+		packageBytes = cds.CodePackage
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(packageBytes))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	var indexes []*Index
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read package")
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == codePackage {
+			codeBytes, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return nil, err
+			}
+			codeIndexes, err := ReadIndexes(codeBytes)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s", codePackage)
+			}
+			indexes = append(indexes, codeIndexes...)
+			continue
+		}
+		// legacy code packages keep the metadata under the source path
+		position := strings.Index(name, couchDBDir)
+		if position < 0 || path.Ext(name) != ".json" {
+			continue
+		}
+		fileBytes, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		index, err := ParseIndex(name[position:], fileBytes)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// ParseIndex parses an index definition, fileName is its path from META-INF
+func ParseIndex(fileName string, indexBytes []byte) (*Index, error) {
+	err := ccmetadata.ValidateMetadataFile(fileName, indexBytes)
+	if err != nil {
+		return nil, err
+	}
+	definition := &indexDefinition{}
+	err = json.Unmarshal(indexBytes, definition)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{
+		Name:      definition.Name,
+		DesignDoc: definition.DesignDoc,
+	}
+	if index.Name == "" {
+		index.Name = strings.TrimSuffix(path.Base(fileName), ".json")
+	}
+	if strings.HasPrefix(fileName, collectionsDir) {
+		index.Collection = strings.SplitN(strings.TrimPrefix(fileName, collectionsDir), "/", 2)[0]
+	}
+	for _, field := range definition.Index.Fields {
+		switch field := field.(type) {
+		case string:
+			index.Fields = append(index.Fields, IndexField{Name: field})
+		case map[string]interface{}:
+			// a sort field such as {"size": "desc"}
+			var names []string
+			for name := range field {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				index.Fields = append(index.Fields, IndexField{Name: name, Desc: field[name] == "desc"})
+			}
+		default:
+			log.Warnf("Ignoring field %v of index %s", field, fileName)
+		}
+	}
+	return index, nil
+}
+
+func isGzip(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
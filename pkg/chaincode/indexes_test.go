@@ -0,0 +1,78 @@
+package chaincode
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func tarGz(t *testing.T, files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tarWriter.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	return buf.Bytes()
+}
+
+const ownerIndex = `{"index":{"fields":["docType","owner"]},"ddoc":"indexOwnerDoc","name":"indexOwner","type":"json"}`
+const sizeIndex = `{"index":{"fields":[{"size":"desc"},{"color":"asc"}]},"ddoc":"indexSizeDoc","type":"json"}`
+
+func TestReadIndexes(t *testing.T) {
+	code := tarGz(t, map[string][]byte{
+		"src/main.go": []byte("package main"),
+		"META-INF/statedb/couchdb/indexes/indexOwner.json":                   []byte(ownerIndex),
+		"META-INF/statedb/couchdb/collections/collection1/indexes/size.json": []byte(sizeIndex),
+	})
+	lifecyclePackage := tarGz(t, map[string][]byte{
+		"metadata.json": []byte(`{"type":"golang","label":"asset_1.0"}`),
+		"code.tar.gz":   code,
+	})
+	indexes, err := ReadIndexes(lifecyclePackage)
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	byName := map[string]*Index{}
+	for _, index := range indexes {
+		byName[index.Name] = index
+	}
+	owner := byName["indexOwner"]
+	require.NotNil(t, owner)
+	assert.Equal(t, "indexOwnerDoc", owner.DesignDoc)
+	assert.Equal(t, "", owner.Collection)
+	assert.Equal(t, []IndexField{{Name: "docType"}, {Name: "owner"}}, owner.Fields)
+	size := byName["size"]
+	require.NotNil(t, size)
+	assert.Equal(t, "collection1", size.Collection)
+	assert.Equal(t, []IndexField{{Name: "size", Desc: true}, {Name: "color"}}, size.Fields)
+
+	// legacy deployment specs keep the metadata next to the source
+	cdsBytes, err := proto.Marshal(&pb.ChaincodeDeploymentSpec{
+		CodePackage: tarGz(t, map[string][]byte{
+			"src/github.com/asset/META-INF/statedb/couchdb/indexes/indexOwner.json": []byte(ownerIndex),
+		}),
+	})
+	require.NoError(t, err)
+	indexes, err = ReadIndexes(cdsBytes)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	assert.Equal(t, "indexOwner", indexes[0].Name)
+}
+
+func TestParseInvalidIndex(t *testing.T) {
+	_, err := ParseIndex("META-INF/statedb/couchdb/indexes/bad.json", []byte(`{"index":{"fields":"owner"}}`))
+	assert.Error(t, err)
+	_, err = ParseIndex("META-INF/statedb/couchdb/other/bad.json", []byte(ownerIndex))
+	assert.Error(t, err)
+	_, err = ReadIndexes([]byte("not a package"))
+	assert.Error(t, err)
+}
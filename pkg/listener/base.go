@@ -1,6 +1,12 @@
 package listener
 
-import cb "github.com/hyperledger/fabric-protos-go/common"
+import (
+	"fmt"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/chaincode"
+	"github.com/pkg/errors"
+	"strings"
+)
 
 type Item struct {
 	ID          string      `json:"id"`
@@ -20,3 +26,79 @@ type BlockStorage interface {
 	Store(block *cb.Block) error
 	StoreBulk(blocks []*cb.Block) error
 }
+
+// Migrator is implemented by the storages that need to rewrite the documents stored by
+// previous versions, e.g. to move them to the canonical document ID
+type Migrator interface {
+	Migrate() error
+}
+
+// Checkpointer is implemented by the storages that keep the last stored block along with the data,
+// so the checkpoint can't get out of sync with what was written
+type Checkpointer interface {
+	// Checkpoint returns the last block stored, ok is false when nothing has been stored yet
+	Checkpoint() (blockNumber int, ok bool, err error)
+}
+
+// Pipeliner is implemented by the storages that return from Store before the writes are applied,
+// the checkpoint can only move up to the last block they have committed
+type Pipeliner interface {
+	// Committed returns the last block whose writes have all been applied, ok is false when none has
+	// been yet. The error is the one of the first write that failed, a RewindError when the writes
+	// after the last block committed were dropped
+	Committed() (blockNumber int, ok bool, err error)
+	// Flush waits for the pending writes
+	Flush() error
+}
+
+// RewindError is returned by a Pipeliner that dropped the writes after the last block committed
+// because one of them failed, the blocks after it must be stored again
+type RewindError struct {
+	Err error
+}
+
+func (e *RewindError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the error of the write that failed
+func (e *RewindError) Cause() error {
+	return e.Err
+}
+
+// Indexer is implemented by the storages that can index the fields of the CouchDB index definitions
+// shipped in the chaincode packages, so the off-chain queries are as fast as the rich queries
+type Indexer interface {
+	CreateIndexes(chaincodeID string, indexes []*chaincode.Index) error
+}
+
+// Reindexer is implemented by the storages that can rebuild their indexes from the ledger while the
+// sync keeps writing to the current ones
+type Reindexer interface {
+	// Reindex returns a storage writing to a new generation of the indexes
+	Reindex() (Generation, error)
+}
+
+// Generation is a new set of indexes being built by a reindex
+type Generation interface {
+	BlockStorage
+	// Publish atomically switches the readers to the new indexes, deleting the previous ones if deleteOld is set
+	Publish(deleteOld bool) error
+}
+
+// indexFieldPath returns the segments of an index field, rejecting those that can't be safely quoted
+func indexFieldPath(field chaincode.IndexField) ([]string, error) {
+	path := field.Path()
+	for _, segment := range path {
+		if segment == "" || strings.ContainsAny(segment, "\\\"'`{},") {
+			return nil, errors.Errorf("unsupported index field %s", field.Name)
+		}
+	}
+	return path, nil
+}
+
+// blocksIndexName is the name of the table or index holding the block records of a channel.
+// Chaincode names can't start with an underscore so it can't collide with a chaincode index
+func blocksIndexName(channelID string) string {
+	return fmt.Sprintf("%s__blocks", channelID)
+}
@@ -0,0 +1,266 @@
+package listener
+
+import (
+	"encoding/json"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// CDCEnvelopeType is the format of the change events of the sinks publishing the writes
+type CDCEnvelopeType string
+
+const (
+	// DebeziumEnvelope wraps every write in a Debezium change event, with the previous and new values of the key
+	DebeziumEnvelope CDCEnvelopeType = "debezium"
+	// DefaultCDCStateDir is the badger directory keeping the last value of every key
+	DefaultCDCStateDir = "hlf-sync-cdc.badgerdb"
+
+	cdcStatePrefix      = "cdc_state_"
+	cdcCheckpointPrefix = "cdc_checkpoint_"
+)
+
+// CDCConfig configures the change events of a sink, no envelope is used when Envelope is not set
+type CDCConfig struct {
+	Envelope CDCEnvelopeType
+	// StateDir is the badger directory of the last value of every key, each sink needs its own.
+	// The state is kept in memory when set to :memory:
+	StateDir string
+}
+
+// Validate checks the envelope and sets the default state directory
+func (c *CDCConfig) Validate() error {
+	switch c.Envelope {
+	case "":
+	case DebeziumEnvelope:
+		if c.StateDir == "" {
+			c.StateDir = DefaultCDCStateDir
+		}
+	default:
+		return errors.Errorf("envelope %s not supported", c.Envelope)
+	}
+	return nil
+}
+
+// CDCEnvelope is a Debezium change event of a key of the world state
+type CDCEnvelope struct {
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Source CDCSource              `json:"source"`
+	// Op is c for a key created, u for a key updated and d for a key deleted
+	Op   string `json:"op"`
+	TsMs int64  `json:"ts_ms"`
+}
+
+// CDCSource is the position of the write in the ledger, the database is the channel and the table the chaincode.
+// The validation code is always VALID, the invalid transactions have no change events
+type CDCSource struct {
+	Version        string `json:"version"`
+	Connector      string `json:"connector"`
+	Name           string `json:"name"`
+	TsMs           int64  `json:"ts_ms"`
+	Snapshot       string `json:"snapshot"`
+	DB             string `json:"db"`
+	Table          string `json:"table"`
+	Channel        string `json:"channel"`
+	Chaincode      string `json:"chaincode"`
+	Collection     string `json:"collection"`
+	Key            string `json:"key"`
+	Block          int    `json:"block"`
+	TxIndex        int    `json:"txIndex"`
+	WriteIndex     int    `json:"writeIndex"`
+	TxID           string `json:"txId"`
+	ValidationCode string `json:"validationCode"`
+}
+
+// CDCEvent is the change event of a write with the document it changes
+type CDCEvent struct {
+	Document *transformation.Document
+	Envelope *CDCEnvelope
+}
+
+// Key is the Debezium key of the event, the ID of the document
+func (e *CDCEvent) Key() []byte {
+	key, _ := json.Marshal(map[string]string{"id": e.Document.PrimaryKey})
+	return key
+}
+
+// cdcEntry is the last value of a key, with the value before it to build the event again when a batch is replayed
+type cdcEntry struct {
+	Version  int64                  `json:"version"`
+	Value    map[string]interface{} `json:"value"`
+	Previous map[string]interface{} `json:"previous"`
+}
+
+// cdcState keeps the last value of every key of a channel to fill the before of the change events.
+// It's written once the events are published, along with the last block published
+type cdcState struct {
+	db        *badger.DB
+	channelID string
+}
+
+// cdcBatch are the events of a batch of blocks and the values they leave
+type cdcBatch struct {
+	events      []*CDCEvent
+	entries     map[string]*cdcEntry
+	blockNumber int
+}
+
+func openCDCState(config CDCConfig, channelID string) (*cdcState, error) {
+	opts := badger.DefaultOptions(config.StateDir).WithLogger(nil)
+	if config.StateDir == ":memory:" {
+		opts = badger.DefaultOptions("").WithInMemory(true).WithLogger(nil)
+	}
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open the CDC state in %s", config.StateDir)
+	}
+	return &cdcState{db: db, channelID: channelID}, nil
+}
+
+func (s *cdcState) entry(key string) (*cdcEntry, error) {
+	var entry *cdcEntry
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(cdcStatePrefix + key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			entry = &cdcEntry{}
+			return json.Unmarshal(val, entry)
+		})
+	})
+	return entry, err
+}
+
+// events returns the change events of the writes of the valid transactions, in ledger order. The values
+// left by the pending batches, not committed yet, are taken before those of the state
+func (s *cdcState) events(response *transformation.DocumentExtractionResponse, pending ...*cdcBatch) (*cdcBatch, error) {
+	batch := &cdcBatch{entries: map[string]*cdcEntry{}, blockNumber: -1}
+	if len(response.Blocks) > 0 {
+		batch.blockNumber = response.Blocks[len(response.Blocks)-1].Number
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, event := range response.Events {
+		document := event.Document
+		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
+			continue
+		}
+		entry, ok := batch.entries[document.PrimaryKey]
+		for i := len(pending) - 1; !ok && i >= 0; i-- {
+			entry, ok = pending[i].entries[document.PrimaryKey]
+		}
+		if !ok {
+			var err error
+			entry, err = s.entry(document.PrimaryKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		version := document.Version()
+		var before map[string]interface{}
+		switch {
+		case entry == nil:
+		case version > entry.Version:
+			before = entry.Value
+		case version == entry.Version:
+			// the batch is replayed after the state was written
+			before = entry.Previous
+		default:
+			log.Debugf("Write of key %s in block %d is older than the state, no before value", document.Key, document.BlockNumber)
+		}
+		envelope := &CDCEnvelope{
+			Before: before,
+			Source: CDCSource{
+				Version:        "1",
+				Connector:      "hlf-sync",
+				Name:           document.ChannelID,
+				TsMs:           int64(document.TXDate),
+				Snapshot:       "false",
+				DB:             document.ChannelID,
+				Table:          document.ChaincodeID,
+				Channel:        document.ChannelID,
+				Chaincode:      document.ChaincodeID,
+				Collection:     document.Collection,
+				Key:            document.Key,
+				Block:          event.BlockNumber,
+				TxIndex:        event.TXIndex,
+				WriteIndex:     event.WriteIndex,
+				TxID:           document.TXID,
+				ValidationCode: "VALID",
+			},
+			TsMs: now,
+		}
+		switch {
+		case event.Operation == transformation.Delete:
+			envelope.Op = "d"
+		case before == nil:
+			envelope.After = document.Data
+			envelope.Op = "c"
+		default:
+			envelope.After = document.Data
+			envelope.Op = "u"
+		}
+		if entry == nil || version >= entry.Version {
+			batch.entries[document.PrimaryKey] = &cdcEntry{Version: version, Value: envelope.After, Previous: before}
+		}
+		batch.events = append(batch.events, &CDCEvent{Document: document, Envelope: envelope})
+	}
+	return batch, nil
+}
+
+// commit stores the values left by a batch once its events are published, and the block reached
+func (s *cdcState) commit(batch *cdcBatch) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for key, entry := range batch.entries {
+		val, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		err = wb.Set([]byte(cdcStatePrefix+key), val)
+		if err != nil {
+			return err
+		}
+	}
+	err := wb.Flush()
+	if err != nil {
+		return errors.Wrap(err, "failed to store the CDC state")
+	}
+	if batch.blockNumber < 0 {
+		return nil
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(cdcCheckpointPrefix+s.channelID), []byte(strconv.Itoa(batch.blockNumber)))
+	})
+}
+
+// checkpoint returns the last block whose events have been published
+func (s *cdcState) checkpoint() (int, bool, error) {
+	blockNumber := 0
+	found := false
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(cdcCheckpointPrefix + s.channelID))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			blockNumber, err = strconv.Atoi(string(val))
+			if err != nil {
+				return errors.Errorf("invalid CDC checkpoint %q", val)
+			}
+			found = true
+			return nil
+		})
+	})
+	return blockNumber, found, err
+}
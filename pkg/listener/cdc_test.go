@@ -0,0 +1,126 @@
+package listener
+
+import (
+	"encoding/json"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// cdcTestBlocks updates car1, deletes car2 and has an invalid write of car4 after esTestBlocks
+func cdcTestBlocks(channelID string) []*cb.Block {
+	invalidTx := writeTx("4", "fabcar", &kvrwset.KVWrite{Key: "car4", Value: []byte(`{"owner":"x"}`)})
+	invalidTx.TxValidationCode = pb.TxValidationCode_MVCC_READ_CONFLICT
+	return append(esTestBlocks(channelID), newTestBlock(
+		channelID,
+		2,
+		writeTx("3", "fabcar",
+			&kvrwset.KVWrite{Key: "car1", Value: []byte(`{"owner":"c"}`)},
+			&kvrwset.KVWrite{Key: "car2", IsDelete: true},
+		),
+		invalidTx,
+	))
+}
+
+func newTestCDCState(t *testing.T) *cdcState {
+	state, err := openCDCState(CDCConfig{Envelope: DebeziumEnvelope, StateDir: ":memory:"}, "mychannel")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		state.db.Close()
+	})
+	return state
+}
+
+func cdcOps(batch *cdcBatch) map[string]string {
+	ops := map[string]string{}
+	for _, event := range batch.events {
+		ops[event.Document.Key] = event.Envelope.Op
+	}
+	return ops
+}
+
+func TestCDCEvents(t *testing.T) {
+	state := newTestCDCState(t)
+	blocks := cdcTestBlocks("mychannel")
+	first, err := transformation.BlocksToDocuments(blocks[:2])
+	require.NoError(t, err)
+	batch, err := state.events(first)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"car1": "c", "car2": "c", "car3": "d"}, cdcOps(batch))
+	car1 := batch.events[0].Envelope
+	assert.Nil(t, car1.Before)
+	assert.Equal(t, "a", car1.After["owner"])
+	assert.Equal(t, CDCSource{
+		Version:        "1",
+		Connector:      "hlf-sync",
+		Name:           "mychannel",
+		TsMs:           car1.Source.TsMs,
+		Snapshot:       "false",
+		DB:             "mychannel",
+		Table:          "fabcar",
+		Channel:        "mychannel",
+		Chaincode:      "fabcar",
+		Key:            "car1",
+		TxID:           "1",
+		ValidationCode: "VALID",
+	}, car1.Source)
+	_, found, err := state.checkpoint()
+	require.NoError(t, err)
+	assert.False(t, found)
+	require.NoError(t, state.commit(batch))
+
+	second, err := transformation.BlocksToDocuments(blocks[2:])
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		// the second time the batch is replayed after its state was committed
+		batch, err = state.events(second)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"car1": "u", "car2": "d"}, cdcOps(batch))
+		assert.Equal(t, "a", batch.events[0].Envelope.Before["owner"])
+		assert.Equal(t, "c", batch.events[0].Envelope.After["owner"])
+		assert.Equal(t, "b", batch.events[1].Envelope.Before["owner"])
+		assert.Nil(t, batch.events[1].Envelope.After)
+		require.NoError(t, state.commit(batch))
+	}
+	blockNumber, found, err := state.checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 2, blockNumber)
+}
+
+func TestKafkaDebezium(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	storage, err := newKafkaStorage(producer, "mychannel").WithCDC(CDCConfig{Envelope: DebeziumEnvelope, StateDir: ":memory:"})
+	require.NoError(t, err)
+	var messages []*sarama.ProducerMessage
+	for i := 0; i < 4; i++ {
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			messages = append(messages, msg)
+			return nil
+		})
+	}
+	require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+	require.NoError(t, producer.Close())
+
+	require.Len(t, messages, 4)
+	key, _ := messages[0].Key.Encode()
+	assert.JSONEq(t, `{"id":"`+documentID("car1")+`"}`, string(key))
+	var envelope CDCEnvelope
+	value, _ := messages[2].Value.Encode()
+	require.NoError(t, json.Unmarshal(value, &envelope))
+	assert.Equal(t, "d", envelope.Op)
+	assert.Equal(t, "car3", envelope.Source.Key)
+	assert.Equal(t, messages[2].Key, messages[3].Key)
+	assert.Nil(t, messages[3].Value)
+
+	blockNumber, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, blockNumber)
+}
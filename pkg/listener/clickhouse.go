@@ -0,0 +1,423 @@
+package listener
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/ClickHouse/clickhouse-go"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultClickHouseTablePrefix is prepended to the names of the tables
+const DefaultClickHouseTablePrefix = "hlf_"
+
+var clickHouseIdentifier = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+type clickHouseColumn struct {
+	name       string
+	columnType string
+}
+
+// clickHouseTable is a ReplacingMergeTree table, the rows inserted again with the same sorting key replace
+// the previous ones when the parts are merged, so the blocks can be stored again
+type clickHouseTable struct {
+	name        string
+	columns     []clickHouseColumn
+	partitionBy string
+	orderBy     string
+}
+
+var (
+	clickHouseTransactions = clickHouseTable{
+		name: "transactions",
+		columns: []clickHouseColumn{
+			{"channel", "String"},
+			{"tx_id", "String"},
+			{"block_number", "UInt64"},
+			{"tx_index", "UInt32"},
+			{"tx_date", "DateTime64(3, 'UTC')"},
+			{"header_type", "String"},
+			{"validation_code", "String"},
+			{"chaincode", "String"},
+			{"creator", "String"},
+			{"endorsers", "String"},
+		},
+		partitionBy: "toYYYYMM(tx_date)",
+		orderBy:     "channel, block_number, tx_index",
+	}
+	clickHouseKeyHistory = clickHouseTable{
+		name: "key_history",
+		columns: []clickHouseColumn{
+			{"channel", "String"},
+			{"chaincode", "String"},
+			{"collection", "String"},
+			{"key", "String"},
+			{"id", "String"},
+			{"operation", "String"},
+			{"block_number", "UInt64"},
+			{"tx_index", "UInt32"},
+			{"write_index", "UInt32"},
+			{"tx_id", "String"},
+			{"tx_date", "DateTime64(3, 'UTC')"},
+			{"value", "String"},
+		},
+		partitionBy: "toYYYYMM(tx_date)",
+		orderBy:     "channel, chaincode, collection, key, block_number, tx_index, write_index",
+	}
+	clickHouseEvents = clickHouseTable{
+		name: "events",
+		columns: []clickHouseColumn{
+			{"channel", "String"},
+			{"chaincode", "String"},
+			{"event_name", "String"},
+			{"block_number", "UInt64"},
+			{"tx_index", "UInt32"},
+			{"tx_id", "String"},
+			{"tx_date", "DateTime64(3, 'UTC')"},
+			{"payload", "String"},
+		},
+		partitionBy: "toYYYYMM(tx_date)",
+		orderBy:     "channel, chaincode, block_number, tx_index",
+	}
+	// clickHouseCheckpoints keeps the last block stored of every channel, the last row inserted wins
+	clickHouseCheckpoints = clickHouseTable{
+		name: "checkpoints",
+		columns: []clickHouseColumn{
+			{"channel", "String"},
+			{"block_number", "UInt64"},
+			{"updated_at", "DateTime64(3, 'UTC')"},
+		},
+		orderBy: "channel",
+	}
+)
+
+func (t clickHouseTable) createStatement(prefix string) string {
+	var columns []string
+	for _, column := range t.columns {
+		columns = append(columns, fmt.Sprintf("`%s` %s", column.name, column.columnType))
+	}
+	engine := "ReplacingMergeTree"
+	if t.name == clickHouseCheckpoints.name {
+		engine = "ReplacingMergeTree(updated_at)"
+	}
+	statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s%s` (%s) ENGINE = %s", prefix, t.name, strings.Join(columns, ", "), engine)
+	if t.partitionBy != "" {
+		statement += " PARTITION BY " + t.partitionBy
+	}
+	return statement + " ORDER BY (" + t.orderBy + ")"
+}
+
+func (t clickHouseTable) insertStatement(prefix string) string {
+	var columns []string
+	for _, column := range t.columns {
+		columns = append(columns, "`"+column.name+"`")
+	}
+	return fmt.Sprintf("INSERT INTO `%s%s` (%s) VALUES (%s)", prefix, t.name, strings.Join(columns, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(t.columns)), ", "))
+}
+
+// clickHouseTPSStatements create the transactions per minute of every chaincode, aggregated by a materialized
+// view of the transactions. The transactions are counted by ID, so those inserted again aren't counted twice
+func clickHouseTPSStatements(prefix string) (table string, view string, backfill string, tps string) {
+	selectTPS := fmt.Sprintf("SELECT channel, chaincode, toStartOfMinute(tx_date) AS minute, "+
+		"uniqExactState(tx_id) AS transactions, uniqExactIfState(tx_id, validation_code = 'VALID') AS valid_transactions "+
+		"FROM `%stransactions` WHERE chaincode != '' GROUP BY channel, chaincode, minute", prefix)
+	table = fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%stps_per_minute` (`channel` String, `chaincode` String, `minute` DateTime('UTC'), "+
+		"`transactions` AggregateFunction(uniqExact, String), `valid_transactions` AggregateFunction(uniqExactIf, String, UInt8)) "+
+		"ENGINE = AggregatingMergeTree PARTITION BY toYYYYMM(minute) ORDER BY (channel, chaincode, minute)", prefix)
+	view = fmt.Sprintf("CREATE MATERIALIZED VIEW IF NOT EXISTS `%stps_per_minute_mv` TO `%stps_per_minute` AS %s", prefix, prefix, selectTPS)
+	backfill = fmt.Sprintf("INSERT INTO `%stps_per_minute` %s", prefix, selectTPS)
+	tps = fmt.Sprintf("CREATE VIEW IF NOT EXISTS `%stps` AS SELECT channel, chaincode, minute, "+
+		"uniqExactMerge(transactions) AS tx_count, uniqExactIfMerge(valid_transactions) AS valid_tx_count, "+
+		"valid_tx_count / 60 AS tps FROM `%stps_per_minute` GROUP BY channel, chaincode, minute", prefix, prefix)
+	return table, view, backfill, tps
+}
+
+func clickHouseTime(txDate int) time.Time {
+	return time.Unix(0, int64(txDate)*int64(time.Millisecond)).UTC()
+}
+
+// clickHouseJSON returns the JSON of a nested value, empty when it's not set
+func clickHouseJSON(value interface{}) (string, error) {
+	data, _, err := jsonField(value)
+	return data, err
+}
+
+// clickHouseRows returns the rows of the transactions, and of the writes and chaincode events of the valid transactions
+func clickHouseRows(response *transformation.DocumentExtractionResponse) (transactions [][]interface{}, history [][]interface{}, events [][]interface{}, err error) {
+	for _, tx := range response.Transactions {
+		var creator interface{}
+		if tx.Creator != nil {
+			creator = tx.Creator
+		}
+		creatorJSON, err := clickHouseJSON(creator)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var endorsers interface{}
+		if len(tx.Endorsers) > 0 {
+			endorsers = tx.Endorsers
+		}
+		endorsersJSON, err := clickHouseJSON(endorsers)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		transactions = append(transactions, []interface{}{
+			tx.ChannelID,
+			tx.TXID,
+			int64(tx.BlockNumber),
+			int64(tx.TXIndex),
+			clickHouseTime(tx.TXDate),
+			tx.HeaderType,
+			tx.ValidationCode,
+			tx.ChaincodeID,
+			creatorJSON,
+			endorsersJSON,
+		})
+	}
+	for _, event := range response.Events {
+		document := event.Document
+		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
+			continue
+		}
+		value := ""
+		if event.Operation == transformation.Upsert {
+			value, err = clickHouseJSON(document.Data)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		history = append(history, []interface{}{
+			document.ChannelID,
+			document.ChaincodeID,
+			document.Collection,
+			document.Key,
+			document.PrimaryKey,
+			string(event.Operation),
+			int64(event.BlockNumber),
+			int64(event.TXIndex),
+			int64(event.WriteIndex),
+			document.TXID,
+			clickHouseTime(document.TXDate),
+			value,
+		})
+	}
+	for _, event := range response.ChaincodeEvents {
+		events = append(events, []interface{}{
+			event.ChannelID,
+			event.ChaincodeID,
+			event.EventName,
+			int64(event.BlockNumber),
+			int64(event.TXIndex),
+			event.TXID,
+			clickHouseTime(event.TXDate),
+			string(event.Payload),
+		})
+	}
+	return transactions, history, events, nil
+}
+
+// ClickHouseStorage stores the transactions, the history of the keys and the chaincode events in ClickHouse
+// tables shared by the channels. Every table is inserted in one block of the native protocol per batch and
+// the checkpoint last, the rows of a batch stored again are replaced when ClickHouse merges the parts, so the
+// queries needing exact results use FINAL
+type ClickHouseStorage struct {
+	db          *sql.DB
+	channelID   string
+	tablePrefix string
+	opts        []transformation.Option
+}
+
+type ClickHouseConfig struct {
+	// DSN is the address of the native protocol, like tcp://localhost:9000?database=ledger&username=default
+	DSN string `mapstructure:"dsn"`
+	// TablePrefix is prepended to the names of the tables, hlf_ by default
+	TablePrefix string
+	// TPSViews creates the transactions per minute of every chaincode, aggregated by a materialized view
+	TPSViews bool `mapstructure:"tpsViews"`
+}
+
+// NewClickHouseStorage connects to ClickHouse and creates the tables, the config must be validated
+func NewClickHouseStorage(config ClickHouseConfig, channelID string, opts ...transformation.Option) (ClickHouseStorage, error) {
+	db, err := sql.Open("clickhouse", config.DSN)
+	if err != nil {
+		return ClickHouseStorage{}, errors.Wrap(err, "invalid ClickHouse DSN")
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return ClickHouseStorage{}, errors.Wrap(err, "failed to connect to ClickHouse")
+	}
+	storage := ClickHouseStorage{
+		db:          db,
+		channelID:   channelID,
+		tablePrefix: config.TablePrefix,
+		opts:        opts,
+	}
+	for _, table := range []clickHouseTable{clickHouseTransactions, clickHouseKeyHistory, clickHouseEvents, clickHouseCheckpoints} {
+		_, err = db.Exec(table.createStatement(config.TablePrefix))
+		if err != nil {
+			db.Close()
+			return ClickHouseStorage{}, errors.Wrapf(err, "failed to create the table %s%s", config.TablePrefix, table.name)
+		}
+	}
+	if config.TPSViews {
+		storage, err = storage.WithTPSViews()
+		if err != nil {
+			db.Close()
+			return ClickHouseStorage{}, err
+		}
+	}
+	return storage, nil
+}
+
+// WithTPSViews creates the tps_per_minute table filled by a materialized view of the transactions, and the tps view
+// reading it. The transactions already stored are added when the materialized view is created
+func (c ClickHouseStorage) WithTPSViews() (ClickHouseStorage, error) {
+	var exists uint64
+	err := c.db.QueryRow("SELECT count() FROM system.tables WHERE database = currentDatabase() AND name = ?", c.tablePrefix+"tps_per_minute_mv").Scan(&exists)
+	if err != nil {
+		return c, errors.Wrap(err, "failed to look for the TPS view")
+	}
+	table, view, backfill, tps := clickHouseTPSStatements(c.tablePrefix)
+	statements := []string{table, view}
+	if exists == 0 {
+		statements = append(statements, backfill)
+	}
+	for _, statement := range append(statements, tps) {
+		_, err = c.db.Exec(statement)
+		if err != nil {
+			return c, errors.Wrap(err, "failed to create the TPS views")
+		}
+	}
+	return c, nil
+}
+
+// insert inserts the rows in one block
+func (c ClickHouseStorage) insert(table clickHouseTable, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(table.insertStatement(c.tablePrefix))
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "failed to insert into %s%s", c.tablePrefix, table.name)
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		_, err = stmt.Exec(row...)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "failed to insert into %s%s", c.tablePrefix, table.name)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "failed to insert into %s%s", c.tablePrefix, table.name)
+	}
+	return nil
+}
+
+func (c ClickHouseStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
+	transactions, history, events, err := clickHouseRows(response)
+	if err != nil {
+		return err
+	}
+	for _, insert := range []struct {
+		table clickHouseTable
+		rows  [][]interface{}
+	}{
+		{clickHouseTransactions, transactions},
+		{clickHouseKeyHistory, history},
+		{clickHouseEvents, events},
+	} {
+		err = c.insert(insert.table, insert.rows)
+		if err != nil {
+			return err
+		}
+	}
+	if len(response.Blocks) > 0 {
+		blockNumber := response.Blocks[len(response.Blocks)-1].Number
+		err = c.insert(clickHouseCheckpoints, [][]interface{}{{c.channelID, int64(blockNumber), time.Now().UTC()}})
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("ClickHouse rows inserted transactions=%d history=%d events=%d", len(transactions), len(history), len(events))
+	return nil
+}
+
+// Checkpoint returns the last block stored, inserted after the rows of its batch
+func (c ClickHouseStorage) Checkpoint() (int, bool, error) {
+	var blockNumber uint64
+	err := c.db.QueryRow(fmt.Sprintf("SELECT block_number FROM `%scheckpoints` FINAL WHERE channel = ? LIMIT 1", c.tablePrefix), c.channelID).Scan(&blockNumber)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return int(blockNumber), true, nil
+}
+
+func (c ClickHouseStorage) StoreBulk(blocks []*cb.Block) error {
+	response, err := transformation.BlocksToDocuments(blocks, c.opts...)
+	if err != nil {
+		return err
+	}
+	return c.storeDocs(response)
+}
+
+// StoreDocuments stores blocks already decoded
+func (c ClickHouseStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return c.storeDocs(response)
+}
+
+func (c ClickHouseStorage) Store(block *cb.Block) error {
+	response, err := transformation.BlockToDocuments(block, c.opts...)
+	if err != nil {
+		return err
+	}
+	return c.storeDocs(response)
+}
+
+// ClickHouseStorageConfig is the configuration of the clickhouse database type
+type ClickHouseStorageConfig struct {
+	ClickHouseConfig `mapstructure:",squash"`
+}
+
+func (c *ClickHouseStorageConfig) Validate() error {
+	if c.DSN == "" {
+		return errors.New("dsn is required")
+	}
+	if c.TablePrefix == "" {
+		c.TablePrefix = DefaultClickHouseTablePrefix
+	}
+	if !clickHouseIdentifier.MatchString(c.TablePrefix) {
+		return errors.Errorf("invalid table prefix %s, only letters, digits and _ are allowed", c.TablePrefix)
+	}
+	return nil
+}
+
+type clickhouseFactory struct{}
+
+func (clickhouseFactory) NewConfig() StorageConfig {
+	return &ClickHouseStorageConfig{}
+}
+
+func (clickhouseFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	return NewClickHouseStorage(config.(*ClickHouseStorageConfig).ClickHouseConfig, channelID, opts...)
+}
+
+func init() {
+	Register("clickhouse", clickhouseFactory{})
+}
@@ -0,0 +1,101 @@
+package listener
+
+import (
+	"fmt"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClickHouseStatements(t *testing.T) {
+	assert.Equal(t,
+		"CREATE TABLE IF NOT EXISTS `hlf_events` (`channel` String, `chaincode` String, `event_name` String, `block_number` UInt64, "+
+			"`tx_index` UInt32, `tx_id` String, `tx_date` DateTime64(3, 'UTC'), `payload` String) ENGINE = ReplacingMergeTree "+
+			"PARTITION BY toYYYYMM(tx_date) ORDER BY (channel, chaincode, block_number, tx_index)",
+		clickHouseEvents.createStatement("hlf_"))
+	assert.Equal(t,
+		"CREATE TABLE IF NOT EXISTS `hlf_checkpoints` (`channel` String, `block_number` UInt64, `updated_at` DateTime64(3, 'UTC')) "+
+			"ENGINE = ReplacingMergeTree(updated_at) ORDER BY (channel)",
+		clickHouseCheckpoints.createStatement("hlf_"))
+	assert.Equal(t,
+		"INSERT INTO `hlf_checkpoints` (`channel`, `block_number`, `updated_at`) VALUES (?, ?, ?)",
+		clickHouseCheckpoints.insertStatement("hlf_"))
+	_, view, backfill, tps := clickHouseTPSStatements("ledger_")
+	assert.Contains(t, view, "TO `ledger_tps_per_minute` AS SELECT")
+	assert.Contains(t, backfill, "INSERT INTO `ledger_tps_per_minute` SELECT")
+	assert.Contains(t, tps, "FROM `ledger_tps_per_minute`")
+}
+
+func TestClickHouseRows(t *testing.T) {
+	response, err := transformation.BlocksToDocuments(natsTestBlocks("mychannel"))
+	require.NoError(t, err)
+	transactions, history, events, err := clickHouseRows(response)
+	require.NoError(t, err)
+	require.Len(t, transactions, 4)
+	assert.Equal(t, []interface{}{"mychannel", "4", int64(2), int64(1)}, transactions[3][:4])
+	assert.Equal(t, "MVCC_READ_CONFLICT", transactions[3][6])
+	assert.IsType(t, time.Time{}, transactions[0][4])
+
+	// the write and the event of the invalid transaction are left out
+	var keys []interface{}
+	for _, row := range history {
+		assert.Len(t, row, len(clickHouseKeyHistory.columns))
+		keys = append(keys, row[3])
+	}
+	assert.Equal(t, []interface{}{"car1", "car2", "car3", "car4"}, keys)
+	assert.Equal(t, "delete", history[2][5])
+	assert.Equal(t, "", history[2][11])
+	assert.Contains(t, history[0][11], `"owner":"a"`)
+	require.Len(t, events, 1)
+	assert.Equal(t, []interface{}{"mychannel", "fabcar", "CarCreated", int64(2), int64(0), "3"}, events[0][:6])
+}
+
+// newClickHouseTestStorage connects to the clickhouse-server in HLF_SYNC_TEST_CLICKHOUSE_DSN,
+// e.g. tcp://localhost:9000?database=default
+func newClickHouseTestStorage(t *testing.T) ClickHouseStorage {
+	dsn := os.Getenv("HLF_SYNC_TEST_CLICKHOUSE_DSN")
+	if dsn == "" {
+		t.Skip("HLF_SYNC_TEST_CLICKHOUSE_DSN not set")
+	}
+	config := ClickHouseStorageConfig{ClickHouseConfig{DSN: dsn, TablePrefix: fmt.Sprintf("test%d_", time.Now().UnixNano()), TPSViews: true}}
+	require.NoError(t, config.Validate())
+	storage, err := NewClickHouseStorage(config.ClickHouseConfig, "mychannel")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		for _, table := range []string{"tps", "tps_per_minute_mv", "tps_per_minute", "transactions", "key_history", "events", "checkpoints"} {
+			storage.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%s%s`", storage.tablePrefix, table))
+		}
+		storage.db.Close()
+	})
+	return storage
+}
+
+func clickHouseCount(t *testing.T, storage ClickHouseStorage, query string) uint64 {
+	var count uint64
+	require.NoError(t, storage.db.QueryRow(fmt.Sprintf(query, storage.tablePrefix)).Scan(&count))
+	return count
+}
+
+func TestClickHouseStorage(t *testing.T) {
+	storage := newClickHouseTestStorage(t)
+	_, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, storage.StoreBulk(natsTestBlocks("mychannel")))
+	blockNumber, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 2, blockNumber)
+
+	// the blocks stored again replace the rows, and aren't counted twice by the TPS views
+	require.NoError(t, storage.StoreBulk(natsTestBlocks("mychannel")))
+	assert.Equal(t, uint64(4), clickHouseCount(t, storage, "SELECT count() FROM `%stransactions` FINAL"))
+	assert.Equal(t, uint64(4), clickHouseCount(t, storage, "SELECT count() FROM `%skey_history` FINAL"))
+	assert.Equal(t, uint64(1), clickHouseCount(t, storage, "SELECT count() FROM `%sevents` FINAL WHERE event_name = 'CarCreated'"))
+	assert.Equal(t, uint64(4), clickHouseCount(t, storage, "SELECT sum(tx_count) FROM `%stps` WHERE chaincode = 'fabcar'"))
+	assert.Equal(t, uint64(3), clickHouseCount(t, storage, "SELECT sum(valid_tx_count) FROM `%stps` WHERE chaincode = 'fabcar'"))
+}
@@ -5,138 +5,592 @@ import (
 	"encoding/json"
 	"fmt"
 	elasticsearch7 "github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
 	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/chaincode"
 	"github.com/kfsoftware/hlf-sync/pkg/transformation"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ElasticSearchStorage struct {
-	client *elasticsearch7.Client
+	client       *elasticsearch7.Client
+	channelID    string
+	opts         []transformation.Option
+	maxBulkBytes int
+	maxRetries   int
+	retryBackoff time.Duration
+	server       ServerInfo
+	// generation is set when building a new generation of the indexes, see Reindex
+	generation int
+	indices    *elasticIndices
+}
+
+const (
+	DefaultMaxBulkBytes = 5 * 1024 * 1024
+	DefaultBulkRetries  = 5
+	DefaultRetryBackoff = 500 * time.Millisecond
+)
+
+func NewElasticStorage(client *elasticsearch7.Client, channelID string, opts ...transformation.Option) ElasticSearchStorage {
+	return ElasticSearchStorage{
+		client:       client,
+		channelID:    channelID,
+		opts:         opts,
+		maxBulkBytes: DefaultMaxBulkBytes,
+		maxRetries:   DefaultBulkRetries,
+		retryBackoff: DefaultRetryBackoff,
+		indices:      &elasticIndices{ready: map[string]bool{}},
+	}
+}
+
+// WithBulkLimits sets the maximum size in bytes of a bulk request and how many times the actions
+// rejected with 429 or 503 are retried, the backoff doubles on every retry
+func (e ElasticSearchStorage) WithBulkLimits(maxBulkBytes int, maxRetries int, retryBackoff time.Duration) ElasticSearchStorage {
+	e.maxBulkBytes = maxBulkBytes
+	e.maxRetries = maxRetries
+	e.retryBackoff = retryBackoff
+	return e
 }
 
 func (e ElasticSearchStorage) StoreBulk(blocks []*cb.Block) error {
-	docs, err := transformation.BlocksToDocuments(blocks)
+	docs, err := transformation.BlocksToDocuments(blocks, e.opts...)
 	if err != nil {
 		return err
 	}
-	var buf bytes.Buffer
+	return e.storeDocs(docs)
+}
+
+// StoreDocuments stores blocks already decoded
+func (e ElasticSearchStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return e.storeDocs(response)
+}
+
+func (e ElasticSearchStorage) Store(block *cb.Block) error {
+	docs, err := transformation.BlockToDocuments(block, e.opts...)
+	if err != nil {
+		return err
+	}
+	return e.storeDocs(docs)
+}
+
+func (e ElasticSearchStorage) storeDocs(docs *transformation.DocumentExtractionResponse) error {
+	var actions []*bulkAction
 	for _, document := range docs.DocumentsToAdd {
-		key := IndexKey{
-			ChaincodeID: document.ChaincodeID,
-			ChannelID:   document.ChannelID,
+		indexName, err := e.writeIndex(fmt.Sprintf("%s_%s", document.ChannelID, document.ChaincodeID))
+		if err != nil {
+			return err
 		}
-		indexName := fmt.Sprintf("%s_%s", key.ChannelID, key.ChaincodeID)
-
 		data, err := json.Marshal(document.Data)
 		if err != nil {
 			return err
 		}
-		meta := []byte(fmt.Sprintf(`{ "index" : {"_index": "%s",  "_id" : "%s" } }%s`, indexName, document.PrimaryKey, "\n"))
-		data = append(data, "\n"...)
-		buf.Grow(len(meta) + len(data))
-		buf.Write(meta)
-		buf.Write(data)
+		actions = append(actions, newVersionedBulkAction("index", indexName, document.PrimaryKey, document.Version(), data))
 	}
-
 	for _, document := range docs.DocumentsToRemove {
-		key := IndexKey{
-			ChaincodeID: document.ChaincodeID,
-			ChannelID:   document.ChannelID,
+		indexName, err := e.writeIndex(fmt.Sprintf("%s_%s", document.ChannelID, document.ChaincodeID))
+		if err != nil {
+			return err
 		}
-		indexName := fmt.Sprintf("%s_%s", key.ChannelID, key.ChaincodeID)
-
-		var buf bytes.Buffer
-		buf.Write(
-			[]byte(
-				fmt.Sprintf(`{ "delete" : { "_index" : "%s", "_id" : "%s" } }%s`, indexName, document.PrimaryKey, "\n"),
-			),
-		)
+		actions = append(actions, newVersionedBulkAction("delete", indexName, document.PrimaryKey, document.Version(), nil))
+	}
+	blockActions, err := e.blockActions(docs.Blocks)
+	if err != nil {
+		return err
+	}
+	actions = append(actions, blockActions...)
+	conflicts, err := e.bulk(actions)
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		log.Infof("Stale writes skipped=%d", conflicts)
 	}
 	log.Infof("Items added=%d", len(docs.DocumentsToAdd))
 	log.Infof("Items removed=%d", len(docs.DocumentsToRemove))
-	if buf.Len() > 0 {
-		res, err := e.client.Bulk(bytes.NewReader(buf.Bytes()))
+	return nil
+}
+
+func (e ElasticSearchStorage) blockActions(blocks []*transformation.BlockInfo) ([]*bulkAction, error) {
+	var actions []*bulkAction
+	for _, block := range blocks {
+		indexName, err := e.writeIndex(blocksIndexName(block.ChannelID))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if res.IsError() {
-			var raw map[string]interface{}
-			if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
-				return errors.Errorf("Failure to  parse response body: %s", err)
-			} else {
-				return errors.Errorf("  Error: [%d] %s: %s",
-					res.StatusCode,
-					raw["error"].(map[string]interface{})["type"],
-					raw["error"].(map[string]interface{})["reason"],
-				)
+		data, err := json.Marshal(block)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, newBulkAction("index", indexName, strconv.Itoa(block.Number), data))
+	}
+	return actions, nil
+}
+
+// bulkAction is an action of a bulk request with its source, if any, in NDJSON
+type bulkAction struct {
+	action string
+	index  string
+	id     string
+	body   []byte
+}
+
+func newBulkAction(action string, index string, id string, source []byte) *bulkAction {
+	return encodeBulkAction(action, map[string]interface{}{"_index": index, "_id": id}, source)
+}
+
+// newVersionedBulkAction returns an action with an external version, Elasticsearch rejects it
+// with a conflict when the document has been written with the same or a newer version
+func newVersionedBulkAction(action string, index string, id string, version int64, source []byte) *bulkAction {
+	return encodeBulkAction(action, map[string]interface{}{
+		"_index":       index,
+		"_id":          id,
+		"version":      version,
+		"version_type": "external",
+	}, source)
+}
+
+func encodeBulkAction(action string, target map[string]interface{}, source []byte) *bulkAction {
+	meta, _ := json.Marshal(map[string]interface{}{
+		action: target,
+	})
+	body := append(meta, '\n')
+	if source != nil {
+		body = append(append(body, source...), '\n')
+	}
+	return &bulkAction{
+		action: action,
+		index:  target["_index"].(string),
+		id:     target["_id"].(string),
+		body:   body,
+	}
+}
+
+// BulkItemError is a bulk action rejected by Elasticsearch
+type BulkItemError struct {
+	Action string
+	Index  string
+	ID     string
+	Status int
+	Type   string
+	Reason string
+}
+
+// BulkError is returned when some actions of a bulk request failed, the other actions were applied
+type BulkError struct {
+	Items []BulkItemError
+}
+
+func (e *BulkError) Error() string {
+	first := e.Items[0]
+	return fmt.Sprintf(
+		"%d bulk actions failed, first: %s %s/%s [%d] %s: %s",
+		len(e.Items),
+		first.Action,
+		first.Index,
+		first.ID,
+		first.Status,
+		first.Type,
+		first.Reason,
+	)
+}
+
+type bulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]bulkResponseItemResult `json:"items"`
+}
+
+type bulkResponseItemResult struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// bulk sends the actions in requests of at most maxBulkBytes, the actions rejected with 429 or 503
+// are retried with backoff, the rest of the failures are returned as a BulkError. Version conflicts
+// mean the document already holds the same or a newer write, they are only counted
+func (e ElasticSearchStorage) bulk(actions []*bulkAction) (int, error) {
+	conflicts := 0
+	var failures []BulkItemError
+	pending := actions
+	backoff := e.retryBackoff
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			log.Warnf("Retrying %d bulk actions in %s", len(pending), backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retries []*bulkAction
+		for _, chunk := range splitBulkActions(pending, e.maxBulkBytes) {
+			chunkRetries, chunkConflicts, chunkFailures, err := e.sendBulk(chunk)
+			if err != nil {
+				return conflicts, err
 			}
+			conflicts += chunkConflicts
+			retries = append(retries, chunkRetries...)
+			failures = append(failures, chunkFailures...)
 		}
+		if len(retries) > 0 && attempt >= e.maxRetries {
+			for _, action := range retries {
+				failures = append(failures, BulkItemError{
+					Action: action.action,
+					Index:  action.index,
+					ID:     action.id,
+					Status: http.StatusTooManyRequests,
+					Reason: fmt.Sprintf("still rejected after %d retries", e.maxRetries),
+				})
+			}
+			break
+		}
+		pending = retries
 	}
-	return nil
+	if len(failures) > 0 {
+		return conflicts, &BulkError{Items: failures}
+	}
+	return conflicts, nil
 }
 
-func NewElasticStorage(client *elasticsearch7.Client) ElasticSearchStorage {
-	return ElasticSearchStorage{
-		client: client,
+// splitBulkActions groups the actions in chunks of at most maxBytes, an action bigger than
+// maxBytes is sent alone
+func splitBulkActions(actions []*bulkAction, maxBytes int) [][]*bulkAction {
+	var chunks [][]*bulkAction
+	var chunk []*bulkAction
+	size := 0
+	for _, action := range actions {
+		if len(chunk) > 0 && maxBytes > 0 && size+len(action.body) > maxBytes {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			size = 0
+		}
+		chunk = append(chunk, action)
+		size += len(action.body)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
 	}
+	return chunks
 }
-func (e ElasticSearchStorage) Store(block *cb.Block) error {
-	docs, err := transformation.BlockToDocuments(block)
+
+// sendBulk sends one bulk request, returning the actions to retry, the number of version conflicts
+// and the actions that failed
+func (e ElasticSearchStorage) sendBulk(actions []*bulkAction) ([]*bulkAction, int, []BulkItemError, error) {
+	var buf bytes.Buffer
+	for _, action := range actions {
+		buf.Write(action.body)
+	}
+	res, err := e.client.Bulk(bytes.NewReader(buf.Bytes()))
 	if err != nil {
-		return err
+		return nil, 0, nil, err
 	}
-	var buf bytes.Buffer
-	for _, document := range docs.DocumentsToAdd {
-		key := IndexKey{
-			ChaincodeID: document.ChaincodeID,
-			ChannelID:   document.ChannelID,
+	defer res.Body.Close()
+	if isRetryableStatus(res.StatusCode) {
+		return actions, 0, nil, nil
+	}
+	if res.IsError() {
+		return nil, 0, nil, responseError(res)
+	}
+	response := &bulkResponse{}
+	err = json.NewDecoder(res.Body).Decode(response)
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "failed to parse bulk response")
+	}
+	if !response.Errors {
+		return nil, 0, nil, nil
+	}
+	if len(response.Items) != len(actions) {
+		return nil, 0, nil, errors.Errorf("bulk response has %d items for %d actions", len(response.Items), len(actions))
+	}
+	var retries []*bulkAction
+	conflicts := 0
+	var failures []BulkItemError
+	for i, item := range response.Items {
+		action := actions[i]
+		result := item[action.action]
+		if result.Error == nil || action.action == "delete" && result.Status == http.StatusNotFound {
+			// deleting a missing document, or from a missing index, is a no-op
+			continue
+		}
+		if result.Status == http.StatusConflict {
+			conflicts++
+			continue
 		}
-		indexName := fmt.Sprintf("%s_%s", key.ChannelID, key.ChaincodeID)
+		if isRetryableStatus(result.Status) {
+			retries = append(retries, action)
+			continue
+		}
+		failures = append(failures, BulkItemError{
+			Action: action.action,
+			Index:  action.index,
+			ID:     action.id,
+			Status: result.Status,
+			Type:   result.Error.Type,
+			Reason: result.Error.Reason,
+		})
+	}
+	return retries, conflicts, failures, nil
+}
 
-		data, err := json.Marshal(document.Data)
+type esSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Index  string                 `json:"_index"`
+			ID     string                 `json:"_id"`
+			Source map[string]interface{} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// legacyDocumentsQuery matches the documents stored before the canonical document ID was introduced
+const legacyDocumentsQuery = `{
+  "query": {
+    "bool": {
+      "must": [{"exists": {"field": "_fabric_txid"}}],
+      "must_not": [{"exists": {"field": "_fabric_key"}}]
+    }
+  }
+}`
+
+// Migrate moves the documents of the channel indexed with the ledger key as _id to the canonical
+// document ID. The chaincode is taken from the alias <channel>_<chaincode> of the index.
+func (e ElasticSearchStorage) Migrate() error {
+	prefix := e.channelID + "_"
+	res, err := e.client.Search(
+		e.client.Search.WithIndex(prefix+"*"),
+		e.client.Search.WithBody(strings.NewReader(legacyDocumentsQuery)),
+		e.client.Search.WithScroll(time.Minute),
+		e.client.Search.WithSize(500),
+	)
+	for {
+		if err != nil {
+			return err
+		}
+		if res.IsError() {
+			res.Body.Close()
+			return errors.Errorf("Failed to search legacy documents: %s", res.String())
+		}
+		searchResponse := &esSearchResponse{}
+		err = json.NewDecoder(res.Body).Decode(searchResponse)
+		res.Body.Close()
 		if err != nil {
 			return err
 		}
-		meta := []byte(fmt.Sprintf(`{ "index" : {"_index": "%s",  "_id" : "%s" } }%s`, indexName, document.PrimaryKey, "\n"))
-		data = append(data, "\n"...)
-		buf.Grow(len(meta) + len(data))
-		buf.Write(meta)
-		buf.Write(data)
+		hits := searchResponse.Hits.Hits
+		if len(hits) == 0 {
+			if searchResponse.ScrollID != "" {
+				clearRes, err := e.client.ClearScroll(e.client.ClearScroll.WithScrollID(searchResponse.ScrollID))
+				if err == nil {
+					clearRes.Body.Close()
+				}
+			}
+			return nil
+		}
+		var actions []*bulkAction
+		for _, hit := range hits {
+			alias, _, ok := e.parseIndexName(hit.Index)
+			if !ok {
+				log.Warnf("Skipping document %s of index %s", hit.ID, hit.Index)
+				continue
+			}
+			documentKey := transformation.DocumentKey{
+				ChannelID: e.channelID,
+				Namespace: strings.TrimPrefix(alias, prefix),
+				Key:       hit.ID,
+			}
+			data := hit.Source
+			data[transformation.PrimaryKey] = documentKey.ID()
+			data[transformation.KeyKey] = hit.ID
+			data[transformation.ChannelKey] = documentKey.ChannelID
+			data[transformation.NamespaceKey] = documentKey.Namespace
+			data[transformation.CollectionKey] = ""
+			dataBytes, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			actions = append(
+				actions,
+				newBulkAction("index", hit.Index, documentKey.ID(), dataBytes),
+				newBulkAction("delete", hit.Index, hit.ID, nil),
+			)
+		}
+		_, err = e.bulk(actions)
+		if err != nil {
+			return err
+		}
+		log.Infof("Migrated %d documents", len(hits))
+		res, err = e.client.Scroll(
+			e.client.Scroll.WithScrollID(searchResponse.ScrollID),
+			e.client.Scroll.WithScroll(time.Minute),
+		)
 	}
+}
 
-	for _, document := range docs.DocumentsToRemove {
-		key := IndexKey{
-			ChaincodeID: document.ChaincodeID,
-			ChannelID:   document.ChannelID,
+// CreateIndexes maps the string fields of the index definitions as keywords with dynamic templates,
+// so they can be filtered and sorted on. Numbers keep their dynamic mapping and fields already
+// mapped are left as they are since a mapping can't be changed
+func (e ElasticSearchStorage) CreateIndexes(chaincodeID string, indexes []*chaincode.Index) error {
+	var templates []map[string]interface{}
+	fields := map[string]bool{}
+	for _, index := range indexes {
+		for _, field := range index.Fields {
+			if fields[field.Name] {
+				continue
+			}
+			fields[field.Name] = true
+			templates = append(templates, map[string]interface{}{
+				fmt.Sprintf("hlf_sync_%s", field.Name): map[string]interface{}{
+					"path_match":         field.Name,
+					"match_mapping_type": "string",
+					"mapping": map[string]interface{}{
+						"type": "keyword",
+					},
+				},
+			})
 		}
-		indexName := fmt.Sprintf("%s_%s", key.ChannelID, key.ChaincodeID)
-
-		var buf bytes.Buffer
-		buf.Write(
-			[]byte(
-				fmt.Sprintf(`{ "delete" : { "_index" : "%s", "_id" : "%s" } }%s`, indexName, document.PrimaryKey, "\n"),
-			),
-		)
 	}
-	if buf.Len() > 0 {
-		res, err := e.client.Bulk(bytes.NewReader(buf.Bytes()))
-		if err != nil {
-			return err
+	if len(templates) == 0 {
+		return nil
+	}
+	indexName, err := e.writeIndex(fmt.Sprintf("%s_%s", e.channelID, chaincodeID))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Indices.GetMapping(e.client.Indices.GetMapping.WithIndex(indexName))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError(res)
+	}
+	// keyed by the index behind the alias
+	var mappings map[string]struct {
+		Mappings struct {
+			DynamicTemplates []map[string]interface{} `json:"dynamic_templates"`
+			Properties       map[string]struct {
+				Type string `json:"type"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&mappings)
+	if err != nil {
+		return err
+	}
+	for _, mapping := range mappings {
+		current := mapping.Mappings
+		// dynamic templates are replaced as a whole, keep the ones not managed here
+		for _, template := range current.DynamicTemplates {
+			for name := range template {
+				if !strings.HasPrefix(name, "hlf_sync_") || !fields[strings.TrimPrefix(name, "hlf_sync_")] {
+					templates = append(templates, template)
+				}
+			}
 		}
-		if res.IsError() {
-			var raw map[string]interface{}
-			if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
-				return errors.Errorf("Failure to  parse response body: %s", err)
-			} else {
-				return errors.Errorf("  Error: [%d] %s: %s",
-					res.StatusCode,
-					raw["error"].(map[string]interface{})["type"],
-					raw["error"].(map[string]interface{})["reason"],
-				)
+		for field := range fields {
+			if property, ok := current.Properties[field]; ok && property.Type != "keyword" {
+				log.Warnf("Field %s of index %s is already mapped as %s, use %s.keyword to filter and sort", field, indexName, property.Type, field)
 			}
 		}
+		break
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"dynamic_templates": templates,
+	})
+	if err != nil {
+		return err
 	}
+	res, err = e.client.Indices.PutMapping(bytes.NewReader(body), e.client.Indices.PutMapping.WithIndex(indexName))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError(res)
+	}
+	log.Infof("Updated the dynamic templates of index %s", indexName)
+	return nil
+}
 
+func responseError(res *esapi.Response) error {
+	var raw struct {
+		Error struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&raw)
+	if err != nil {
+		return errors.Errorf("[%d] failed to parse response body: %v", res.StatusCode, err)
+	}
+	return errors.Errorf("[%d] %s: %s", res.StatusCode, raw.Error.Type, raw.Error.Reason)
+}
+
+// ElasticBulkLimits configures the bulk requests, the fields not set take the defaults
+type ElasticBulkLimits struct {
+	MaxBytes     int
+	Retries      int
+	RetryBackoff time.Duration
+}
+
+// ElasticsearchStorageConfig is the configuration of the elasticsearch database type
+type ElasticsearchStorageConfig struct {
+	ElasticConfig `mapstructure:",squash"`
+	Bulk          ElasticBulkLimits
+	Template      IndexTemplate
+}
+
+func (c *ElasticsearchStorageConfig) Validate() error {
+	if len(c.URLs) == 0 {
+		return errors.New("urls is required")
+	}
+	if c.Bulk.MaxBytes == 0 {
+		c.Bulk.MaxBytes = DefaultMaxBulkBytes
+	}
+	if c.Bulk.Retries == 0 {
+		c.Bulk.Retries = DefaultBulkRetries
+	}
+	if c.Bulk.RetryBackoff == 0 {
+		c.Bulk.RetryBackoff = DefaultRetryBackoff
+	}
 	return nil
 }
+
+type elasticsearchFactory struct{}
+
+func (elasticsearchFactory) NewConfig() StorageConfig {
+	return &ElasticsearchStorageConfig{}
+}
+
+func (elasticsearchFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	c := config.(*ElasticsearchStorageConfig)
+	client, server, err := NewElasticClient(c.ElasticConfig)
+	if err != nil {
+		return nil, err
+	}
+	storage := NewElasticStorage(client, channelID, opts...).WithServer(server).WithBulkLimits(
+		c.Bulk.MaxBytes,
+		c.Bulk.Retries,
+		c.Bulk.RetryBackoff,
+	)
+	err = storage.InstallTemplate(c.Template)
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func init() {
+	Register("elasticsearch", elasticsearchFactory{})
+}
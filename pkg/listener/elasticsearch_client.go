@@ -0,0 +1,214 @@
+package listener
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	elasticsearch7 "github.com/elastic/go-elasticsearch/v7"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type Flavor string
+
+const (
+	ElasticsearchFlavor Flavor = "elasticsearch"
+	OpenSearchFlavor    Flavor = "opensearch"
+)
+
+// ElasticConfig configures the connection to an Elasticsearch or OpenSearch cluster
+type ElasticConfig struct {
+	URLs     []string
+	Username string `mapstructure:"user"`
+	Password string
+	// APIKey is the base64 encoded id:api_key returned by the create API key API, it takes precedence over the user
+	APIKey string
+	// ServiceToken is a service account token, sent as a bearer token
+	ServiceToken string
+	// CACert is the path of the PEM file with the certificate authorities of the cluster
+	CACert string
+	// CAFingerprint is the SHA-256 fingerprint, in hex, of a certificate in the chain of the cluster,
+	// as printed by Elasticsearch 8 on first start. It replaces the verification of the chain
+	CAFingerprint string
+	// ClientCert and ClientKey are the paths of the PEM files of the client certificate for mTLS
+	ClientCert string
+	ClientKey  string
+	// Flavor and Version are detected from the cluster when not set, Version is major[.minor]
+	Flavor  Flavor
+	Version string
+}
+
+// ServerInfo is the flavor and version of a cluster
+type ServerInfo struct {
+	Flavor Flavor
+	Major  int
+	Minor  int
+}
+
+func (s ServerInfo) String() string {
+	return fmt.Sprintf("%s %d.%d", s.Flavor, s.Major, s.Minor)
+}
+
+// composableTemplates tells if the cluster supports the composable index templates, added in Elasticsearch 7.8.
+// Every OpenSearch version supports them
+func (s ServerInfo) composableTemplates() bool {
+	return s.Flavor != ElasticsearchFlavor || s.Major == 0 || s.Major > 7 || s.Major == 7 && s.Minor >= 8
+}
+
+// parseVersion parses a major[.minor[.patch]] version
+func parseVersion(version string) (int, int, error) {
+	parts := strings.SplitN(version, ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid version %s", version)
+	}
+	minor := 0
+	if len(parts) > 1 {
+		minor, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, errors.Errorf("invalid version %s", version)
+		}
+	}
+	return major, minor, nil
+}
+
+// NewElasticClient connects to an Elasticsearch or OpenSearch cluster, the documents are stored in the
+// same format in both since only the APIs they share are used
+func NewElasticClient(config ElasticConfig) (*elasticsearch7.Client, ServerInfo, error) {
+	transport, err := elasticTransport(config)
+	if err != nil {
+		return nil, ServerInfo{}, err
+	}
+	// the client sends the basic credentials only when there's no Authorization header
+	header := http.Header{}
+	switch {
+	case config.APIKey != "" && config.ServiceToken != "":
+		return nil, ServerInfo{}, errors.New("either an API key or a service token can be set")
+	case config.APIKey != "":
+		header.Set("Authorization", fmt.Sprintf("ApiKey %s", config.APIKey))
+	case config.ServiceToken != "":
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", config.ServiceToken))
+	}
+	client, err := elasticsearch7.NewClient(elasticsearch7.Config{
+		Addresses: config.URLs,
+		Username:  config.Username,
+		Password:  config.Password,
+		Header:    header,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, ServerInfo{}, err
+	}
+	var info ServerInfo
+	if config.Flavor != "" && config.Version != "" {
+		info.Flavor = config.Flavor
+		info.Major, info.Minor, err = parseVersion(config.Version)
+		if err != nil {
+			return nil, ServerInfo{}, err
+		}
+	} else {
+		info, err = detectServer(client)
+		if err != nil {
+			return nil, ServerInfo{}, err
+		}
+		if config.Flavor != "" && config.Flavor != info.Flavor {
+			return nil, ServerInfo{}, errors.Errorf("the cluster is %s, not %s", info, config.Flavor)
+		}
+	}
+	switch info.Flavor {
+	case ElasticsearchFlavor:
+		if info.Major < 7 {
+			return nil, ServerInfo{}, errors.Errorf("%s isn't supported, 7.0 or later is required", info)
+		}
+	case OpenSearchFlavor:
+	default:
+		return nil, ServerInfo{}, errors.Errorf("unknown flavor %s", info.Flavor)
+	}
+	log.Infof("Connected to %s", info)
+	return client, info, nil
+}
+
+// detectServer reads the flavor and version of the cluster from its root endpoint
+func detectServer(client *elasticsearch7.Client) (ServerInfo, error) {
+	res, err := client.Info()
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return ServerInfo{}, errors.Wrap(responseError(res), "failed to get the cluster version")
+	}
+	var root struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&root)
+	if err != nil {
+		return ServerInfo{}, errors.Wrap(err, "failed to parse the cluster version")
+	}
+	info := ServerInfo{Flavor: ElasticsearchFlavor}
+	if root.Version.Distribution == string(OpenSearchFlavor) {
+		info.Flavor = OpenSearchFlavor
+	}
+	info.Major, info.Minor, err = parseVersion(root.Version.Number)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	return info, nil
+}
+
+func elasticTransport(config ElasticConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{}
+	if config.CACert != "" {
+		caBytes, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the CA certificate")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, errors.Errorf("no certificates found in %s", config.CACert)
+		}
+	}
+	if config.ClientCert != "" || config.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load the client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if config.CAFingerprint != "" {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(config.CAFingerprint, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, errors.Errorf("invalid CA fingerprint %s", config.CAFingerprint)
+		}
+		// the chain is trusted when one of its certificates has the fingerprint
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, certificate := range state.PeerCertificates {
+				digest := sha256.Sum256(certificate.Raw)
+				if string(digest[:]) == string(fingerprint) {
+					return nil
+				}
+			}
+			return errors.New("no certificate of the cluster matches the CA fingerprint")
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// WithServer sets the flavor and version of the cluster, so the storage uses the APIs it supports
+func (e ElasticSearchStorage) WithServer(server ServerInfo) ElasticSearchStorage {
+	e.server = server
+	return e
+}
@@ -0,0 +1,238 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	elasticsearch7Root = `{"name":"es","version":{"number":"7.7.1","build_flavor":"default"},"tagline":"You Know, for Search"}`
+	elasticsearch8Root = `{"name":"es","version":{"number":"8.5.0","build_flavor":"default"},"tagline":"You Know, for Search"}`
+	openSearchRoot     = `{"name":"os","version":{"distribution":"opensearch","number":"2.11.0"},"tagline":"The OpenSearch Project: https://opensearch.org/"}`
+)
+
+func TestNewElasticClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		root   string
+		config ElasticConfig
+		server ServerInfo
+		err    string
+	}{
+		{name: "Elasticsearch7", root: elasticsearch7Root, server: ServerInfo{Flavor: ElasticsearchFlavor, Major: 7, Minor: 7}},
+		{name: "Elasticsearch8", root: elasticsearch8Root, server: ServerInfo{Flavor: ElasticsearchFlavor, Major: 8, Minor: 5}},
+		{name: "OpenSearch", root: openSearchRoot, server: ServerInfo{Flavor: OpenSearchFlavor, Major: 2, Minor: 11}},
+		{name: "Elasticsearch6", root: `{"version":{"number":"6.8.0"}}`, err: "7.0 or later is required"},
+		{name: "WrongFlavor", root: openSearchRoot, config: ElasticConfig{Flavor: ElasticsearchFlavor}, err: "not elasticsearch"},
+		{
+			name:   "Configured",
+			root:   `{"error":{"type":"security_exception","reason":"no access to /"}}`,
+			config: ElasticConfig{Flavor: OpenSearchFlavor, Version: "1.3"},
+			server: ServerInfo{Flavor: OpenSearchFlavor, Major: 1, Minor: 3},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+				if strings.Contains(tt.root, "error") {
+					return 403, tt.root
+				}
+				return 200, tt.root
+			})
+			defer server.Close()
+			config := tt.config
+			config.URLs = []string{server.URL}
+			_, info, err := NewElasticClient(config)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.server, info)
+		})
+	}
+}
+
+func TestElasticAuthentication(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        ElasticConfig
+		authorization string
+	}{
+		{
+			name:          "Basic",
+			config:        ElasticConfig{Username: "elastic", Password: "secret"},
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("elastic:secret")),
+		},
+		{
+			name:          "APIKey",
+			config:        ElasticConfig{Username: "elastic", Password: "secret", APIKey: "aWQ6a2V5"},
+			authorization: "ApiKey aWQ6a2V5",
+		},
+		{
+			name:          "ServiceToken",
+			config:        ElasticConfig{ServiceToken: "AAEAAWVsYXN0aWM"},
+			authorization: "Bearer AAEAAWVsYXN0aWM",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+				return 200, elasticsearch8Root
+			})
+			defer server.Close()
+			config := tt.config
+			config.URLs = []string{server.URL}
+			_, _, err := NewElasticClient(config)
+			require.NoError(t, err)
+			require.Len(t, *requests, 1)
+			assert.Equal(t, []string{tt.authorization}, (*requests)[0].Header["Authorization"])
+		})
+	}
+}
+
+// writeClientCertificate writes a self-signed client certificate and its key to dir
+func writeClientCertificate(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hlf-sync"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client.key")
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certificate, certPath, keyPath
+}
+
+func TestElasticTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCertificate, clientCert, clientKey := writeClientCertificate(t, dir)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(elasticsearch8Root))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caCert := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	digest := sha256.Sum256(server.Certificate().Raw)
+	fingerprint := strings.ToUpper(hex.EncodeToString(digest[:]))
+	var colonFingerprint []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colonFingerprint = append(colonFingerprint, fingerprint[i:i+2])
+	}
+
+	tests := []struct {
+		name   string
+		config ElasticConfig
+		err    bool
+	}{
+		{name: "UnknownAuthority", err: true},
+		{name: "CACert", config: ElasticConfig{CACert: caCert}},
+		{name: "CAFingerprint", config: ElasticConfig{CAFingerprint: fingerprint}},
+		{name: "CAFingerprintWithColons", config: ElasticConfig{CAFingerprint: strings.Join(colonFingerprint, ":")}},
+		{name: "WrongFingerprint", config: ElasticConfig{CAFingerprint: strings.Repeat("00", 32)}, err: true},
+		{name: "ClientCertificate", config: ElasticConfig{CACert: caCert, ClientCert: clientCert, ClientKey: clientKey}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.URLs = []string{server.URL}
+			_, _, err := NewElasticClient(config)
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("ClientCertificateRequired", func(t *testing.T) {
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		_, _, err := NewElasticClient(ElasticConfig{URLs: []string{server.URL}, CACert: caCert})
+		assert.Error(t, err)
+		_, _, err = NewElasticClient(ElasticConfig{URLs: []string{server.URL}, CACert: caCert, ClientCert: clientCert, ClientKey: clientKey})
+		assert.NoError(t, err)
+	})
+}
+
+func TestElasticFlavors(t *testing.T) {
+	// the blocks are built once since their transactions are stamped with the current time
+	blocks := esTestBlocks("mychannel")
+	var bodies [][]string
+	for _, root := range []string{elasticsearch7Root, elasticsearch8Root, openSearchRoot} {
+		cluster := newFakeCluster(t)
+		server, requests := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+			if r.Path == "/" {
+				return 200, root
+			}
+			if strings.HasPrefix(r.Path, "/_template/") {
+				cluster.templates[strings.TrimPrefix(r.Path, "/_template/")] = r.Body
+				return 200, `{"acknowledged":true}`
+			}
+			return cluster.handle(r)
+		})
+		client, info, err := NewElasticClient(ElasticConfig{URLs: []string{server.URL}})
+		require.NoError(t, err)
+		storage := NewElasticStorage(client, "mychannel").WithServer(info)
+		require.NoError(t, storage.InstallTemplate(IndexTemplate{}))
+		template := cluster.templates["hlf-sync-mychannel"]
+		if root == elasticsearch7Root {
+			// Elasticsearch 7.7 only has legacy templates
+			assert.Equal(t, float64(100), template["order"])
+			assert.Contains(t, template, "mappings")
+		} else {
+			assert.Equal(t, float64(100), template["priority"])
+			assert.Contains(t, template, "template")
+		}
+		require.NoError(t, storage.StoreBulk(blocks))
+		// documents are read from maps, sort the lines to compare the bodies
+		lines := strings.Split(string(bulkRequests(*requests)[0].Raw), "\n")
+		sort.Strings(lines)
+		bodies = append(bodies, lines)
+		server.Close()
+	}
+	assert.Equal(t, bodies[0], bodies[1])
+	assert.Equal(t, bodies[0], bodies[2])
+}
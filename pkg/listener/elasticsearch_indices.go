@@ -0,0 +1,400 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultFieldsLimit is the default maximum number of fields of an index, as in Elasticsearch
+const DefaultFieldsLimit = 1000
+
+// DefaultGCDeletes is how long the versions of the deleted documents are kept by default, Elasticsearch
+// keeps them for 60s so replaying an older block after that would bring back a deleted document
+const DefaultGCDeletes = "7d"
+
+// IndexTemplate configures the index templates installed for the indexes of a channel
+type IndexTemplate struct {
+	// FieldsLimit is the maximum number of fields of an index, documents adding more are rejected
+	FieldsLimit int
+	// GCDeletes is how long the versions of the deleted documents are kept, blocks older than a
+	// delete can only be replayed within that time
+	GCDeletes string
+	// DynamicTemplates are added to the mappings of the chaincode indexes, e.g. to map the
+	// unknown fields as keywords or to stop indexing a whole subtree
+	DynamicTemplates []map[string]interface{}
+}
+
+// elasticIndices caches the indexes, by alias, known to exist
+type elasticIndices struct {
+	sync.Mutex
+	ready map[string]bool
+}
+
+// generationIndex is the name of the index of a generation
+func generationIndex(alias string, generation int) string {
+	return fmt.Sprintf("%s.v%d", alias, generation)
+}
+
+// parseIndexName splits the name of an index of the channel into its alias and generation, the generation is 0
+// for the indexes created by previous versions. Channel names can contain dots but chaincode names can't, so the
+// generation suffix is the first dot after the <channel>_ prefix
+func (e ElasticSearchStorage) parseIndexName(indexName string) (alias string, generation int, ok bool) {
+	prefix := e.channelID + "_"
+	if !strings.HasPrefix(indexName, prefix) || len(indexName) == len(prefix) {
+		return "", 0, false
+	}
+	name := strings.TrimPrefix(indexName, prefix)
+	dot := strings.Index(name, ".")
+	if dot < 0 {
+		return indexName, 0, true
+	}
+	generation, err := strconv.Atoi(strings.TrimPrefix(name[dot:], ".v"))
+	if err != nil || !strings.HasPrefix(name[dot:], ".v") {
+		return "", 0, false
+	}
+	return prefix + name[:dot], generation, true
+}
+
+func (e ElasticSearchStorage) fabricTemplateName() string {
+	return fmt.Sprintf("hlf-sync-%s", e.channelID)
+}
+
+// InstallTemplate creates or updates the index templates of the channel, they only apply to the
+// indexes created afterwards, use a reindex to apply them to the existing ones
+func (e ElasticSearchStorage) InstallTemplate(template IndexTemplate) error {
+	if template.FieldsLimit == 0 {
+		template.FieldsLimit = DefaultFieldsLimit
+	}
+	if template.GCDeletes == "" {
+		template.GCDeletes = DefaultGCDeletes
+	}
+	keyword := map[string]interface{}{"type": "keyword"}
+	epochMillis := map[string]interface{}{"type": "date", "format": "epoch_millis"}
+	dynamicTemplates := make([]interface{}, 0, len(template.DynamicTemplates))
+	for _, dynamicTemplate := range template.DynamicTemplates {
+		dynamicTemplates = append(dynamicTemplates, jsonValue(dynamicTemplate))
+	}
+	templates := map[string]map[string]interface{}{
+		e.fabricTemplateName(): {
+			"index_patterns": []string{fmt.Sprintf("%s_*", e.channelID)},
+			"priority":       100,
+			"template": map[string]interface{}{
+				"settings": map[string]interface{}{
+					"index.mapping.total_fields.limit": template.FieldsLimit,
+					"index.gc_deletes":                 template.GCDeletes,
+				},
+				"mappings": map[string]interface{}{
+					"dynamic_templates": dynamicTemplates,
+					"properties": map[string]interface{}{
+						transformation.PrimaryKey:    keyword,
+						transformation.KeyKey:        keyword,
+						transformation.TxIDKey:       keyword,
+						transformation.ChannelKey:    keyword,
+						transformation.NamespaceKey:  keyword,
+						transformation.CollectionKey: keyword,
+						transformation.DateKey:       epochMillis,
+					},
+				},
+			},
+		},
+		// the blocks index matches both patterns, the one with the highest priority applies
+		fmt.Sprintf("%s-blocks", e.fabricTemplateName()): {
+			"index_patterns": []string{fmt.Sprintf("%s*", blocksIndexName(e.channelID))},
+			"priority":       101,
+			"template": map[string]interface{}{
+				"mappings": map[string]interface{}{
+					"properties": map[string]interface{}{
+						"channelId":    keyword,
+						"number":       map[string]interface{}{"type": "long"},
+						"hash":         keyword,
+						"previousHash": keyword,
+						"dataHash":     keyword,
+						"commitHash":   keyword,
+						"firstTxDate":  epochMillis,
+						"lastTxDate":   epochMillis,
+					},
+				},
+			},
+		},
+	}
+	for name, body := range templates {
+		if !e.server.composableTemplates() {
+			body = legacyTemplate(body)
+		}
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		var res *esapi.Response
+		if e.server.composableTemplates() {
+			res, err = e.client.Indices.PutIndexTemplate(name, bytes.NewReader(bodyBytes))
+		} else {
+			res, err = e.client.Indices.PutTemplate(name, bytes.NewReader(bodyBytes))
+		}
+		if err != nil {
+			return err
+		}
+		if res.IsError() {
+			err = errors.Wrapf(responseError(res), "failed to install index template %s", name)
+			res.Body.Close()
+			return err
+		}
+		res.Body.Close()
+		log.Infof("Installed index template %s", name)
+	}
+	return nil
+}
+
+// legacyTemplate converts a composable template to a legacy one, for Elasticsearch before 7.8.
+// Legacy templates have no template section and all the matching ones are merged by order
+func legacyTemplate(template map[string]interface{}) map[string]interface{} {
+	legacy := map[string]interface{}{
+		"index_patterns": template["index_patterns"],
+		"order":          template["priority"],
+	}
+	for key, value := range template["template"].(map[string]interface{}) {
+		legacy[key] = value
+	}
+	return legacy
+}
+
+// jsonValue converts the maps decoded from YAML, keyed by interface{}, to maps that can be encoded as JSON
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for k, v := range value {
+			result[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for k, v := range value {
+			result[k] = jsonValue(v)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, v := range value {
+			result[i] = jsonValue(v)
+		}
+		return result
+	}
+	return value
+}
+
+// writeIndex returns the name to write the documents of alias to, creating the index if needed.
+// Indexes are created as the first generation behind the alias, so they can be rebuilt with a reindex.
+// A reindex writes straight to the indexes of its generation
+func (e ElasticSearchStorage) writeIndex(alias string) (string, error) {
+	indexName := alias
+	if e.generation > 0 {
+		indexName = generationIndex(alias, e.generation)
+	}
+	e.indices.Lock()
+	defer e.indices.Unlock()
+	if e.indices.ready[alias] {
+		return indexName, nil
+	}
+	if e.generation > 0 {
+		err := e.createIndex(indexName, "")
+		if err != nil {
+			return "", err
+		}
+	} else {
+		// an alias or an index created by a previous version
+		res, err := e.client.Indices.Exists([]string{alias})
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			err = e.createIndex(generationIndex(alias, 1), alias)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	e.indices.ready[alias] = true
+	return indexName, nil
+}
+
+// createIndex creates an index, as the write index of alias if set. It's not an error if the index exists
+func (e ElasticSearchStorage) createIndex(indexName string, alias string) error {
+	body := map[string]interface{}{}
+	if alias != "" {
+		body["aliases"] = map[string]interface{}{
+			alias: map[string]interface{}{"is_write_index": true},
+		}
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Indices.Create(indexName, e.client.Indices.Create.WithBody(bytes.NewReader(bodyBytes)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		err = responseError(res)
+		if strings.Contains(err.Error(), "resource_already_exists_exception") {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to create index %s", indexName)
+	}
+	log.Infof("Created index %s", indexName)
+	return nil
+}
+
+// catIndices returns the names of the indexes matching pattern
+func (e ElasticSearchStorage) catIndices(pattern string) ([]string, error) {
+	res, err := e.client.Cat.Indices(
+		e.client.Cat.Indices.WithIndex(pattern),
+		e.client.Cat.Indices.WithFormat("json"),
+		e.client.Cat.Indices.WithH("index"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, responseError(res)
+	}
+	var rows []struct {
+		Index string `json:"index"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rows)
+	if err != nil {
+		return nil, err
+	}
+	var indices []string
+	for _, row := range rows {
+		indices = append(indices, row.Index)
+	}
+	return indices, nil
+}
+
+// aliasIndices returns the indexes behind an alias, or the alias itself when it's an index
+// created by a previous version
+func (e ElasticSearchStorage) aliasIndices(alias string) ([]string, error) {
+	res, err := e.client.Indices.Get([]string{alias})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, responseError(res)
+	}
+	var indices map[string]json.RawMessage
+	err = json.NewDecoder(res.Body).Decode(&indices)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range indices {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Reindex returns a storage writing to a new generation of the indexes of the channel, the aliases
+// keep pointing to the current generation until it's published
+func (e ElasticSearchStorage) Reindex() (Generation, error) {
+	indices, err := e.catIndices(fmt.Sprintf("%s_*", e.channelID))
+	if err != nil {
+		return nil, err
+	}
+	// the first generation is created by the sync
+	generation := 1
+	for _, index := range indices {
+		_, number, ok := e.parseIndexName(index)
+		if ok && number > generation {
+			generation = number
+		}
+	}
+	e.generation = generation + 1
+	e.indices = &elasticIndices{ready: map[string]bool{}}
+	log.Infof("Building generation %d of the indexes of channel %s", e.generation, e.channelID)
+	return e, nil
+}
+
+// Publish atomically points every alias to its index of the generation being built. Indexes created
+// by previous versions have the name of the alias so they are always deleted
+func (e ElasticSearchStorage) Publish(deleteOld bool) error {
+	if e.generation == 0 {
+		return errors.New("the storage isn't building a generation")
+	}
+	suffix := fmt.Sprintf(".v%d", e.generation)
+	indices, err := e.catIndices(fmt.Sprintf("%s_*%s", e.channelID, suffix))
+	if err != nil {
+		return err
+	}
+	var actions []map[string]interface{}
+	var oldIndices []string
+	for _, index := range indices {
+		alias := strings.TrimSuffix(index, suffix)
+		current, err := e.aliasIndices(alias)
+		if err != nil {
+			return err
+		}
+		for _, name := range current {
+			switch name {
+			case index:
+			case alias:
+				actions = append(actions, map[string]interface{}{
+					"remove_index": map[string]interface{}{"index": alias},
+				})
+			default:
+				actions = append(actions, map[string]interface{}{
+					"remove": map[string]interface{}{"index": name, "alias": alias},
+				})
+				oldIndices = append(oldIndices, name)
+			}
+		}
+		actions = append(actions, map[string]interface{}{
+			"add": map[string]interface{}{"index": index, "alias": alias, "is_write_index": true},
+		})
+	}
+	if len(actions) == 0 {
+		return errors.Errorf("generation %d has no indexes", e.generation)
+	}
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Indices.UpdateAliases(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.Wrap(responseError(res), "failed to switch the aliases")
+	}
+	log.Infof("Published generation %d of %d indexes", e.generation, len(indices))
+	if !deleteOld || len(oldIndices) == 0 {
+		return nil
+	}
+	res, err = e.client.Indices.Delete(oldIndices)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.Wrap(responseError(res), "failed to delete the previous indexes")
+	}
+	log.Infof("Deleted indexes %s", strings.Join(oldIndices, ","))
+	return nil
+}
@@ -1 +1,634 @@
 package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	elasticsearch7 "github.com/elastic/go-elasticsearch/v7"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/kfsoftware/hlf-sync/pkg/chaincode"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type esRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Raw    []byte
+	Body   map[string]interface{}
+}
+
+// newElasticsearchServer is a stand-in for the Elasticsearch API, handler answers the requests and
+// every request received is recorded
+func newElasticsearchServer(t *testing.T, handler func(r *esRequest) (int, string)) (*httptest.Server, *[]*esRequest) {
+	var requests []*esRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		request := &esRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header, Raw: body}
+		if len(body) > 0 {
+			_ = json.Unmarshal(body, &request.Body)
+		}
+		requests = append(requests, request)
+		status, response := handler(request)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	return server, &requests
+}
+
+func newTestElasticStorage(t *testing.T, server *httptest.Server) ElasticSearchStorage {
+	client, err := elasticsearch7.NewClient(elasticsearch7.Config{Addresses: []string{server.URL}})
+	require.NoError(t, err)
+	return NewElasticStorage(client, "mychannel")
+}
+
+var testIndexes = []*chaincode.Index{
+	{Name: "indexOwner", Fields: []chaincode.IndexField{{Name: "docType"}, {Name: "owner"}}},
+	{Name: "indexSize", Fields: []chaincode.IndexField{{Name: "size", Desc: true}, {Name: "owner"}}},
+}
+
+func TestElasticCreateIndexes(t *testing.T) {
+	t.Run("NewIndex", func(t *testing.T) {
+		server, requests := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+			switch r.Method {
+			case http.MethodHead:
+				return 404, ""
+			case http.MethodGet:
+				return 200, `{"mychannel_fabcar.v1":{"mappings":{}}}`
+			}
+			return 200, `{"acknowledged":true}`
+		})
+		defer server.Close()
+		storage := newTestElasticStorage(t, server)
+		require.NoError(t, storage.CreateIndexes("fabcar", testIndexes))
+		require.Len(t, *requests, 4)
+		create := (*requests)[1]
+		assert.Equal(t, http.MethodPut, create.Method)
+		assert.Equal(t, "/mychannel_fabcar.v1", create.Path)
+		assert.Contains(t, create.Body["aliases"], "mychannel_fabcar")
+		put := (*requests)[3]
+		assert.Equal(t, "/mychannel_fabcar/_mapping", put.Path)
+		templates := put.Body["dynamic_templates"].([]interface{})
+		assert.Len(t, templates, 3)
+		owner := templates[1].(map[string]interface{})["hlf_sync_owner"].(map[string]interface{})
+		assert.Equal(t, "owner", owner["path_match"])
+		assert.Equal(t, "string", owner["match_mapping_type"])
+	})
+	t.Run("ExistingIndex", func(t *testing.T) {
+		server, requests := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+			switch r.Method {
+			case http.MethodHead:
+				return 200, ""
+			case http.MethodGet:
+				return 200, `{"mychannel_fabcar":{"mappings":{
+					"dynamic_templates":[{"custom":{"match":"x_*","mapping":{"type":"long"}}},{"hlf_sync_owner":{"path_match":"owner"}}],
+					"properties":{"owner":{"type":"text"}}
+				}}}`
+			}
+			return 200, `{"acknowledged":true}`
+		})
+		defer server.Close()
+		storage := newTestElasticStorage(t, server)
+		require.NoError(t, storage.CreateIndexes("fabcar", testIndexes))
+		require.Len(t, *requests, 3)
+		put := (*requests)[2]
+		assert.Equal(t, http.MethodPut, put.Method)
+		assert.Equal(t, "/mychannel_fabcar/_mapping", put.Path)
+		var names []string
+		for _, template := range put.Body["dynamic_templates"].([]interface{}) {
+			for name := range template.(map[string]interface{}) {
+				names = append(names, name)
+			}
+		}
+		assert.ElementsMatch(t, []string{"hlf_sync_docType", "hlf_sync_owner", "hlf_sync_size", "custom"}, names)
+	})
+	t.Run("Error", func(t *testing.T) {
+		server, _ := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+			switch r.Method {
+			case http.MethodHead:
+				return 200, ""
+			case http.MethodGet:
+				return 200, `{"mychannel_fabcar.v1":{"mappings":{}}}`
+			}
+			return 400, `{"error":{"type":"mapper_parsing_exception","reason":"bad mapping"}}`
+		})
+		defer server.Close()
+		storage := newTestElasticStorage(t, server)
+		err := storage.CreateIndexes("fabcar", testIndexes)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "bad mapping")
+	})
+}
+
+type bulkTestAction struct {
+	Action string
+	Index  string
+	ID     string
+}
+
+// parseBulkActions returns the actions of a bulk request body
+func parseBulkActions(t *testing.T, body []byte) []bulkTestAction {
+	var actions []bulkTestAction
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		var meta map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &meta))
+		for action, target := range meta {
+			actions = append(actions, bulkTestAction{Action: action, Index: target.Index, ID: target.ID})
+			if action == "index" {
+				require.True(t, scanner.Scan())
+			}
+		}
+	}
+	return actions
+}
+
+// bulkHandler answers bulk requests with the status returned by itemStatus for every action
+func bulkHandler(t *testing.T, itemStatus func(action bulkTestAction) int) func(r *esRequest) (int, string) {
+	return func(r *esRequest) (int, string) {
+		if r.Path != "/_bulk" {
+			// the indexes exist
+			return 200, `{"acknowledged":true}`
+		}
+		var items []string
+		errorsFound := false
+		for _, action := range parseBulkActions(t, r.Raw) {
+			status := itemStatus(action)
+			item := fmt.Sprintf(`"_index":%q,"_id":%q,"status":%d`, action.Index, action.ID, status)
+			if status >= 400 && !(action.Action == "delete" && status == 404) {
+				errorsFound = true
+				item += fmt.Sprintf(`,"error":{"type":"error_%d","reason":"rejected %s"}`, status, action.ID)
+			}
+			items = append(items, fmt.Sprintf(`{%q:{%s}}`, action.Action, item))
+		}
+		return 200, fmt.Sprintf(`{"took":1,"errors":%t,"items":[%s]}`, errorsFound, strings.Join(items, ","))
+	}
+}
+
+// bulkRequests filters the bulk requests out of the requests received
+func bulkRequests(requests []*esRequest) []*esRequest {
+	var result []*esRequest
+	for _, request := range requests {
+		if request.Path == "/_bulk" {
+			result = append(result, request)
+		}
+	}
+	return result
+}
+
+func esTestBlocks(channelID string) []*cb.Block {
+	return []*cb.Block{
+		newTestBlock(
+			channelID,
+			0,
+			writeTx("1", "fabcar",
+				&kvrwset.KVWrite{Key: "car1", Value: []byte(`{"owner":"a"}`)},
+				&kvrwset.KVWrite{Key: "car2", Value: []byte(`{"owner":"b"}`)},
+			),
+		),
+		newTestBlock(
+			channelID,
+			1,
+			writeTx("2", "fabcar",
+				&kvrwset.KVWrite{Key: "car3", IsDelete: true},
+			),
+		),
+	}
+}
+
+func documentID(key string) string {
+	return transformation.DocumentKey{ChannelID: "mychannel", Namespace: "fabcar", Key: key}.ID()
+}
+
+func TestElasticStoreBulk(t *testing.T) {
+	t.Run("Deletes", func(t *testing.T) {
+		server, requests := newElasticsearchServer(t, bulkHandler(t, func(action bulkTestAction) int {
+			if action.Action == "delete" {
+				return 404
+			}
+			return 200
+		}))
+		defer server.Close()
+		storage := newTestElasticStorage(t, server)
+		require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+		require.Len(t, bulkRequests(*requests), 1)
+		actions := parseBulkActions(t, bulkRequests(*requests)[0].Raw)
+		assert.Contains(t, actions, bulkTestAction{Action: "delete", Index: "mychannel_fabcar", ID: documentID("car3")})
+		assert.Contains(t, actions, bulkTestAction{Action: "index", Index: "mychannel_fabcar", ID: documentID("car1")})
+		assert.Contains(t, actions, bulkTestAction{Action: "index", Index: "mychannel__blocks", ID: "1"})
+
+		*requests = nil
+		require.NoError(t, storage.Store(esTestBlocks("mychannel")[1]))
+		actions = parseBulkActions(t, bulkRequests(*requests)[0].Raw)
+		assert.Contains(t, actions, bulkTestAction{Action: "delete", Index: "mychannel_fabcar", ID: documentID("car3")})
+	})
+	t.Run("ItemFailures", func(t *testing.T) {
+		server, requests := newElasticsearchServer(t, bulkHandler(t, func(action bulkTestAction) int {
+			if action.ID == documentID("car2") {
+				return 400
+			}
+			return 201
+		}))
+		defer server.Close()
+		storage := newTestElasticStorage(t, server)
+		err := storage.StoreBulk(esTestBlocks("mychannel"))
+		require.Error(t, err)
+		bulkErr, ok := err.(*BulkError)
+		require.True(t, ok)
+		require.Len(t, bulkErr.Items, 1)
+		assert.Equal(t, documentID("car2"), bulkErr.Items[0].ID)
+		assert.Equal(t, 400, bulkErr.Items[0].Status)
+		assert.Equal(t, "error_400", bulkErr.Items[0].Type)
+		assert.Len(t, bulkRequests(*requests), 1)
+	})
+	t.Run("RetryRejectedItems", func(t *testing.T) {
+		rejected := 0
+		server, requests := newElasticsearchServer(t, bulkHandler(t, func(action bulkTestAction) int {
+			if action.ID == documentID("car1") && rejected < 2 {
+				rejected++
+				return 429
+			}
+			return 201
+		}))
+		defer server.Close()
+		storage := newTestElasticStorage(t, server).WithBulkLimits(DefaultMaxBulkBytes, 3, time.Millisecond)
+		require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+		require.Len(t, bulkRequests(*requests), 3)
+		assert.Equal(t, []bulkTestAction{{Action: "index", Index: "mychannel_fabcar", ID: documentID("car1")}}, parseBulkActions(t, bulkRequests(*requests)[2].Raw))
+	})
+	t.Run("RetriesExhausted", func(t *testing.T) {
+		server, requests := newElasticsearchServer(t, bulkHandler(t, func(action bulkTestAction) int {
+			if action.ID == documentID("car1") {
+				return 503
+			}
+			return 201
+		}))
+		defer server.Close()
+		storage := newTestElasticStorage(t, server).WithBulkLimits(DefaultMaxBulkBytes, 2, time.Millisecond)
+		err := storage.StoreBulk(esTestBlocks("mychannel"))
+		require.Error(t, err)
+		bulkErr, ok := err.(*BulkError)
+		require.True(t, ok)
+		require.Len(t, bulkErr.Items, 1)
+		assert.Equal(t, documentID("car1"), bulkErr.Items[0].ID)
+		assert.Len(t, bulkRequests(*requests), 3)
+	})
+	t.Run("RetryRejectedRequest", func(t *testing.T) {
+		calls := 0
+		handler := bulkHandler(t, func(action bulkTestAction) int { return 201 })
+		server, requests := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+			if r.Path == "/_bulk" {
+				calls++
+			}
+			if calls == 1 {
+				return 429, `{"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}`
+			}
+			return handler(r)
+		})
+		defer server.Close()
+		storage := newTestElasticStorage(t, server).WithBulkLimits(DefaultMaxBulkBytes, 3, time.Millisecond)
+		require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+		assert.Len(t, bulkRequests(*requests), 2)
+	})
+	t.Run("RequestError", func(t *testing.T) {
+		server, _ := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+			return 400, `{"error":{"type":"illegal_argument_exception","reason":"bad request"}}`
+		})
+		defer server.Close()
+		storage := newTestElasticStorage(t, server)
+		err := storage.StoreBulk(esTestBlocks("mychannel"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "bad request")
+	})
+	t.Run("SplitBySize", func(t *testing.T) {
+		server, requests := newElasticsearchServer(t, bulkHandler(t, func(action bulkTestAction) int { return 201 }))
+		defer server.Close()
+		maxBytes := 600
+		storage := newTestElasticStorage(t, server).WithBulkLimits(maxBytes, 0, time.Millisecond)
+		require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+		require.True(t, len(bulkRequests(*requests)) > 1)
+		total := 0
+		for _, request := range bulkRequests(*requests) {
+			actions := parseBulkActions(t, request.Raw)
+			if len(actions) > 1 {
+				assert.True(t, len(request.Raw) <= maxBytes)
+			}
+			total += len(actions)
+		}
+		// two documents, one delete and two blocks
+		assert.Equal(t, 5, total)
+	})
+}
+
+func TestElasticExternalVersioning(t *testing.T) {
+	server, requests := newElasticsearchServer(t, bulkHandler(t, func(action bulkTestAction) int {
+		if action.ID == documentID("car1") {
+			return 409
+		}
+		return 201
+	}))
+	defer server.Close()
+	storage := newTestElasticStorage(t, server)
+	// replaying a block whose documents were overwritten later is not an error
+	require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+	require.Len(t, bulkRequests(*requests), 1)
+
+	var versions []int64
+	scanner := bufio.NewScanner(bytes.NewReader(bulkRequests(*requests)[0].Raw))
+	for scanner.Scan() {
+		var meta map[string]map[string]interface{}
+		if json.Unmarshal(scanner.Bytes(), &meta) != nil {
+			continue
+		}
+		for action, target := range meta {
+			if target["_index"] != "mychannel_fabcar" {
+				continue
+			}
+			assert.Equal(t, "external", target["version_type"], action)
+			versions = append(versions, int64(target["version"].(float64)))
+		}
+	}
+	// car1 and car2 are written by the first tx of block 0, car3 is deleted by the first tx of block 1
+	assert.ElementsMatch(t, []int64{0, 0, 1 << 32}, versions)
+}
+
+func TestElasticReplayAfterDelete(t *testing.T) {
+	// versions keeps the version of every document and of the deleted ones, as Elasticsearch
+	// does for index.gc_deletes
+	versions := map[string]int64{}
+	deleted := map[string]bool{}
+	server, _ := newElasticsearchServer(t, func(r *esRequest) (int, string) {
+		if r.Path != "/_bulk" {
+			return 200, `{"acknowledged":true}`
+		}
+		var items []string
+		conflicts := false
+		scanner := bufio.NewScanner(bytes.NewReader(r.Raw))
+		for scanner.Scan() {
+			var meta map[string]map[string]interface{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &meta))
+			for action, target := range meta {
+				if action == "index" {
+					require.True(t, scanner.Scan())
+				}
+				id := target["_id"].(string)
+				status := 201
+				version, versioned := target["version"].(float64)
+				if current, ok := versions[id]; versioned && ok && int64(version) <= current {
+					status = 409
+				} else if versioned {
+					versions[id] = int64(version)
+					deleted[id] = action == "delete"
+				}
+				item := fmt.Sprintf(`"_index":%q,"_id":%q,"status":%d`, target["_index"], id, status)
+				if status == 409 {
+					conflicts = true
+					item += `,"error":{"type":"version_conflict_engine_exception","reason":"conflict"}`
+				}
+				items = append(items, fmt.Sprintf(`{%q:{%s}}`, action, item))
+			}
+		}
+		return 200, fmt.Sprintf(`{"took":1,"errors":%t,"items":[%s]}`, conflicts, strings.Join(items, ","))
+	})
+	defer server.Close()
+	storage := newTestElasticStorage(t, server)
+	blocks := []*cb.Block{
+		newTestBlock("mychannel", 0, writeTx("1", "fabcar", &kvrwset.KVWrite{Key: "car1", Value: []byte(`{"owner":"a"}`)})),
+		newTestBlock("mychannel", 1, writeTx("2", "fabcar", &kvrwset.KVWrite{Key: "car1", IsDelete: true})),
+	}
+	require.NoError(t, storage.StoreBulk(blocks))
+	require.True(t, deleted[documentID("car1")])
+
+	// replaying the upsert after its delete is rejected while the version of the delete is kept
+	require.NoError(t, storage.Store(blocks[0]))
+	assert.True(t, deleted[documentID("car1")])
+	assert.Equal(t, int64(1)<<32, versions[documentID("car1")])
+}
+
+// fakeCluster keeps the indexes and aliases managed through the API, documents are discarded
+type fakeCluster struct {
+	t         *testing.T
+	indices   map[string]map[string]bool
+	templates map[string]map[string]interface{}
+}
+
+func newFakeCluster(t *testing.T, indices ...string) *fakeCluster {
+	cluster := &fakeCluster{t: t, indices: map[string]map[string]bool{}, templates: map[string]map[string]interface{}{}}
+	for _, index := range indices {
+		cluster.indices[index] = map[string]bool{}
+	}
+	return cluster
+}
+
+// resolve returns the indexes of an index or alias name
+func (c *fakeCluster) resolve(name string) []string {
+	if _, ok := c.indices[name]; ok {
+		return []string{name}
+	}
+	var indices []string
+	for index, aliases := range c.indices {
+		if aliases[name] {
+			indices = append(indices, index)
+		}
+	}
+	return indices
+}
+
+func (c *fakeCluster) handle(r *esRequest) (int, string) {
+	name := strings.TrimPrefix(r.Path, "/")
+	switch {
+	case r.Path == "/_bulk":
+		return bulkHandler(c.t, func(action bulkTestAction) int { return 201 })(r)
+	case strings.HasPrefix(r.Path, "/_index_template/"):
+		c.templates[strings.TrimPrefix(r.Path, "/_index_template/")] = r.Body
+		return 200, `{"acknowledged":true}`
+	case strings.HasPrefix(r.Path, "/_cat/indices/"):
+		var rows []string
+		for index := range c.indices {
+			if ok, _ := path.Match(strings.TrimPrefix(r.Path, "/_cat/indices/"), index); ok {
+				rows = append(rows, fmt.Sprintf(`{"index":%q}`, index))
+			}
+		}
+		return 200, "[" + strings.Join(rows, ",") + "]"
+	case r.Path == "/_aliases":
+		for _, action := range r.Body["actions"].([]interface{}) {
+			for kind, params := range action.(map[string]interface{}) {
+				params := params.(map[string]interface{})
+				index := params["index"].(string)
+				switch kind {
+				case "add":
+					c.indices[index][params["alias"].(string)] = true
+				case "remove":
+					delete(c.indices[index], params["alias"].(string))
+				case "remove_index":
+					delete(c.indices, index)
+				}
+			}
+		}
+		return 200, `{"acknowledged":true}`
+	}
+	indices := c.resolve(name)
+	switch r.Method {
+	case http.MethodHead:
+		if len(indices) == 0 {
+			return 404, ""
+		}
+		return 200, ""
+	case http.MethodGet:
+		if len(indices) == 0 {
+			return 404, `{"error":{"type":"index_not_found_exception","reason":"no such index"}}`
+		}
+		var entries []string
+		for _, index := range indices {
+			entries = append(entries, fmt.Sprintf(`%q:{}`, index))
+		}
+		return 200, "{" + strings.Join(entries, ",") + "}"
+	case http.MethodPut:
+		if len(indices) > 0 {
+			return 400, `{"error":{"type":"resource_already_exists_exception","reason":"index already exists"}}`
+		}
+		c.indices[name] = map[string]bool{}
+		if aliases, ok := r.Body["aliases"].(map[string]interface{}); ok {
+			for alias := range aliases {
+				c.indices[name][alias] = true
+			}
+		}
+		return 200, `{"acknowledged":true}`
+	case http.MethodDelete:
+		for _, index := range strings.Split(name, ",") {
+			delete(c.indices, index)
+		}
+		return 200, `{"acknowledged":true}`
+	}
+	return 400, `{"error":{"type":"unsupported","reason":"unsupported request"}}`
+}
+
+// bulkIndices returns the indexes written by the bulk requests
+func bulkIndices(t *testing.T, requests []*esRequest) []string {
+	indices := map[string]bool{}
+	for _, request := range bulkRequests(requests) {
+		for _, action := range parseBulkActions(t, request.Raw) {
+			indices[action.Index] = true
+		}
+	}
+	var result []string
+	for index := range indices {
+		result = append(result, index)
+	}
+	return result
+}
+
+func TestElasticInstallTemplate(t *testing.T) {
+	cluster := newFakeCluster(t)
+	server, _ := newElasticsearchServer(t, cluster.handle)
+	defer server.Close()
+	storage := newTestElasticStorage(t, server)
+	err := storage.InstallTemplate(IndexTemplate{
+		FieldsLimit: 500,
+		DynamicTemplates: []map[string]interface{}{
+			{"strings": map[interface{}]interface{}{
+				"match_mapping_type": "string",
+				"mapping":            map[interface{}]interface{}{"type": "keyword"},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	require.Contains(t, cluster.templates, "hlf-sync-mychannel")
+	require.Contains(t, cluster.templates, "hlf-sync-mychannel-blocks")
+
+	template := cluster.templates["hlf-sync-mychannel"]
+	assert.Equal(t, []interface{}{"mychannel_*"}, template["index_patterns"])
+	settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+	assert.Equal(t, float64(500), settings["index.mapping.total_fields.limit"])
+	assert.Equal(t, DefaultGCDeletes, settings["index.gc_deletes"])
+	mappings := template["template"].(map[string]interface{})["mappings"].(map[string]interface{})
+	properties := mappings["properties"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "date", "format": "epoch_millis"}, properties["_fabric_date"])
+	assert.Equal(t, map[string]interface{}{"type": "keyword"}, properties["_fabric_id"])
+	dynamicTemplates := mappings["dynamic_templates"].([]interface{})
+	require.Len(t, dynamicTemplates, 1)
+	assert.Equal(t, "keyword", dynamicTemplates[0].(map[string]interface{})["strings"].(map[string]interface{})["mapping"].(map[string]interface{})["type"])
+
+	blocksTemplate := cluster.templates["hlf-sync-mychannel-blocks"]
+	assert.Equal(t, []interface{}{"mychannel__blocks*"}, blocksTemplate["index_patterns"])
+	assert.True(t, blocksTemplate["priority"].(float64) > template["priority"].(float64))
+}
+
+func TestElasticReindex(t *testing.T) {
+	// mychannel_fabcar was created by a previous version without an alias
+	cluster := newFakeCluster(t, "mychannel_fabcar")
+	server, requests := newElasticsearchServer(t, cluster.handle)
+	defer server.Close()
+	storage := newTestElasticStorage(t, server)
+	require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+	assert.ElementsMatch(t, []string{"mychannel_fabcar", "mychannel__blocks"}, bulkIndices(t, *requests))
+	assert.Equal(t, map[string]map[string]bool{
+		"mychannel_fabcar":     {},
+		"mychannel__blocks.v1": {"mychannel__blocks": true},
+	}, cluster.indices)
+
+	generation, err := storage.Reindex()
+	require.NoError(t, err)
+	*requests = nil
+	require.NoError(t, generation.StoreBulk(esTestBlocks("mychannel")))
+	assert.ElementsMatch(t, []string{"mychannel_fabcar.v2", "mychannel__blocks.v2"}, bulkIndices(t, *requests))
+	// readers still see the current indexes
+	assert.Empty(t, cluster.indices["mychannel_fabcar.v2"])
+	assert.Equal(t, []string{"mychannel__blocks.v1"}, cluster.resolve("mychannel__blocks"))
+
+	require.NoError(t, generation.Publish(true))
+	assert.Equal(t, map[string]map[string]bool{
+		"mychannel_fabcar.v2":  {"mychannel_fabcar": true},
+		"mychannel__blocks.v2": {"mychannel__blocks": true},
+	}, cluster.indices)
+
+	// the sync keeps writing through the aliases
+	*requests = nil
+	require.NoError(t, storage.Store(esTestBlocks("mychannel")[1]))
+	assert.ElementsMatch(t, []string{"mychannel_fabcar", "mychannel__blocks"}, bulkIndices(t, *requests))
+
+	next, err := storage.Reindex()
+	require.NoError(t, err)
+	assert.Equal(t, 3, next.(ElasticSearchStorage).generation)
+	assert.Error(t, storage.Publish(false))
+}
+
+func TestElasticParseIndexName(t *testing.T) {
+	// channel names can contain dots, even one looking like a generation
+	storage := NewElasticStorage(nil, "org.v2")
+	for indexName, expected := range map[string]struct {
+		alias      string
+		generation int
+	}{
+		"org.v2_fabcar":       {"org.v2_fabcar", 0},
+		"org.v2_fabcar.v3":    {"org.v2_fabcar", 3},
+		"org.v2__blocks.v12":  {"org.v2__blocks", 12},
+		"org.v2_fabcar-cc.v1": {"org.v2_fabcar-cc", 1},
+	} {
+		alias, generation, ok := storage.parseIndexName(indexName)
+		assert.True(t, ok, indexName)
+		assert.Equal(t, expected.alias, alias, indexName)
+		assert.Equal(t, expected.generation, generation, indexName)
+	}
+	for _, indexName := range []string{"org.v2_", "org_fabcar.v1", "org.v2_fabcar.backup", "org.v2_fabcar.vx"} {
+		_, _, ok := storage.parseIndexName(indexName)
+		assert.False(t, ok, indexName)
+	}
+}
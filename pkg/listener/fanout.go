@@ -0,0 +1,396 @@
+package listener
+
+import (
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// FanOutPolicy tells which sinks a batch of blocks waits for
+type FanOutPolicy string
+
+const (
+	// WaitAll waits for every sink, a failing sink stops the sync
+	WaitAll FanOutPolicy = "all"
+	// WaitPrimary waits for the primary sink only, the other sinks store the blocks in the background
+	// and catch up on their own when they fall behind
+	WaitPrimary FanOutPolicy = "primary"
+)
+
+const (
+	// DefaultCatchUpBatch is the number of blocks fetched at once by a sink catching up
+	DefaultCatchUpBatch = 2000
+	maxRetryDelay       = time.Minute
+	// checkpointInterval is how often the sinks applying the writes asynchronously save their checkpoint
+	checkpointInterval = 10 * time.Second
+)
+
+// sinkRetryDelay is the first delay before storing again the blocks a background sink failed to store
+var sinkRetryDelay = time.Second
+
+// Sink is a storage the blocks of the channel are delivered to
+type Sink struct {
+	Name    string
+	Storage BlockStorage
+	Primary bool
+}
+
+// CheckpointStore keeps the last block stored by every sink
+type CheckpointStore interface {
+	LoadCheckpoint(sink string) (blockNumber int, ok bool, err error)
+	SaveCheckpoint(sink string, blockNumber int) error
+}
+
+// BlockSource fetches the blocks of the channel, from and to included
+type BlockSource interface {
+	Blocks(from int, to int) ([]*cb.Block, error)
+}
+
+// DocumentStorer is implemented by the storages that can store blocks already decoded, so the
+// blocks are decoded once for every sink
+type DocumentStorer interface {
+	StoreDocuments(response *transformation.DocumentExtractionResponse) error
+}
+
+// FanOut delivers the blocks of a channel to several sinks, each one with its own checkpoint
+type FanOut struct {
+	policy  FanOutPolicy
+	opts    []transformation.Option
+	workers []*sinkWorker
+	wg      sync.WaitGroup
+}
+
+type fanOutBatch struct {
+	first    int
+	last     int
+	blocks   []*cb.Block
+	response *transformation.DocumentExtractionResponse
+}
+
+type sinkWorker struct {
+	sink        Sink
+	required    bool
+	checkpoints CheckpointStore
+	source      BlockSource
+	batchSize   int
+	retryDelay  time.Duration
+	// next is the next block to store, only accessed by the goroutine storing the blocks
+	next  int
+	saved int
+	// committed is the last block applied, the pipelined storages store again the blocks after it
+	// when a write fails
+	committed int
+	// mailbox holds the last batch delivered to a background sink
+	mailbox chan *fanOutBatch
+}
+
+// NewFanOut creates the fan-out to the sinks, starting every sink after its checkpoint. The sink
+// marked as primary, or the first one, is the one waited for with the WaitPrimary policy
+func NewFanOut(
+	sinks []Sink,
+	policy FanOutPolicy,
+	checkpoints CheckpointStore,
+	source BlockSource,
+	opts ...transformation.Option,
+) (*FanOut, error) {
+	if len(sinks) == 0 {
+		return nil, errors.New("no sinks configured")
+	}
+	if policy != WaitAll && policy != WaitPrimary {
+		return nil, errors.Errorf("unknown fan-out policy %s, use %s or %s", policy, WaitAll, WaitPrimary)
+	}
+	primary := 0
+	names := map[string]bool{}
+	for i, sink := range sinks {
+		if names[sink.Name] {
+			return nil, errors.Errorf("duplicate sink %q", sink.Name)
+		}
+		names[sink.Name] = true
+		if sink.Primary {
+			primary = i
+		}
+	}
+	f := &FanOut{policy: policy, opts: opts}
+	for i, sink := range sinks {
+		w := &sinkWorker{
+			sink:        sink,
+			required:    policy == WaitAll || i == primary,
+			checkpoints: checkpoints,
+			source:      source,
+			batchSize:   DefaultCatchUpBatch,
+			retryDelay:  sinkRetryDelay,
+			saved:       -1,
+		}
+		err := w.loadCheckpoint()
+		if err != nil {
+			return nil, err
+		}
+		f.workers = append(f.workers, w)
+	}
+	for _, w := range f.workers {
+		if !w.required {
+			w.mailbox = make(chan *fanOutBatch, 1)
+			f.wg.Add(1)
+			go func(w *sinkWorker) {
+				defer f.wg.Done()
+				w.run()
+			}(w)
+		}
+	}
+	return f, nil
+}
+
+// Rewind makes every sink store the blocks again from blockNumber. Must be called before delivering blocks
+func (f *FanOut) Rewind(blockNumber int) {
+	for _, w := range f.workers {
+		w.next = blockNumber
+		w.committed = blockNumber - 1
+	}
+}
+
+// Next returns the next block to deliver, the first block missing in the sinks waited for. The sinks
+// further ahead skip the blocks they already have
+func (f *FanOut) Next() int {
+	next := -1
+	for _, w := range f.workers {
+		if w.required && (next < 0 || w.next < next) {
+			next = w.next
+		}
+	}
+	return next
+}
+
+// Deliver decodes a batch of consecutive blocks and stores them in every sink. It returns once the
+// sinks waited for have stored them, the other sinks get the batch in the background
+func (f *FanOut) Deliver(blocks []*cb.Block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	response, err := transformation.BlocksToDocuments(blocks, f.opts...)
+	if err != nil {
+		return err
+	}
+	batch := &fanOutBatch{
+		first:    int(blocks[0].Header.Number),
+		last:     int(blocks[len(blocks)-1].Header.Number),
+		blocks:   blocks,
+		response: response,
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(f.workers))
+	for i, w := range f.workers {
+		if !w.required {
+			w.offer(batch)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, w *sinkWorker) {
+			defer wg.Done()
+			errs[i] = w.store(batch)
+		}(i, w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint saves the checkpoint of the sinks waited for that apply the writes asynchronously
+func (f *FanOut) Checkpoint() error {
+	for _, w := range f.workers {
+		if w.required {
+			err := w.checkpoint()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the sinks storing the blocks in the background, the blocks they haven't stored yet
+// are stored on the next start
+func (f *FanOut) Close() {
+	for _, w := range f.workers {
+		if w.mailbox != nil {
+			close(w.mailbox)
+		}
+	}
+	f.wg.Wait()
+}
+
+// loadCheckpoint reads the last block stored, from the storage itself when it keeps it
+func (w *sinkWorker) loadCheckpoint() error {
+	blockNumber, ok, err := w.checkpoints.LoadCheckpoint(w.sink.Name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the checkpoint of sink %q", w.sink.Name)
+	}
+	if checkpointer, isCheckpointer := w.sink.Storage.(Checkpointer); isCheckpointer {
+		storedBlockNumber, found, err := checkpointer.Checkpoint()
+		if err != nil {
+			return errors.Wrapf(err, "failed to load the checkpoint of sink %q", w.sink.Name)
+		}
+		if found {
+			blockNumber, ok = storedBlockNumber, true
+		}
+	}
+	if ok {
+		w.next = blockNumber + 1
+		w.saved = blockNumber
+	}
+	w.committed = w.next - 1
+	log.Infof("Sink %q starts from block %d", w.sink.Name, w.next)
+	return nil
+}
+
+// offer hands a batch to a background sink, replacing the batch it hasn't started to store.
+// The sink fetches the blocks of the batches replaced when catching up
+func (w *sinkWorker) offer(batch *fanOutBatch) {
+	select {
+	case w.mailbox <- batch:
+	default:
+		select {
+		case <-w.mailbox:
+		default:
+		}
+		w.mailbox <- batch
+	}
+}
+
+// run stores the batches of a background sink, retrying with a backoff while it fails
+func (w *sinkWorker) run() {
+	var batch *fanOutBatch
+	delay := w.retryDelay
+	retryAt := time.Now()
+	_, pipelined := w.sink.Storage.(Pipeliner)
+	for {
+		var wait <-chan time.Time
+		switch {
+		case batch != nil:
+			wait = time.After(time.Until(retryAt))
+		case pipelined:
+			wait = time.After(checkpointInterval)
+		}
+		select {
+		case newer, ok := <-w.mailbox:
+			if !ok {
+				return
+			}
+			batch = newer
+			continue
+		case <-wait:
+		}
+		if batch == nil {
+			err := w.checkpoint()
+			if err != nil {
+				log.Errorf("Sink %q failed to save its checkpoint: %v", w.sink.Name, err)
+			}
+			continue
+		}
+		err := w.catchUp(batch)
+		if err != nil {
+			log.Errorf("Sink %q is lagging at block %d, retrying in %s: %v", w.sink.Name, w.next, delay, err)
+			retryAt = time.Now().Add(delay)
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+		batch = nil
+		delay = w.retryDelay
+	}
+}
+
+// catchUp fetches and stores the blocks missing before the batch, then stores the batch
+func (w *sinkWorker) catchUp(batch *fanOutBatch) error {
+	for w.next < batch.first {
+		to := batch.first - 1
+		if w.next+w.batchSize-1 < to {
+			to = w.next + w.batchSize - 1
+		}
+		blocks, err := w.source.Blocks(w.next, to)
+		if err != nil {
+			return err
+		}
+		log.Infof("Sink %q catching up with blocks %d..%d", w.sink.Name, w.next, to)
+		err = w.storeBlocks(blocks, nil, to)
+		if err != nil {
+			return err
+		}
+	}
+	return w.store(batch)
+}
+
+// store stores the blocks of the batch the sink doesn't have yet
+func (w *sinkWorker) store(batch *fanOutBatch) error {
+	if batch.last < w.next {
+		return nil
+	}
+	if batch.first < w.next {
+		// the documents decoded are those of the whole batch, the sink decodes the blocks it's missing
+		return w.storeBlocks(batch.blocks[w.next-batch.first:], nil, batch.last)
+	}
+	return w.storeBlocks(batch.blocks, batch.response, batch.last)
+}
+
+// storeBlocks stores the blocks up to last, decoded in response when not nil, and saves the checkpoint
+func (w *sinkWorker) storeBlocks(blocks []*cb.Block, response *transformation.DocumentExtractionResponse, last int) error {
+	var err error
+	storer, ok := w.sink.Storage.(DocumentStorer)
+	if ok && response != nil {
+		err = storer.StoreDocuments(response)
+	} else {
+		err = w.sink.Storage.StoreBulk(blocks)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "sink %q failed storing blocks %d..%d", w.sink.Name, w.next, last)
+		if _, ok := w.sink.Storage.(Pipeliner); ok {
+			// the storage may have dropped the writes of the blocks before, they are stored again
+			checkpointErr := w.checkpoint()
+			if checkpointErr != nil {
+				log.Warnf("%v", checkpointErr)
+			}
+		}
+		return err
+	}
+	w.next = last + 1
+	return w.checkpoint()
+}
+
+// checkpoint saves the last block stored, or committed for the storages applying the writes asynchronously
+func (w *sinkWorker) checkpoint() error {
+	blockNumber := w.next - 1
+	if pipeliner, ok := w.sink.Storage.(Pipeliner); ok {
+		committed, found, err := pipeliner.Committed()
+		if found {
+			w.committed = committed
+		}
+		if _, ok := err.(*RewindError); ok {
+			log.Warnf("Sink %q stores again the blocks from %d", w.sink.Name, w.committed+1)
+			w.next = w.committed + 1
+		}
+		if err != nil {
+			return errors.Wrapf(err, "sink %q", w.sink.Name)
+		}
+		if !found {
+			return nil
+		}
+		blockNumber = committed
+	}
+	if blockNumber < 0 || blockNumber == w.saved {
+		return nil
+	}
+	err := w.checkpoints.SaveCheckpoint(w.sink.Name, blockNumber)
+	if err != nil {
+		return errors.Wrapf(err, "failed to save the checkpoint of sink %q", w.sink.Name)
+	}
+	w.saved = blockNumber
+	return nil
+}
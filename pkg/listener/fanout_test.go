@@ -0,0 +1,262 @@
+package listener
+
+import (
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink records the blocks stored, failing while failing is set
+type memorySink struct {
+	mutex     sync.Mutex
+	blocks    []int
+	documents int
+	failing   bool
+}
+
+func (s *memorySink) Store(block *cb.Block) error {
+	return s.StoreBulk([]*cb.Block{block})
+}
+
+func (s *memorySink) StoreBulk(blocks []*cb.Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failing {
+		return errors.New("sink down")
+	}
+	for _, block := range blocks {
+		s.blocks = append(s.blocks, int(block.Header.Number))
+	}
+	return nil
+}
+
+func (s *memorySink) stored() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]int{}, s.blocks...)
+}
+
+func (s *memorySink) setFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+}
+
+// decodedSink stores the documents decoded by the fan-out
+type decodedSink struct {
+	memorySink
+}
+
+func (s *decodedSink) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failing {
+		return errors.New("sink down")
+	}
+	for _, block := range response.Blocks {
+		s.blocks = append(s.blocks, block.Number)
+	}
+	s.documents += len(response.DocumentsToAdd)
+	return nil
+}
+
+// pipelinedSink reports the blocks up to committed as applied, and fails once with failed
+type pipelinedSink struct {
+	memorySink
+	committed int
+	failed    error
+}
+
+func (s *pipelinedSink) Committed() (int, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failed != nil {
+		err := &RewindError{Err: s.failed}
+		s.failed = nil
+		return s.committed, s.committed >= 0, err
+	}
+	return s.committed, s.committed >= 0, nil
+}
+
+func (s *pipelinedSink) Flush() error {
+	return nil
+}
+
+type memoryCheckpoints struct {
+	mutex       sync.Mutex
+	checkpoints map[string]int
+}
+
+func newMemoryCheckpoints() *memoryCheckpoints {
+	return &memoryCheckpoints{checkpoints: map[string]int{}}
+}
+
+func (c *memoryCheckpoints) LoadCheckpoint(sink string) (int, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	blockNumber, ok := c.checkpoints[sink]
+	return blockNumber, ok, nil
+}
+
+func (c *memoryCheckpoints) SaveCheckpoint(sink string, blockNumber int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checkpoints[sink] = blockNumber
+	return nil
+}
+
+func (c *memoryCheckpoints) get(sink string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	blockNumber, ok := c.checkpoints[sink]
+	if !ok {
+		return -1
+	}
+	return blockNumber
+}
+
+type testBlockSource struct{}
+
+func (testBlockSource) Blocks(from int, to int) ([]*cb.Block, error) {
+	var blocks []*cb.Block
+	for i := from; i <= to; i++ {
+		blocks = append(blocks, fanOutTestBlock(i))
+	}
+	return blocks, nil
+}
+
+func fanOutTestBlock(number int) *cb.Block {
+	return newTestBlock("mychannel", uint64(number), writeTx(strconv.Itoa(number), "fabcar",
+		&kvrwset.KVWrite{Key: "car" + strconv.Itoa(number), Value: []byte(`{"owner":"a"}`)},
+	))
+}
+
+func TestFanOutWaitAll(t *testing.T) {
+	decoded := &decodedSink{}
+	plain := &memorySink{}
+	checkpoints := newMemoryCheckpoints()
+	f, err := NewFanOut([]Sink{
+		{Name: "search", Storage: decoded},
+		{Name: "bi", Storage: plain},
+	}, WaitAll, checkpoints, testBlockSource{})
+	require.NoError(t, err)
+	defer f.Close()
+
+	blocks, _ := testBlockSource{}.Blocks(0, 1)
+	require.NoError(t, f.Deliver(blocks))
+	assert.Equal(t, []int{0, 1}, decoded.stored())
+	assert.Equal(t, 2, decoded.documents)
+	assert.Equal(t, []int{0, 1}, plain.stored())
+	assert.Equal(t, 1, checkpoints.get("search"))
+	assert.Equal(t, 1, checkpoints.get("bi"))
+	assert.Equal(t, 2, f.Next())
+
+	plain.setFailing(true)
+	blocks, _ = testBlockSource{}.Blocks(2, 2)
+	assert.Error(t, f.Deliver(blocks))
+	assert.Equal(t, 2, checkpoints.get("search"))
+	assert.Equal(t, 1, checkpoints.get("bi"))
+	assert.Equal(t, 2, f.Next())
+
+	plain.setFailing(false)
+	require.NoError(t, f.Deliver(blocks))
+	assert.Equal(t, []int{0, 1, 2}, decoded.stored())
+	assert.Equal(t, []int{0, 1, 2}, plain.stored())
+	assert.Equal(t, 3, f.Next())
+}
+
+func TestFanOutWaitPrimary(t *testing.T) {
+	defer func(delay time.Duration) { sinkRetryDelay = delay }(sinkRetryDelay)
+	sinkRetryDelay = time.Millisecond
+	primary := &memorySink{}
+	secondary := &memorySink{failing: true}
+	checkpoints := newMemoryCheckpoints()
+	f, err := NewFanOut([]Sink{
+		{Name: "search", Storage: secondary},
+		{Name: "bi", Storage: primary, Primary: true},
+	}, WaitPrimary, checkpoints, testBlockSource{})
+	require.NoError(t, err)
+	defer f.Close()
+
+	for i := 0; i < 4; i += 2 {
+		blocks, _ := testBlockSource{}.Blocks(i, i+1)
+		require.NoError(t, f.Deliver(blocks))
+	}
+	assert.Equal(t, []int{0, 1, 2, 3}, primary.stored())
+	assert.Equal(t, 3, checkpoints.get("bi"))
+	assert.Equal(t, -1, checkpoints.get("search"))
+	assert.Equal(t, 4, f.Next())
+
+	// the secondary catches up with the blocks it missed once it's back
+	secondary.setFailing(false)
+	blocks, _ := testBlockSource{}.Blocks(4, 4)
+	require.NoError(t, f.Deliver(blocks))
+	assert.Eventually(t, func() bool {
+		return checkpoints.get("search") == 4
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, secondary.stored())
+}
+
+func TestFanOutCheckpoints(t *testing.T) {
+	checkpoints := newMemoryCheckpoints()
+	checkpoints.checkpoints["search"] = 9
+	checkpoints.checkpoints["bi"] = 4
+	checkpoints.checkpoints["events"] = 6
+	search := &memorySink{}
+	bi := &memorySink{}
+	events := &decodedSink{}
+	f, err := NewFanOut([]Sink{
+		{Name: "search", Storage: search},
+		{Name: "bi", Storage: bi},
+		{Name: "events", Storage: events},
+	}, WaitAll, checkpoints, testBlockSource{})
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, 5, f.Next())
+
+	// the blocks already stored by a sink are skipped
+	blocks, _ := testBlockSource{}.Blocks(5, 9)
+	require.NoError(t, f.Deliver(blocks))
+	assert.Empty(t, search.stored())
+	assert.Equal(t, []int{5, 6, 7, 8, 9}, bi.stored())
+	assert.Equal(t, []int{7, 8, 9}, events.stored())
+	assert.Equal(t, 9, checkpoints.get("events"))
+	assert.Equal(t, 10, f.Next())
+
+	f.Rewind(0)
+	assert.Equal(t, 0, f.Next())
+
+	_, err = NewFanOut([]Sink{{Name: "bi", Storage: bi}, {Name: "bi", Storage: search}}, WaitAll, checkpoints, testBlockSource{})
+	assert.EqualError(t, err, `duplicate sink "bi"`)
+	_, err = NewFanOut([]Sink{{Name: "bi", Storage: bi}}, "some", checkpoints, testBlockSource{})
+	assert.Error(t, err)
+}
+
+func TestFanOutPipelinedRewind(t *testing.T) {
+	checkpoints := newMemoryCheckpoints()
+	search := &pipelinedSink{committed: -1}
+	f, err := NewFanOut([]Sink{{Name: "search", Storage: search}}, WaitAll, checkpoints, testBlockSource{})
+	require.NoError(t, err)
+	defer f.Close()
+	blocks, _ := testBlockSource{}.Blocks(0, 4)
+	require.NoError(t, f.Deliver(blocks))
+	assert.Equal(t, 5, f.Next())
+
+	// the writes after the last block committed were dropped, they are stored again
+	search.committed = 2
+	search.failed = errors.New("task failed")
+	assert.Error(t, f.Checkpoint())
+	assert.Equal(t, 3, f.Next())
+	require.NoError(t, f.Checkpoint())
+	assert.Equal(t, 2, checkpoints.get("search"))
+	blocks, _ = testBlockSource{}.Blocks(3, 4)
+	require.NoError(t, f.Deliver(blocks))
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 3, 4}, search.stored())
+}
@@ -0,0 +1,555 @@
+package listener
+
+import (
+	"encoding/json"
+	"fmt"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileFormat is the format of the files of a file sink
+type FileFormat string
+
+const (
+	// FileParquet writes Snappy compressed Parquet files, the JSON fields are UTF8 columns
+	FileParquet FileFormat = "parquet"
+	// FileJSONL writes gzipped JSON lines
+	FileJSONL FileFormat = "jsonl"
+)
+
+// FileDataset is a kind of rows written by a file sink, every dataset is a directory of the target
+type FileDataset string
+
+const (
+	// FileState has the last write of every key in the blocks covered by a file, the world state is
+	// the row of every key with the highest blockNumber, txIndex and writeIndex across the files
+	FileState FileDataset = "state"
+	// FileHistory has every write, or its Debezium change event when the cdc section is set
+	FileHistory FileDataset = "history"
+	// FileTransactions has a row for every transaction, valid or not
+	FileTransactions FileDataset = "transactions"
+)
+
+const (
+	// DefaultFileRollSize is the size of the rows of a file, before compression, that rolls it
+	DefaultFileRollSize = 64 << 20
+	// DefaultFileRollInterval is the age of the oldest row of a file that rolls it
+	DefaultFileRollInterval = 15 * time.Minute
+
+	fileManifestDir = "_manifests"
+	// fileNullPartition is the partition of the transactions without chaincode, Hive, Spark and Trino read it as null
+	fileNullPartition = "__HIVE_DEFAULT_PARTITION__"
+)
+
+var cdcRecord = &kafkaRecord{name: "CDCEvent", fields: []kafkaField{
+	{"before", kafkaJSON},
+	{"after", kafkaJSON},
+	{"source", kafkaJSON},
+	{"op", kafkaString},
+	{"ts_ms", kafkaLong},
+}}
+
+// FileS3Config is the bucket of S3, or of a compatible store like MinIO, the files are written to
+type FileS3Config struct {
+	// Endpoint is the URL of the store, like https://s3.amazonaws.com or http://minio:9000
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to the names of the objects
+	Prefix string
+	Region string
+	// AccessKey and SecretKey are taken from the environment, the AWS credentials file or the
+	// IAM role of the instance when not set
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle puts the bucket in the path of the URLs instead of the host name
+	PathStyle bool
+}
+
+type FileConfig struct {
+	// Dir is the local directory of the files, used when no bucket is set
+	Dir string
+	S3  FileS3Config `mapstructure:"s3"`
+	// Format is parquet by default
+	Format FileFormat
+	// Datasets are the datasets written, all of them by default
+	Datasets []FileDataset
+	// RollSize and RollInterval close a file when its rows reach the size, before compression, or when
+	// its oldest row reaches the age. The age is checked when the sync saves its checkpoint
+	RollSize     int
+	RollInterval time.Duration
+}
+
+// Validate checks the target and the datasets and sets the defaults
+func (c *FileConfig) Validate() error {
+	if c.S3.Bucket != "" {
+		if c.S3.Endpoint == "" {
+			return errors.New("the endpoint of the S3 bucket is required")
+		}
+	} else if c.Dir == "" {
+		return errors.New("a dir or an S3 bucket is required")
+	}
+	switch c.Format {
+	case "":
+		c.Format = FileParquet
+	case FileParquet, FileJSONL:
+	default:
+		return errors.Errorf("format %s not supported", c.Format)
+	}
+	if len(c.Datasets) == 0 {
+		c.Datasets = []FileDataset{FileState, FileHistory, FileTransactions}
+	}
+	datasets := map[FileDataset]bool{}
+	for _, dataset := range c.Datasets {
+		switch dataset {
+		case FileState, FileHistory, FileTransactions:
+		default:
+			return errors.Errorf("dataset %s not supported", dataset)
+		}
+		if datasets[dataset] {
+			return errors.Errorf("dataset %s is duplicated", dataset)
+		}
+		datasets[dataset] = true
+	}
+	if c.RollSize == 0 {
+		c.RollSize = DefaultFileRollSize
+	}
+	if c.RollInterval == 0 {
+		c.RollInterval = DefaultFileRollInterval
+	}
+	return nil
+}
+
+// fileRow is a row of a file, the JSON fields are encoded already
+type fileRow struct {
+	blockNumber int
+	values      []interface{}
+	size        int
+}
+
+func newFileRow(record *kafkaRecord, blockNumber int, values []interface{}) (*fileRow, error) {
+	row := &fileRow{blockNumber: blockNumber, values: values}
+	for i, field := range record.fields {
+		switch field.fieldType {
+		case kafkaString:
+			row.size += len(values[i].(string))
+		case kafkaLong:
+			row.size += 8
+		case kafkaJSON:
+			value, ok, err := jsonField(values[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to encode field %s", field.name)
+			}
+			values[i] = nil
+			if ok {
+				values[i] = json.RawMessage(value)
+				row.size += len(value)
+			}
+		}
+	}
+	return row, nil
+}
+
+// fileManifest lists the files of a partition and the blocks they cover. The rows of the blocks up to the
+// last one covered are skipped when the blocks are stored again, so a re-run writes no duplicates
+type fileManifest struct {
+	Dataset   FileDataset         `json:"dataset"`
+	Channel   string              `json:"channel"`
+	Chaincode string              `json:"chaincode"`
+	Date      string              `json:"date"`
+	Files     []fileManifestEntry `json:"files"`
+}
+
+type fileManifestEntry struct {
+	Path      string     `json:"path"`
+	Format    FileFormat `json:"format"`
+	FromBlock int        `json:"fromBlock"`
+	ToBlock   int        `json:"toBlock"`
+	Rows      int        `json:"rows"`
+	Bytes     int        `json:"bytes"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// lastBlock returns the last block covered by the files, -1 when there is none
+func (m fileManifest) lastBlock() int {
+	lastBlock := -1
+	for _, file := range m.Files {
+		if file.ToBlock > lastBlock {
+			lastBlock = file.ToBlock
+		}
+	}
+	return lastBlock
+}
+
+// filePartition is a directory of a dataset with the rows of the file not written yet. The rows come in ledger
+// order and a file is only closed between batches, so the files of a partition cover consecutive block ranges
+type filePartition struct {
+	dir      string
+	record   *kafkaRecord
+	manifest fileManifest
+	rows     []*fileRow
+	// keys are the positions of the rows of the keys in the state dataset, where a write replaces the previous one
+	keys      map[string]int
+	size      int
+	fromBlock int
+	openedAt  time.Time
+}
+
+func (p *filePartition) add(row *fileRow, key string) {
+	if len(p.rows) == 0 {
+		p.fromBlock = row.blockNumber
+		p.openedAt = time.Now()
+		p.keys = map[string]int{}
+	}
+	p.size += row.size
+	if key != "" {
+		if i, ok := p.keys[key]; ok {
+			p.size -= p.rows[i].size
+			p.rows[i] = row
+			return
+		}
+		p.keys[key] = len(p.rows)
+	}
+	p.rows = append(p.rows, row)
+}
+
+// fileBuffers are the partitions of the storage, with the change events whose rows aren't all written yet
+type fileBuffers struct {
+	sync.Mutex
+	partitions map[string]*filePartition
+	lastBlock  int
+	cdcPending []*cdcBatch
+}
+
+// FileStorage writes the world state, the history of the writes and the transactions as Parquet or JSON lines
+// files, in a local directory or an S3 bucket, partitioned like <dataset>/channel=x/chaincode=y/date=YYYY-MM-DD.
+// The rows are kept in memory until their file rolls, the checkpoint only moves past the blocks whose rows
+// are all written
+type FileStorage struct {
+	channelID string
+	config    FileConfig
+	target    fileTarget
+	files     *fileBuffers
+	opts      []transformation.Option
+	// cdc is the state of the keys when the history has Debezium change events
+	cdc *cdcState
+}
+
+// NewFileStorage writes to the directory or the bucket of the config, the config must be validated
+func NewFileStorage(config FileConfig, channelID string, opts ...transformation.Option) (FileStorage, error) {
+	var target fileTarget = dirTarget{dir: config.Dir}
+	if config.S3.Bucket != "" {
+		var err error
+		target, err = newS3Target(config.S3)
+		if err != nil {
+			return FileStorage{}, err
+		}
+	}
+	return FileStorage{
+		channelID: channelID,
+		config:    config,
+		target:    target,
+		files:     &fileBuffers{partitions: map[string]*filePartition{}, lastBlock: -1},
+		opts:      opts,
+	}, nil
+}
+
+// WithCDC writes the history as change events of the envelope, keeping the values of the keys in the state directory
+func (f FileStorage) WithCDC(config CDCConfig) (FileStorage, error) {
+	if config.Envelope == "" {
+		f.cdc = nil
+		return f, nil
+	}
+	cdc, err := openCDCState(config, f.channelID)
+	if err != nil {
+		return f, err
+	}
+	f.cdc = cdc
+	return f, nil
+}
+
+// partition returns the partition of the rows of a chaincode written on the date of txDate, loading its manifest
+func (f FileStorage) partition(dataset FileDataset, record *kafkaRecord, chaincodeID string, txDate int) (*filePartition, error) {
+	if chaincodeID == "" {
+		chaincodeID = fileNullPartition
+	}
+	date := time.Unix(0, int64(txDate)*int64(time.Millisecond)).UTC().Format("2006-01-02")
+	dir := fmt.Sprintf("%s/channel=%s/chaincode=%s/date=%s", dataset, url.PathEscape(f.channelID), url.PathEscape(chaincodeID), date)
+	p, ok := f.files.partitions[dir]
+	if ok {
+		return p, nil
+	}
+	p = &filePartition{
+		dir:      dir,
+		record:   record,
+		manifest: fileManifest{Dataset: dataset, Channel: f.channelID, Chaincode: chaincodeID, Date: date},
+	}
+	data, found, err := f.target.get(fileManifestDir + "/" + dir + ".json")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the manifest of %s", dir)
+	}
+	if found {
+		err = json.Unmarshal(data, &p.manifest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid manifest of %s", dir)
+		}
+	}
+	f.files.partitions[dir] = p
+	return p, nil
+}
+
+// add adds a row to its partition, unless a file of a previous run covers its block already
+func (f FileStorage) add(dataset FileDataset, record *kafkaRecord, chaincodeID string, txDate int, key string, blockNumber int, values ...interface{}) error {
+	p, err := f.partition(dataset, record, chaincodeID, txDate)
+	if err != nil {
+		return err
+	}
+	if blockNumber <= p.manifest.lastBlock() {
+		return nil
+	}
+	row, err := newFileRow(record, blockNumber, values)
+	if err != nil {
+		return err
+	}
+	p.add(row, key)
+	return nil
+}
+
+func (f FileStorage) addRows(response *transformation.DocumentExtractionResponse, batch *cdcBatch) error {
+	for _, dataset := range f.config.Datasets {
+		switch {
+		case dataset == FileTransactions:
+			for _, tx := range response.Transactions {
+				err := f.add(dataset, transactionRecord, tx.ChaincodeID, tx.TXDate, "", tx.BlockNumber, transactionValues(tx)...)
+				if err != nil {
+					return err
+				}
+			}
+		case dataset == FileHistory && batch != nil:
+			for _, event := range batch.events {
+				envelope := event.Envelope
+				err := f.add(dataset, cdcRecord, event.Document.ChaincodeID, event.Document.TXDate, "", envelope.Source.Block,
+					envelope.Before, envelope.After, envelope.Source, envelope.Op, envelope.TsMs)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			for _, event := range response.Events {
+				document := event.Document
+				if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
+					continue
+				}
+				key := ""
+				if dataset == FileState {
+					key = document.PrimaryKey
+				}
+				err := f.add(dataset, changeRecord, document.ChaincodeID, document.TXDate, key, event.BlockNumber, changeValues(event)...)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// write writes the file of the rows of the partition and adds it to the manifest
+func (f FileStorage) write(p *filePartition) error {
+	var data []byte
+	var err error
+	extension := "parquet"
+	if f.config.Format == FileJSONL {
+		extension = "jsonl.gz"
+		data, err = encodeJSONLines(p.record, p.rows)
+	} else {
+		data, err = encodeParquet(p.record, p.rows)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode the rows of %s", p.dir)
+	}
+	// the name only depends on the first block, a file written before its manifest is overwritten by a re-run
+	name := fmt.Sprintf("%s/part-%012d.%s", p.dir, p.fromBlock, extension)
+	err = f.target.put(name, data)
+	if err != nil {
+		return err
+	}
+	manifest := p.manifest
+	manifest.Files = append(manifest.Files[:len(manifest.Files):len(manifest.Files)], fileManifestEntry{
+		Path:      name,
+		Format:    f.config.Format,
+		FromBlock: p.fromBlock,
+		ToBlock:   f.files.lastBlock,
+		Rows:      len(p.rows),
+		Bytes:     len(data),
+		CreatedAt: time.Now().UTC(),
+	})
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = f.target.put(fileManifestDir+"/"+p.dir+".json", manifestData)
+	if err != nil {
+		return err
+	}
+	log.Infof("File %s written rows=%d blocks=%d..%d", name, len(p.rows), p.fromBlock, f.files.lastBlock)
+	p.manifest = manifest
+	p.rows = nil
+	p.keys = nil
+	p.size = 0
+	return nil
+}
+
+// roll writes the files that reached the roll size or interval, or every file when all is set
+func (f FileStorage) roll(all bool) error {
+	var dirs []string
+	for dir, p := range f.files.partitions {
+		if len(p.rows) > 0 && (all || p.size >= f.config.RollSize || time.Since(p.openedAt) >= f.config.RollInterval) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		err := f.write(f.files.partitions[dir])
+		if err != nil {
+			return err
+		}
+	}
+	return f.commitCDC()
+}
+
+// committed returns the last block whose rows are all written, -1 when none is
+func (f FileStorage) committed() int {
+	committed := f.files.lastBlock
+	for _, p := range f.files.partitions {
+		if len(p.rows) > 0 && p.fromBlock-1 < committed {
+			committed = p.fromBlock - 1
+		}
+	}
+	return committed
+}
+
+// commitCDC commits the change events of the blocks whose rows are all written, the state isn't ahead of the
+// files when the blocks not written are stored again
+func (f FileStorage) commitCDC() error {
+	committed := f.committed()
+	for len(f.files.cdcPending) > 0 && f.files.cdcPending[0].blockNumber <= committed {
+		err := f.cdc.commit(f.files.cdcPending[0])
+		if err != nil {
+			return err
+		}
+		f.files.cdcPending = f.files.cdcPending[1:]
+	}
+	return nil
+}
+
+func (f FileStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
+	f.files.Lock()
+	defer f.files.Unlock()
+	var batch *cdcBatch
+	if f.cdc != nil {
+		var err error
+		batch, err = f.cdc.events(response, f.files.cdcPending...)
+		if err != nil {
+			return err
+		}
+		f.files.cdcPending = append(f.files.cdcPending, batch)
+	}
+	err := f.addRows(response, batch)
+	if err != nil {
+		return err
+	}
+	if len(response.Blocks) > 0 {
+		f.files.lastBlock = response.Blocks[len(response.Blocks)-1].Number
+	}
+	return f.roll(false)
+}
+
+// Committed rolls the files that reached the roll interval and returns the last block whose rows are all written
+func (f FileStorage) Committed() (int, bool, error) {
+	f.files.Lock()
+	defer f.files.Unlock()
+	err := f.roll(false)
+	if err != nil {
+		return 0, false, err
+	}
+	committed := f.committed()
+	return committed, committed >= 0, nil
+}
+
+// Flush writes the files of all the rows stored
+func (f FileStorage) Flush() error {
+	f.files.Lock()
+	defer f.files.Unlock()
+	return f.roll(true)
+}
+
+// Close writes the files of all the rows stored and releases the state of the change events
+func (f FileStorage) Close() error {
+	err := f.Flush()
+	if f.cdc != nil {
+		f.cdc.db.Close()
+	}
+	return err
+}
+
+func (f FileStorage) StoreBulk(blocks []*cb.Block) error {
+	response, err := transformation.BlocksToDocuments(blocks, f.opts...)
+	if err != nil {
+		return err
+	}
+	return f.storeDocs(response)
+}
+
+// StoreDocuments stores blocks already decoded
+func (f FileStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return f.storeDocs(response)
+}
+
+func (f FileStorage) Store(block *cb.Block) error {
+	response, err := transformation.BlockToDocuments(block, f.opts...)
+	if err != nil {
+		return err
+	}
+	return f.storeDocs(response)
+}
+
+// FileStorageConfig is the configuration of the file database type
+type FileStorageConfig struct {
+	FileConfig `mapstructure:",squash"`
+	// CDC writes the history as Debezium change events
+	CDC CDCConfig `mapstructure:"cdc"`
+}
+
+func (c *FileStorageConfig) Validate() error {
+	err := c.FileConfig.Validate()
+	if err != nil {
+		return err
+	}
+	return c.CDC.Validate()
+}
+
+type fileFactory struct{}
+
+func (fileFactory) NewConfig() StorageConfig {
+	return &FileStorageConfig{}
+}
+
+func (fileFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	c := config.(*FileStorageConfig)
+	storage, err := NewFileStorage(c.FileConfig, channelID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return storage.WithCDC(c.CDC)
+}
+
+func init() {
+	Register("file", fileFactory{})
+}
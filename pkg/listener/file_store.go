@@ -0,0 +1,188 @@
+package listener
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/writer"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fileTarget is where the files of a file sink are written, the names are slash separated
+type fileTarget interface {
+	put(name string, data []byte) error
+	// get returns the content of a file, ok is false when it doesn't exist
+	get(name string) (data []byte, ok bool, err error)
+}
+
+// dirTarget writes the files in a local directory, every file is written to a temporary file first
+// and renamed, so a file is either complete or missing
+type dirTarget struct {
+	dir string
+}
+
+func (t dirTarget) put(name string, data []byte) error {
+	filePath := filepath.Join(t.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := filePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+func (t dirTarget) get(name string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// s3Target writes the files as objects of a bucket of S3 or of a compatible store like MinIO
+type s3Target struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Target(config FileS3Config) (s3Target, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return s3Target{}, errors.Errorf("invalid S3 endpoint %s, it must be a URL like https://s3.amazonaws.com", config.Endpoint)
+	}
+	creds := credentials.NewStaticV4(config.AccessKey, config.SecretKey, config.SessionToken)
+	if config.AccessKey == "" {
+		// the credentials of the environment, the AWS credentials file or the IAM role of the instance
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.Scheme == "https",
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return s3Target{}, errors.Wrap(err, "failed to create the S3 client")
+	}
+	exists, err := client.BucketExists(context.Background(), config.Bucket)
+	if err != nil {
+		return s3Target{}, errors.Wrapf(err, "failed to check the bucket %s", config.Bucket)
+	}
+	if !exists {
+		return s3Target{}, errors.Errorf("bucket %s not found", config.Bucket)
+	}
+	return s3Target{client: client, bucket: config.Bucket, prefix: strings.Trim(config.Prefix, "/")}, nil
+}
+
+func (t s3Target) put(name string, data []byte) error {
+	_, err := t.client.PutObject(context.Background(), t.bucket, path.Join(t.prefix, name), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to upload %s", name)
+	}
+	return nil
+}
+
+func (t s3Target) get(name string) ([]byte, bool, error) {
+	object, err := t.client.GetObject(context.Background(), t.bucket, path.Join(t.prefix, name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to download %s", name)
+	}
+	defer object.Close()
+	data, err := ioutil.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to download %s", name)
+	}
+	return data, true, nil
+}
+
+// encodeJSONLines writes the rows as gzipped JSON lines, the JSON fields are nested in the objects
+func encodeJSONLines(record *kafkaRecord, rows []*fileRow) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, row := range rows {
+		line, err := jsonKafkaEncoder{}.encode("", record, row.values)
+		if err != nil {
+			return nil, err
+		}
+		gz.Write(append(line, '\n'))
+	}
+	err := gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parquetSchema returns the columns of the record, the JSON fields are optional UTF8 columns
+func parquetSchema(record *kafkaRecord) []string {
+	var schema []string
+	for _, field := range record.fields {
+		switch field.fieldType {
+		case kafkaString:
+			schema = append(schema, fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED", field.name))
+		case kafkaLong:
+			schema = append(schema, fmt.Sprintf("name=%s, type=INT64, repetitiontype=REQUIRED", field.name))
+		case kafkaJSON:
+			schema = append(schema, fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL", field.name))
+		}
+	}
+	return schema
+}
+
+// encodeParquet writes the rows as a Snappy compressed Parquet file
+func encodeParquet(record *kafkaRecord, rows []*fileRow) ([]byte, error) {
+	var buf bytes.Buffer
+	pw, err := writer.NewCSVWriterFromWriter(parquetSchema(record), &buf, 1)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		values := make([]interface{}, len(row.values))
+		for i, value := range row.values {
+			if raw, ok := value.(json.RawMessage); ok {
+				value = string(raw)
+			}
+			values[i] = value
+		}
+		err = pw.Write(values)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to write the Parquet row")
+		}
+	}
+	err = pw.WriteStop()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write the Parquet file")
+	}
+	return buf.Bytes(), nil
+}
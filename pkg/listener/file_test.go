@@ -0,0 +1,313 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileStorage(t *testing.T, config FileConfig) FileStorage {
+	require.NoError(t, config.Validate())
+	storage, err := NewFileStorage(config, "mychannel")
+	require.NoError(t, err)
+	return storage
+}
+
+// fileTestDir is the partition of the fabcar rows of a dataset, the test blocks are stamped with the current time
+func fileTestDir(dataset FileDataset) string {
+	return string(dataset) + "/channel=mychannel/chaincode=fabcar/date=" + time.Now().UTC().Format("2006-01-02")
+}
+
+func readFileManifest(t *testing.T, storage FileStorage, dir string) fileManifest {
+	data, found, err := storage.target.get(fileManifestDir + "/" + dir + ".json")
+	require.NoError(t, err)
+	require.True(t, found, "manifest of %s not found", dir)
+	var manifest fileManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	return manifest
+}
+
+// readFileRows reads the rows of the files of the manifest of a partition, decoded as JSON objects
+func readFileRows(t *testing.T, storage FileStorage, dir string) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, file := range readFileManifest(t, storage, dir).Files {
+		data, found, err := storage.target.get(file.Path)
+		require.NoError(t, err)
+		require.True(t, found, "file %s not found", file.Path)
+		if file.Format == FileJSONL {
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			require.NoError(t, err)
+			scanner := bufio.NewScanner(gz)
+			for scanner.Scan() {
+				var row map[string]interface{}
+				require.NoError(t, json.Unmarshal(scanner.Bytes(), &row))
+				rows = append(rows, row)
+			}
+			require.NoError(t, scanner.Err())
+			continue
+		}
+		pf, err := buffer.NewBufferFile(data)
+		require.NoError(t, err)
+		pr, err := reader.NewParquetColumnReader(pf, 1)
+		require.NoError(t, err)
+		numRows := pr.GetNumRows()
+		fileRows := make([]map[string]interface{}, numRows)
+		for i := range fileRows {
+			fileRows[i] = map[string]interface{}{}
+		}
+		for i, column := range pr.SchemaHandler.ValueColumns {
+			name := pr.SchemaHandler.GetExName(int(pr.SchemaHandler.MapIndex[column]))
+			values, _, _, err := pr.ReadColumnByIndex(int64(i), numRows)
+			require.NoError(t, err)
+			for j, value := range values {
+				fileRows[j][name] = value
+			}
+		}
+		pr.ReadStop()
+		rows = append(rows, fileRows...)
+	}
+	return rows
+}
+
+func fileRowValues(rows []map[string]interface{}, field string) []interface{} {
+	var values []interface{}
+	for _, row := range rows {
+		values = append(values, row[field])
+	}
+	return values
+}
+
+func TestFileStorage(t *testing.T) {
+	config := FileConfig{Dir: t.TempDir(), Format: FileJSONL}
+	storage := newTestFileStorage(t, config)
+	require.NoError(t, storage.StoreBulk(cdcTestBlocks("mychannel")))
+	// the rows are in memory until the files roll
+	_, found, err := storage.Committed()
+	require.NoError(t, err)
+	assert.False(t, found)
+	require.NoError(t, storage.Flush())
+	blockNumber, found, err := storage.Committed()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 2, blockNumber)
+
+	history := readFileRows(t, storage, fileTestDir(FileHistory))
+	// the write of the invalid transaction isn't in the history nor in the state
+	assert.Equal(t, []interface{}{"car1", "car2", "car3", "car1", "car2"}, fileRowValues(history, "key"))
+	state := readFileRows(t, storage, fileTestDir(FileState))
+	assert.Equal(t, []interface{}{"car1", "car2", "car3"}, fileRowValues(state, "key"))
+	assert.Equal(t, []interface{}{"upsert", "delete", "delete"}, fileRowValues(state, "operation"))
+	assert.Equal(t, "c", state[0]["value"].(map[string]interface{})["owner"])
+	transactions := readFileRows(t, storage, fileTestDir(FileTransactions))
+	assert.Equal(t, []interface{}{"1", "2", "3", "4"}, fileRowValues(transactions, "txId"))
+	assert.Equal(t, "MVCC_READ_CONFLICT", transactions[3]["validationCode"])
+
+	manifest := readFileManifest(t, storage, fileTestDir(FileHistory))
+	require.Len(t, manifest.Files, 1)
+	assert.Equal(t, fileTestDir(FileHistory)+"/part-000000000000.jsonl.gz", manifest.Files[0].Path)
+	assert.Equal(t, 0, manifest.Files[0].FromBlock)
+	assert.Equal(t, 2, manifest.Files[0].ToBlock)
+	assert.Equal(t, 5, manifest.Files[0].Rows)
+	assert.Equal(t, "fabcar", manifest.Chaincode)
+
+	// a re-run of the blocks covered by the manifests writes nothing
+	storage = newTestFileStorage(t, config)
+	require.NoError(t, storage.StoreBulk(cdcTestBlocks("mychannel")))
+	require.NoError(t, storage.Flush())
+	assert.Len(t, readFileManifest(t, storage, fileTestDir(FileHistory)).Files, 1)
+	assert.Len(t, readFileRows(t, storage, fileTestDir(FileTransactions)), 4)
+
+	require.NoError(t, storage.Store(newTestBlock("mychannel", 3, writeTx("5", "fabcar",
+		&kvrwset.KVWrite{Key: "car5", Value: []byte(`{"owner":"e"}`)},
+	))))
+	require.NoError(t, storage.Flush())
+	manifest = readFileManifest(t, storage, fileTestDir(FileHistory))
+	require.Len(t, manifest.Files, 2)
+	assert.Equal(t, fileTestDir(FileHistory)+"/part-000000000003.jsonl.gz", manifest.Files[1].Path)
+	assert.Equal(t, []interface{}{"car1", "car2", "car3", "car1", "car2", "car5"}, fileRowValues(readFileRows(t, storage, fileTestDir(FileHistory)), "key"))
+}
+
+func TestFileStorageParquet(t *testing.T) {
+	config := FileConfig{Dir: t.TempDir(), Datasets: []FileDataset{FileState, FileTransactions}, RollSize: 1}
+	storage := newTestFileStorage(t, config)
+	for _, block := range esTestBlocks("mychannel") {
+		require.NoError(t, storage.Store(block))
+	}
+	// every block rolls the files with a roll size of a byte
+	blockNumber, found, err := storage.Committed()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, blockNumber)
+	_, err = os.Stat(filepath.Join(config.Dir, fileTestDir(FileHistory)))
+	assert.True(t, os.IsNotExist(err))
+
+	manifest := readFileManifest(t, storage, fileTestDir(FileState))
+	require.Len(t, manifest.Files, 2)
+	assert.Equal(t, fileTestDir(FileState)+"/part-000000000001.parquet", manifest.Files[1].Path)
+	assert.Equal(t, FileParquet, manifest.Files[1].Format)
+	state := readFileRows(t, storage, fileTestDir(FileState))
+	assert.Equal(t, []interface{}{"car1", "car2", "car3"}, fileRowValues(state, "key"))
+	assert.Equal(t, []interface{}{int64(0), int64(0), int64(1)}, fileRowValues(state, "blockNumber"))
+	values := fileRowValues(state, "value")
+	assert.Contains(t, values[0], `"owner":"a"`)
+	assert.Contains(t, values[1], `"owner":"b"`)
+	assert.Nil(t, values[2])
+	transactions := readFileRows(t, storage, fileTestDir(FileTransactions))
+	assert.Equal(t, []interface{}{"1", "2"}, fileRowValues(transactions, "txId"))
+}
+
+func TestFileDebezium(t *testing.T) {
+	config := FileStorageConfig{
+		FileConfig: FileConfig{Dir: t.TempDir(), Format: FileJSONL, Datasets: []FileDataset{FileHistory}},
+		CDC:        CDCConfig{Envelope: DebeziumEnvelope, StateDir: ":memory:"},
+	}
+	require.NoError(t, config.Validate())
+	blockStorage, err := fileFactory{}.NewStorage(&config, "mychannel")
+	require.NoError(t, err)
+	storage := blockStorage.(FileStorage)
+	defer storage.Close()
+	blocks := cdcTestBlocks("mychannel")
+	require.NoError(t, storage.StoreBulk(blocks[:2]))
+	// the values of the keys are taken from the change events not written yet
+	require.NoError(t, storage.StoreBulk(blocks[2:]))
+	assert.Len(t, storage.files.cdcPending, 2)
+	require.NoError(t, storage.Flush())
+	assert.Empty(t, storage.files.cdcPending)
+
+	history := readFileRows(t, storage, fileTestDir(FileHistory))
+	assert.Equal(t, []interface{}{"c", "c", "d", "u", "d"}, fileRowValues(history, "op"))
+	assert.Equal(t, "a", history[3]["before"].(map[string]interface{})["owner"])
+	assert.Equal(t, float64(2), history[3]["source"].(map[string]interface{})["block"])
+}
+
+// fakeS3 keeps the objects uploaded to it in memory
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	s3 := &fakeS3{bucket: bucket, objects: map[string][]byte{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s3.Lock()
+		defer s3.Unlock()
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if parts[0] != s3.bucket {
+			w.WriteHeader(http.StatusNotFound)
+			xml.NewEncoder(w).Encode(struct {
+				XMLName xml.Name `xml:"Error"`
+				Code    string
+			}{Code: "NoSuchBucket"})
+			return
+		}
+		if len(parts) == 1 || parts[1] == "" {
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+				body = decodeAWSChunks(t, body)
+			}
+			s3.objects[parts[1]] = body
+			w.Header().Set("ETag", `"etag"`)
+		case http.MethodGet:
+			object, ok := s3.objects[parts[1]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				xml.NewEncoder(w).Encode(struct {
+					XMLName xml.Name `xml:"Error"`
+					Code    string
+					Key     string
+				}{Code: "NoSuchKey", Key: parts[1]})
+				return
+			}
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Write(object)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return s3, server
+}
+
+// decodeAWSChunks returns the payload of a body signed in chunks, every chunk being <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+func decodeAWSChunks(t *testing.T, body []byte) []byte {
+	var payload []byte
+	for len(body) > 0 {
+		header := body[:bytes.Index(body, []byte("\r\n"))]
+		size, err := strconv.ParseInt(string(bytes.SplitN(header, []byte(";"), 2)[0]), 16, 64)
+		require.NoError(t, err)
+		body = body[len(header)+2:]
+		payload = append(payload, body[:size]...)
+		body = body[size+2:]
+	}
+	return payload
+}
+
+func (s *fakeS3) keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestFileStorageS3(t *testing.T) {
+	var s3 *fakeS3
+	config := FileConfig{Format: FileJSONL, Datasets: []FileDataset{FileHistory}}
+	if endpoint := os.Getenv("HLF_SYNC_TEST_S3_ENDPOINT"); endpoint != "" {
+		config.S3 = FileS3Config{
+			Endpoint:  endpoint,
+			Bucket:    os.Getenv("HLF_SYNC_TEST_S3_BUCKET"),
+			AccessKey: os.Getenv("HLF_SYNC_TEST_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("HLF_SYNC_TEST_S3_SECRET_KEY"),
+			Prefix:    "hlf-sync-test-" + time.Now().Format("20060102150405"),
+		}
+	} else {
+		var server *httptest.Server
+		s3, server = newFakeS3(t, "ledger")
+		config.S3 = FileS3Config{Endpoint: server.URL, Bucket: "ledger", Prefix: "exports/", Region: "us-east-1", AccessKey: "key", SecretKey: "secret"}
+	}
+	_, err := NewFileStorage(FileConfig{S3: FileS3Config{Endpoint: config.S3.Endpoint, Bucket: "missing", Region: "us-east-1", AccessKey: "key", SecretKey: "secret"}}, "mychannel")
+	assert.Error(t, err)
+
+	storage := newTestFileStorage(t, config)
+	require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+	require.NoError(t, storage.Flush())
+	assert.Equal(t, []interface{}{"car1", "car2", "car3"}, fileRowValues(readFileRows(t, storage, fileTestDir(FileHistory)), "key"))
+	if s3 != nil {
+		assert.Equal(t, []string{
+			"exports/_manifests/" + fileTestDir(FileHistory) + ".json",
+			"exports/" + fileTestDir(FileHistory) + "/part-000000000000.jsonl.gz",
+		}, s3.keys())
+	}
+
+	storage = newTestFileStorage(t, config)
+	require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+	require.NoError(t, storage.Flush())
+	assert.Len(t, readFileManifest(t, storage, fileTestDir(FileHistory)).Files, 1)
+}
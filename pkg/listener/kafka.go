@@ -0,0 +1,480 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/Shopify/sarama"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// KafkaStorage publishes a message for every write of the ledger, and optionally for every transaction
+// and block. Store returns once every message has been acknowledged by all the in-sync replicas, so the
+// checkpoint only moves after the messages are committed
+type KafkaStorage struct {
+	producer  sarama.SyncProducer
+	channelID string
+	topics    KafkaTopics
+	encoder   kafkaEncoder
+	opts      []transformation.Option
+	// cdc is the state of the keys when the writes are published as Debezium change events
+	cdc *cdcState
+}
+
+// KafkaTopics are the topics of the messages
+type KafkaTopics struct {
+	// Changes receives the writes keyed by channel/chaincode/key, so the writes of a key keep their order.
+	// It's <channel>.changes by default
+	Changes string
+	// Transactions and Blocks are keyed by channel, every message of a channel goes to the same partition.
+	// No message is published for them when not set
+	Transactions string
+	Blocks       string
+}
+
+// sharedTopic returns a topic set for two kinds of messages
+func (t KafkaTopics) sharedTopic() string {
+	topics := map[string]bool{}
+	for _, topic := range []string{t.Changes, t.Transactions, t.Blocks} {
+		if topic == "" {
+			continue
+		}
+		if topics[topic] {
+			return topic
+		}
+		topics[topic] = true
+	}
+	return ""
+}
+
+type KafkaConfig struct {
+	Brokers  []string
+	ClientID string `mapstructure:"clientId"`
+	// Version is the version of the brokers, at least 0.11 for the idempotent producer
+	Version string
+	// Compression is none, gzip, snappy, lz4 or zstd
+	Compression string
+	// Username and Password authenticate with SASL/PLAIN
+	Username string `mapstructure:"user"`
+	Password string
+	TLS      bool `mapstructure:"tls"`
+	// CACert, ClientCert and ClientKey are the paths of the PEM files of the TLS connection
+	CACert     string
+	ClientCert string
+	ClientKey  string
+}
+
+// NewKafkaStorage connects to the brokers with an idempotent producer, publishing the writes in JSON to <channel>.changes
+func NewKafkaStorage(config KafkaConfig, channelID string, opts ...transformation.Option) (KafkaStorage, error) {
+	producerConfig, err := newKafkaProducerConfig(config)
+	if err != nil {
+		return KafkaStorage{}, err
+	}
+	producer, err := sarama.NewSyncProducer(config.Brokers, producerConfig)
+	if err != nil {
+		return KafkaStorage{}, errors.Wrap(err, "failed to connect to Kafka")
+	}
+	return newKafkaStorage(producer, channelID, opts...), nil
+}
+
+func newKafkaStorage(producer sarama.SyncProducer, channelID string, opts ...transformation.Option) KafkaStorage {
+	return KafkaStorage{
+		producer:  producer,
+		channelID: channelID,
+		topics:    KafkaTopics{Changes: channelID + ".changes"},
+		encoder:   jsonKafkaEncoder{},
+		opts:      opts,
+	}
+}
+
+// WithTopics sets the topics of the messages, the changes topic is kept when not set
+func (k KafkaStorage) WithTopics(topics KafkaTopics) KafkaStorage {
+	if topics.Changes == "" {
+		topics.Changes = k.topics.Changes
+	}
+	k.topics = topics
+	return k
+}
+
+// WithFormat sets the encoding of the messages, the schemas of Avro and Protobuf are registered in the registry
+func (k KafkaStorage) WithFormat(format KafkaFormat, registry SchemaRegistryConfig) KafkaStorage {
+	if format == KafkaAvro || format == KafkaProtobuf {
+		k.encoder = registryKafkaEncoder{format: format, registry: newSchemaRegistry(registry)}
+	} else {
+		k.encoder = jsonKafkaEncoder{}
+	}
+	return k
+}
+
+// WithCDC publishes the writes as change events of the envelope, keeping the values of the keys in the state directory
+func (k KafkaStorage) WithCDC(config CDCConfig) (KafkaStorage, error) {
+	if config.Envelope == "" {
+		k.cdc = nil
+		return k, nil
+	}
+	cdc, err := openCDCState(config, k.channelID)
+	if err != nil {
+		return k, err
+	}
+	k.cdc = cdc
+	return k, nil
+}
+
+func newKafkaProducerConfig(config KafkaConfig) (*sarama.Config, error) {
+	producerConfig := sarama.NewConfig()
+	producerConfig.ClientID = config.ClientID
+	if producerConfig.ClientID == "" {
+		producerConfig.ClientID = "hlf-sync"
+	}
+	producerConfig.Version = sarama.V2_1_0_0
+	if config.Version != "" {
+		version, err := sarama.ParseKafkaVersion(config.Version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid Kafka version %s", config.Version)
+		}
+		producerConfig.Version = version
+	}
+	// the idempotent producer writes every message once and in order even when retrying
+	producerConfig.Producer.Idempotent = true
+	producerConfig.Producer.RequiredAcks = sarama.WaitForAll
+	producerConfig.Producer.Return.Successes = true
+	producerConfig.Producer.Retry.Max = 10
+	producerConfig.Net.MaxOpenRequests = 1
+	switch config.Compression {
+	case "", "none":
+		producerConfig.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		producerConfig.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		producerConfig.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		producerConfig.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		producerConfig.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, errors.Errorf("compression %s not supported", config.Compression)
+	}
+	if config.Username != "" {
+		producerConfig.Net.SASL.Enable = true
+		producerConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		producerConfig.Net.SASL.User = config.Username
+		producerConfig.Net.SASL.Password = config.Password
+	}
+	if config.TLS {
+		tlsConfig := &tls.Config{}
+		if config.CACert != "" {
+			caBytes, err := ioutil.ReadFile(config.CACert)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read the CA certificate")
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+				return nil, errors.Errorf("no certificates found in %s", config.CACert)
+			}
+		}
+		if config.ClientCert != "" || config.ClientKey != "" {
+			certificate, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to load the client certificate")
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		producerConfig.Net.TLS.Enable = true
+		producerConfig.Net.TLS.Config = tlsConfig
+	}
+	err := producerConfig.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return producerConfig, nil
+}
+
+// changeKey is the key of the messages of a document, the writes of a key go to the same partition
+func changeKey(document *transformation.Document) string {
+	parts := []string{document.ChannelID, document.ChaincodeID}
+	if document.Collection != "" {
+		parts = append(parts, document.Collection)
+	}
+	return strings.Join(append(parts, document.Key), "/")
+}
+
+// changeValues are the values of the changeRecord of a write, the value is nil for deletes
+func changeValues(event *transformation.ChangeEvent) []interface{} {
+	document := event.Document
+	var value interface{}
+	if event.Operation == transformation.Upsert {
+		value = document.Data
+	}
+	return []interface{}{
+		document.ChannelID,
+		document.ChaincodeID,
+		document.Collection,
+		document.Key,
+		document.PrimaryKey,
+		string(event.Operation),
+		int64(event.BlockNumber),
+		int64(event.TXIndex),
+		int64(event.WriteIndex),
+		document.TXID,
+		int64(document.TXDate),
+		value,
+	}
+}
+
+// transactionValues are the values of the transactionRecord of a transaction
+func transactionValues(tx *transformation.Transaction) []interface{} {
+	var endorsers interface{}
+	if len(tx.Endorsers) > 0 {
+		endorsers = tx.Endorsers
+	}
+	var creator interface{}
+	if tx.Creator != nil {
+		creator = tx.Creator
+	}
+	return []interface{}{
+		tx.ChannelID,
+		tx.TXID,
+		int64(tx.BlockNumber),
+		int64(tx.TXIndex),
+		int64(tx.TXDate),
+		tx.HeaderType,
+		tx.ValidationCode,
+		tx.ChaincodeID,
+		creator,
+		endorsers,
+	}
+}
+
+func (k KafkaStorage) message(topic string, key string, txDate int, record *kafkaRecord, values ...interface{}) (*sarama.ProducerMessage, error) {
+	value, err := k.encoder.encode(topic, record, values)
+	if err != nil {
+		return nil, err
+	}
+	message := &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	}
+	if txDate > 0 {
+		message.Timestamp = time.Unix(0, int64(txDate)*int64(time.Millisecond))
+	}
+	return message, nil
+}
+
+// cdcMessages returns the change events of the writes, a delete is followed by a tombstone so the key
+// can be removed from a compacted topic
+func (k KafkaStorage) cdcMessages(response *transformation.DocumentExtractionResponse) ([]*sarama.ProducerMessage, *cdcBatch, error) {
+	batch, err := k.cdc.events(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	var messages []*sarama.ProducerMessage
+	for _, event := range batch.events {
+		value, err := json.Marshal(event.Envelope)
+		if err != nil {
+			return nil, nil, err
+		}
+		key := event.Key()
+		message := &sarama.ProducerMessage{
+			Topic:     k.topics.Changes,
+			Key:       sarama.ByteEncoder(key),
+			Value:     sarama.ByteEncoder(value),
+			Timestamp: time.Unix(0, event.Envelope.Source.TsMs*int64(time.Millisecond)),
+		}
+		messages = append(messages, message)
+		if event.Envelope.Op == "d" {
+			messages = append(messages, &sarama.ProducerMessage{
+				Topic:     k.topics.Changes,
+				Key:       sarama.ByteEncoder(key),
+				Timestamp: message.Timestamp,
+			})
+		}
+	}
+	return messages, batch, nil
+}
+
+// messages returns the messages of the writes, transactions and blocks, in ledger order
+func (k KafkaStorage) messages(response *transformation.DocumentExtractionResponse) ([]*sarama.ProducerMessage, *cdcBatch, error) {
+	var messages []*sarama.ProducerMessage
+	var batch *cdcBatch
+	if k.cdc != nil {
+		var err error
+		messages, batch, err = k.cdcMessages(response)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		for _, event := range response.Events {
+			document := event.Document
+			if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
+				continue
+			}
+			message, err := k.message(k.topics.Changes, changeKey(document), document.TXDate, changeRecord, changeValues(event)...)
+			if err != nil {
+				return nil, nil, err
+			}
+			messages = append(messages, message)
+		}
+	}
+	if k.topics.Transactions != "" {
+		for _, tx := range response.Transactions {
+			message, err := k.message(k.topics.Transactions, tx.ChannelID, tx.TXDate, transactionRecord, transactionValues(tx)...)
+			if err != nil {
+				return nil, nil, err
+			}
+			messages = append(messages, message)
+		}
+	}
+	if k.topics.Blocks != "" {
+		for _, block := range response.Blocks {
+			var signer interface{}
+			if block.Signer != nil {
+				signer = block.Signer
+			}
+			message, err := k.message(k.topics.Blocks, block.ChannelID, block.LastTXDate, blockRecord,
+				block.ChannelID,
+				int64(block.Number),
+				block.Hash,
+				block.PreviousHash,
+				block.DataHash,
+				int64(block.TXCount),
+				int64(block.ValidTXCount),
+				int64(block.InvalidTXCount),
+				int64(block.LastConfigIndex),
+				int64(block.FirstTXDate),
+				int64(block.LastTXDate),
+				signer,
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+			messages = append(messages, message)
+		}
+	}
+	return messages, batch, nil
+}
+
+func (k KafkaStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
+	messages, batch, err := k.messages(response)
+	if err != nil {
+		return err
+	}
+	if len(messages) > 0 {
+		err = k.producer.SendMessages(messages)
+	}
+	if producerErrs, ok := err.(sarama.ProducerErrors); ok && len(producerErrs) > 0 {
+		first := producerErrs[0]
+		return errors.Wrapf(first.Err, "%d messages failed, first to topic %s", len(producerErrs), first.Msg.Topic)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to publish the messages")
+	}
+	if batch != nil {
+		err = k.cdc.commit(batch)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Messages published=%d", len(messages))
+	return nil
+}
+
+// Checkpoint returns the last block whose change events have been published, the state of the keys
+// can't get out of sync with the events
+func (k KafkaStorage) Checkpoint() (int, bool, error) {
+	if k.cdc == nil {
+		return 0, false, nil
+	}
+	return k.cdc.checkpoint()
+}
+
+func (k KafkaStorage) StoreBulk(blocks []*cb.Block) error {
+	response, err := transformation.BlocksToDocuments(blocks, k.opts...)
+	if err != nil {
+		return err
+	}
+	return k.storeDocs(response)
+}
+
+// StoreDocuments stores blocks already decoded
+func (k KafkaStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return k.storeDocs(response)
+}
+
+func (k KafkaStorage) Store(block *cb.Block) error {
+	response, err := transformation.BlockToDocuments(block, k.opts...)
+	if err != nil {
+		return err
+	}
+	return k.storeDocs(response)
+}
+
+// KafkaStorageConfig is the configuration of the kafka database type
+type KafkaStorageConfig struct {
+	KafkaConfig `mapstructure:",squash"`
+	Topics      KafkaTopics
+	// Format is json, avro or protobuf, Avro and Protobuf require the schema registry
+	Format         KafkaFormat
+	SchemaRegistry SchemaRegistryConfig
+	// CDC publishes the writes as Debezium change events, in JSON
+	CDC CDCConfig `mapstructure:"cdc"`
+}
+
+func (c *KafkaStorageConfig) Validate() error {
+	if len(c.Brokers) == 0 {
+		return errors.New("brokers are required")
+	}
+	switch c.Format {
+	case "":
+		c.Format = KafkaJSON
+	case KafkaJSON:
+	case KafkaAvro, KafkaProtobuf:
+		if c.SchemaRegistry.URL == "" {
+			return errors.Errorf("the %s format requires the schemaRegistry url", c.Format)
+		}
+		// the schema of every topic is registered under the <topic>-value subject, a topic has a single schema
+		if topic := c.Topics.sharedTopic(); topic != "" {
+			return errors.Errorf("the %s format requires a topic per kind of message, %s is set twice", c.Format, topic)
+		}
+	default:
+		return errors.Errorf("format %s not supported", c.Format)
+	}
+	err := c.CDC.Validate()
+	if err != nil {
+		return err
+	}
+	if c.CDC.Envelope != "" && c.Format != KafkaJSON {
+		return errors.Errorf("the %s envelope is only published in json", c.CDC.Envelope)
+	}
+	return nil
+}
+
+type kafkaFactory struct{}
+
+func (kafkaFactory) NewConfig() StorageConfig {
+	return &KafkaStorageConfig{}
+}
+
+func (kafkaFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	c := config.(*KafkaStorageConfig)
+	// the default changes topic is only known with the channel
+	topics := newKafkaStorage(nil, channelID).WithTopics(c.Topics).topics
+	if topic := topics.sharedTopic(); topic != "" && c.Format != KafkaJSON {
+		return nil, errors.Errorf("the %s format requires a topic per kind of message, %s is set twice", c.Format, topic)
+	}
+	storage, err := NewKafkaStorage(c.KafkaConfig, channelID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return storage.WithTopics(c.Topics).WithFormat(c.Format, c.SchemaRegistry).WithCDC(c.CDC)
+}
+
+func init() {
+	Register("kafka", kafkaFactory{})
+}
@@ -0,0 +1,327 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// KafkaFormat is the encoding of the values of the messages
+type KafkaFormat string
+
+const (
+	KafkaJSON     KafkaFormat = "json"
+	KafkaAvro     KafkaFormat = "avro"
+	KafkaProtobuf KafkaFormat = "protobuf"
+)
+
+type kafkaFieldType int
+
+const (
+	kafkaString kafkaFieldType = iota
+	kafkaLong
+	// kafkaJSON is a nested value, the chaincode data or an identity. Avro and Protobuf carry it as a
+	// JSON string since the chaincode data has no schema
+	kafkaJSON
+)
+
+type kafkaField struct {
+	name      string
+	fieldType kafkaFieldType
+}
+
+// kafkaRecord is the schema of a message, the values of a message are given in the order of its fields:
+// string, int64 or any value for the JSON fields
+type kafkaRecord struct {
+	name   string
+	fields []kafkaField
+}
+
+var (
+	changeRecord = &kafkaRecord{name: "ChangeEvent", fields: []kafkaField{
+		{"channel", kafkaString},
+		{"chaincode", kafkaString},
+		{"collection", kafkaString},
+		{"key", kafkaString},
+		{"id", kafkaString},
+		{"operation", kafkaString},
+		{"blockNumber", kafkaLong},
+		{"txIndex", kafkaLong},
+		{"writeIndex", kafkaLong},
+		{"txId", kafkaString},
+		{"txDate", kafkaLong},
+		{"value", kafkaJSON},
+	}}
+	transactionRecord = &kafkaRecord{name: "Transaction", fields: []kafkaField{
+		{"channel", kafkaString},
+		{"txId", kafkaString},
+		{"blockNumber", kafkaLong},
+		{"txIndex", kafkaLong},
+		{"txDate", kafkaLong},
+		{"headerType", kafkaString},
+		{"validationCode", kafkaString},
+		{"chaincode", kafkaString},
+		{"creator", kafkaJSON},
+		{"endorsers", kafkaJSON},
+	}}
+	blockRecord = &kafkaRecord{name: "Block", fields: []kafkaField{
+		{"channel", kafkaString},
+		{"number", kafkaLong},
+		{"hash", kafkaString},
+		{"previousHash", kafkaString},
+		{"dataHash", kafkaString},
+		{"txCount", kafkaLong},
+		{"validTxCount", kafkaLong},
+		{"invalidTxCount", kafkaLong},
+		{"lastConfigIndex", kafkaLong},
+		{"firstTxDate", kafkaLong},
+		{"lastTxDate", kafkaLong},
+		{"signer", kafkaJSON},
+	}}
+)
+
+// kafkaEncoder encodes the value of the messages of a topic
+type kafkaEncoder interface {
+	encode(topic string, record *kafkaRecord, values []interface{}) ([]byte, error)
+}
+
+type jsonKafkaEncoder struct{}
+
+func (jsonKafkaEncoder) encode(topic string, record *kafkaRecord, values []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range record.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(values[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encode field %s", field.name)
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// registryKafkaEncoder encodes the values in Avro or Protobuf with the Confluent wire format, the schema
+// of every topic is registered under the <topic>-value subject
+type registryKafkaEncoder struct {
+	format   KafkaFormat
+	registry *schemaRegistry
+}
+
+func (e registryKafkaEncoder) encode(topic string, record *kafkaRecord, values []interface{}) ([]byte, error) {
+	var schemaType, schema string
+	if e.format == KafkaAvro {
+		schemaType, schema = "AVRO", avroSchema(record)
+	} else {
+		schemaType, schema = "PROTOBUF", protobufSchema(record)
+	}
+	id, err := e.registry.register(topic+"-value", schemaType, schema)
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[1:], uint32(id))
+	if e.format == KafkaAvro {
+		return encodeAvro(buf, record, values)
+	}
+	// the indexes of the message in the schema, the first message is written as a single 0
+	buf = append(buf, 0)
+	return encodeProtobuf(buf, record, values)
+}
+
+// jsonField returns the JSON of a nested value, ok is false when it's not set
+func jsonField(value interface{}) (string, bool, error) {
+	if value == nil {
+		return "", false, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", false, err
+	}
+	if string(data) == "null" {
+		return "", false, nil
+	}
+	return string(data), true, nil
+}
+
+func avroSchema(record *kafkaRecord) string {
+	var fields []map[string]interface{}
+	for _, field := range record.fields {
+		switch field.fieldType {
+		case kafkaString:
+			fields = append(fields, map[string]interface{}{"name": field.name, "type": "string"})
+		case kafkaLong:
+			fields = append(fields, map[string]interface{}{"name": field.name, "type": "long"})
+		case kafkaJSON:
+			fields = append(fields, map[string]interface{}{"name": field.name, "type": []string{"null", "string"}, "default": nil})
+		}
+	}
+	schema, _ := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      record.name,
+		"namespace": "io.hlfsync",
+		"fields":    fields,
+	})
+	return string(schema)
+}
+
+func encodeAvro(buf []byte, record *kafkaRecord, values []interface{}) ([]byte, error) {
+	for i, field := range record.fields {
+		switch field.fieldType {
+		case kafkaString:
+			buf = appendAvroString(buf, values[i].(string))
+		case kafkaLong:
+			buf = appendAvroLong(buf, values[i].(int64))
+		case kafkaJSON:
+			value, ok, err := jsonField(values[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to encode field %s", field.name)
+			}
+			if !ok {
+				buf = appendAvroLong(buf, 0)
+				continue
+			}
+			buf = appendAvroString(appendAvroLong(buf, 1), value)
+		}
+	}
+	return buf, nil
+}
+
+func appendAvroLong(buf []byte, value int64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(varint[:], value)
+	return append(buf, varint[:n]...)
+}
+
+func appendAvroString(buf []byte, value string) []byte {
+	return append(appendAvroLong(buf, int64(len(value))), value...)
+}
+
+func protobufSchema(record *kafkaRecord) string {
+	var schema strings.Builder
+	schema.WriteString("syntax = \"proto3\";\npackage io.hlfsync;\n\n")
+	fmt.Fprintf(&schema, "message %s {\n", record.name)
+	for i, field := range record.fields {
+		fieldType := "string"
+		if field.fieldType == kafkaLong {
+			fieldType = "int64"
+		}
+		fmt.Fprintf(&schema, "  %s %s = %d;\n", fieldType, field.name, i+1)
+	}
+	schema.WriteString("}\n")
+	return schema.String()
+}
+
+// encodeProtobuf encodes the message of the schema of protobufSchema, the fields with the default value are omitted
+func encodeProtobuf(buf []byte, record *kafkaRecord, values []interface{}) ([]byte, error) {
+	for i, field := range record.fields {
+		number := uint64(i + 1)
+		switch field.fieldType {
+		case kafkaString:
+			buf = appendProtobufString(buf, number, values[i].(string))
+		case kafkaLong:
+			if value := values[i].(int64); value != 0 {
+				buf = appendProtobufVarint(buf, number<<3)
+				buf = appendProtobufVarint(buf, uint64(value))
+			}
+		case kafkaJSON:
+			value, _, err := jsonField(values[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to encode field %s", field.name)
+			}
+			buf = appendProtobufString(buf, number, value)
+		}
+	}
+	return buf, nil
+}
+
+func appendProtobufVarint(buf []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], value)
+	return append(buf, varint[:n]...)
+}
+
+func appendProtobufString(buf []byte, number uint64, value string) []byte {
+	if value == "" {
+		return buf
+	}
+	buf = appendProtobufVarint(buf, number<<3|2)
+	buf = appendProtobufVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// SchemaRegistryConfig is the Confluent compatible schema registry of the Avro and Protobuf schemas
+type SchemaRegistryConfig struct {
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"user"`
+	Password string
+}
+
+// schemaRegistry registers the schemas and caches their IDs
+type schemaRegistry struct {
+	sync.Mutex
+	config     SchemaRegistryConfig
+	httpClient *http.Client
+	ids        map[string]int
+}
+
+func newSchemaRegistry(config SchemaRegistryConfig) *schemaRegistry {
+	return &schemaRegistry{config: config, httpClient: http.DefaultClient, ids: map[string]int{}}
+}
+
+// register returns the ID of the schema of the subject, registering it if it's new. The registry returns
+// the ID of the existing version when the schema is already registered
+func (r *schemaRegistry) register(subject string, schemaType string, schema string) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if id, ok := r.ids[subject]; ok {
+		return id, nil
+	}
+	body, _ := json.Marshal(map[string]string{"schemaType": schemaType, "schema": schema})
+	req, err := http.NewRequest(
+		http.MethodPost,
+		strings.TrimSuffix(r.config.URL, "/")+"/subjects/"+url.PathEscape(subject)+"/versions",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.config.Username != "" {
+		req.SetBasicAuth(r.config.Username, r.config.Password)
+	}
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to register the schema of %s", subject)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("failed to register the schema of %s: [%d] %s", subject, res.StatusCode, resBody)
+	}
+	var registered struct {
+		ID int `json:"id"`
+	}
+	err = json.Unmarshal(resBody, &registered)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to register the schema of %s", subject)
+	}
+	r.ids[subject] = registered.ID
+	return registered.ID, nil
+}
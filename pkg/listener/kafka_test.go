@@ -0,0 +1,216 @@
+package listener
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// producedMessage is a message checked by the mock producer
+type producedMessage struct {
+	topic string
+	key   string
+	value map[string]interface{}
+}
+
+func expectMessages(t *testing.T, producer *mocks.SyncProducer, count int) *[]producedMessage {
+	var messages []producedMessage
+	for i := 0; i < count; i++ {
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			key, _ := msg.Key.Encode()
+			value, _ := msg.Value.Encode()
+			message := producedMessage{topic: msg.Topic, key: string(key)}
+			err := json.Unmarshal(value, &message.value)
+			messages = append(messages, message)
+			return err
+		})
+	}
+	return &messages
+}
+
+func TestKafkaStoreBulk(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	storage := newKafkaStorage(producer, "mychannel").WithTopics(KafkaTopics{
+		Transactions: "mychannel.transactions",
+		Blocks:       "mychannel.blocks",
+	})
+	messages := expectMessages(t, producer, 7)
+	require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+	require.NoError(t, producer.Close())
+
+	require.Len(t, *messages, 7)
+	changes := (*messages)[:3]
+	for _, message := range changes {
+		assert.Equal(t, "mychannel.changes", message.topic)
+		assert.Equal(t, "mychannel/fabcar/"+message.value["key"].(string), message.key)
+	}
+	assert.Equal(t, "car1", changes[0].value["key"])
+	assert.Equal(t, "upsert", changes[0].value["operation"])
+	assert.Equal(t, documentID("car1"), changes[0].value["id"])
+	assert.Equal(t, "a", changes[0].value["value"].(map[string]interface{})["owner"])
+	assert.Equal(t, float64(1), changes[1].value["writeIndex"])
+	assert.Equal(t, "car3", changes[2].value["key"])
+	assert.Equal(t, "delete", changes[2].value["operation"])
+	assert.Equal(t, float64(1), changes[2].value["blockNumber"])
+	assert.Nil(t, changes[2].value["value"])
+
+	for _, message := range (*messages)[3:5] {
+		assert.Equal(t, "mychannel.transactions", message.topic)
+		assert.Equal(t, "mychannel", message.key)
+	}
+	assert.Equal(t, "1", (*messages)[3].value["txId"])
+	for i, message := range (*messages)[5:] {
+		assert.Equal(t, "mychannel.blocks", message.topic)
+		assert.Equal(t, float64(i), message.value["number"])
+	}
+}
+
+func TestKafkaInvalidTransactions(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	storage := newKafkaStorage(producer, "mychannel")
+	messages := expectMessages(t, producer, 5)
+	require.NoError(t, storage.StoreBulk(cdcTestBlocks("mychannel")))
+	require.NoError(t, producer.Close())
+
+	// the write of the invalid transaction is not published
+	var keys []string
+	for _, message := range *messages {
+		keys = append(keys, message.value["key"].(string))
+	}
+	assert.Equal(t, []string{"car1", "car2", "car3", "car1", "car2"}, keys)
+}
+
+func TestKafkaStoreFailure(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	storage := newKafkaStorage(producer, "mychannel")
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndFail(sarama.ErrNotEnoughReplicas)
+	producer.ExpectSendMessageAndSucceed()
+	err := storage.StoreBulk(esTestBlocks("mychannel"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), sarama.ErrNotEnoughReplicas.Error())
+}
+
+func TestKafkaRecordEncoding(t *testing.T) {
+	record := &kafkaRecord{name: "Test", fields: []kafkaField{
+		{"name", kafkaString},
+		{"count", kafkaLong},
+		{"data", kafkaJSON},
+	}}
+	avro, err := encodeAvro(nil, record, []interface{}{"a", int64(3), map[string]int{"x": 1}})
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{0x02, 'a', 0x06, 0x02, 0x0e}, `{"x":1}`...), avro)
+	avro, err = encodeAvro(nil, record, []interface{}{"", int64(-1), nil})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0x01, 0x00}, avro)
+
+	protobuf, err := encodeProtobuf(nil, record, []interface{}{"a", int64(3), map[string]int{"x": 1}})
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{0x0a, 0x01, 'a', 0x10, 0x03, 0x1a, 0x07}, `{"x":1}`...), protobuf)
+	protobuf, err = encodeProtobuf(nil, record, []interface{}{"", int64(0), nil})
+	require.NoError(t, err)
+	assert.Empty(t, protobuf)
+
+	assert.Equal(t, "syntax = \"proto3\";\npackage io.hlfsync;\n\nmessage Test {\n  string name = 1;\n  int64 count = 2;\n  string data = 3;\n}\n", protobufSchema(record))
+	var schema map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(avroSchema(record)), &schema))
+	assert.Equal(t, "Test", schema["name"])
+	assert.Equal(t, []interface{}{"null", "string"}, schema["fields"].([]interface{})[2].(map[string]interface{})["type"])
+}
+
+func TestKafkaSchemaRegistry(t *testing.T) {
+	var mutex sync.Mutex
+	registered := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("registry:secret")), r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		var request map[string]string
+		require.NoError(t, json.Unmarshal(body, &request))
+		mutex.Lock()
+		defer mutex.Unlock()
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+		assert.NotContains(t, registered, subject)
+		registered[subject] = request["schemaType"]
+		fmt.Fprintf(w, `{"id":%d}`, len(registered)+40)
+	}))
+	defer server.Close()
+	registry := SchemaRegistryConfig{URL: server.URL, Username: "registry", Password: "secret"}
+
+	for _, format := range []KafkaFormat{KafkaAvro, KafkaProtobuf} {
+		producer := mocks.NewSyncProducer(t, nil)
+		topic := fmt.Sprintf("mychannel.%s", format)
+		storage := newKafkaStorage(producer, "mychannel").WithTopics(KafkaTopics{Changes: topic}).WithFormat(format, registry)
+		var values [][]byte
+		for i := 0; i < 3; i++ {
+			producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(value []byte) error {
+				values = append(values, value)
+				return nil
+			})
+		}
+		require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+		require.NoError(t, producer.Close())
+		require.Len(t, values, 3)
+		id := byte(41)
+		if format == KafkaProtobuf {
+			id = 42
+		}
+		for _, value := range values {
+			assert.Equal(t, []byte{0, 0, 0, 0, id}, value[:5])
+		}
+		if format == KafkaAvro {
+			// the channel name is the first field
+			assert.Equal(t, append([]byte{0x12}, "mychannel"...), values[0][5:15])
+		} else {
+			assert.Equal(t, append([]byte{0x00, 0x0a, 0x09}, "mychannel"...), values[0][5:17])
+		}
+	}
+	assert.Equal(t, map[string]string{"mychannel.avro-value": "AVRO", "mychannel.protobuf-value": "PROTOBUF"}, registered)
+}
+
+// TestKafkaBroker publishes to the brokers in HLF_SYNC_TEST_KAFKA_BROKERS, e.g. localhost:9092,
+// and reads the messages back
+func TestKafkaBroker(t *testing.T) {
+	brokers := os.Getenv("HLF_SYNC_TEST_KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("HLF_SYNC_TEST_KAFKA_BROKERS not set")
+	}
+	config := KafkaConfig{Brokers: strings.Split(brokers, ",")}
+	channelID := fmt.Sprintf("test%d", time.Now().UnixNano())
+	storage, err := NewKafkaStorage(config, channelID)
+	require.NoError(t, err)
+	defer storage.producer.Close()
+	require.NoError(t, storage.StoreBulk(esTestBlocks(channelID)))
+
+	consumer, err := sarama.NewConsumer(config.Brokers, sarama.NewConfig())
+	require.NoError(t, err)
+	defer consumer.Close()
+	partitions, err := consumer.Partitions(channelID + ".changes")
+	require.NoError(t, err)
+	var keys []string
+	for _, partition := range partitions {
+		partitionConsumer, err := consumer.ConsumePartition(channelID+".changes", partition, sarama.OffsetOldest)
+		require.NoError(t, err)
+		highWaterMark := partitionConsumer.HighWaterMarkOffset()
+		for highWaterMark > 0 {
+			message := <-partitionConsumer.Messages()
+			keys = append(keys, string(message.Key))
+			if message.Offset+1 >= highWaterMark {
+				break
+			}
+		}
+		partitionConsumer.Close()
+	}
+	assert.ElementsMatch(t, []string{channelID + "/fabcar/car1", channelID + "/fabcar/car2", channelID + "/fabcar/car3"}, keys)
+}
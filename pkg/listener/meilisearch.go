@@ -1,11 +1,9 @@
 package listener
 
 import (
-	"context"
-	"fmt"
 	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/chaincode"
 	"github.com/kfsoftware/hlf-sync/pkg/transformation"
-	"github.com/meilisearch/meilisearch-go"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"math"
@@ -13,61 +11,103 @@ import (
 )
 
 type MeilisearchStorage struct {
-	client    meilisearch.ClientInterface
-	indexName string
+	client    *meiliClient
+	channelID string
+	// indexName is the index holding the documents of every chaincode before they had an index each
+	indexName       string
+	blocksIndexName string
+	opts            []transformation.Option
+	indexes         *meiliIndexes
+	pipeline        *meiliPipeline
 }
 
-func NewMeilisearchStorage(client meilisearch.ClientInterface, channelID string) (MeilisearchStorage, error) {
-	indexName := fmt.Sprintf("%s", channelID)
+func NewMeilisearchStorage(config MeilisearchConfig, channelID string, opts ...transformation.Option) (MeilisearchStorage, error) {
+	client, err := newMeiliClient(config)
+	if err != nil {
+		return MeilisearchStorage{}, err
+	}
+	indexes, _ := newMeiliIndexes(MeilisearchMapping{})
 	storage := MeilisearchStorage{
-		client:    client,
-		indexName: indexName,
+		client:          client,
+		channelID:       channelID,
+		indexName:       channelID,
+		blocksIndexName: blocksIndexName(channelID),
+		opts:            opts,
+		indexes:         indexes,
+		pipeline:        newMeiliPipeline(client, DefaultMaxPendingTasks, DefaultTaskPollInterval),
 	}
-	_, err := storage.createIndex(indexName)
+	err = storage.createIndex(storage.blocksIndexName, "number", []string{"number:desc"})
 	if err != nil {
 		return storage, err
 	}
 	return storage, nil
 }
 
-func (m MeilisearchStorage) createIndex(indexName string) (*meilisearch.Index, error) {
-	index, err := m.client.Indexes().Get(indexName)
-	if err != nil {
-		meilieErr := errors.Cause(err).(*meilisearch.Error)
-		log.Print(meilieErr)
-		if meilieErr.StatusCode == 404 {
-			// not found
-		} else {
-			return nil, err
-		}
-	} else {
-		return index, nil
-	}
-	responseIndex, err := m.client.Indexes().Create(meilisearch.CreateIndexRequest{
-		UID:        indexName,
-		PrimaryKey: transformation.PrimaryKey,
-		Name:       indexName,
-	})
-	if err != nil {
-		return nil, err
+// createIndex creates an index with the ranking rules of the sortable attributes if it doesn't exist
+func (m MeilisearchStorage) createIndex(indexName string, primaryKey string, sortables []string) error {
+	exists, err := m.client.indexExists(indexName)
+	if err != nil || exists {
+		return err
 	}
-	err = m.waitForUpdate(responseIndex.UpdateID)
+	task, err := m.client.createIndex(indexName, primaryKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	asyncUpdate, err := m.client.Settings(index.Name).UpdateRankingRules([]string{"desc(_fabric_date)"})
+	err = m.waitTask(task)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = m.waitForUpdate(asyncUpdate.UpdateID)
-	if err != nil {
-		return nil, err
+	if len(sortables) > 0 {
+		task, err = m.client.updateSettings(indexName, map[string]interface{}{
+			"rankingRules": m.client.rankingRules(sortables),
+		})
+		if err != nil {
+			return err
+		}
+		err = m.waitTask(task)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Created index %s", indexName)
+	return nil
+}
+
+// CreateIndexes makes the fields of the index definitions filterable in the indexes of the chaincode
+func (m MeilisearchStorage) CreateIndexes(chaincodeID string, indexes []*chaincode.Index) error {
+	var fields []string
+	for _, index := range indexes {
+		for _, field := range index.Fields {
+			fields = union(fields, []string{field.Name})
+		}
+	}
+	if len(fields) == 0 {
+		return nil
 	}
-	index, err = m.client.Indexes().Get(responseIndex.UID)
+	m.indexes.Lock()
+	defer m.indexes.Unlock()
+	err := m.loadIndexes()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	uids := []string{meiliIndexUID(m.channelID, chaincodeID, "")}
+	for uid, index := range m.indexes.applied {
+		if index.chaincodeID == chaincodeID && index.objectType != "" {
+			uids = append(uids, uid)
+		}
 	}
-	return index, nil
+	for _, uid := range uids {
+		objectType := ""
+		if index, ok := m.indexes.applied[uid]; ok {
+			objectType = index.objectType
+		}
+		err = m.ensureIndex(uid, chaincodeID, objectType, fields)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Made %d fields of chaincode %s filterable in %d indexes", len(fields), chaincodeID, len(uids))
+	return nil
 }
 
 type IndexKey struct {
@@ -76,46 +116,72 @@ type IndexKey struct {
 }
 type IndexDoc = map[string]interface{}
 
-func (m MeilisearchStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
-	var documentsToAdd []IndexDoc
-	var documentsToRemove []string
+// storeDocs submits the writes of the documents without waiting for them, see Committed
+func (m MeilisearchStorage) storeDocs(response *transformation.DocumentExtractionResponse) (err error) {
+	documentsToAdd := map[string][]IndexDoc{}
+	documentsToRemove := map[string][]string{}
+	indexChaincodes := map[string]*meiliIndex{}
+	idsToAdd := map[string][]string{}
 	keyDocsAdded := []string{}
 	for _, document := range response.DocumentsToAdd {
 		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
 			continue
 		}
-		documentsToAdd = append(
-			documentsToAdd,
-			document.Data,
-		)
-		keyDocsAdded = append(keyDocsAdded, document.PrimaryKey)
+		objectType := m.indexes.objectType(document.ChaincodeID, document.Data)
+		uid := meiliIndexUID(document.ChannelID, document.ChaincodeID, objectType)
+		indexChaincodes[uid] = &meiliIndex{chaincodeID: document.ChaincodeID, objectType: objectType}
+		documentsToAdd[uid] = append(documentsToAdd[uid], document.Data)
+		idsToAdd[uid] = append(idsToAdd[uid], document.PrimaryKey)
+		keyDocsAdded = append(keyDocsAdded, document.Key)
+	}
+	err = m.ensureIndexes(indexChaincodes, documentsToAdd)
+	if err != nil {
+		return err
+	}
+	// the object type of a document may have changed, its copy in the index of the previous type is removed
+	for uid, ids := range idsToAdd {
+		for _, other := range m.indexes.chaincodeIndexes(m.channelID, indexChaincodes[uid].chaincodeID) {
+			if other != uid {
+				documentsToRemove[other] = append(documentsToRemove[other], ids...)
+			}
+		}
 	}
 	for _, document := range response.DocumentsToRemove {
 		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
 			continue
 		}
-		documentsToRemove = append(
-			documentsToRemove,
-			document.PrimaryKey,
-		)
+		// the object type of a deleted document is unknown
+		for _, uid := range m.indexes.chaincodeIndexes(document.ChannelID, document.ChaincodeID) {
+			documentsToRemove[uid] = append(documentsToRemove[uid], document.PrimaryKey)
+		}
 	}
 
-	if len(documentsToAdd) > 0 {
-		updateRes, err := m.client.Documents(m.indexName).AddOrUpdate(documentsToAdd)
-		if err != nil {
-			return err
-		}
-		err = m.waitForUpdate(updateRes.UpdateID)
+	batch := m.pipeline.begin(lastBlockNumber(response.Blocks))
+	defer func() {
+		m.pipeline.end(batch, err)
+	}()
+	for uid, documents := range documentsToAdd {
+		uid, documents := uid, documents
+		err = m.pipeline.submit(batch, func() (*meiliTask, error) {
+			return m.client.addDocuments(uid, documents)
+		})
 		if err != nil {
 			return err
 		}
 	}
-	if len(documentsToRemove) > 0 {
-		updateRes, err := m.client.Documents(m.indexName).Deletes(documentsToRemove)
+	for uid, ids := range documentsToRemove {
+		uid, ids := uid, ids
+		err = m.pipeline.submit(batch, func() (*meiliTask, error) {
+			return m.client.deleteDocuments(uid, ids)
+		})
 		if err != nil {
 			return err
 		}
-		err = m.waitForUpdate(updateRes.UpdateID)
+	}
+	if len(response.Blocks) > 0 {
+		err = m.pipeline.submit(batch, func() (*meiliTask, error) {
+			return m.client.addDocuments(m.blocksIndexName, response.Blocks)
+		})
 		if err != nil {
 			return err
 		}
@@ -126,24 +192,108 @@ func (m MeilisearchStorage) storeDocs(response *transformation.DocumentExtractio
 	return nil
 }
 
-func (m MeilisearchStorage) waitForUpdate(updateID int64) error {
-	ctx := context.Background()
-	log.Debugf("Update ID: %d", updateID)
-	updateStatus, err := m.client.WaitForPendingUpdate(
-		ctx,
-		200*time.Millisecond,
-		m.indexName,
-		&meilisearch.AsyncUpdateID{UpdateID: int64(updateID)},
-	)
+// ensureIndexes creates the indexes the documents are added to, with the fields of the documents
+// filterable when the settings are inferred
+func (m MeilisearchStorage) ensureIndexes(indexes map[string]*meiliIndex, documents map[string][]IndexDoc) error {
+	m.indexes.Lock()
+	defer m.indexes.Unlock()
+	err := m.loadIndexes()
+	if err != nil {
+		return err
+	}
+	for uid, index := range indexes {
+		var fields []string
+		if m.indexes.infer {
+			fields = scalarFields(documents[uid])
+		}
+		err = m.ensureIndex(uid, index.chaincodeID, index.objectType, fields)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastBlockNumber returns the number of the last block, -1 if there are none
+func lastBlockNumber(blocks []*transformation.BlockInfo) int {
+	number := -1
+	for _, block := range blocks {
+		if block.Number > number {
+			number = block.Number
+		}
+	}
+	return number
+}
+
+// waitTask waits for a task of the setup of the indexes, which are applied before the documents
+func (m MeilisearchStorage) waitTask(task *meiliTask) error {
+	return m.client.waitTask(task, m.pipeline.pollInterval)
+}
+
+// Migrate moves the documents of the channel index to the index of their chaincode and deletes the
+// channel index. The documents indexed with the ledger key as ID don't record their chaincode so they
+// are dropped, the sync needs to be restarted from the first block to index them again.
+func (m MeilisearchStorage) Migrate() error {
+	exists, err := m.client.indexExists(m.indexName)
+	if err != nil || !exists {
+		return err
+	}
+	legacy := 0
+	moved := 0
+	for offset := 0; ; offset += 1000 {
+		documents, err := m.client.documents(m.indexName, offset, 1000)
+		if err != nil {
+			return err
+		}
+		if len(documents) == 0 {
+			break
+		}
+		documentsToAdd := map[string][]IndexDoc{}
+		indexChaincodes := map[string]*meiliIndex{}
+		for _, document := range documents {
+			chaincodeID, ok := document[transformation.NamespaceKey].(string)
+			if _, hasKey := document[transformation.KeyKey]; !hasKey || !ok {
+				legacy++
+				continue
+			}
+			objectType := m.indexes.objectType(chaincodeID, document)
+			uid := meiliIndexUID(m.channelID, chaincodeID, objectType)
+			indexChaincodes[uid] = &meiliIndex{chaincodeID: chaincodeID, objectType: objectType}
+			documentsToAdd[uid] = append(documentsToAdd[uid], document)
+		}
+		err = m.ensureIndexes(indexChaincodes, documentsToAdd)
+		if err != nil {
+			return err
+		}
+		for uid, documents := range documentsToAdd {
+			task, err := m.client.addDocuments(uid, documents)
+			if err != nil {
+				return err
+			}
+			err = m.waitTask(task)
+			if err != nil {
+				return err
+			}
+			moved += len(documents)
+		}
+	}
+	task, err := m.client.deleteIndex(m.indexName)
+	if err != nil {
+		return err
+	}
+	err = m.waitTask(task)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Update %d=%s", updateID, updateStatus)
+	log.Infof("Moved %d documents from index %s to the chaincode indexes", moved, m.indexName)
+	if legacy > 0 {
+		log.Warnf("Dropped %d legacy documents from index %s, restart the sync with --block-number 0 to index them again", legacy, m.indexName)
+	}
 	return nil
 }
 
 func (m MeilisearchStorage) StoreBulk(blocks []*cb.Block) error {
-	response, err := transformation.BlocksToDocuments(blocks)
+	response, err := transformation.BlocksToDocuments(blocks, m.opts...)
 	if err != nil {
 		return err
 	}
@@ -153,8 +303,14 @@ func (m MeilisearchStorage) StoreBulk(blocks []*cb.Block) error {
 	}
 	return nil
 }
+
+// StoreDocuments stores blocks already decoded
+func (m MeilisearchStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return m.storeDocs(response)
+}
+
 func (m MeilisearchStorage) Store(block *cb.Block) error {
-	response, err := transformation.BlockToDocuments(block)
+	response, err := transformation.BlockToDocuments(block, m.opts...)
 	if err != nil {
 		return err
 	}
@@ -164,3 +320,50 @@ func (m MeilisearchStorage) Store(block *cb.Block) error {
 	}
 	return nil
 }
+
+// MeilisearchTaskLimits configures the pipelining of the tasks, the fields not set take the defaults
+type MeilisearchTaskLimits struct {
+	MaxPending   int
+	PollInterval time.Duration
+}
+
+// MeilisearchStorageConfig is the configuration of the meilisearch database type
+type MeilisearchStorageConfig struct {
+	MeilisearchConfig `mapstructure:",squash"`
+	Tasks             MeilisearchTaskLimits
+	// Indexes are the settings of the chaincode indexes, applied to the existing ones even when not set
+	Indexes MeilisearchMapping
+}
+
+func (c *MeilisearchStorageConfig) Validate() error {
+	if c.Host == "" {
+		return errors.New("url is required")
+	}
+	if c.Tasks.MaxPending == 0 {
+		c.Tasks.MaxPending = DefaultMaxPendingTasks
+	}
+	if c.Tasks.PollInterval == 0 {
+		c.Tasks.PollInterval = DefaultTaskPollInterval
+	}
+	return nil
+}
+
+type meilisearchFactory struct{}
+
+func (meilisearchFactory) NewConfig() StorageConfig {
+	return &MeilisearchStorageConfig{}
+}
+
+func (meilisearchFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	c := config.(*MeilisearchStorageConfig)
+	storage, err := NewMeilisearchStorage(c.MeilisearchConfig, channelID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	storage = storage.WithTaskLimits(c.Tasks.MaxPending, c.Tasks.PollInterval)
+	return storage.WithIndexSettings(c.Indexes)
+}
+
+func init() {
+	Register("meilisearch", meilisearchFactory{})
+}
@@ -0,0 +1,376 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MeilisearchConfig configures the connection to Meilisearch
+type MeilisearchConfig struct {
+	Host   string `mapstructure:"url"`
+	APIKey string
+}
+
+// meiliClient talks to both the update API of Meilisearch, before 0.25, and the task API that replaced it.
+// Writes are asynchronous in both: they return an update of the index or a task of the instance
+type meiliClient struct {
+	host       string
+	apiKey     string
+	httpClient *http.Client
+	// tasks is set from 0.25, where the attributes for faceting are filterable attributes, the
+	// ranking rules sort with field:order and the updates of the indexes are tasks
+	tasks bool
+	// patchSettings is set from 0.28, where the settings are updated with PATCH
+	patchSettings bool
+}
+
+// meiliTask is an update of an index, or a task of the instance in the task API
+type meiliTask struct {
+	indexUID string
+	id       int64
+	// ignoreNotFound makes a task failing because its index doesn't exist succeed, the task API
+	// only reports it when processing the task
+	ignoreNotFound bool
+}
+
+// MeilisearchError is an error returned by Meilisearch, for a request or a failed task
+type MeilisearchError struct {
+	StatusCode int
+	IndexUID   string
+	TaskID     int64
+	Message    string
+	Code       string
+	Type       string
+	Link       string
+}
+
+func (e *MeilisearchError) Error() string {
+	prefix := fmt.Sprintf("[%d]", e.StatusCode)
+	if e.StatusCode == 0 {
+		prefix = fmt.Sprintf("task %d of index %s failed:", e.TaskID, e.IndexUID)
+	}
+	return fmt.Sprintf("%s %s: %s", prefix, e.Code, e.Message)
+}
+
+// meiliErrorPayload holds the error fields of both APIs, they were renamed in 0.25
+type meiliErrorPayload struct {
+	Message   string `json:"message"`
+	Code      string `json:"code"`
+	Type      string `json:"type"`
+	Link      string `json:"link"`
+	ErrorCode string `json:"errorCode"`
+	ErrorType string `json:"errorType"`
+	ErrorLink string `json:"errorLink"`
+}
+
+func (p meiliErrorPayload) toError(statusCode int) *MeilisearchError {
+	meiliErr := &MeilisearchError{
+		StatusCode: statusCode,
+		Message:    p.Message,
+		Code:       p.Code,
+		Type:       p.Type,
+		Link:       p.Link,
+	}
+	if meiliErr.Code == "" {
+		meiliErr.Code = p.ErrorCode
+		meiliErr.Type = p.ErrorType
+		meiliErr.Link = p.ErrorLink
+	}
+	return meiliErr
+}
+
+// meiliSettings are the settings of an index read back from Meilisearch
+type meiliSettings struct {
+	RankingRules          []string `json:"rankingRules"`
+	SearchableAttributes  []string `json:"searchableAttributes"`
+	DistinctAttribute     *string  `json:"distinctAttribute"`
+	AttributesForFaceting []string `json:"attributesForFaceting"`
+	FilterableAttributes  []string `json:"filterableAttributes"`
+	SortableAttributes    []string `json:"sortableAttributes"`
+}
+
+// filterable returns the filterable attributes, which are the attributes for faceting before 0.25
+func (s meiliSettings) filterable() []string {
+	if s.FilterableAttributes != nil {
+		return s.FilterableAttributes
+	}
+	return s.AttributesForFaceting
+}
+
+// newMeiliClient connects to Meilisearch and detects its API from the version
+func newMeiliClient(config MeilisearchConfig) (*meiliClient, error) {
+	client := &meiliClient{
+		host:       strings.TrimSuffix(config.Host, "/"),
+		apiKey:     config.APIKey,
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+	var version struct {
+		PkgVersion string `json:"pkgVersion"`
+	}
+	err := client.do(http.MethodGet, "/version", nil, &version)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the Meilisearch version")
+	}
+	major, minor, err := parseVersion(version.PkgVersion)
+	if err != nil {
+		return nil, err
+	}
+	client.tasks = major > 0 || minor >= 25
+	client.patchSettings = major > 0 || minor >= 28
+	return client, nil
+}
+
+func (c *meiliClient) do(method string, path string, body interface{}, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(bodyBytes)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.host+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		// the update API reads the key from X-Meili-API-Key and the task API from Authorization
+		req.Header.Set("X-Meili-API-Key", c.apiKey)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%s %s failed", method, path)
+	}
+	defer res.Body.Close()
+	resBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		var payload meiliErrorPayload
+		if json.Unmarshal(resBytes, &payload) != nil || payload.Message == "" {
+			payload.Message = strings.TrimSpace(string(resBytes))
+		}
+		return payload.toError(res.StatusCode)
+	}
+	if out == nil || len(resBytes) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resBytes, out)
+}
+
+// submit sends an asynchronous write, the task is nil when the write was applied right away
+func (c *meiliClient) submit(method string, indexUID string, path string, body interface{}) (*meiliTask, error) {
+	var res struct {
+		UpdateID *int64 `json:"updateId"`
+		TaskUID  *int64 `json:"taskUid"`
+		// uid is the task before 0.28, and the index created by the update API
+		UID json.RawMessage `json:"uid"`
+	}
+	err := c.do(method, path, body, &res)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.UpdateID != nil:
+		return &meiliTask{indexUID: indexUID, id: *res.UpdateID}, nil
+	case res.TaskUID != nil:
+		return &meiliTask{indexUID: indexUID, id: *res.TaskUID}, nil
+	case len(res.UID) > 0 && c.tasks:
+		var id int64
+		err = json.Unmarshal(res.UID, &id)
+		if err != nil {
+			return nil, err
+		}
+		return &meiliTask{indexUID: indexUID, id: id}, nil
+	}
+	return nil, nil
+}
+
+// taskDone tells if a task has been processed, the error is the one of the task when it failed
+func (c *meiliClient) taskDone(task *meiliTask) (bool, error) {
+	var res struct {
+		Status string          `json:"status"`
+		Error  json.RawMessage `json:"error"`
+		meiliErrorPayload
+	}
+	path := fmt.Sprintf("/tasks/%d", task.id)
+	if !c.tasks {
+		path = fmt.Sprintf("/indexes/%s/updates/%d", url.PathEscape(task.indexUID), task.id)
+	}
+	err := c.do(http.MethodGet, path, nil, &res)
+	if err != nil {
+		return false, err
+	}
+	switch res.Status {
+	case "enqueued", "processing":
+		return false, nil
+	case "processed", "succeeded":
+		return true, nil
+	}
+	// the update API has the error fields at the top level with error as the message
+	payload := res.meiliErrorPayload
+	if len(res.Error) > 0 && res.Error[0] == '{' {
+		_ = json.Unmarshal(res.Error, &payload)
+	} else if len(res.Error) > 0 {
+		_ = json.Unmarshal(res.Error, &payload.Message)
+	}
+	meiliErr := payload.toError(0)
+	meiliErr.IndexUID = task.indexUID
+	meiliErr.TaskID = task.id
+	if meiliErr.Message == "" {
+		meiliErr.Message = fmt.Sprintf("task %s", res.Status)
+	}
+	if task.ignoreNotFound && meiliErr.Code == "index_not_found" {
+		return true, nil
+	}
+	return true, meiliErr
+}
+
+// waitTask polls a task until it's processed
+func (c *meiliClient) waitTask(task *meiliTask, interval time.Duration) error {
+	for task != nil {
+		done, err := c.taskDone(task)
+		if done || err != nil {
+			return err
+		}
+		time.Sleep(interval)
+	}
+	return nil
+}
+
+// indexExists tells if an index exists
+func (c *meiliClient) indexExists(indexUID string) (bool, error) {
+	err := c.do(http.MethodGet, fmt.Sprintf("/indexes/%s", url.PathEscape(indexUID)), nil, nil)
+	if isMeiliNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// listIndexes returns the uids of the indexes, the task API returns them in pages from 0.28
+func (c *meiliClient) listIndexes() ([]string, error) {
+	type index struct {
+		UID string `json:"uid"`
+	}
+	var uids []string
+	for offset := 0; ; offset += 100 {
+		var raw json.RawMessage
+		err := c.do(http.MethodGet, fmt.Sprintf("/indexes?offset=%d&limit=100", offset), nil, &raw)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Results []index `json:"results"`
+		}
+		paginated := len(raw) > 0 && raw[0] == '{'
+		if paginated {
+			err = json.Unmarshal(raw, &page)
+		} else {
+			err = json.Unmarshal(raw, &page.Results)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range page.Results {
+			uids = append(uids, index.UID)
+		}
+		if !paginated || len(page.Results) < 100 {
+			return uids, nil
+		}
+	}
+}
+
+func (c *meiliClient) createIndex(indexUID string, primaryKey string) (*meiliTask, error) {
+	return c.submit(http.MethodPost, indexUID, "/indexes", map[string]string{
+		"uid":        indexUID,
+		"primaryKey": primaryKey,
+	})
+}
+
+func (c *meiliClient) deleteIndex(indexUID string) (*meiliTask, error) {
+	return c.submit(http.MethodDelete, indexUID, fmt.Sprintf("/indexes/%s", url.PathEscape(indexUID)), nil)
+}
+
+func (c *meiliClient) settings(indexUID string) (meiliSettings, error) {
+	var settings meiliSettings
+	err := c.do(http.MethodGet, fmt.Sprintf("/indexes/%s/settings", url.PathEscape(indexUID)), nil, &settings)
+	return settings, err
+}
+
+// updateSettings updates the settings given, a nil value resets a setting
+func (c *meiliClient) updateSettings(indexUID string, settings map[string]interface{}) (*meiliTask, error) {
+	method := http.MethodPost
+	if c.patchSettings {
+		method = http.MethodPatch
+	}
+	return c.submit(method, indexUID, fmt.Sprintf("/indexes/%s/settings", url.PathEscape(indexUID)), settings)
+}
+
+// rankingRules returns the ranking rules sorting by the sortable attributes before the default ones
+func (c *meiliClient) rankingRules(sortables []string) []string {
+	var rankingRules []string
+	for _, sortable := range sortables {
+		field, order, _ := parseSortable(sortable)
+		if c.tasks {
+			rankingRules = append(rankingRules, fmt.Sprintf("%s:%s", field, order))
+		} else {
+			rankingRules = append(rankingRules, fmt.Sprintf("%s(%s)", order, field))
+		}
+	}
+	if c.tasks {
+		return append(rankingRules, "words", "typo", "proximity", "attribute", "sort", "exactness")
+	}
+	return append(rankingRules, "typo", "words", "proximity", "attribute", "wordsPosition", "exactness")
+}
+
+// addDocuments adds the documents or updates their fields
+func (c *meiliClient) addDocuments(indexUID string, documents interface{}) (*meiliTask, error) {
+	return c.submit(http.MethodPut, indexUID, fmt.Sprintf("/indexes/%s/documents", url.PathEscape(indexUID)), documents)
+}
+
+// deleteDocuments deletes the documents by ID, the index not existing isn't an error
+func (c *meiliClient) deleteDocuments(indexUID string, ids []string) (*meiliTask, error) {
+	task, err := c.submit(http.MethodPost, indexUID, fmt.Sprintf("/indexes/%s/documents/delete-batch", url.PathEscape(indexUID)), ids)
+	if isMeiliNotFound(err) {
+		return nil, nil
+	}
+	if task != nil {
+		task.ignoreNotFound = true
+	}
+	return task, err
+}
+
+// documents returns a page of the documents of an index, they are paginated in an object from 1.0
+func (c *meiliClient) documents(indexUID string, offset int, limit int) ([]IndexDoc, error) {
+	var raw json.RawMessage
+	err := c.do(http.MethodGet, fmt.Sprintf("/indexes/%s/documents?offset=%d&limit=%d", url.PathEscape(indexUID), offset, limit), nil, &raw)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		Results []IndexDoc `json:"results"`
+	}
+	if len(raw) > 0 && raw[0] == '{' {
+		err = json.Unmarshal(raw, &page)
+	} else {
+		err = json.Unmarshal(raw, &page.Results)
+	}
+	return page.Results, err
+}
+
+func isMeiliNotFound(err error) bool {
+	meiliErr, ok := errors.Cause(err).(*MeilisearchError)
+	return ok && meiliErr.StatusCode == http.StatusNotFound
+}
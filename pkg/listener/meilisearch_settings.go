@@ -0,0 +1,342 @@
+package listener
+
+import (
+	"fmt"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MeilisearchIndexSettings are the settings of the indexes of a chaincode. Sortable attributes are
+// given as field or field:desc
+type MeilisearchIndexSettings struct {
+	FilterableAttributes []string
+	SortableAttributes   []string
+	SearchableAttributes []string
+	DistinctAttribute    string
+}
+
+// MeilisearchObjectSettings are the settings of the index of an object type
+type MeilisearchObjectSettings struct {
+	ObjectType               string
+	MeilisearchIndexSettings `mapstructure:",squash"`
+}
+
+// MeilisearchChaincodeSettings are the settings of the indexes of a chaincode
+type MeilisearchChaincodeSettings struct {
+	Name                     string
+	MeilisearchIndexSettings `mapstructure:",squash"`
+	// ObjectTypeField splits the documents of the chaincode in an index per value of the field,
+	// the documents without it stay in the chaincode index
+	ObjectTypeField string
+	Objects         []MeilisearchObjectSettings
+}
+
+// MeilisearchMapping configures the indexes of the chaincodes. Infer adds the scalar fields of the
+// documents to the filterable attributes of their index
+type MeilisearchMapping struct {
+	Infer      bool
+	Chaincodes []MeilisearchChaincodeSettings
+}
+
+// defaultMeiliSettings apply to every chaincode index
+var defaultMeiliSettings = MeilisearchIndexSettings{
+	FilterableAttributes: []string{transformation.TxIDKey, transformation.KeyKey, transformation.CollectionKey},
+	SortableAttributes:   []string{fmt.Sprintf("%s:desc", transformation.DateKey)},
+}
+
+var invalidIndexChars = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+// meiliIndexUID is the index of the documents of a chaincode, or of an object type of a chaincode.
+// Chaincode names can't have two separators in a row so the object type can't collide with a chaincode
+func meiliIndexUID(channelID string, chaincodeID string, objectType string) string {
+	uid := fmt.Sprintf("%s_%s", channelID, chaincodeID)
+	if objectType != "" {
+		uid = fmt.Sprintf("%s__%s", uid, invalidIndexChars.ReplaceAllString(objectType, "-"))
+	}
+	return uid
+}
+
+// meiliIndexes holds the settings of the chaincodes and the indexes known to exist with their settings
+type meiliIndexes struct {
+	sync.Mutex
+	infer      bool
+	chaincodes map[string]MeilisearchChaincodeSettings
+	loaded     bool
+	applied    map[string]*meiliIndex
+}
+
+type meiliIndex struct {
+	chaincodeID string
+	objectType  string
+	settings    MeilisearchIndexSettings
+}
+
+func newMeiliIndexes(mapping MeilisearchMapping) (*meiliIndexes, error) {
+	indexes := &meiliIndexes{
+		infer:      mapping.Infer,
+		chaincodes: map[string]MeilisearchChaincodeSettings{},
+		applied:    map[string]*meiliIndex{},
+	}
+	for _, chaincodeSettings := range mapping.Chaincodes {
+		if chaincodeSettings.Name == "" {
+			return nil, errors.New("chaincode without name in the index settings")
+		}
+		all := []MeilisearchIndexSettings{chaincodeSettings.MeilisearchIndexSettings}
+		for _, object := range chaincodeSettings.Objects {
+			if chaincodeSettings.ObjectTypeField == "" {
+				return nil, errors.Errorf("chaincode %s has object settings but no objectTypeField", chaincodeSettings.Name)
+			}
+			all = append(all, object.MeilisearchIndexSettings)
+		}
+		for _, settings := range all {
+			for _, sortable := range settings.SortableAttributes {
+				_, _, err := parseSortable(sortable)
+				if err != nil {
+					return nil, errors.Wrapf(err, "chaincode %s", chaincodeSettings.Name)
+				}
+			}
+		}
+		indexes.chaincodes[chaincodeSettings.Name] = chaincodeSettings
+	}
+	return indexes, nil
+}
+
+// parseSortable parses field or field:asc|desc
+func parseSortable(sortable string) (string, string, error) {
+	parts := strings.SplitN(sortable, ":", 2)
+	if parts[0] == "" {
+		return "", "", errors.Errorf("invalid sortable attribute %s", sortable)
+	}
+	if len(parts) == 1 {
+		return parts[0], "asc", nil
+	}
+	if parts[1] != "asc" && parts[1] != "desc" {
+		return "", "", errors.Errorf("invalid sortable attribute %s, the order is either asc or desc", sortable)
+	}
+	return parts[0], parts[1], nil
+}
+
+// settingsFor returns the settings of an index: the defaults, the chaincode ones and the object type ones
+func (i *meiliIndexes) settingsFor(chaincodeID string, objectType string) MeilisearchIndexSettings {
+	settings := MeilisearchIndexSettings{
+		FilterableAttributes: append([]string{}, defaultMeiliSettings.FilterableAttributes...),
+		SortableAttributes:   append([]string{}, defaultMeiliSettings.SortableAttributes...),
+	}
+	chaincodeSettings, ok := i.chaincodes[chaincodeID]
+	if !ok {
+		return settings
+	}
+	overrides := []MeilisearchIndexSettings{chaincodeSettings.MeilisearchIndexSettings}
+	for _, object := range chaincodeSettings.Objects {
+		if objectType != "" && invalidIndexChars.ReplaceAllString(object.ObjectType, "-") == objectType {
+			overrides = append(overrides, object.MeilisearchIndexSettings)
+		}
+	}
+	for _, override := range overrides {
+		settings.FilterableAttributes = union(settings.FilterableAttributes, override.FilterableAttributes)
+		if len(override.SortableAttributes) > 0 {
+			settings.SortableAttributes = override.SortableAttributes
+		}
+		if len(override.SearchableAttributes) > 0 {
+			settings.SearchableAttributes = override.SearchableAttributes
+		}
+		if override.DistinctAttribute != "" {
+			settings.DistinctAttribute = override.DistinctAttribute
+		}
+	}
+	return settings
+}
+
+// objectType returns the object type of the data of a chaincode, empty if the chaincode isn't split
+func (i *meiliIndexes) objectType(chaincodeID string, data map[string]interface{}) string {
+	field := i.chaincodes[chaincodeID].ObjectTypeField
+	if field == "" {
+		return ""
+	}
+	if value, ok := data[field].(string); ok {
+		return invalidIndexChars.ReplaceAllString(value, "-")
+	}
+	return ""
+}
+
+// chaincodeIndexes returns the known indexes of a chaincode
+func (i *meiliIndexes) chaincodeIndexes(channelID string, chaincodeID string) []string {
+	i.Lock()
+	defer i.Unlock()
+	uids := []string{meiliIndexUID(channelID, chaincodeID, "")}
+	for uid, index := range i.applied {
+		if index.chaincodeID == chaincodeID && index.objectType != "" {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Strings(uids[1:])
+	return uids
+}
+
+func union(values []string, others []string) []string {
+	for _, value := range others {
+		if !contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// WithIndexSettings sets the settings of the chaincode indexes and applies them to the existing indexes
+func (m MeilisearchStorage) WithIndexSettings(mapping MeilisearchMapping) (MeilisearchStorage, error) {
+	indexes, err := newMeiliIndexes(mapping)
+	if err != nil {
+		return m, err
+	}
+	m.indexes = indexes
+	m.indexes.Lock()
+	defer m.indexes.Unlock()
+	err = m.loadIndexes()
+	if err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// loadIndexes applies the settings to the existing indexes of the channel, must be called holding the lock
+func (m MeilisearchStorage) loadIndexes() error {
+	if m.indexes.loaded {
+		return nil
+	}
+	uids, err := m.client.listIndexes()
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("%s_", m.channelID)
+	for _, uid := range uids {
+		if !strings.HasPrefix(uid, prefix) || uid == m.blocksIndexName {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(uid, prefix), "__", 2)
+		objectType := ""
+		if len(parts) == 2 {
+			objectType = parts[1]
+		}
+		err = m.ensureIndex(uid, parts[0], objectType, nil)
+		if err != nil {
+			return err
+		}
+	}
+	m.indexes.loaded = true
+	return nil
+}
+
+// ensureIndex creates the index if needed and updates its settings when they differ from the
+// expected ones or new fields are filterable, must be called holding the lock
+func (m MeilisearchStorage) ensureIndex(uid string, chaincodeID string, objectType string, fields []string) error {
+	applied, ok := m.indexes.applied[uid]
+	if ok && containsAll(applied.settings.FilterableAttributes, fields) {
+		return nil
+	}
+	settings := m.indexes.settingsFor(chaincodeID, objectType)
+	if ok {
+		settings.FilterableAttributes = union(settings.FilterableAttributes, applied.settings.FilterableAttributes)
+	} else {
+		err := m.createIndex(uid, transformation.PrimaryKey, nil)
+		if err != nil {
+			return err
+		}
+	}
+	settings.FilterableAttributes = union(settings.FilterableAttributes, fields)
+	err := m.applySettings(uid, settings)
+	if err != nil {
+		return err
+	}
+	m.indexes.applied[uid] = &meiliIndex{chaincodeID: chaincodeID, objectType: objectType, settings: settings}
+	return nil
+}
+
+// applySettings updates the settings of an index that differ. Filterable attributes are only added since
+// they may have been added by CreateIndexes or inferred from the documents
+func (m MeilisearchStorage) applySettings(uid string, settings MeilisearchIndexSettings) error {
+	current, err := m.client.settings(uid)
+	if err != nil {
+		return err
+	}
+	update := map[string]interface{}{}
+	filterable := union(append([]string{}, current.filterable()...), settings.FilterableAttributes)
+	if len(filterable) != len(current.filterable()) {
+		if m.client.tasks {
+			update["filterableAttributes"] = filterable
+		} else {
+			update["attributesForFaceting"] = filterable
+		}
+	}
+	rankingRules := m.client.rankingRules(settings.SortableAttributes)
+	if strings.Join(current.RankingRules, ",") != strings.Join(rankingRules, ",") {
+		update["rankingRules"] = rankingRules
+	}
+	if m.client.tasks {
+		// the update API sorts with the ranking rules only
+		var sortable []string
+		for _, attribute := range settings.SortableAttributes {
+			field, _, _ := parseSortable(attribute)
+			sortable = union(sortable, []string{field})
+		}
+		sort.Strings(sortable)
+		currentSortable := append([]string{}, current.SortableAttributes...)
+		sort.Strings(currentSortable)
+		if strings.Join(currentSortable, ",") != strings.Join(sortable, ",") {
+			update["sortableAttributes"] = sortable
+		}
+	}
+	searchable := settings.SearchableAttributes
+	if len(searchable) == 0 {
+		searchable = []string{"*"}
+	}
+	if strings.Join(current.SearchableAttributes, ",") != strings.Join(searchable, ",") {
+		update["searchableAttributes"] = searchable
+	}
+	currentDistinct := ""
+	if current.DistinctAttribute != nil {
+		currentDistinct = *current.DistinctAttribute
+	}
+	if settings.DistinctAttribute != currentDistinct {
+		if settings.DistinctAttribute == "" {
+			// null resets the setting
+			update["distinctAttribute"] = nil
+		} else {
+			update["distinctAttribute"] = settings.DistinctAttribute
+		}
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	task, err := m.client.updateSettings(uid, update)
+	if err != nil {
+		return err
+	}
+	err = m.waitTask(task)
+	if err != nil {
+		return err
+	}
+	log.Infof("Updated the settings of index %s", uid)
+	return nil
+}
+
+// scalarFields returns the top level fields of the documents holding a string, a number or a boolean
+func scalarFields(documents []IndexDoc) []string {
+	var fields []string
+	for _, document := range documents {
+		for field, value := range document {
+			switch value.(type) {
+			case string, float64, int, int64, bool:
+				if !contains(fields, field) {
+					fields = append(fields, field)
+				}
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
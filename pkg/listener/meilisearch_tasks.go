@@ -0,0 +1,165 @@
+package listener
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxPendingTasks  = 32
+	DefaultTaskPollInterval = 50 * time.Millisecond
+)
+
+// meiliPipeline tracks the tasks submitted for the batches of blocks without waiting for them,
+// a batch is committed once every task up to it has succeeded
+type meiliPipeline struct {
+	sync.Mutex
+	client       *meiliClient
+	maxPending   int
+	pollInterval time.Duration
+	batches      []*meiliBatch
+	pending      int
+	committed    int
+	hasCommitted bool
+	// err is the first failure, nothing is committed after it until Committed reports it
+	err error
+}
+
+type meiliBatch struct {
+	// blockNumber is the last block of the batch, negative when it has no blocks
+	blockNumber int
+	tasks       []*meiliTask
+	submitted   bool
+}
+
+func newMeiliPipeline(client *meiliClient, maxPending int, pollInterval time.Duration) *meiliPipeline {
+	if maxPending <= 0 {
+		maxPending = 1
+	}
+	return &meiliPipeline{client: client, maxPending: maxPending, pollInterval: pollInterval}
+}
+
+// begin starts the batch of the blocks up to blockNumber
+func (p *meiliPipeline) begin(blockNumber int) *meiliBatch {
+	p.Lock()
+	defer p.Unlock()
+	batch := &meiliBatch{blockNumber: blockNumber}
+	p.batches = append(p.batches, batch)
+	return batch
+}
+
+// submit sends a write of the batch once there's room for another outstanding task
+func (p *meiliPipeline) submit(batch *meiliBatch, write func() (*meiliTask, error)) error {
+	p.Lock()
+	defer p.Unlock()
+	for p.err == nil && p.pending >= p.maxPending {
+		err := p.poll()
+		if err != nil {
+			return err
+		}
+		if p.err == nil && p.pending >= p.maxPending {
+			time.Sleep(p.pollInterval)
+		}
+	}
+	if p.err != nil {
+		return p.err
+	}
+	task, err := write()
+	if err != nil {
+		return err
+	}
+	if task != nil {
+		batch.tasks = append(batch.tasks, task)
+		p.pending++
+	}
+	return nil
+}
+
+// end marks every write of the batch as submitted, a batch that failed to submit is never committed
+func (p *meiliPipeline) end(batch *meiliBatch, err error) {
+	p.Lock()
+	defer p.Unlock()
+	if err != nil && p.err == nil {
+		p.err = errors.Wrapf(err, "failed to submit the writes of block %d", batch.blockNumber)
+	}
+	batch.submitted = true
+}
+
+// poll checks the outstanding tasks in order, up to the first one not processed yet. A failed task
+// fails the pipeline, the error returned is the one of a request that can be retried. Must be
+// called holding the lock
+func (p *meiliPipeline) poll() error {
+	for p.err == nil && len(p.batches) > 0 {
+		batch := p.batches[0]
+		for len(batch.tasks) > 0 {
+			done, err := p.client.taskDone(batch.tasks[0])
+			if err != nil && done {
+				p.err = errors.Wrapf(err, "failed to store block %d", batch.blockNumber)
+				return nil
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to check the writes of block %d", batch.blockNumber)
+			}
+			if !done {
+				return nil
+			}
+			batch.tasks = batch.tasks[1:]
+			p.pending--
+		}
+		if !batch.submitted {
+			return nil
+		}
+		if batch.blockNumber >= 0 {
+			p.committed = batch.blockNumber
+			p.hasCommitted = true
+		}
+		p.batches = p.batches[1:]
+	}
+	return nil
+}
+
+// Committed returns the last block whose writes have all been applied by Meilisearch. After a write
+// failed, it returns a RewindError once and drops the writes submitted after the last block committed
+func (m MeilisearchStorage) Committed() (int, bool, error) {
+	p := m.pipeline
+	p.Lock()
+	defer p.Unlock()
+	err := p.poll()
+	if err != nil {
+		log.Warnf("Failed to check the Meilisearch tasks, retrying on the next checkpoint: %v", err)
+	}
+	if p.err != nil {
+		err = &RewindError{Err: p.err}
+		p.batches = nil
+		p.pending = 0
+		p.err = nil
+		return p.committed, p.hasCommitted, err
+	}
+	return p.committed, p.hasCommitted, nil
+}
+
+// Flush waits for the writes submitted to be applied
+func (m MeilisearchStorage) Flush() error {
+	p := m.pipeline
+	p.Lock()
+	defer p.Unlock()
+	for {
+		err := p.poll()
+		if err != nil {
+			return err
+		}
+		if p.err != nil || len(p.batches) == 0 {
+			return p.err
+		}
+		time.Sleep(p.pollInterval)
+	}
+}
+
+// WithTaskLimits sets how many tasks can be outstanding before Store waits for the oldest one,
+// and how often the tasks are polled
+func (m MeilisearchStorage) WithTaskLimits(maxPending int, pollInterval time.Duration) MeilisearchStorage {
+	m.pipeline = newMeiliPipeline(m.client, maxPending, pollInterval)
+	return m
+}
@@ -1,24 +1,334 @@
 package listener
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/gogo/protobuf/proto"
 	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
 	pb "github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/kfsoftware/hlf-sync/pkg/mocks"
-	"github.com/meilisearch/meilisearch-go"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestFoo(t *testing.T) {
-	var meiliClient = meilisearch.NewClient(meilisearch.Config{
-		Host:   "http://127.0.0.1:7700",
-		APIKey: "meilisearch123",
-	})
-	meiliStorage := MeilisearchStorage{
-		client: meiliClient,
+// meiliTestVersions are a version with the update API and one with the task API
+var meiliTestVersions = []string{"0.20.0", "1.3.0"}
+
+// fakeMeilisearch is a stand-in for Meilisearch keeping the indexes, their settings and documents in
+// memory. Writes are applied right away, their tasks are processing the first time they are polled
+// and processed the second time, unless held
+type fakeMeilisearch struct {
+	sync.Mutex
+	version string
+	// tasks is set for the versions with the task API
+	tasks   bool
+	indexes map[string]*fakeMeiliIndex
+	// settingsUpdates counts the settings updates by index
+	settingsUpdates map[string]int
+	taskList        []*fakeMeiliTask
+	// held keeps the tasks of the document writes enqueued
+	held bool
+	// failIndex makes the document writes to the index fail
+	failIndex string
+	// failPolls is the number of task polls answered with an error
+	failPolls int
+	// maxOutstanding is the highest number of unprocessed tasks when a task was enqueued
+	maxOutstanding int
+}
+
+type fakeMeiliIndex struct {
+	primaryKey string
+	settings   map[string]interface{}
+	documents  map[string]map[string]interface{}
+}
+
+type fakeMeiliTask struct {
+	indexUID string
+	status   string
+	code     string
+	document bool
+}
+
+func newFakeMeilisearch(version string) *fakeMeilisearch {
+	return &fakeMeilisearch{
+		version:         version,
+		tasks:           !strings.HasPrefix(version, "0.2") || version >= "0.25",
+		indexes:         map[string]*fakeMeiliIndex{},
+		settingsUpdates: map[string]int{},
+	}
+}
+
+func (f *fakeMeilisearch) defaultSettings() map[string]interface{} {
+	if f.tasks {
+		return map[string]interface{}{
+			"rankingRules":         []interface{}{"words", "typo", "proximity", "attribute", "sort", "exactness"},
+			"searchableAttributes": []interface{}{"*"},
+			"distinctAttribute":    nil,
+			"filterableAttributes": []interface{}{},
+			"sortableAttributes":   []interface{}{},
+		}
+	}
+	return map[string]interface{}{
+		"rankingRules":          []interface{}{"typo", "words", "proximity", "attribute", "wordsPosition", "exactness"},
+		"searchableAttributes":  []interface{}{"*"},
+		"distinctAttribute":     nil,
+		"attributesForFaceting": []interface{}{},
+	}
+}
+
+func (f *fakeMeilisearch) createIndex(uid string, primaryKey string) *fakeMeiliIndex {
+	index := &fakeMeiliIndex{
+		primaryKey: primaryKey,
+		settings:   f.defaultSettings(),
+		documents:  map[string]map[string]interface{}{},
+	}
+	f.indexes[uid] = index
+	return index
+}
+
+// setting returns a list setting of an index
+func (f *fakeMeilisearch) setting(uid string, name string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var values []string
+	for _, value := range f.indexes[uid].settings[name].([]interface{}) {
+		values = append(values, value.(string))
+	}
+	return values
+}
+
+// filterable returns the filterable attributes, or the attributes for faceting, of an index
+func (f *fakeMeilisearch) filterable(uid string) []string {
+	if f.tasks {
+		return f.setting(uid, "filterableAttributes")
+	}
+	return f.setting(uid, "attributesForFaceting")
+}
+
+func (f *fakeMeilisearch) release() {
+	f.Lock()
+	defer f.Unlock()
+	f.held = false
+}
+
+func (f *fakeMeilisearch) enqueue(w http.ResponseWriter, indexUID string, code string, document bool) {
+	outstanding := 1
+	for _, task := range f.taskList {
+		if task.status == "enqueued" || task.status == "processing" {
+			outstanding++
+		}
+	}
+	if outstanding > f.maxOutstanding {
+		f.maxOutstanding = outstanding
+	}
+	f.taskList = append(f.taskList, &fakeMeiliTask{indexUID: indexUID, status: "enqueued", code: code, document: document})
+	id := len(f.taskList) - 1
+	w.WriteHeader(http.StatusAccepted)
+	if f.tasks {
+		json.NewEncoder(w).Encode(map[string]interface{}{"taskUid": id, "indexUid": indexUID, "status": "enqueued"})
+	} else {
+		json.NewEncoder(w).Encode(map[string]interface{}{"updateId": id})
+	}
+}
+
+func (f *fakeMeilisearch) writeTask(w http.ResponseWriter, id int) {
+	if f.failPolls > 0 {
+		f.failPolls--
+		f.writeError(w, http.StatusServiceUnavailable, "unavailable", "unavailable")
+		return
+	}
+	task := f.taskList[id]
+	if !f.held || !task.document {
+		switch task.status {
+		case "enqueued":
+			task.status = "processing"
+		case "processing":
+			task.status = "succeeded"
+			if task.code != "" {
+				task.status = "failed"
+			}
+		}
+	}
+	status := task.status
+	var body map[string]interface{}
+	if f.tasks {
+		body = map[string]interface{}{"uid": id, "indexUid": task.indexUID, "status": status}
+		if status == "failed" {
+			body["error"] = map[string]string{"message": "write failed", "code": task.code, "type": "invalid_request", "link": "https://docs.meilisearch.com/errors#" + task.code}
+		}
+	} else {
+		if status == "succeeded" {
+			status = "processed"
+		}
+		body = map[string]interface{}{"updateId": id, "status": status}
+		if status == "failed" {
+			body["error"] = "write failed"
+			body["errorCode"] = task.code
+			body["errorType"] = "invalid_request_error"
+		}
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeMeilisearch) writeError(w http.ResponseWriter, status int, message string, code string) {
+	w.WriteHeader(status)
+	if f.tasks {
+		json.NewEncoder(w).Encode(map[string]string{"message": message, "code": code, "type": "invalid_request"})
+	} else {
+		json.NewEncoder(w).Encode(map[string]string{"message": message, "errorCode": code, "errorType": "invalid_request_error"})
+	}
+}
+
+func (f *fakeMeilisearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/version":
+		json.NewEncoder(w).Encode(map[string]string{"pkgVersion": f.version})
+		return
+	case parts[0] == "tasks" && f.tasks:
+		id, _ := strconv.Atoi(parts[1])
+		f.writeTask(w, id)
+		return
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		var uids []string
+		for uid := range f.indexes {
+			uids = append(uids, uid)
+		}
+		sort.Strings(uids)
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		indexes := []map[string]string{}
+		for _, uid := range uids[offset:] {
+			indexes = append(indexes, map[string]string{"uid": uid, "primaryKey": f.indexes[uid].primaryKey})
+		}
+		if f.tasks {
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": indexes, "offset": offset, "total": len(uids)})
+		} else {
+			json.NewEncoder(w).Encode(indexes)
+		}
+		return
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		f.createIndex(request["uid"], request["primaryKey"])
+		if f.tasks {
+			f.enqueue(w, request["uid"], "", false)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(request)
+		}
+		return
 	}
+	uid := parts[1]
+	index, ok := f.indexes[uid]
+	route := r.Method + " " + strings.Join(parts[2:], "/")
+	if !ok {
+		if route == "POST documents/delete-batch" && f.tasks {
+			// the task API only checks the index when processing the task
+			f.enqueue(w, uid, "index_not_found", true)
+			return
+		}
+		f.writeError(w, http.StatusNotFound, fmt.Sprintf("Index %s not found", uid), "index_not_found")
+		return
+	}
+	settingsMethod := http.MethodPost
+	if f.tasks && f.version >= "0.28" {
+		settingsMethod = http.MethodPatch
+	}
+	switch {
+	case route == "GET ":
+		json.NewEncoder(w).Encode(map[string]string{"uid": uid, "primaryKey": index.primaryKey})
+	case route == "DELETE ":
+		delete(f.indexes, uid)
+		if f.tasks {
+			f.enqueue(w, uid, "", false)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case strings.HasPrefix(route, "GET updates/") && !f.tasks:
+		id, _ := strconv.Atoi(parts[3])
+		f.writeTask(w, id)
+	case route == "GET settings":
+		json.NewEncoder(w).Encode(index.settings)
+	case route == settingsMethod+" settings":
+		var update map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&update)
+		defaults := f.defaultSettings()
+		for name, value := range update {
+			if _, ok := defaults[name]; !ok {
+				f.writeError(w, http.StatusBadRequest, "unknown setting "+name, "bad_request")
+				return
+			}
+			if value == nil {
+				value = defaults[name]
+			}
+			index.settings[name] = value
+		}
+		f.settingsUpdates[uid]++
+		f.enqueue(w, uid, "", false)
+	case route == "GET documents":
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		var ids []string
+		for id := range index.documents {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		documents := []map[string]interface{}{}
+		for i := offset; i < len(ids); i++ {
+			documents = append(documents, index.documents[ids[i]])
+		}
+		if f.version >= "1" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": documents, "offset": offset})
+		} else {
+			json.NewEncoder(w).Encode(documents)
+		}
+	case route == "PUT documents":
+		var documents []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&documents)
+		if uid == f.failIndex {
+			f.enqueue(w, uid, "invalid_document_id", true)
+			return
+		}
+		for _, document := range documents {
+			index.documents[fmt.Sprint(document[index.primaryKey])] = document
+		}
+		f.enqueue(w, uid, "", true)
+	case route == "POST documents/delete-batch":
+		var ids []string
+		json.NewDecoder(r.Body).Decode(&ids)
+		for _, id := range ids {
+			delete(index.documents, id)
+		}
+		f.enqueue(w, uid, "", true)
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "unsupported route "+route, "method_not_allowed")
+	}
+}
+
+func newFakeMeilisearchStorage(t *testing.T, fake *fakeMeilisearch) MeilisearchStorage {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	storage, err := NewMeilisearchStorage(MeilisearchConfig{Host: server.URL, APIKey: "meilisearch123"}, "mychannel")
+	require.NoError(t, err)
+	return storage.WithTaskLimits(DefaultMaxPendingTasks, time.Millisecond)
+}
+
+func TestFoo(t *testing.T) {
 	channelID := "mychannel"
+	meiliStorage := newFakeMeilisearchStorage(t, newFakeMeilisearch(meiliTestVersions[0]))
 	envBytes, err := proto.Marshal(
 		mocks.NewTx(
 			channelID,
@@ -51,3 +361,266 @@ func TestFoo(t *testing.T) {
 	err = meiliStorage.Store(blk)
 	assert.NoError(t, err)
 }
+
+func TestMeilisearchCreateIndexes(t *testing.T) {
+	for _, version := range meiliTestVersions {
+		t.Run(version, func(t *testing.T) {
+			fake := newFakeMeilisearch(version)
+			storage := newFakeMeilisearchStorage(t, fake)
+			require.NoError(t, storage.CreateIndexes("fabcar", testIndexes))
+			require.NotNil(t, fake.indexes["mychannel_fabcar"])
+			assert.ElementsMatch(t, []string{"_fabric_txid", "_fabric_key", "_fabric_collection", "docType", "owner", "size"}, fake.filterable("mychannel_fabcar"))
+			assert.Equal(t, 1, fake.settingsUpdates["mychannel_fabcar"])
+			// nothing to update the second time
+			require.NoError(t, storage.CreateIndexes("fabcar", testIndexes))
+			assert.Equal(t, 1, fake.settingsUpdates["mychannel_fabcar"])
+		})
+	}
+}
+
+func TestMeilisearchChaincodeIndexes(t *testing.T) {
+	blocks := []*cb.Block{
+		newTestBlock("mychannel", 0,
+			writeTx("1", "fabcar",
+				&kvrwset.KVWrite{Key: "car1", Value: []byte(`{"docType":"car","make":"Ford","owner":{"name":"a"}}`)},
+				&kvrwset.KVWrite{Key: "owner1", Value: []byte(`{"docType":"owner","name":"a"}`)},
+				&kvrwset.KVWrite{Key: "other", Value: []byte(`{"size":1}`)},
+			),
+			writeTx("2", "marbles",
+				&kvrwset.KVWrite{Key: "marble1", Value: []byte(`{"color":"blue"}`)},
+			),
+		),
+		newTestBlock("mychannel", 1,
+			writeTx("3", "fabcar",
+				&kvrwset.KVWrite{Key: "car1", IsDelete: true},
+				&kvrwset.KVWrite{Key: "car9", IsDelete: true},
+			),
+		),
+	}
+	mapping := MeilisearchMapping{
+		Infer: true,
+		Chaincodes: []MeilisearchChaincodeSettings{
+			{
+				Name:            "fabcar",
+				ObjectTypeField: "docType",
+				Objects: []MeilisearchObjectSettings{
+					{
+						ObjectType: "car",
+						MeilisearchIndexSettings: MeilisearchIndexSettings{
+							SortableAttributes:   []string{"make"},
+							SearchableAttributes: []string{"make", "owner"},
+							DistinctAttribute:    "make",
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, version := range meiliTestVersions {
+		t.Run(version, func(t *testing.T) {
+			fake := newFakeMeilisearch(version)
+			storage, err := newFakeMeilisearchStorage(t, fake).WithIndexSettings(mapping)
+			require.NoError(t, err)
+			require.NoError(t, storage.Store(blocks[0]))
+			require.NoError(t, storage.Flush())
+
+			car := fake.indexes["mychannel_fabcar__car"]
+			require.NotNil(t, car)
+			assert.Len(t, car.documents, 1)
+			assert.Equal(t, storage.client.rankingRules([]string{"make"}), fake.setting("mychannel_fabcar__car", "rankingRules"))
+			assert.Equal(t, []string{"make", "owner"}, fake.setting("mychannel_fabcar__car", "searchableAttributes"))
+			assert.Equal(t, "make", car.settings["distinctAttribute"])
+			// the object isn't a scalar field
+			assert.ElementsMatch(t, []string{"_fabric_txid", "_fabric_key", "_fabric_collection", "_fabric_channel", "_fabric_date", "_fabric_id", "_fabric_namespace", "docType", "make"}, fake.filterable("mychannel_fabcar__car"))
+			if fake.tasks {
+				assert.Equal(t, []string{"make"}, fake.setting("mychannel_fabcar__car", "sortableAttributes"))
+			}
+
+			owner := fake.indexes["mychannel_fabcar__owner"]
+			require.NotNil(t, owner)
+			assert.Len(t, owner.documents, 1)
+			assert.Equal(t, storage.client.rankingRules([]string{"_fabric_date:desc"}), fake.setting("mychannel_fabcar__owner", "rankingRules"))
+			assert.Equal(t, []string{"*"}, fake.setting("mychannel_fabcar__owner", "searchableAttributes"))
+			assert.Nil(t, owner.settings["distinctAttribute"])
+
+			require.NotNil(t, fake.indexes["mychannel_fabcar"])
+			assert.Len(t, fake.indexes["mychannel_fabcar"].documents, 1)
+			require.NotNil(t, fake.indexes["mychannel_marbles"])
+			assert.Contains(t, fake.filterable("mychannel_marbles"), "color")
+			assert.Len(t, fake.indexes["mychannel__blocks"].documents, 1)
+
+			// the deletes are sent to every index of the chaincode
+			require.NoError(t, storage.Store(blocks[1]))
+			require.NoError(t, storage.Flush())
+			assert.Len(t, car.documents, 0)
+			assert.Len(t, owner.documents, 1)
+
+			// a document whose object type changes is moved to the index of its new type
+			require.NoError(t, storage.Store(newTestBlock("mychannel", 2,
+				writeTx("4", "fabcar", &kvrwset.KVWrite{Key: "owner1", Value: []byte(`{"docType":"car","make":"Fiat"}`)}),
+			)))
+			require.NoError(t, storage.Flush())
+			assert.Len(t, owner.documents, 0)
+			assert.Len(t, car.documents, 1)
+			assert.Len(t, fake.indexes["mychannel_fabcar"].documents, 1)
+		})
+	}
+}
+
+func TestMeilisearchIndexSettingsIdempotent(t *testing.T) {
+	mapping := MeilisearchMapping{
+		Chaincodes: []MeilisearchChaincodeSettings{
+			{
+				Name: "fabcar",
+				MeilisearchIndexSettings: MeilisearchIndexSettings{
+					FilterableAttributes: []string{"owner"},
+					SortableAttributes:   []string{"_fabric_date:desc", "price"},
+					DistinctAttribute:    "make",
+				},
+			},
+		},
+	}
+	for _, version := range meiliTestVersions {
+		t.Run(version, func(t *testing.T) {
+			fake := newFakeMeilisearch(version)
+			storage, err := newFakeMeilisearchStorage(t, fake).WithIndexSettings(mapping)
+			require.NoError(t, err)
+			require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+			require.NoError(t, storage.Flush())
+			require.NotNil(t, fake.indexes["mychannel_fabcar"])
+			assert.Equal(t, storage.client.rankingRules([]string{"_fabric_date:desc", "price"}), fake.setting("mychannel_fabcar", "rankingRules"))
+			assert.ElementsMatch(t, []string{"_fabric_txid", "_fabric_key", "_fabric_collection", "owner"}, fake.filterable("mychannel_fabcar"))
+			assert.Equal(t, 1, fake.settingsUpdates["mychannel_fabcar"])
+
+			// a restart with the same settings doesn't update them
+			_, err = newFakeMeilisearchStorage(t, fake).WithIndexSettings(mapping)
+			require.NoError(t, err)
+			assert.Equal(t, 1, fake.settingsUpdates["mychannel_fabcar"])
+
+			// settings removed from the config are reset, filterable attributes are kept
+			_, err = newFakeMeilisearchStorage(t, fake).WithIndexSettings(MeilisearchMapping{})
+			require.NoError(t, err)
+			assert.Equal(t, storage.client.rankingRules([]string{"_fabric_date:desc"}), fake.setting("mychannel_fabcar", "rankingRules"))
+			assert.Nil(t, fake.indexes["mychannel_fabcar"].settings["distinctAttribute"])
+			assert.Contains(t, fake.filterable("mychannel_fabcar"), "owner")
+
+			_, err = newFakeMeilisearchStorage(t, fake).WithIndexSettings(MeilisearchMapping{
+				Chaincodes: []MeilisearchChaincodeSettings{
+					{Name: "fabcar", MeilisearchIndexSettings: MeilisearchIndexSettings{SortableAttributes: []string{"price:up"}}},
+				},
+			})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMeilisearchMigrate(t *testing.T) {
+	for _, version := range meiliTestVersions {
+		t.Run(version, func(t *testing.T) {
+			fake := newFakeMeilisearch(version)
+			channelIndex := fake.createIndex("mychannel", transformation.PrimaryKey)
+			channelIndex.documents["1"] = map[string]interface{}{
+				transformation.PrimaryKey:   "1",
+				transformation.KeyKey:       "car1",
+				transformation.NamespaceKey: "fabcar",
+				"owner":                     "a",
+			}
+			// stored with the ledger key as ID, without chaincode
+			channelIndex.documents["car2"] = map[string]interface{}{transformation.PrimaryKey: "car2", "owner": "b"}
+			storage := newFakeMeilisearchStorage(t, fake)
+			require.NoError(t, storage.Migrate())
+			assert.Nil(t, fake.indexes["mychannel"])
+			require.NotNil(t, fake.indexes["mychannel_fabcar"])
+			assert.Equal(t, map[string]map[string]interface{}{"1": channelIndex.documents["1"]}, fake.indexes["mychannel_fabcar"].documents)
+			// nothing left to migrate
+			require.NoError(t, storage.Migrate())
+		})
+	}
+}
+
+func TestMeilisearchPipeline(t *testing.T) {
+	blocks := esTestBlocks("mychannel")
+	for _, version := range meiliTestVersions {
+		t.Run(version, func(t *testing.T) {
+			t.Run("CommitAfterTasks", func(t *testing.T) {
+				fake := newFakeMeilisearch(version)
+				storage := newFakeMeilisearchStorage(t, fake)
+				fake.held = true
+				require.NoError(t, storage.Store(blocks[0]))
+				require.NoError(t, storage.Store(blocks[1]))
+				_, ok, err := storage.Committed()
+				require.NoError(t, err)
+				assert.False(t, ok)
+
+				fake.release()
+				require.NoError(t, storage.Flush())
+				blockNumber, ok, err := storage.Committed()
+				require.NoError(t, err)
+				assert.True(t, ok)
+				assert.Equal(t, 1, blockNumber)
+			})
+			t.Run("BoundedTasks", func(t *testing.T) {
+				fake := newFakeMeilisearch(version)
+				storage := newFakeMeilisearchStorage(t, fake).WithTaskLimits(2, time.Millisecond)
+				for i := uint64(0); i < 5; i++ {
+					require.NoError(t, storage.Store(newTestBlock("mychannel", i,
+						writeTx(fmt.Sprint(i), "fabcar", &kvrwset.KVWrite{Key: fmt.Sprintf("car%d", i), Value: []byte(`{"owner":"a"}`)}),
+					)))
+				}
+				require.NoError(t, storage.Flush())
+				assert.Equal(t, 2, fake.maxOutstanding)
+				blockNumber, _, err := storage.Committed()
+				require.NoError(t, err)
+				assert.Equal(t, 4, blockNumber)
+				assert.Len(t, fake.indexes["mychannel_fabcar"].documents, 5)
+			})
+			t.Run("FailedTask", func(t *testing.T) {
+				fake := newFakeMeilisearch(version)
+				storage := newFakeMeilisearchStorage(t, fake)
+				require.NoError(t, storage.Store(newTestBlock("mychannel", 0,
+					writeTx("1", "marbles", &kvrwset.KVWrite{Key: "marble1", Value: []byte(`{"color":"blue"}`)}),
+				)))
+				require.NoError(t, storage.Flush())
+				fake.failIndex = "mychannel_fabcar"
+				require.NoError(t, storage.StoreBulk(blocks))
+				err := storage.Flush()
+				require.Error(t, err)
+				meiliErr, ok := errors.Cause(err).(*MeilisearchError)
+				require.True(t, ok)
+				assert.Equal(t, "mychannel_fabcar", meiliErr.IndexUID)
+				assert.Equal(t, "invalid_document_id", meiliErr.Code)
+				assert.Equal(t, "write failed", meiliErr.Message)
+				// the checkpoint stays at the last block fully written
+				blockNumber, ok, err := storage.Committed()
+				require.Error(t, err)
+				assert.IsType(t, &RewindError{}, err)
+				assert.True(t, ok)
+				assert.Equal(t, 0, blockNumber)
+				// the pipeline restarts from the last block committed
+				fake.failIndex = ""
+				require.NoError(t, storage.StoreBulk(blocks))
+				require.NoError(t, storage.Flush())
+				blockNumber, _, err = storage.Committed()
+				require.NoError(t, err)
+				assert.Equal(t, 1, blockNumber)
+				assert.NotEmpty(t, fake.indexes["mychannel_fabcar"].documents)
+			})
+			t.Run("UnavailablePolls", func(t *testing.T) {
+				fake := newFakeMeilisearch(version)
+				storage := newFakeMeilisearchStorage(t, fake)
+				require.NoError(t, storage.StoreBulk(blocks))
+				fake.Lock()
+				fake.failPolls = 2
+				fake.Unlock()
+				_, _, err := storage.Committed()
+				require.NoError(t, err)
+				require.Error(t, storage.Flush())
+				require.NoError(t, storage.Flush())
+				blockNumber, ok, err := storage.Committed()
+				require.NoError(t, err)
+				assert.True(t, ok)
+				assert.Equal(t, 1, blockNumber)
+			})
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mongoBlocksCollection and mongoMetadataCollection can't collide with a chaincode collection,
+	// chaincode names can't start with an underscore
+	mongoBlocksCollection   = "_blocks"
+	mongoMetadataCollection = "_metadata"
+	mongoCheckpointID       = "checkpoint"
+	// mongoNamespaceExists is the error code of creating a collection that already exists
+	mongoNamespaceExists = 48
+	mongoConnectTimeout  = 10 * time.Second
+)
+
+// MongoDBStorage stores the documents of a channel in a database named after it, with a collection per
+// chaincode. The writes of a batch of blocks and the checkpoint are applied in one transaction, so the
+// server must be a replica set
+type MongoDBStorage struct {
+	client      *mongo.Client
+	db          *mongo.Database
+	channelID   string
+	opts        []transformation.Option
+	collections *mongoCollections
+}
+
+// mongoCollections are the collections already created with their indexes
+type mongoCollections struct {
+	sync.Mutex
+	created map[string]bool
+}
+
+type MongoDBConfig struct {
+	URI string `mapstructure:"uri"`
+	// DatabasePrefix is prepended to the channel name to get the name of the database
+	DatabasePrefix string
+}
+
+func NewMongoDBStorage(config MongoDBConfig, channelID string, opts ...transformation.Option) (MongoDBStorage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(config.URI))
+	if err != nil {
+		return MongoDBStorage{}, errors.Wrap(err, "failed to connect to MongoDB")
+	}
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		return MongoDBStorage{}, errors.Wrap(err, "failed to connect to MongoDB")
+	}
+	storage := MongoDBStorage{
+		client:      client,
+		db:          client.Database(mongoDatabaseName(config.DatabasePrefix, channelID)),
+		channelID:   channelID,
+		opts:        opts,
+		collections: &mongoCollections{created: map[string]bool{}},
+	}
+	for _, name := range []string{mongoBlocksCollection, mongoMetadataCollection} {
+		err = storage.createCollection(name, false)
+		if err != nil {
+			return storage, err
+		}
+	}
+	return storage, nil
+}
+
+// mongoDatabaseName returns the database of a channel, dots aren't allowed in database names
+func mongoDatabaseName(prefix string, channelID string) string {
+	return strings.ReplaceAll(prefix+channelID, ".", "_")
+}
+
+// createCollection creates a collection if it doesn't exist yet, with the indexes on the transaction ID
+// and date for the chaincode collections. Collections can't be created in a transaction before MongoDB 4.4
+func (m MongoDBStorage) createCollection(name string, chaincode bool) error {
+	m.collections.Lock()
+	defer m.collections.Unlock()
+	if m.collections.created[name] {
+		return nil
+	}
+	ctx := context.Background()
+	err := m.db.CreateCollection(ctx, name)
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Code == mongoNamespaceExists) {
+		return errors.Wrapf(err, "failed to create collection %s", name)
+	}
+	if chaincode {
+		_, err = m.db.Collection(name).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: transformation.TxIDKey, Value: 1}}},
+			{Keys: bson.D{{Key: transformation.DateKey, Value: -1}}},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to create the indexes of collection %s", name)
+		}
+	}
+	m.collections.created[name] = true
+	return nil
+}
+
+// mongoWrite is a write of a document, ordered by its version
+type mongoWrite struct {
+	document *transformation.Document
+	delete   bool
+}
+
+// writeModels returns the writes of every chaincode collection, in ledger order
+func writeModels(response *transformation.DocumentExtractionResponse) (map[string][]mongo.WriteModel, error) {
+	var writes []mongoWrite
+	for _, document := range response.DocumentsToAdd {
+		writes = append(writes, mongoWrite{document: document})
+	}
+	for _, document := range response.DocumentsToRemove {
+		writes = append(writes, mongoWrite{document: document, delete: true})
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		if writes[i].document.Version() != writes[j].document.Version() {
+			return writes[i].document.Version() < writes[j].document.Version()
+		}
+		return writes[i].document.PrimaryKey < writes[j].document.PrimaryKey
+	})
+	models := map[string][]mongo.WriteModel{}
+	for _, write := range writes {
+		document := write.document
+		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
+			continue
+		}
+		filter := bson.D{{Key: "_id", Value: document.PrimaryKey}}
+		if write.delete {
+			models[document.ChaincodeID] = append(models[document.ChaincodeID], mongo.NewDeleteOneModel().SetFilter(filter))
+			continue
+		}
+		data := bson.M{}
+		for field, value := range document.Data {
+			data[field] = value
+		}
+		if creator, ok := data[transformation.CreatorKey]; ok {
+			// the identity gets the field names of its JSON encoding, the BSON ones are the lowercased Go names
+			identity, err := mongoDocument(creator)
+			if err != nil {
+				return nil, err
+			}
+			data[transformation.CreatorKey] = identity
+		}
+		data["_id"] = document.PrimaryKey
+		models[document.ChaincodeID] = append(
+			models[document.ChaincodeID],
+			mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(data).SetUpsert(true),
+		)
+	}
+	for _, block := range response.Blocks {
+		data, err := mongoDocument(block)
+		if err != nil {
+			return nil, err
+		}
+		data["_id"] = block.Number
+		models[mongoBlocksCollection] = append(
+			models[mongoBlocksCollection],
+			mongo.NewReplaceOneModel().SetFilter(bson.D{{Key: "_id", Value: block.Number}}).SetReplacement(data).SetUpsert(true),
+		)
+	}
+	return models, nil
+}
+
+// mongoDocument converts a value to a document with the field names of its JSON encoding
+func mongoDocument(value interface{}) (bson.M, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	document := bson.M{}
+	err = decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func (m MongoDBStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
+	models, err := writeModels(response)
+	if err != nil {
+		return err
+	}
+	var collections []string
+	for name := range models {
+		collections = append(collections, name)
+		err = m.createCollection(name, name != mongoBlocksCollection)
+		if err != nil {
+			return err
+		}
+	}
+	sort.Strings(collections)
+	ctx := context.Background()
+	session, err := m.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		for _, name := range collections {
+			_, err := m.db.Collection(name).BulkWrite(sessionCtx, models[name], options.BulkWrite().SetOrdered(true))
+			if err != nil {
+				return nil, errors.Wrapf(err, "bulk write to collection %s failed", name)
+			}
+		}
+		if len(response.Blocks) > 0 {
+			blockNumber := response.Blocks[len(response.Blocks)-1].Number
+			_, err := m.db.Collection(mongoMetadataCollection).ReplaceOne(
+				sessionCtx,
+				bson.D{{Key: "_id", Value: mongoCheckpointID}},
+				bson.D{{Key: "_id", Value: mongoCheckpointID}, {Key: "blockNumber", Value: blockNumber}},
+				options.Replace().SetUpsert(true),
+			)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to store the checkpoint")
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Items added=%d", len(response.DocumentsToAdd))
+	log.Infof("Items removed=%d", len(response.DocumentsToRemove))
+	return nil
+}
+
+// Checkpoint returns the last block stored, written in the same transaction as the documents
+func (m MongoDBStorage) Checkpoint() (int, bool, error) {
+	var checkpoint struct {
+		BlockNumber int `bson:"blockNumber"`
+	}
+	err := m.db.Collection(mongoMetadataCollection).FindOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: mongoCheckpointID}},
+	).Decode(&checkpoint)
+	if err == mongo.ErrNoDocuments {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return checkpoint.BlockNumber, true, nil
+}
+
+func (m MongoDBStorage) StoreBulk(blocks []*cb.Block) error {
+	response, err := transformation.BlocksToDocuments(blocks, m.opts...)
+	if err != nil {
+		return err
+	}
+	return m.storeDocs(response)
+}
+
+// StoreDocuments stores blocks already decoded
+func (m MongoDBStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return m.storeDocs(response)
+}
+
+func (m MongoDBStorage) Store(block *cb.Block) error {
+	response, err := transformation.BlockToDocuments(block, m.opts...)
+	if err != nil {
+		return err
+	}
+	return m.storeDocs(response)
+}
+
+// MongoDBStorageConfig is the configuration of the mongodb database type
+type MongoDBStorageConfig struct {
+	MongoDBConfig `mapstructure:",squash"`
+}
+
+func (c *MongoDBStorageConfig) Validate() error {
+	if c.URI == "" {
+		return errors.New("uri is required")
+	}
+	return nil
+}
+
+type mongodbFactory struct{}
+
+func (mongodbFactory) NewConfig() StorageConfig {
+	return &MongoDBStorageConfig{}
+}
+
+func (mongodbFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	return NewMongoDBStorage(config.(*MongoDBStorageConfig).MongoDBConfig, channelID, opts...)
+}
+
+func init() {
+	Register("mongodb", mongodbFactory{})
+}
@@ -0,0 +1,127 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/kfsoftware/hlf-sync/pkg/mocks"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMongoWriteModels(t *testing.T) {
+	response, err := transformation.BlocksToDocuments(esTestBlocks("mychannel"))
+	require.NoError(t, err)
+	models, err := writeModels(response)
+	require.NoError(t, err)
+	require.Len(t, models["fabcar"], 3)
+	var ids []string
+	for _, model := range models["fabcar"][:2] {
+		replace, ok := model.(*mongo.ReplaceOneModel)
+		require.True(t, ok)
+		assert.True(t, *replace.Upsert)
+		replacement := replace.Replacement.(bson.M)
+		assert.Equal(t, replacement[transformation.PrimaryKey], replacement["_id"])
+		ids = append(ids, replacement["_id"].(string))
+	}
+	assert.ElementsMatch(t, []string{documentID("car1"), documentID("car2")}, ids)
+	deleteModel, ok := models["fabcar"][2].(*mongo.DeleteOneModel)
+	require.True(t, ok)
+	assert.Equal(t, bson.D{{Key: "_id", Value: documentID("car3")}}, deleteModel.Filter)
+
+	require.Len(t, models[mongoBlocksCollection], 2)
+	block := models[mongoBlocksCollection][1].(*mongo.ReplaceOneModel).Replacement.(bson.M)
+	assert.Equal(t, 1, block["_id"])
+	assert.Equal(t, "mychannel", block["channelId"])
+
+	assert.Equal(t, "hlf_my_channel", mongoDatabaseName("hlf_", "my.channel"))
+}
+
+func TestMongoCreator(t *testing.T) {
+	tx := writeTx("1", "fabcar", &kvrwset.KVWrite{Key: "car1", Value: []byte(`{"owner":"a"}`)})
+	tx.Creator = mocks.NewSerializedIdentity("Org1MSP", "user1", []string{"client"}, map[string]string{"role": "admin"})
+	response, err := transformation.BlocksToDocuments([]*cb.Block{newTestBlock("mychannel", 0, tx)}, transformation.WithCreator(true))
+	require.NoError(t, err)
+	models, err := writeModels(response)
+	require.NoError(t, err)
+	require.Len(t, models["fabcar"], 1)
+	data, err := bson.Marshal(models["fabcar"][0].(*mongo.ReplaceOneModel).Replacement)
+	require.NoError(t, err)
+	var stored struct {
+		Creator bson.M `bson:"_fabric_creator"`
+	}
+	require.NoError(t, bson.Unmarshal(data, &stored))
+	assert.Equal(t, "Org1MSP", stored.Creator["mspid"])
+	assert.Equal(t, "user1", stored.Creator["cn"])
+	assert.Equal(t, bson.A{"client"}, stored.Creator["ous"])
+	assert.Equal(t, bson.M{"role": "admin"}, stored.Creator["attrs"])
+	assert.NotContains(t, stored.Creator, "commonname")
+}
+
+// newMongoTestStorage connects to the MongoDB replica set in HLF_SYNC_TEST_MONGODB_URI,
+// e.g. mongodb://localhost:27017/?replicaSet=rs0
+func newMongoTestStorage(t *testing.T) MongoDBStorage {
+	uri := os.Getenv("HLF_SYNC_TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("HLF_SYNC_TEST_MONGODB_URI not set")
+	}
+	channelID := fmt.Sprintf("test%d", time.Now().UnixNano())
+	storage, err := NewMongoDBStorage(MongoDBConfig{URI: uri, DatabasePrefix: "hlf_sync_"}, channelID)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		storage.db.Drop(context.Background())
+	})
+	return storage
+}
+
+func TestMongoDBStorage(t *testing.T) {
+	storage := newMongoTestStorage(t)
+	ctx := context.Background()
+	_, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	blocks := esTestBlocks(storage.channelID)
+	blocks = append(blocks, newTestBlock(storage.channelID, 2, writeTx("3", "fabcar",
+		&kvrwset.KVWrite{Key: "car2", IsDelete: true},
+		&kvrwset.KVWrite{Key: "car4", Value: []byte(`{"owner":"d"}`)},
+	)))
+	require.NoError(t, storage.StoreBulk(blocks[:2]))
+	require.NoError(t, storage.StoreBulk(blocks[2:]))
+
+	cursor, err := storage.db.Collection("fabcar").Find(ctx, bson.D{})
+	require.NoError(t, err)
+	var documents []bson.M
+	require.NoError(t, cursor.All(ctx, &documents))
+	owners := map[string]interface{}{}
+	for _, document := range documents {
+		owners[document[transformation.KeyKey].(string)] = document["owner"]
+		assert.Equal(t, document[transformation.PrimaryKey], document["_id"])
+	}
+	assert.Equal(t, map[string]interface{}{"car1": "a", "car4": "d"}, owners)
+
+	blockCount, err := storage.db.Collection(mongoBlocksCollection).CountDocuments(ctx, bson.D{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), blockCount)
+	blockNumber, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 2, blockNumber)
+
+	cursor, err = storage.db.Collection("fabcar").Indexes().List(ctx)
+	require.NoError(t, err)
+	var indexes []bson.M
+	require.NoError(t, cursor.All(ctx, &indexes))
+	var indexNames []string
+	for _, index := range indexes {
+		indexNames = append(indexNames, index["name"].(string))
+	}
+	assert.Subset(t, indexNames, []string{transformation.TxIDKey + "_1", transformation.DateKey + "_-1"})
+}
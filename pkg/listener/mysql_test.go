@@ -5,20 +5,13 @@ import (
 	cb "github.com/hyperledger/fabric-protos-go/common"
 	pb "github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/kfsoftware/hlf-sync/pkg/mocks"
-	"github.com/meilisearch/meilisearch-go"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 func TestMysqlStorage(t *testing.T) {
-	var meiliClient = meilisearch.NewClient(meilisearch.Config{
-		Host:   "http://127.0.0.1:7700",
-		APIKey: "meilisearch123",
-	})
-	meiliStorage := MeilisearchStorage{
-		client: meiliClient,
-	}
 	channelID := "mychannel"
+	meiliStorage := newFakeMeilisearchStorage(t, newFakeMeilisearch(meiliTestVersions[0]))
 	envBytes, err := proto.Marshal(
 		mocks.NewTx(
 			channelID,
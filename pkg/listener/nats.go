@@ -0,0 +1,354 @@
+package listener
+
+import (
+	"encoding/json"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultNATSSubjectPrefix is the first token of the subjects
+	DefaultNATSSubjectPrefix = "hlf"
+	// DefaultNATSObjectTypeField is the field of the documents giving the last token of their subjects
+	DefaultNATSObjectTypeField = "objectType"
+	// DefaultNATSMaxPending is the number of messages published before waiting for their acks
+	DefaultNATSMaxPending = 256
+	// DefaultNATSAckWait is how long the acks of the pending messages are waited for
+	DefaultNATSAckWait = 30 * time.Second
+
+	// natsNoObjectType is the last token of the subjects of the documents without object type
+	natsNoObjectType = "_"
+)
+
+// NATSStorage publishes the writes of the valid transactions and the chaincode events to JetStream, on the subjects
+// <prefix>.<channel>.<chaincode>.<objectType> and <prefix>.<channel>.<chaincode>.events.<eventName>.
+// Every message has a Nats-Msg-Id so the stream drops the messages published again after a restart, and
+// Store returns once all of them are acknowledged
+type NATSStorage struct {
+	conn            *nats.Conn
+	js              nats.JetStreamContext
+	channelID       string
+	prefix          string
+	objectTypeField string
+	maxPending      int
+	ackWait         time.Duration
+	opts            []transformation.Option
+}
+
+type NATSConfig struct {
+	URL string
+	// Username and Password, Token or the credentials file of a user JWT authenticate the connection
+	Username    string `mapstructure:"user"`
+	Password    string
+	Token       string
+	Credentials string
+	// CACert, ClientCert and ClientKey are the paths of the PEM files of the TLS connection
+	CACert     string
+	ClientCert string
+	ClientKey  string
+}
+
+// NATSStreamConfig is the stream capturing the subjects of the channel, created when it doesn't exist
+type NATSStreamConfig struct {
+	Name     string
+	Replicas int
+	// DuplicateWindow is how long the stream remembers the message IDs, 2 minutes by default
+	DuplicateWindow time.Duration `mapstructure:"duplicateWindow"`
+}
+
+// NewNATSStorage connects to the server, publishing to the subjects under hlf
+func NewNATSStorage(config NATSConfig, channelID string, opts ...transformation.Option) (NATSStorage, error) {
+	options := []nats.Option{nats.Name("hlf-sync"), nats.MaxReconnects(-1)}
+	switch {
+	case config.Credentials != "":
+		options = append(options, nats.UserCredentials(config.Credentials))
+	case config.Token != "":
+		options = append(options, nats.Token(config.Token))
+	case config.Username != "":
+		options = append(options, nats.UserInfo(config.Username, config.Password))
+	}
+	if config.CACert != "" {
+		options = append(options, nats.RootCAs(config.CACert))
+	}
+	if config.ClientCert != "" || config.ClientKey != "" {
+		options = append(options, nats.ClientCert(config.ClientCert, config.ClientKey))
+	}
+	conn, err := nats.Connect(config.URL, options...)
+	if err != nil {
+		return NATSStorage{}, errors.Wrap(err, "failed to connect to NATS")
+	}
+	return newNATSStorage(conn, channelID, opts...)
+}
+
+func newNATSStorage(conn *nats.Conn, channelID string, opts ...transformation.Option) (NATSStorage, error) {
+	js, err := conn.JetStream()
+	if err != nil {
+		return NATSStorage{}, errors.Wrap(err, "failed to get the JetStream context")
+	}
+	return NATSStorage{
+		conn:            conn,
+		js:              js,
+		channelID:       channelID,
+		prefix:          DefaultNATSSubjectPrefix,
+		objectTypeField: DefaultNATSObjectTypeField,
+		maxPending:      DefaultNATSMaxPending,
+		ackWait:         DefaultNATSAckWait,
+		opts:            opts,
+	}, nil
+}
+
+// WithSubjects sets the prefix of the subjects and the field of the object type, the values not set are kept
+func (n NATSStorage) WithSubjects(prefix string, objectTypeField string) NATSStorage {
+	if prefix != "" {
+		n.prefix = prefix
+	}
+	if objectTypeField != "" {
+		n.objectTypeField = objectTypeField
+	}
+	return n
+}
+
+// WithAckLimits sets how many messages are published before waiting for their acks, and for how long
+func (n NATSStorage) WithAckLimits(maxPending int, ackWait time.Duration) NATSStorage {
+	if maxPending > 0 {
+		n.maxPending = maxPending
+	}
+	if ackWait > 0 {
+		n.ackWait = ackWait
+	}
+	return n
+}
+
+// WithStream creates the stream of the subjects of the channel when it doesn't exist, nothing is done when
+// the name is not set
+func (n NATSStorage) WithStream(config NATSStreamConfig) (NATSStorage, error) {
+	if config.Name == "" {
+		return n, nil
+	}
+	_, err := n.js.StreamInfo(config.Name)
+	if err == nil {
+		return n, nil
+	}
+	if err != nats.ErrStreamNotFound {
+		return n, errors.Wrapf(err, "failed to get stream %s", config.Name)
+	}
+	streamConfig := &nats.StreamConfig{
+		Name:       config.Name,
+		Subjects:   []string{n.channelSubject() + ".>"},
+		Storage:    nats.FileStorage,
+		Replicas:   config.Replicas,
+		Duplicates: config.DuplicateWindow,
+	}
+	_, err = n.js.AddStream(streamConfig)
+	if err != nil {
+		return n, errors.Wrapf(err, "failed to create stream %s", config.Name)
+	}
+	log.Infof("Stream %s created for %s", config.Name, streamConfig.Subjects[0])
+	return n, nil
+}
+
+// natsToken replaces the characters that can't be used in a token of a subject
+var natsToken = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_", "\r", "_", "\n", "_")
+
+func (n NATSStorage) channelSubject() string {
+	return n.prefix + "." + natsToken.Replace(n.channelID)
+}
+
+// changeSubject is the subject of a write, the last token is the object type of the document or _ when it has none
+func (n NATSStorage) changeSubject(document *transformation.Document) string {
+	objectType, _ := document.Data[n.objectTypeField].(string)
+	if objectType == "" {
+		objectType = natsNoObjectType
+	}
+	return strings.Join([]string{n.channelSubject(), natsToken.Replace(document.ChaincodeID), natsToken.Replace(objectType)}, ".")
+}
+
+func (n NATSStorage) eventSubject(event *transformation.ChaincodeEvent) string {
+	return strings.Join([]string{n.channelSubject(), natsToken.Replace(event.ChaincodeID), "events", natsToken.Replace(event.EventName)}, ".")
+}
+
+// chaincodeEventMessage is the message of a chaincode event, the payload is kept as JSON when it's valid
+type chaincodeEventMessage struct {
+	Channel     string      `json:"channel"`
+	Chaincode   string      `json:"chaincode"`
+	EventName   string      `json:"eventName"`
+	BlockNumber int         `json:"blockNumber"`
+	TXIndex     int         `json:"txIndex"`
+	TXID        string      `json:"txId"`
+	TXDate      int         `json:"txDate"`
+	Payload     interface{} `json:"payload"`
+}
+
+func newChaincodeEventMessage(event *transformation.ChaincodeEvent) chaincodeEventMessage {
+	var payload interface{} = string(event.Payload)
+	if json.Valid(event.Payload) {
+		payload = json.RawMessage(event.Payload)
+	}
+	return chaincodeEventMessage{
+		Channel:     event.ChannelID,
+		Chaincode:   event.ChaincodeID,
+		EventName:   event.EventName,
+		BlockNumber: event.BlockNumber,
+		TXIndex:     event.TXIndex,
+		TXID:        event.TXID,
+		TXDate:      event.TXDate,
+		Payload:     payload,
+	}
+}
+
+func newNATSMessage(subject string, msgID string, data []byte) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(nats.MsgIdHdr, msgID)
+	msg.Data = data
+	return msg
+}
+
+// messages returns the messages of the writes and the chaincode events of the valid transactions, in ledger order
+func (n NATSStorage) messages(response *transformation.DocumentExtractionResponse) ([]*nats.Msg, error) {
+	var messages []*nats.Msg
+	for _, event := range response.Events {
+		document := event.Document
+		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
+			continue
+		}
+		data, err := jsonKafkaEncoder{}.encode("", changeRecord, changeValues(event))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, newNATSMessage(n.changeSubject(document), document.TXID+"/"+changeKey(document), data))
+	}
+	for _, event := range response.ChaincodeEvents {
+		data, err := json.Marshal(newChaincodeEventMessage(event))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, newNATSMessage(n.eventSubject(event), event.TXID+"/events/"+event.EventName, data))
+	}
+	return messages, nil
+}
+
+// publish publishes the messages asynchronously, waiting for the acks every maxPending messages.
+// It returns the number of messages the stream dropped as duplicates
+func (n NATSStorage) publish(messages []*nats.Msg) (int, error) {
+	duplicates := 0
+	for start := 0; start < len(messages); start += n.maxPending {
+		end := start + n.maxPending
+		if end > len(messages) {
+			end = len(messages)
+		}
+		var futures []nats.PubAckFuture
+		for _, msg := range messages[start:end] {
+			future, err := n.js.PublishMsgAsync(msg)
+			if err != nil {
+				return duplicates, errors.Wrapf(err, "failed to publish to %s", msg.Subject)
+			}
+			futures = append(futures, future)
+		}
+		timeout := time.After(n.ackWait)
+		for _, future := range futures {
+			select {
+			case ack := <-future.Ok():
+				if ack.Duplicate {
+					duplicates++
+				}
+			case err := <-future.Err():
+				return duplicates, errors.Wrapf(err, "failed to publish to %s", future.Msg().Subject)
+			case <-timeout:
+				return duplicates, errors.Errorf("timed out after %s waiting for the acks of %d messages", n.ackWait, len(futures))
+			}
+		}
+	}
+	return duplicates, nil
+}
+
+func (n NATSStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
+	messages, err := n.messages(response)
+	if err != nil {
+		return err
+	}
+	duplicates, err := n.publish(messages)
+	if err != nil {
+		return err
+	}
+	log.Infof("Messages published=%d duplicates=%d", len(messages), duplicates)
+	return nil
+}
+
+func (n NATSStorage) StoreBulk(blocks []*cb.Block) error {
+	response, err := transformation.BlocksToDocuments(blocks, n.opts...)
+	if err != nil {
+		return err
+	}
+	return n.storeDocs(response)
+}
+
+// StoreDocuments stores blocks already decoded
+func (n NATSStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return n.storeDocs(response)
+}
+
+func (n NATSStorage) Store(block *cb.Block) error {
+	response, err := transformation.BlockToDocuments(block, n.opts...)
+	if err != nil {
+		return err
+	}
+	return n.storeDocs(response)
+}
+
+// NATSStorageConfig is the configuration of the nats database type
+type NATSStorageConfig struct {
+	NATSConfig `mapstructure:",squash"`
+	// SubjectPrefix is the first token of the subjects, hlf by default
+	SubjectPrefix   string
+	ObjectTypeField string
+	Stream          NATSStreamConfig
+	MaxPending      int
+	AckWait         time.Duration
+}
+
+func (c *NATSStorageConfig) Validate() error {
+	if c.URL == "" {
+		return errors.New("url is required")
+	}
+	if strings.ContainsAny(c.SubjectPrefix, "*> \t\r\n") {
+		return errors.Errorf("invalid subject prefix %s", c.SubjectPrefix)
+	}
+	if c.SubjectPrefix == "" {
+		c.SubjectPrefix = DefaultNATSSubjectPrefix
+	}
+	if c.ObjectTypeField == "" {
+		c.ObjectTypeField = DefaultNATSObjectTypeField
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = DefaultNATSMaxPending
+	}
+	if c.AckWait == 0 {
+		c.AckWait = DefaultNATSAckWait
+	}
+	return nil
+}
+
+type natsFactory struct{}
+
+func (natsFactory) NewConfig() StorageConfig {
+	return &NATSStorageConfig{}
+}
+
+func (natsFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	c := config.(*NATSStorageConfig)
+	storage, err := NewNATSStorage(c.NATSConfig, channelID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	storage = storage.WithSubjects(c.SubjectPrefix, c.ObjectTypeField).WithAckLimits(c.MaxPending, c.AckWait)
+	return storage.WithStream(c.Stream)
+}
+
+func init() {
+	Register("nats", natsFactory{})
+}
@@ -0,0 +1,94 @@
+package listener
+
+import (
+	"encoding/json"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// runNATSServer starts an embedded server with JetStream
+func runNATSServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	require.NoError(t, err)
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func natsTestBlocks(channelID string) []*cb.Block {
+	created := writeTx("3", "fabcar", &kvrwset.KVWrite{Key: "car4", Value: []byte(`{"objectType":"car","owner":"c"}`)})
+	created.Event = &pb.ChaincodeEvent{ChaincodeId: "fabcar", TxId: "3", EventName: "CarCreated", Payload: []byte(`{"key":"car4"}`)}
+	invalidTx := writeTx("4", "fabcar", &kvrwset.KVWrite{Key: "car5", Value: []byte(`{"objectType":"car"}`)})
+	invalidTx.TxValidationCode = pb.TxValidationCode_MVCC_READ_CONFLICT
+	invalidTx.Event = &pb.ChaincodeEvent{ChaincodeId: "fabcar", TxId: "4", EventName: "CarCreated"}
+	return append(esTestBlocks(channelID), newTestBlock(channelID, 2, created, invalidTx))
+}
+
+func TestNATSStorage(t *testing.T) {
+	s := runNATSServer(t)
+	storage, err := NewNATSStorage(NATSConfig{URL: s.ClientURL()}, "my.channel")
+	require.NoError(t, err)
+	defer storage.conn.Close()
+	storage, err = storage.WithAckLimits(2, 0).WithStream(NATSStreamConfig{Name: "HLF"})
+	require.NoError(t, err)
+
+	sub, err := storage.js.SubscribeSync("hlf.my_channel.>")
+	require.NoError(t, err)
+	blocks := natsTestBlocks("my.channel")
+	require.NoError(t, storage.StoreBulk(blocks))
+
+	var subjects []string
+	var msgs []*nats.Msg
+	for i := 0; i < 5; i++ {
+		msg, err := sub.NextMsg(5 * time.Second)
+		require.NoError(t, err)
+		subjects = append(subjects, msg.Subject)
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, []string{
+		"hlf.my_channel.fabcar._",
+		"hlf.my_channel.fabcar._",
+		"hlf.my_channel.fabcar._",
+		"hlf.my_channel.fabcar.car",
+		"hlf.my_channel.fabcar.events.CarCreated",
+	}, subjects)
+	assert.Equal(t, "1/my.channel/fabcar/car1", msgs[0].Header.Get(nats.MsgIdHdr))
+	var change map[string]interface{}
+	require.NoError(t, json.Unmarshal(msgs[2].Data, &change))
+	assert.Equal(t, "car3", change["key"])
+	assert.Equal(t, "delete", change["operation"])
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(msgs[4].Data, &event))
+	assert.Equal(t, "CarCreated", event["eventName"])
+	assert.Equal(t, float64(2), event["blockNumber"])
+	assert.Equal(t, map[string]interface{}{"key": "car4"}, event["payload"])
+	assert.Equal(t, "3/events/CarCreated", msgs[4].Header.Get(nats.MsgIdHdr))
+
+	// the messages published again are dropped by the stream
+	require.NoError(t, storage.StoreBulk(blocks))
+	_, err = sub.NextMsg(500 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err)
+	info, err := storage.js.StreamInfo("HLF")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), info.State.Msgs)
+}
+
+func TestNATSNoStream(t *testing.T) {
+	s := runNATSServer(t)
+	storage, err := NewNATSStorage(NATSConfig{URL: s.ClientURL()}, "mychannel")
+	require.NoError(t, err)
+	defer storage.conn.Close()
+	err = storage.WithAckLimits(0, 2*time.Second).StoreBulk(esTestBlocks("mychannel"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hlf.mychannel.fabcar._")
+}
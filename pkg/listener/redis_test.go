@@ -0,0 +1,171 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newRedisTestStorage(t *testing.T, config RedisConfig) (*miniredis.Miniredis, RedisStorage) {
+	s := miniredis.RunT(t)
+	config.URL = "redis://" + s.Addr()
+	storage, err := NewRedisStorage(config, "mychannel")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		storage.Close()
+	})
+	return s, storage
+}
+
+func TestRedisIndexValue(t *testing.T) {
+	fields, err := redisHashFields(map[string]interface{}{
+		"owner": "a",
+		"year":  2020,
+		"model": map[string]interface{}{"make": "Toyota", "doors": 4},
+		"color": nil,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `{"doors":4,"make":"Toyota"}`, fields["model"])
+	for field, expected := range map[string]string{"owner": "a", "year": "2020", "model.make": "Toyota", "model.doors": "4"} {
+		value, ok := redisIndexValue(fields, field)
+		assert.True(t, ok, field)
+		assert.Equal(t, expected, value, field)
+	}
+	for _, field := range []string{"color", "missing", "owner.name", "model.engine"} {
+		_, ok := redisIndexValue(fields, field)
+		assert.False(t, ok, field)
+	}
+}
+
+func TestRedisStorage(t *testing.T) {
+	t.Run("Hash", func(t *testing.T) {
+		s, storage := newRedisTestStorage(t, RedisConfig{Indexes: []RedisIndex{{Chaincode: "fabcar", Fields: []string{"owner"}}}})
+		_, found, err := storage.Checkpoint()
+		require.NoError(t, err)
+		assert.False(t, found)
+
+		blocks := cdcTestBlocks("mychannel")
+		require.NoError(t, storage.StoreBulk(blocks[:2]))
+		assert.Equal(t, "a", s.HGet("mychannel:fabcar:car1", "owner"))
+		assert.Equal(t, "b", s.HGet("mychannel:fabcar:car2", "owner"))
+		members, err := s.SMembers("mychannel:_idx:fabcar:owner:a")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mychannel:fabcar:car1"}, members)
+
+		// the update moves car1 to the set of its new owner and the delete removes car2 from its set
+		require.NoError(t, storage.Store(blocks[2]))
+		assert.Equal(t, "c", s.HGet("mychannel:fabcar:car1", "owner"))
+		assert.False(t, s.Exists("mychannel:fabcar:car2"))
+		assert.False(t, s.Exists("mychannel:fabcar:car4"), "the write of the invalid transaction is applied")
+		assert.False(t, s.Exists("mychannel:_idx:fabcar:owner:a"))
+		assert.False(t, s.Exists("mychannel:_idx:fabcar:owner:b"))
+		members, err = s.SMembers("mychannel:_idx:fabcar:owner:c")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mychannel:fabcar:car1"}, members)
+
+		blockNumber, found, err := storage.Checkpoint()
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, 2, blockNumber)
+
+		// a ledger key looking like an index set is a document like any other
+		require.NoError(t, storage.Store(newTestBlock("mychannel", 3, writeTx("5", "fabcar",
+			&kvrwset.KVWrite{Key: "idx:owner:c", Value: []byte(`{"owner":"c"}`)},
+		))))
+		assert.Equal(t, "c", s.HGet("mychannel:fabcar:idx:owner:c", "owner"))
+		members, err = s.SMembers("mychannel:_idx:fabcar:owner:c")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mychannel:fabcar:car1", "mychannel:fabcar:idx:owner:c"}, members)
+	})
+	t.Run("JSON", func(t *testing.T) {
+		s, storage := newRedisTestStorage(t, RedisConfig{
+			Format:    RedisJSON,
+			KeyPrefix: "ledger:",
+			Indexes:   []RedisIndex{{Chaincode: "fabcar", Fields: []string{"owner"}}},
+		})
+		blocks := cdcTestBlocks("mychannel")
+		require.NoError(t, storage.StoreBulk(blocks[:1]))
+
+		// the blocks stored again in a single batch give the same state as stored one by one
+		require.NoError(t, storage.StoreBulk(blocks))
+		value, err := s.Get("ledger:mychannel:fabcar:car1")
+		require.NoError(t, err)
+		var document map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(value), &document))
+		assert.Equal(t, "c", document["owner"])
+		assert.False(t, s.Exists("ledger:mychannel:fabcar:car2"))
+		assert.False(t, s.Exists("ledger:mychannel:_idx:fabcar:owner:a"))
+		members, err := s.SMembers("ledger:mychannel:_idx:fabcar:owner:c")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ledger:mychannel:fabcar:car1"}, members)
+		checkpoint, err := s.Get("ledger:mychannel:_checkpoint")
+		require.NoError(t, err)
+		assert.Equal(t, "2", checkpoint)
+	})
+	t.Run("PrivateData", func(t *testing.T) {
+		s := miniredis.RunT(t)
+		storage, err := NewRedisStorage(RedisConfig{URL: "redis://" + s.Addr()}, "mychannel", transformation.WithPrivateDataHashes(true))
+		require.NoError(t, err)
+		defer storage.Close()
+		// the key 0102 of the collection coll and the public key coll:0102 are different documents
+		txRWSet := &rwsetutil.TxRwSet{NsRwSets: []*rwsetutil.NsRwSet{{
+			NameSpace: "fabcar",
+			KvRwSet:   &kvrwset.KVRWSet{Writes: []*kvrwset.KVWrite{{Key: "coll:0102", Value: []byte(`{"owner":"a"}`)}}},
+			CollHashedRwSets: []*rwsetutil.CollHashedRwSet{{
+				CollectionName: "coll",
+				HashedRwSet: &kvrwset.HashedRWSet{HashedWrites: []*kvrwset.KVWriteHash{
+					{KeyHash: []byte{0x01, 0x02}, ValueHash: []byte{0x0a, 0x0b}},
+				}},
+			}},
+		}}}
+		results, err := txRWSet.ToProtoBytes()
+		require.NoError(t, err)
+		tx := writeTx("1", "fabcar")
+		tx.Results = results
+		require.NoError(t, storage.Store(newTestBlock("mychannel", 0, tx)))
+		assert.Equal(t, "a", s.HGet("mychannel:fabcar:coll:0102", "owner"))
+		assert.Equal(t, "0a0b", s.HGet("mychannel:fabcar$$coll:0102", transformation.ValueHashKey))
+		assert.Equal(t, "", s.HGet("mychannel:fabcar:coll:0102", transformation.ValueHashKey))
+	})
+	t.Run("Stream", func(t *testing.T) {
+		s, storage := newRedisTestStorage(t, RedisConfig{Notifications: RedisStream, StreamMaxLen: 100})
+		require.NoError(t, storage.StoreBulk(natsTestBlocks("mychannel")))
+		entries, err := s.Stream("mychannel:changes")
+		require.NoError(t, err)
+		var keys []string
+		for _, entry := range entries {
+			require.Equal(t, "change", entry.Values[0])
+			var change map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(entry.Values[1]), &change))
+			keys = append(keys, change["key"].(string)+"/"+change["operation"].(string))
+		}
+		assert.Equal(t, []string{"car1/upsert", "car2/upsert", "car3/delete", "car4/upsert"}, keys)
+	})
+	t.Run("PubSub", func(t *testing.T) {
+		_, storage := newRedisTestStorage(t, RedisConfig{Notifications: RedisPubSub})
+		sub := storage.client.Subscribe(context.Background(), "mychannel:changes")
+		defer sub.Close()
+		_, err := sub.Receive(context.Background())
+		require.NoError(t, err)
+
+		require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+		var payloads []string
+		for i := 0; i < 3; i++ {
+			select {
+			case msg := <-sub.Channel():
+				payloads = append(payloads, msg.Payload)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the changes")
+			}
+		}
+		assert.Contains(t, payloads[0], `"key":"car1","id":`)
+		assert.Contains(t, payloads[2], `"operation":"delete"`)
+	})
+}
@@ -0,0 +1,76 @@
+package listener
+
+import (
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+)
+
+// StorageConfig is the configuration of a backend, decoded from the database section
+type StorageConfig interface {
+	// Validate checks the configuration and sets the defaults of the fields not set
+	Validate() error
+}
+
+// StorageFactory creates the storages of a backend
+type StorageFactory interface {
+	// NewConfig returns a pointer to an empty configuration of the backend
+	NewConfig() StorageConfig
+	// NewStorage creates the storage of a channel from a validated configuration
+	NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error)
+}
+
+// ConfigDecoder decodes the database section of the configuration into the configuration of a backend
+type ConfigDecoder func(config interface{}) error
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]StorageFactory{}
+)
+
+// Register makes a backend available under the database type name, it panics if the name is
+// already registered. Programs embedding hlf-sync register their own backends in an init function
+func Register(name string, factory StorageFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("listener: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("listener: Register called twice for backend " + name)
+	}
+	factories[name] = factory
+}
+
+// Backends returns the names of the registered backends
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStorage creates the storage of a channel with the backend registered under name
+func NewStorage(name string, channelID string, decode ConfigDecoder, opts ...transformation.Option) (BlockStorage, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown database type %q, the registered ones are %v", name, Backends())
+	}
+	config := factory.NewConfig()
+	err := decode(config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s configuration", name)
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s configuration", name)
+	}
+	return factory.NewStorage(config, channelID, opts...)
+}
@@ -0,0 +1,358 @@
+package listener
+
+import (
+	"github.com/Shopify/sarama"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configDecoder decodes the database section of a YAML configuration like the sync command
+func configDecoder(t *testing.T, config string) ConfigDecoder {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(config)))
+	return func(config interface{}) error {
+		return v.UnmarshalKey("database", config)
+	}
+}
+
+type testSinkConfig struct {
+	Target string
+}
+
+func (c *testSinkConfig) Validate() error {
+	if c.Target == "" {
+		return errors.New("target is required")
+	}
+	return nil
+}
+
+type testSink struct {
+	channelID string
+	target    string
+}
+
+func (s testSink) Store(block *cb.Block) error        { return nil }
+func (s testSink) StoreBulk(blocks []*cb.Block) error { return nil }
+
+type testSinkFactory struct{}
+
+func (testSinkFactory) NewConfig() StorageConfig {
+	return &testSinkConfig{}
+}
+
+func (testSinkFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	return testSink{channelID: channelID, target: config.(*testSinkConfig).Target}, nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register("test-sink", testSinkFactory{})
+	assert.Contains(t, Backends(), "test-sink")
+	assert.Subset(t, Backends(), []string{"clickhouse", "elasticsearch", "file", "kafka", "meilisearch", "mongodb", "nats", "redis", "sql", "webhook"})
+	assert.Panics(t, func() {
+		Register("test-sink", testSinkFactory{})
+	})
+
+	storage, err := NewStorage("test-sink", "mychannel", configDecoder(t, `
+database:
+  type: test-sink
+  target: somewhere
+`))
+	require.NoError(t, err)
+	assert.Equal(t, testSink{channelID: "mychannel", target: "somewhere"}, storage)
+
+	_, err = NewStorage("test-sink", "mychannel", configDecoder(t, "database:\n  type: test-sink\n"))
+	assert.EqualError(t, err, "invalid test-sink configuration: target is required")
+
+	_, err = NewStorage("cassandra", "mychannel", configDecoder(t, "database:\n  type: cassandra\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "test-sink")
+}
+
+func TestBackendConfigs(t *testing.T) {
+	decode := func(t *testing.T, name string, config string) StorageConfig {
+		storageConfig := factories[name].NewConfig()
+		require.NoError(t, configDecoder(t, config)(storageConfig))
+		require.NoError(t, storageConfig.Validate())
+		return storageConfig
+	}
+	t.Run("Elasticsearch", func(t *testing.T) {
+		config := decode(t, "elasticsearch", `
+database:
+  type: elasticsearch
+  urls:
+    - http://localhost:9200
+  user: elastic
+  password: changeme
+  caFingerprint: "AA:BB"
+  bulk:
+    retryBackoff: 1s
+  template:
+    fieldsLimit: 2000
+    dynamicTemplates:
+      - strings_as_keywords:
+          match_mapping_type: string
+`).(*ElasticsearchStorageConfig)
+		assert.Equal(t, []string{"http://localhost:9200"}, config.URLs)
+		assert.Equal(t, "elastic", config.Username)
+		assert.Equal(t, "changeme", config.Password)
+		assert.Equal(t, "AA:BB", config.CAFingerprint)
+		assert.Equal(t, ElasticBulkLimits{MaxBytes: DefaultMaxBulkBytes, Retries: DefaultBulkRetries, RetryBackoff: time.Second}, config.Bulk)
+		assert.Equal(t, 2000, config.Template.FieldsLimit)
+		assert.Len(t, config.Template.DynamicTemplates, 1)
+	})
+	t.Run("Meilisearch", func(t *testing.T) {
+		config := decode(t, "meilisearch", `
+database:
+  type: meilisearch
+  url: http://localhost:7700
+  apiKey: masterKey
+  tasks:
+    maxPending: 4
+  indexes:
+    chaincodes:
+      - name: fabcar
+        filterableAttributes: [owner]
+        objectTypeField: docType
+        objects:
+          - objectType: car
+            distinctAttribute: make
+`).(*MeilisearchStorageConfig)
+		assert.Equal(t, MeilisearchConfig{Host: "http://localhost:7700", APIKey: "masterKey"}, config.MeilisearchConfig)
+		assert.Equal(t, MeilisearchTaskLimits{MaxPending: 4, PollInterval: DefaultTaskPollInterval}, config.Tasks)
+		require.Len(t, config.Indexes.Chaincodes, 1)
+		assert.Equal(t, []string{"owner"}, config.Indexes.Chaincodes[0].FilterableAttributes)
+		assert.Equal(t, "make", config.Indexes.Chaincodes[0].Objects[0].DistinctAttribute)
+	})
+	t.Run("MongoDB", func(t *testing.T) {
+		config := decode(t, "mongodb", `
+database:
+  type: mongodb
+  uri: mongodb://localhost:27017/?replicaSet=rs0
+  databasePrefix: hlf_
+`).(*MongoDBStorageConfig)
+		assert.Equal(t, MongoDBConfig{URI: "mongodb://localhost:27017/?replicaSet=rs0", DatabasePrefix: "hlf_"}, config.MongoDBConfig)
+	})
+	t.Run("Kafka", func(t *testing.T) {
+		config := decode(t, "kafka", `
+database:
+  type: kafka
+  brokers: [localhost:9092]
+  compression: zstd
+  topics:
+    transactions: mychannel.transactions
+  format: avro
+  schemaRegistry:
+    url: http://localhost:8081
+`).(*KafkaStorageConfig)
+		assert.Equal(t, []string{"localhost:9092"}, config.Brokers)
+		assert.Equal(t, KafkaTopics{Transactions: "mychannel.transactions"}, config.Topics)
+		assert.Equal(t, KafkaAvro, config.Format)
+		producerConfig, err := newKafkaProducerConfig(config.KafkaConfig)
+		require.NoError(t, err)
+		assert.True(t, producerConfig.Producer.Idempotent)
+		assert.Equal(t, sarama.WaitForAll, producerConfig.Producer.RequiredAcks)
+
+		storageConfig := factories["kafka"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  brokers: [localhost:9092]\n  format: protobuf\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "the protobuf format requires the schemaRegistry url")
+
+		// every topic has a single schema in the registry
+		storageConfig = factories["kafka"].NewConfig()
+		require.NoError(t, configDecoder(t, `
+database:
+  brokers: [localhost:9092]
+  topics:
+    transactions: mychannel.events
+    blocks: mychannel.events
+  format: avro
+  schemaRegistry:
+    url: http://localhost:8081
+`)(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "the avro format requires a topic per kind of message, mychannel.events is set twice")
+		storageConfig = factories["kafka"].NewConfig()
+		require.NoError(t, configDecoder(t, `
+database:
+  brokers: [localhost:9092]
+  topics:
+    blocks: mychannel.changes
+  format: protobuf
+  schemaRegistry:
+    url: http://localhost:8081
+`)(storageConfig))
+		require.NoError(t, storageConfig.Validate())
+		_, err = factories["kafka"].NewStorage(storageConfig, "mychannel")
+		assert.EqualError(t, err, "the protobuf format requires a topic per kind of message, mychannel.changes is set twice")
+
+		storageConfig = factories["kafka"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  brokers: [localhost:9092]\n  cdc:\n    envelope: debezium\n")(storageConfig))
+		require.NoError(t, storageConfig.Validate())
+		assert.Equal(t, CDCConfig{Envelope: DebeziumEnvelope, StateDir: DefaultCDCStateDir}, storageConfig.(*KafkaStorageConfig).CDC)
+	})
+	t.Run("NATS", func(t *testing.T) {
+		config := decode(t, "nats", `
+database:
+  type: nats
+  url: nats://localhost:4222
+  stream:
+    name: HLF
+    duplicateWindow: 1h
+  ackWait: 10s
+`).(*NATSStorageConfig)
+		assert.Equal(t, &NATSStorageConfig{
+			NATSConfig:      NATSConfig{URL: "nats://localhost:4222"},
+			SubjectPrefix:   DefaultNATSSubjectPrefix,
+			ObjectTypeField: DefaultNATSObjectTypeField,
+			Stream:          NATSStreamConfig{Name: "HLF", DuplicateWindow: time.Hour},
+			MaxPending:      DefaultNATSMaxPending,
+			AckWait:         10 * time.Second,
+		}, config)
+
+		storageConfig := factories["nats"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  url: nats://localhost:4222\n  subjectPrefix: hlf.*\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "invalid subject prefix hlf.*")
+	})
+	t.Run("Webhook", func(t *testing.T) {
+		config := decode(t, "webhook", `
+database:
+  type: webhook
+  outboxDir: /var/lib/hlf-sync/webhook
+  retry:
+    maxDelay: 1m
+  endpoints:
+    - name: erp
+      url: https://erp.example.com/hooks/fabric
+      secret: s3cret
+      chaincodes: [fabcar]
+      batchSize: 50
+    - name: alerts
+      url: https://alerts.example.com/fabric
+      payload: events
+      eventNames: ["Car*"]
+      headers:
+        Authorization: Bearer token
+`).(*WebhookStorageConfig)
+		assert.Equal(t, "/var/lib/hlf-sync/webhook", config.OutboxDir)
+		assert.Equal(t, WebhookRetry{Delay: DefaultWebhookRetryDelay, MaxDelay: time.Minute}, config.Retry)
+		require.Len(t, config.Endpoints, 2)
+		assert.Equal(t, WebhookEndpoint{
+			Name:       "erp",
+			URL:        "https://erp.example.com/hooks/fabric",
+			Payload:    WebhookChanges,
+			Secret:     "s3cret",
+			Chaincodes: []string{"fabcar"},
+			BatchSize:  50,
+			Timeout:    DefaultWebhookTimeout,
+		}, config.Endpoints[0])
+		assert.Equal(t, WebhookEvents, config.Endpoints[1].Payload)
+		assert.Equal(t, []string{"Car*"}, config.Endpoints[1].EventNames)
+		assert.Equal(t, map[string]string{"Authorization": "Bearer token"}, config.Endpoints[1].Headers)
+
+		storageConfig := factories["webhook"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  endpoints:\n    - name: erp\n      url: http://erp\n      eventNames: [Car*]\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "endpoint erp filters event names but receives changes")
+	})
+	t.Run("ClickHouse", func(t *testing.T) {
+		config := decode(t, "clickhouse", `
+database:
+  type: clickhouse
+  dsn: tcp://localhost:9000?database=ledger
+  tpsViews: true
+`).(*ClickHouseStorageConfig)
+		assert.Equal(t, ClickHouseConfig{DSN: "tcp://localhost:9000?database=ledger", TablePrefix: DefaultClickHouseTablePrefix, TPSViews: true}, config.ClickHouseConfig)
+
+		storageConfig := factories["clickhouse"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  dsn: tcp://localhost:9000\n  tablePrefix: ledger-\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "invalid table prefix ledger-, only letters, digits and _ are allowed")
+	})
+	t.Run("Redis", func(t *testing.T) {
+		config := decode(t, "redis", `
+database:
+  type: redis
+  url: redis://localhost:6379/0
+  indexes:
+    - chaincode: fabcar
+      fields: [owner, model.make]
+  notifications: stream
+`).(*RedisStorageConfig)
+		assert.Equal(t, RedisConfig{
+			URL:           "redis://localhost:6379/0",
+			Format:        RedisHash,
+			Indexes:       []RedisIndex{{Chaincode: "fabcar", Fields: []string{"owner", "model.make"}}},
+			Notifications: RedisStream,
+			StreamMaxLen:  DefaultRedisStreamMaxLen,
+		}, config.RedisConfig)
+
+		storageConfig := factories["redis"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  url: redis://localhost:6379\n  notifications: keyspace\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "invalid notifications keyspace, it must be pubsub or stream")
+	})
+	t.Run("File", func(t *testing.T) {
+		config := decode(t, "file", `
+database:
+  type: file
+  s3:
+    endpoint: http://minio:9000
+    bucket: ledger
+    accessKey: minio
+    pathStyle: true
+  format: jsonl
+  datasets: [history, transactions]
+  rollInterval: 1h
+  cdc:
+    envelope: debezium
+`).(*FileStorageConfig)
+		assert.Equal(t, FileS3Config{Endpoint: "http://minio:9000", Bucket: "ledger", AccessKey: "minio", PathStyle: true}, config.S3)
+		assert.Equal(t, FileJSONL, config.Format)
+		assert.Equal(t, []FileDataset{FileHistory, FileTransactions}, config.Datasets)
+		assert.Equal(t, DefaultFileRollSize, config.RollSize)
+		assert.Equal(t, time.Hour, config.RollInterval)
+		assert.Equal(t, DefaultCDCStateDir, config.CDC.StateDir)
+
+		storageConfig := factories["file"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  dir: /data\n  datasets: [blocks]\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "dataset blocks not supported")
+		storageConfig = factories["file"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  format: csv\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "a dir or an S3 bucket is required")
+	})
+	t.Run("SQL", func(t *testing.T) {
+		config := decode(t, "sql", `
+database:
+  type: sql
+  driver: sqlite
+  dataSource: hlf.db
+`).(*SQLStorageConfig)
+		assert.Equal(t, &SQLStorageConfig{Driver: SQLiteDriver, DataSource: "hlf.db"}, config)
+
+		storageConfig := factories["sql"].NewConfig()
+		require.NoError(t, configDecoder(t, "database:\n  type: sql\n  driver: oracle\n  dataSource: x\n")(storageConfig))
+		assert.EqualError(t, storageConfig.Validate(), "driver oracle not supported")
+	})
+}
+
+func TestNewSQLStorageFromConfig(t *testing.T) {
+	storage, err := NewStorage("sql", "mychannel", configDecoder(t, `
+database:
+  type: sql
+  driver: sqlite
+  dataSource: `+filepath.Join(t.TempDir(), "hlf.db")+`
+  tables:
+    chaincodes:
+      - name: fabcar
+        infer: true
+`))
+	require.NoError(t, err)
+	dbStorage, ok := storage.(DatabaseStorage)
+	require.True(t, ok)
+	assert.NotNil(t, dbStorage.tables)
+	require.NoError(t, dbStorage.StoreBulk(esTestBlocks("mychannel")))
+}
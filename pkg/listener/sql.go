@@ -1,42 +1,79 @@
 package listener
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/chaincode"
 	"github.com/kfsoftware/hlf-sync/pkg/transformation"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/datatypes"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 	"math"
+	"strings"
 	"time"
 )
 
 type DatabaseStorage struct {
-	tableName string
-	db        *gorm.DB
+	tableName           string
+	blocksTableName     string
+	checkpointTableName string
+	channelID           string
+	tables              *typedTables
+	db                  *gorm.DB
+	opts                []transformation.Option
 }
 type DriverName string
 
 const (
 	PostgresqlDriver = "postgres"
 	MySQLDriver      = "mysql"
+	SQLiteDriver     = "sqlite"
 )
 
+const checkpointID = "current_block"
+
 type Record struct {
-	ID        string
-	Data      datatypes.JSON
-	Chaincode string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID         string
+	Data       datatypes.JSON
+	Chaincode  string
+	Collection string
+	LedgerKey  string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+type BlockRecord struct {
+	Number          int `gorm:"primaryKey;autoIncrement:false"`
+	Hash            string
+	PreviousHash    string
+	DataHash        string
+	TXCount         int
+	ValidTXCount    int
+	InvalidTXCount  int
+	CommitHash      string
+	LastConfigIndex int
+	Signer          datatypes.JSON
+	FirstTXDate     int
+	LastTXDate      int
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+type CheckpointRecord struct {
+	ID          string `gorm:"primaryKey"`
+	BlockNumber int
+	UpdatedAt   time.Time
 }
 
-func NewPostgresStorage(driverName DriverName, dataSourceName string, channelID string) (DatabaseStorage, error) {
+func NewPostgresStorage(driverName DriverName, dataSourceName string, channelID string, opts ...transformation.Option) (DatabaseStorage, error) {
 	var db *gorm.DB
 	var err error
 	newLogger := logger.New(
@@ -69,26 +106,96 @@ func NewPostgresStorage(driverName DriverName, dataSourceName string, channelID
 		if err != nil {
 			return DatabaseStorage{}, err
 		}
+	case SQLiteDriver:
+		db, err = openSQLite(dataSourceName, gormConfig)
+		if err != nil {
+			return DatabaseStorage{}, err
+		}
+		storage, err := newDatabaseStorage(db, channelID, opts...)
+		if err != nil {
+			return storage, err
+		}
+		return storage.withCheckpoint()
 	default:
 		return DatabaseStorage{}, errors.Errorf("Driver %s not supported", string(driverName))
 
 	}
+	return newDatabaseStorage(db, channelID, opts...)
+}
+
+// openSQLite opens the database file in WAL mode, the data can be queried with the JSON1 functions,
+// e.g. SELECT json_extract(data, '$.owner') FROM mychannel
+func openSQLite(dataSourceName string, gormConfig *gorm.Config) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(dataSourceName), gormConfig)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, sharing one connection avoids "database is locked" errors
+	sqlDB.SetMaxOpenConns(1)
+	err = db.Exec("PRAGMA journal_mode=WAL").Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to enable WAL mode")
+	}
+	return db, nil
+}
+
+func newDatabaseStorage(db *gorm.DB, channelID string, opts ...transformation.Option) (DatabaseStorage, error) {
 	tableName := fmt.Sprintf("%s", channelID)
 	storage := DatabaseStorage{
-		db:        db,
-		tableName: tableName,
+		db:              db,
+		tableName:       tableName,
+		blocksTableName: blocksIndexName(channelID),
+		channelID:       channelID,
+		opts:            opts,
+	}
+	err := db.Table(tableName).AutoMigrate(&Record{})
+	if err != nil {
+		return storage, err
 	}
-	err = db.Table(tableName).AutoMigrate(&Record{})
+	err = db.Table(storage.blocksTableName).AutoMigrate(&BlockRecord{})
 	if err != nil {
 		return storage, err
 	}
 	return storage, nil
 }
 
+// withCheckpoint keeps the last stored block in a table of the same database,
+// it is written in the same transaction as the records
+func (m DatabaseStorage) withCheckpoint() (DatabaseStorage, error) {
+	m.checkpointTableName = fmt.Sprintf("%s__checkpoint", m.channelID)
+	err := m.db.Table(m.checkpointTableName).AutoMigrate(&CheckpointRecord{})
+	if err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// Checkpoint returns the last block stored when the storage keeps its own checkpoint
+func (m DatabaseStorage) Checkpoint() (int, bool, error) {
+	if m.checkpointTableName == "" {
+		return 0, false, nil
+	}
+	var records []CheckpointRecord
+	err := m.db.Table(m.checkpointTableName).Where("id = ?", checkpointID).Limit(1).Find(&records).Error
+	if err != nil {
+		return 0, false, err
+	}
+	if len(records) == 0 {
+		return 0, false, nil
+	}
+	return records[0].BlockNumber, true, nil
+}
+
 func (m DatabaseStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
 	var recordsToAdd []Record
 	var recordsToRemove []string
 	var keyDocsAdded []string
+	var documentsToAdd []*transformation.Document
+	var documentsToRemove []*transformation.Document
 	for _, document := range response.DocumentsToAdd {
 		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
 			continue
@@ -100,25 +207,180 @@ func (m DatabaseStorage) storeDocs(response *transformation.DocumentExtractionRe
 		recordsToAdd = append(
 			recordsToAdd,
 			Record{
-				ID:        document.PrimaryKey,
-				Chaincode: document.ChaincodeID,
-				Data:      jsonBytes,
+				ID:         document.PrimaryKey,
+				Chaincode:  document.ChaincodeID,
+				Collection: document.Collection,
+				LedgerKey:  document.Key,
+				Data:       jsonBytes,
 			},
 		)
-		keyDocsAdded = append(keyDocsAdded, document.PrimaryKey)
+		keyDocsAdded = append(keyDocsAdded, document.Key)
+		documentsToAdd = append(documentsToAdd, document)
+	}
+	for _, document := range response.DocumentsToRemove {
+		if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" {
+			continue
+		}
+		recordsToRemove = append(recordsToRemove, document.PrimaryKey)
+		documentsToRemove = append(documentsToRemove, document)
+	}
+	if m.tables != nil {
+		err := m.tables.prepare(m.db, documentsToAdd)
+		if err != nil {
+			return err
+		}
+	}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if len(recordsToAdd) > 0 {
+			err := tx.Table(m.tableName).Clauses(clause.OnConflict{
+				UpdateAll: true,
+			}).CreateInBatches(recordsToAdd, 100).Error
+			if err != nil {
+				return errors.Wrapf(err, "failed to upsert %d records", len(recordsToAdd))
+			}
+		}
+		if len(recordsToRemove) > 0 {
+			err := tx.Table(m.tableName).Delete(Record{}, "id IN ?", recordsToRemove).Error
+			if err != nil {
+				return errors.Wrapf(err, "failed to delete %d records", len(recordsToRemove))
+			}
+		}
+		if m.tables != nil {
+			err := m.tables.store(tx, documentsToAdd, documentsToRemove)
+			if err != nil {
+				return err
+			}
+		}
+		err := storeBlocks(tx, m.blocksTableName, response.Blocks)
+		if err != nil {
+			return err
+		}
+		if m.checkpointTableName == "" || len(response.Blocks) == 0 {
+			return nil
+		}
+		checkpoint := CheckpointRecord{ID: checkpointID}
+		for _, block := range response.Blocks {
+			if block.Number > checkpoint.BlockNumber {
+				checkpoint.BlockNumber = block.Number
+			}
+		}
+		err = tx.Table(m.checkpointTableName).Clauses(clause.OnConflict{
+			UpdateAll: true,
+		}).Create(&checkpoint).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to store checkpoint")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	m.db.Table(m.tableName).Clauses(clause.OnConflict{
-		UpdateAll: true,
-	}).CreateInBatches(recordsToAdd, 100)
-	m.db.Table(m.tableName).Delete(Record{}, "id IN ?", recordsToRemove)
 
 	log.Infof("Items added=%d %v", len(response.DocumentsToAdd), keyDocsAdded[:int(math.Min(float64(10), float64(len(keyDocsAdded))))])
-	log.Infof("Items removed=%d", len(response.DocumentsToRemove))
+	log.Infof("Items removed=%d", len(recordsToRemove))
+	return nil
+}
+
+func storeBlocks(db *gorm.DB, tableName string, blocks []*transformation.BlockInfo) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	var records []BlockRecord
+	for _, block := range blocks {
+		signer, err := json.Marshal(block.Signer)
+		if err != nil {
+			return err
+		}
+		records = append(records, BlockRecord{
+			Number:          block.Number,
+			Hash:            block.Hash,
+			PreviousHash:    block.PreviousHash,
+			DataHash:        block.DataHash,
+			TXCount:         block.TXCount,
+			ValidTXCount:    block.ValidTXCount,
+			InvalidTXCount:  block.InvalidTXCount,
+			CommitHash:      block.CommitHash,
+			LastConfigIndex: block.LastConfigIndex,
+			Signer:          signer,
+			FirstTXDate:     block.FirstTXDate,
+			LastTXDate:      block.LastTXDate,
+		})
+	}
+	err := db.Table(tableName).Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).CreateInBatches(records, 100).Error
+	if err != nil {
+		return errors.Wrapf(err, "failed to upsert %d blocks", len(records))
+	}
 	return nil
 }
 
+// Migrate moves the records stored with the ledger key as ID to the canonical document ID. A record the sync
+// already stored with the canonical ID is newer, the legacy record is deleted then
+func (m DatabaseStorage) Migrate() error {
+	for {
+		var records []Record
+		err := m.db.Table(m.tableName).Where("ledger_key IS NULL OR ledger_key = ?", "").Limit(500).Find(&records).Error
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			for _, record := range records {
+				documentKey := transformation.DocumentKey{
+					ChannelID: m.channelID,
+					Namespace: record.Chaincode,
+					Key:       record.ID,
+				}
+				var count int64
+				err := tx.Table(m.tableName).Where("id = ?", documentKey.ID()).Count(&count).Error
+				if err != nil {
+					return err
+				}
+				if count > 0 {
+					err = tx.Table(m.tableName).Where("id = ?", record.ID).Delete(&Record{}).Error
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				var data map[string]interface{}
+				err = json.Unmarshal(record.Data, &data)
+				if err != nil {
+					return err
+				}
+				data[transformation.PrimaryKey] = documentKey.ID()
+				data[transformation.KeyKey] = record.ID
+				data[transformation.ChannelKey] = m.channelID
+				data[transformation.NamespaceKey] = record.Chaincode
+				data[transformation.CollectionKey] = ""
+				jsonBytes, err := json.Marshal(data)
+				if err != nil {
+					return err
+				}
+				err = tx.Table(m.tableName).Where("id = ?", record.ID).Updates(map[string]interface{}{
+					"id":         documentKey.ID(),
+					"ledger_key": record.ID,
+					"collection": "",
+					"data":       datatypes.JSON(jsonBytes),
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Infof("Migrated %d records of table %s", len(records), m.tableName)
+	}
+}
+
 func (m DatabaseStorage) StoreBulk(blocks []*cb.Block) error {
-	response, err := transformation.BlocksToDocuments(blocks)
+	response, err := transformation.BlocksToDocuments(blocks, m.opts...)
 	if err != nil {
 		return err
 	}
@@ -128,8 +390,14 @@ func (m DatabaseStorage) StoreBulk(blocks []*cb.Block) error {
 	}
 	return nil
 }
+
+// StoreDocuments stores blocks already decoded
+func (m DatabaseStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return m.storeDocs(response)
+}
+
 func (m DatabaseStorage) Store(block *cb.Block) error {
-	response, err := transformation.BlockToDocuments(block)
+	response, err := transformation.BlockToDocuments(block, m.opts...)
 	if err != nil {
 		return err
 	}
@@ -139,3 +407,120 @@ func (m DatabaseStorage) Store(block *cb.Block) error {
 	}
 	return nil
 }
+
+// CreateIndexes creates an expression index on the JSON column for every index definition of the chaincode
+func (m DatabaseStorage) CreateIndexes(chaincodeID string, indexes []*chaincode.Index) error {
+	for _, index := range indexes {
+		indexName := fmt.Sprintf(
+			"idx_%x",
+			sha256.Sum256([]byte(strings.Join([]string{m.tableName, chaincodeID, index.Collection, index.DesignDoc, index.Name}, "\x00"))),
+		)[:24]
+		var keyParts []string
+		for _, field := range index.Fields {
+			path, err := indexFieldPath(field)
+			if err != nil {
+				return errors.Wrapf(err, "invalid index %s", index.Name)
+			}
+			keyPart := jsonFieldExpression(m.db, path)
+			if field.Desc {
+				keyPart += " DESC"
+			}
+			keyParts = append(keyParts, keyPart)
+		}
+		var statement string
+		switch m.db.Dialector.Name() {
+		case MySQLDriver:
+			var count int64
+			err := m.db.Raw(
+				"SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?",
+				m.tableName,
+				indexName,
+			).Scan(&count).Error
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			// MySQL has no partial indexes, the chaincode and the collection are the first key parts
+			keyParts = append([]string{"`chaincode`(64)", "`collection`(64)"}, keyParts...)
+			statement = fmt.Sprintf("CREATE INDEX %s ON %s (%s)", quote(m.db, indexName), quote(m.db, m.tableName), strings.Join(keyParts, ", "))
+		default:
+			statement = fmt.Sprintf(
+				"CREATE INDEX IF NOT EXISTS %s ON %s (%s) WHERE %s = %s AND %s = %s",
+				quote(m.db, indexName),
+				quote(m.db, m.tableName),
+				strings.Join(keyParts, ", "),
+				quote(m.db, "chaincode"),
+				quoteLiteral(chaincodeID),
+				quote(m.db, "collection"),
+				quoteLiteral(index.Collection),
+			)
+		}
+		err := m.db.Exec(statement).Error
+		if err != nil {
+			return errors.Wrapf(err, "failed to create index %s of chaincode %s", index.Name, chaincodeID)
+		}
+		log.Infof("Created index %s of chaincode %s on table %s", index.Name, chaincodeID, m.tableName)
+	}
+	return nil
+}
+
+// jsonFieldExpression returns the expression extracting a field of the data column as text,
+// queries must use the same expression to use the index
+func jsonFieldExpression(db *gorm.DB, path []string) string {
+	switch db.Dialector.Name() {
+	case PostgresqlDriver:
+		return fmt.Sprintf(`(data #>> '{"%s"}')`, strings.Join(path, `","`))
+	case MySQLDriver:
+		return fmt.Sprintf(`(CAST(data->>'$."%s"' AS CHAR(255)) COLLATE utf8mb4_bin)`, strings.Join(path, `"."`))
+	default:
+		return fmt.Sprintf(`json_extract(data, '$."%s"')`, strings.Join(path, `"."`))
+	}
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// SQLStorageConfig is the configuration of the sql database type
+type SQLStorageConfig struct {
+	Driver     DriverName
+	DataSource string
+	// Tables also stores the documents in typed tables when set
+	Tables *TableMapping
+}
+
+func (c *SQLStorageConfig) Validate() error {
+	switch c.Driver {
+	case PostgresqlDriver, MySQLDriver, SQLiteDriver:
+	default:
+		return errors.Errorf("driver %s not supported", c.Driver)
+	}
+	if c.DataSource == "" {
+		return errors.New("dataSource is required")
+	}
+	return nil
+}
+
+type sqlFactory struct{}
+
+func (sqlFactory) NewConfig() StorageConfig {
+	return &SQLStorageConfig{}
+}
+
+func (sqlFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	c := config.(*SQLStorageConfig)
+	storage, err := NewPostgresStorage(c.Driver, c.DataSource, channelID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.Tables != nil {
+		return storage.WithTables(*c.Tables)
+	}
+	return storage, nil
+}
+
+func init() {
+	Register("sql", sqlFactory{})
+}
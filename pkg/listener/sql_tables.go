@@ -0,0 +1,874 @@
+package listener
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ColumnType string
+
+const (
+	StringColumn  ColumnType = "string"
+	IntegerColumn ColumnType = "integer"
+	NumberColumn  ColumnType = "number"
+	BooleanColumn ColumnType = "boolean"
+	JSONColumn    ColumnType = "json"
+)
+
+const (
+	blockNumberColumn = "_fabric_block"
+	parentIDColumn    = "_parent_id"
+	positionColumn    = "_position"
+)
+
+// systemColumns are added to every chaincode table
+var systemColumns = []string{
+	transformation.PrimaryKey,
+	transformation.KeyKey,
+	transformation.CollectionKey,
+	transformation.TxIDKey,
+	transformation.DateKey,
+	blockNumberColumn,
+}
+
+// ColumnSchema declares a column of a typed table, the column name is the field of the document
+type ColumnSchema struct {
+	Name string     `mapstructure:"name"`
+	Type ColumnType `mapstructure:"type"`
+}
+
+// ChildTableSchema declares the table holding the objects of an array field
+type ChildTableSchema struct {
+	Field   string         `mapstructure:"field"`
+	Columns []ColumnSchema `mapstructure:"columns"`
+	Indexes []string       `mapstructure:"indexes"`
+}
+
+// TableSchema declares the columns of a table, arrays of objects are stored in child tables
+type TableSchema struct {
+	Columns  []ColumnSchema     `mapstructure:"columns"`
+	Indexes  []string           `mapstructure:"indexes"`
+	Children []ChildTableSchema `mapstructure:"children"`
+}
+
+// ObjectSchema declares the table of the documents of an object type
+type ObjectSchema struct {
+	ObjectType  string `mapstructure:"objectType"`
+	TableSchema `mapstructure:",squash"`
+}
+
+// ChaincodeSchema maps the documents of a chaincode to tables. The documents are stored in one table
+// per object type when ObjectTypeField is set, the chaincode schema applies to the documents without it
+type ChaincodeSchema struct {
+	Name            string `mapstructure:"name"`
+	TableSchema     `mapstructure:",squash"`
+	ObjectTypeField string         `mapstructure:"objectTypeField"`
+	Objects         []ObjectSchema `mapstructure:"objects"`
+	Infer           bool           `mapstructure:"infer"`
+}
+
+// TableMapping is the typed tables configuration, chaincodes not declared get inferred tables when Infer is set.
+// Names are declared as values instead of map keys since the configuration keys are case insensitive
+type TableMapping struct {
+	Infer      bool              `mapstructure:"infer"`
+	Chaincodes []ChaincodeSchema `mapstructure:"chaincodes"`
+}
+
+type tableSchema struct {
+	columns  map[string]ColumnType
+	indexes  []string
+	children map[string]tableSchema
+}
+
+type chaincodeTables struct {
+	root            tableSchema
+	objectTypeField string
+	objects         map[string]tableSchema
+	infer           bool
+}
+
+func newTableSchema(columns []ColumnSchema, indexes []string) (tableSchema, error) {
+	schema := tableSchema{
+		columns:  map[string]ColumnType{},
+		indexes:  indexes,
+		children: map[string]tableSchema{},
+	}
+	for _, column := range columns {
+		if !validColumnName(column.Name) {
+			return schema, errors.Errorf("column %s can't contain dots or exceed %d characters", column.Name, maxIdentifierLength)
+		}
+		switch column.Type {
+		case StringColumn, IntegerColumn, NumberColumn, BooleanColumn, JSONColumn:
+		default:
+			return schema, errors.Errorf("column %s has an unknown type %s", column.Name, column.Type)
+		}
+		schema.columns[column.Name] = column.Type
+	}
+	for _, index := range indexes {
+		if _, ok := schema.columns[index]; !ok && !isSystemColumn(index) {
+			return schema, errors.Errorf("index column %s is not declared", index)
+		}
+	}
+	return schema, nil
+}
+
+func compileTableSchema(declared TableSchema) (tableSchema, error) {
+	schema, err := newTableSchema(declared.Columns, declared.Indexes)
+	if err != nil {
+		return schema, err
+	}
+	for _, child := range declared.Children {
+		childSchema, err := newTableSchema(child.Columns, child.Indexes)
+		if err != nil {
+			return schema, errors.Wrapf(err, "invalid child table %s", child.Field)
+		}
+		schema.children[child.Field] = childSchema
+	}
+	return schema, nil
+}
+
+func compileTableMapping(mapping TableMapping) (map[string]chaincodeTables, error) {
+	chaincodes := map[string]chaincodeTables{}
+	for _, chaincode := range mapping.Chaincodes {
+		root, err := compileTableSchema(chaincode.TableSchema)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid schema of chaincode %s", chaincode.Name)
+		}
+		tables := chaincodeTables{
+			root:            root,
+			objectTypeField: chaincode.ObjectTypeField,
+			objects:         map[string]tableSchema{},
+			infer:           chaincode.Infer,
+		}
+		for _, object := range chaincode.Objects {
+			schema, err := compileTableSchema(object.TableSchema)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid schema of %s in chaincode %s", object.ObjectType, chaincode.Name)
+			}
+			tables.objects[object.ObjectType] = schema
+		}
+		chaincodes[chaincode.Name] = tables
+	}
+	return chaincodes, nil
+}
+
+// TableRecord is the registry entry of a typed table, the registry keeps the inferred schema between restarts
+type TableRecord struct {
+	Name       string `gorm:"primaryKey"`
+	Chaincode  string
+	ObjectType string
+	Parent     string
+	Field      string
+	Columns    datatypes.JSON
+	Indexes    datatypes.JSON
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+type typedTable struct {
+	name       string
+	chaincode  string
+	objectType string
+	parent     string
+	field      string
+	columns    map[string]ColumnType
+	indexes    []string
+	children   map[string]*typedTable
+}
+
+type typedTables struct {
+	channelID         string
+	registryTableName string
+	infer             bool
+	chaincodes        map[string]chaincodeTables
+	tables            map[string]*typedTable
+}
+
+var identifierRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func sanitizeIdentifier(name string) string {
+	return identifierRegexp.ReplaceAllString(name, "_")
+}
+
+// maxIdentifierLength is the identifier length limit of PostgreSQL, MySQL allows 64
+const maxIdentifierLength = 63
+
+// validColumnName reports if a field can be stored as a column, gorm quotes the parts of a name
+// with dots as a qualified name and the databases reject the names exceeding the identifier length
+func validColumnName(name string) bool {
+	return name != "" && !strings.Contains(name, ".") && len(name) <= maxIdentifierLength
+}
+
+// tableIdentifier replaces the dots of a table name, channel names can contain them, and
+// shortens the names exceeding the identifier length with a hash suffix
+func tableIdentifier(name string) string {
+	name = strings.Replace(name, ".", "_", -1)
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	suffix := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:16]
+	return name[:maxIdentifierLength-len(suffix)-1] + "_" + suffix
+}
+
+func isSystemColumn(column string) bool {
+	for _, systemColumn := range systemColumns {
+		if column == systemColumn {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTables also stores the chaincode documents in typed tables, one per chaincode or object type
+func (m DatabaseStorage) WithTables(mapping TableMapping) (DatabaseStorage, error) {
+	chaincodes, err := compileTableMapping(mapping)
+	if err != nil {
+		return m, err
+	}
+	tables := &typedTables{
+		channelID:         m.channelID,
+		registryTableName: fmt.Sprintf("%s__tables", m.channelID),
+		infer:             mapping.Infer,
+		chaincodes:        chaincodes,
+	}
+	err = m.db.Table(tables.registryTableName).AutoMigrate(&TableRecord{})
+	if err != nil {
+		return m, err
+	}
+	err = tables.load(m.db)
+	if err != nil {
+		return m, err
+	}
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		for chaincodeID, schema := range chaincodes {
+			if schema.objectTypeField == "" || len(schema.root.columns) > 0 {
+				_, err := tables.ensureTable(tx, chaincodeID, "", schema.root)
+				if err != nil {
+					return err
+				}
+			}
+			for objectType, objectSchema := range schema.objects {
+				_, err := tables.ensureTable(tx, chaincodeID, objectType, objectSchema)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	m.tables = tables
+	return m, nil
+}
+
+// load reads the registry, it's also used to discard the changes of a failed transaction
+func (t *typedTables) load(db *gorm.DB) error {
+	var records []TableRecord
+	err := db.Table(t.registryTableName).Find(&records).Error
+	if err != nil {
+		return err
+	}
+	t.tables = map[string]*typedTable{}
+	for _, record := range records {
+		table := &typedTable{
+			name:       record.Name,
+			chaincode:  record.Chaincode,
+			objectType: record.ObjectType,
+			parent:     record.Parent,
+			field:      record.Field,
+			columns:    map[string]ColumnType{},
+			children:   map[string]*typedTable{},
+		}
+		err = json.Unmarshal(record.Columns, &table.columns)
+		if err != nil {
+			return errors.Wrapf(err, "invalid columns of table %s", record.Name)
+		}
+		if len(record.Indexes) > 0 {
+			err = json.Unmarshal(record.Indexes, &table.indexes)
+			if err != nil {
+				return errors.Wrapf(err, "invalid indexes of table %s", record.Name)
+			}
+		}
+		t.tables[table.name] = table
+	}
+	for _, table := range t.tables {
+		if parent, ok := t.tables[table.parent]; ok {
+			parent.children[table.field] = table
+		}
+	}
+	return nil
+}
+
+func (t *typedTables) tableName(chaincodeID string, objectType string) string {
+	name := fmt.Sprintf("%s_%s", t.channelID, chaincodeID)
+	if objectType != "" {
+		name = fmt.Sprintf("%s_%s", name, sanitizeIdentifier(objectType))
+	}
+	return tableIdentifier(name)
+}
+
+// schemaFor returns the declared schema of the documents of a chaincode and object type,
+// ok is false when they aren't stored in typed tables
+func (t *typedTables) schemaFor(chaincodeID string, objectType string) (schema tableSchema, infer bool, ok bool) {
+	chaincode, declared := t.chaincodes[chaincodeID]
+	if !declared {
+		return tableSchema{}, t.infer, t.infer
+	}
+	if objectType == "" {
+		return chaincode.root, chaincode.infer, true
+	}
+	objectSchema, declared := chaincode.objects[objectType]
+	if !declared {
+		return tableSchema{}, chaincode.infer, chaincode.infer
+	}
+	return objectSchema, chaincode.infer, true
+}
+
+func (t *typedTables) objectTypeOf(document *transformation.Document) string {
+	chaincode, ok := t.chaincodes[document.ChaincodeID]
+	if !ok || chaincode.objectTypeField == "" {
+		return ""
+	}
+	objectType, _ := document.Data[chaincode.objectTypeField].(string)
+	return objectType
+}
+
+// ensureTable creates the table or adds the columns and indexes missing, columns are never dropped or retyped
+func (t *typedTables) ensureTable(tx *gorm.DB, chaincodeID string, objectType string, schema tableSchema) (*typedTable, error) {
+	table, err := t.ensure(tx, &typedTable{
+		name:       t.tableName(chaincodeID, objectType),
+		chaincode:  chaincodeID,
+		objectType: objectType,
+		columns:    schema.columns,
+		indexes:    schema.indexes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for field, childSchema := range schema.children {
+		_, err := t.ensure(tx, &typedTable{
+			name:       tableIdentifier(fmt.Sprintf("%s__%s", table.name, sanitizeIdentifier(field))),
+			chaincode:  chaincodeID,
+			objectType: objectType,
+			parent:     table.name,
+			field:      field,
+			columns:    childSchema.columns,
+			indexes:    childSchema.indexes,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// ensure creates the table or adds the columns and indexes missing. The statements are idempotent since MySQL
+// commits DDL statements implicitly, a table may have been changed without its registry entry being saved
+func (t *typedTables) ensure(tx *gorm.DB, spec *typedTable) (*typedTable, error) {
+	table, exists := t.tables[spec.name]
+	if !exists {
+		table = &typedTable{
+			name:       spec.name,
+			chaincode:  spec.chaincode,
+			objectType: spec.objectType,
+			parent:     spec.parent,
+			field:      spec.field,
+			columns:    map[string]ColumnType{},
+			children:   map[string]*typedTable{},
+		}
+		err := tx.Exec(createTableStatement(tx, spec)).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create table %s", table.name)
+		}
+		log.Infof("Created table %s", table.name)
+	}
+	changed := !exists
+	var currentColumns []string
+	for _, column := range sortedColumns(spec.columns) {
+		columnType := spec.columns[column]
+		currentType, ok := table.columns[column]
+		if ok {
+			if currentType != columnType {
+				log.Warnf("Column %s of table %s is %s, it's not changed to %s", column, table.name, currentType, columnType)
+			}
+			continue
+		}
+		if currentColumns == nil {
+			var err error
+			currentColumns, err = tableColumns(tx, table.name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !contains(currentColumns, column) {
+			err := tx.Exec(fmt.Sprintf(
+				"ALTER TABLE %s ADD COLUMN %s %s",
+				quote(tx, table.name),
+				quote(tx, column),
+				sqlType(tx, columnType),
+			)).Error
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to add column %s to table %s", column, table.name)
+			}
+			log.Infof("Added column %s to table %s", column, table.name)
+		}
+		table.columns[column] = columnType
+		changed = true
+	}
+	if !changed && containsAll(table.indexes, spec.indexes) {
+		return table, nil
+	}
+	for _, column := range spec.indexes {
+		if contains(table.indexes, column) {
+			continue
+		}
+		if !tx.Migrator().HasIndex(table.name, indexName(table, column)) {
+			err := tx.Exec(createIndexStatement(tx, table, column)).Error
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to create index on %s of table %s", column, table.name)
+			}
+		}
+		table.indexes = append(table.indexes, column)
+	}
+	t.tables[table.name] = table
+	if parent, ok := t.tables[table.parent]; ok {
+		parent.children[table.field] = table
+	}
+	return table, t.save(tx, table)
+}
+
+func (t *typedTables) save(tx *gorm.DB, table *typedTable) error {
+	columns, err := json.Marshal(table.columns)
+	if err != nil {
+		return err
+	}
+	indexes, err := json.Marshal(table.indexes)
+	if err != nil {
+		return err
+	}
+	record := TableRecord{
+		Name:       table.name,
+		Chaincode:  table.chaincode,
+		ObjectType: table.objectType,
+		Parent:     table.parent,
+		Field:      table.field,
+		Columns:    columns,
+		Indexes:    indexes,
+	}
+	return tx.Table(t.registryTableName).Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&record).Error
+}
+
+// prepare creates or alters the tables of the documents before they are stored. The schema changes run in their
+// own transaction since MySQL commits DDL statements implicitly, they would also commit the batch of documents
+func (t *typedTables) prepare(db *gorm.DB, documentsToAdd []*transformation.Document) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		prepared := map[string]bool{}
+		for _, document := range documentsToAdd {
+			objectType := t.objectTypeOf(document)
+			schema, infer, ok := t.schemaFor(document.ChaincodeID, objectType)
+			if !ok {
+				continue
+			}
+			name := t.tableName(document.ChaincodeID, objectType)
+			if prepared[name] {
+				continue
+			}
+			prepared[name] = true
+			if infer {
+				schema = inferSchema(schema, t.tables[name], documentsToAdd, func(document *transformation.Document) bool {
+					return t.tableName(document.ChaincodeID, t.objectTypeOf(document)) == name
+				})
+			}
+			_, err := t.ensureTable(tx, document.ChaincodeID, objectType, schema)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// the changes of the registry were rolled back, the schema changes are done again with the next batch
+		loadErr := t.load(db)
+		if loadErr != nil {
+			log.Errorf("Failed to reload the tables registry: %v", loadErr)
+		}
+	}
+	return err
+}
+
+// store replaces the rows of the documents written, a document is deleted from every table of
+// its chaincode first since its object type may have changed
+func (t *typedTables) store(tx *gorm.DB, documentsToAdd []*transformation.Document, documentsToRemove []*transformation.Document) error {
+	idsByChaincode := map[string][]string{}
+	for _, documents := range [][]*transformation.Document{documentsToAdd, documentsToRemove} {
+		for _, document := range documents {
+			idsByChaincode[document.ChaincodeID] = append(idsByChaincode[document.ChaincodeID], document.PrimaryKey)
+		}
+	}
+	for _, table := range t.tables {
+		ids, ok := idsByChaincode[table.chaincode]
+		if !ok {
+			continue
+		}
+		idColumn := transformation.PrimaryKey
+		if table.parent != "" {
+			idColumn = parentIDColumn
+		}
+		for start := 0; start < len(ids); start += 500 {
+			end := int(math.Min(float64(start+500), float64(len(ids))))
+			err := tx.Exec(
+				fmt.Sprintf("DELETE FROM %s WHERE %s IN ?", quote(tx, table.name), quote(tx, idColumn)),
+				ids[start:end],
+			).Error
+			if err != nil {
+				return errors.Wrapf(err, "failed to delete rows of table %s", table.name)
+			}
+		}
+	}
+	documentsByTable := map[string][]*transformation.Document{}
+	var tableNames []string
+	for _, document := range documentsToAdd {
+		objectType := t.objectTypeOf(document)
+		if _, _, ok := t.schemaFor(document.ChaincodeID, objectType); !ok {
+			continue
+		}
+		name := t.tableName(document.ChaincodeID, objectType)
+		if _, ok := documentsByTable[name]; !ok {
+			tableNames = append(tableNames, name)
+		}
+		documentsByTable[name] = append(documentsByTable[name], document)
+	}
+	for _, name := range tableNames {
+		table, ok := t.tables[name]
+		if !ok {
+			return errors.Errorf("table %s doesn't exist", name)
+		}
+		var rows [][]interface{}
+		childRows := map[string][][]interface{}{}
+		for _, document := range documentsByTable[name] {
+			row := []interface{}{
+				document.PrimaryKey,
+				document.Key,
+				document.Collection,
+				document.TXID,
+				document.TXDate,
+				document.BlockNumber,
+			}
+			for _, column := range sortedColumns(table.columns) {
+				row = append(row, columnValue(table, column, document.Data[column]))
+			}
+			rows = append(rows, row)
+			for field, child := range table.children {
+				elements, _ := document.Data[field].([]interface{})
+				for position, element := range elements {
+					object, ok := element.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					childRow := []interface{}{document.PrimaryKey, position}
+					for _, column := range sortedColumns(child.columns) {
+						childRow = append(childRow, columnValue(child, column, object[column]))
+					}
+					childRows[child.name] = append(childRows[child.name], childRow)
+				}
+			}
+		}
+		err := insertRows(tx, table.name, append(append([]string{}, systemColumns...), sortedColumns(table.columns)...), rows)
+		if err != nil {
+			return err
+		}
+		for _, child := range table.children {
+			columns := append([]string{parentIDColumn, positionColumn}, sortedColumns(child.columns)...)
+			err := insertRows(tx, child.name, columns, childRows[child.name])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inferSchema adds to the schema the fields of the documents not yet stored as columns
+func inferSchema(schema tableSchema, table *typedTable, documents []*transformation.Document, filter func(document *transformation.Document) bool) tableSchema {
+	inferred := tableSchema{
+		columns:  map[string]ColumnType{},
+		indexes:  schema.indexes,
+		children: map[string]tableSchema{},
+	}
+	for column, columnType := range schema.columns {
+		inferred.columns[column] = columnType
+	}
+	for field, child := range schema.children {
+		inferred.children[field] = child
+	}
+	if table != nil {
+		for column, columnType := range table.columns {
+			inferred.columns[column] = columnType
+		}
+		for field, child := range table.children {
+			inferred.children[field] = tableSchema{columns: child.columns}
+		}
+	}
+	for _, document := range documents {
+		if !filter(document) {
+			continue
+		}
+		for field, value := range document.Data {
+			if strings.HasPrefix(field, "_fabric_") {
+				continue
+			}
+			if !validColumnName(field) {
+				log.Debugf("Field %s of document %s is not stored as a column", field, document.Key)
+				continue
+			}
+			if _, ok := inferred.columns[field]; ok {
+				continue
+			}
+			if child, ok := inferred.children[field]; ok {
+				inferred.children[field] = inferElements(child, value)
+				continue
+			}
+			if isObjectArray(value) {
+				inferred.children[field] = inferElements(tableSchema{}, value)
+				continue
+			}
+			if columnType, ok := inferColumnType(value); ok {
+				inferred.columns[field] = columnType
+			}
+		}
+	}
+	return inferred
+}
+
+func inferElements(schema tableSchema, value interface{}) tableSchema {
+	inferred := tableSchema{columns: map[string]ColumnType{}, indexes: schema.indexes}
+	for column, columnType := range schema.columns {
+		inferred.columns[column] = columnType
+	}
+	elements, _ := value.([]interface{})
+	for _, element := range elements {
+		object, _ := element.(map[string]interface{})
+		for field, fieldValue := range object {
+			if _, ok := inferred.columns[field]; ok || !validColumnName(field) {
+				continue
+			}
+			if columnType, ok := inferColumnType(fieldValue); ok {
+				inferred.columns[field] = columnType
+			}
+		}
+	}
+	return inferred
+}
+
+// inferColumnType maps a JSON value to a column type, numbers are always inferred as number
+// since a field holding whole numbers may hold decimals later
+func inferColumnType(value interface{}) (ColumnType, bool) {
+	switch value.(type) {
+	case string:
+		return StringColumn, true
+	case bool:
+		return BooleanColumn, true
+	case float64:
+		return NumberColumn, true
+	case map[string]interface{}, []interface{}:
+		return JSONColumn, true
+	}
+	return "", false
+}
+
+func isObjectArray(value interface{}) bool {
+	elements, ok := value.([]interface{})
+	if !ok || len(elements) == 0 {
+		return false
+	}
+	for _, element := range elements {
+		if _, ok := element.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// columnValue converts a JSON value to the column type, values that don't fit are stored as NULL
+func columnValue(table *typedTable, column string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	columnType := table.columns[column]
+	switch columnType {
+	case StringColumn:
+		if s, ok := value.(string); ok {
+			return s
+		}
+	case IntegerColumn:
+		if f, ok := value.(float64); ok && f == math.Trunc(f) {
+			return int64(f)
+		}
+	case NumberColumn:
+		if f, ok := value.(float64); ok {
+			return f
+		}
+	case BooleanColumn:
+		if b, ok := value.(bool); ok {
+			return b
+		}
+	case JSONColumn:
+		jsonBytes, err := json.Marshal(value)
+		if err == nil {
+			return string(jsonBytes)
+		}
+	}
+	log.Debugf("Value %v of column %s in table %s is not %s, storing NULL", value, column, table.name, columnType)
+	return nil
+}
+
+func insertRows(tx *gorm.DB, tableName string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = quote(tx, column)
+	}
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	for start := 0; start < len(rows); start += 100 {
+		end := int(math.Min(float64(start+100), float64(len(rows))))
+		var values []interface{}
+		var tuples []string
+		for _, row := range rows[start:end] {
+			values = append(values, row...)
+			tuples = append(tuples, placeholders)
+		}
+		err := tx.Exec(fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES %s",
+			quote(tx, tableName),
+			strings.Join(quotedColumns, ","),
+			strings.Join(tuples, ","),
+		), values...).Error
+		if err != nil {
+			return errors.Wrapf(err, "failed to insert %d rows in table %s", end-start, tableName)
+		}
+	}
+	return nil
+}
+
+func createTableStatement(tx *gorm.DB, table *typedTable) string {
+	var definitions []string
+	if table.parent == "" {
+		definitions = []string{
+			fmt.Sprintf("%s VARCHAR(64) NOT NULL PRIMARY KEY", quote(tx, transformation.PrimaryKey)),
+			fmt.Sprintf("%s %s", quote(tx, transformation.KeyKey), sqlType(tx, StringColumn)),
+			fmt.Sprintf("%s %s", quote(tx, transformation.CollectionKey), sqlType(tx, StringColumn)),
+			fmt.Sprintf("%s VARCHAR(64)", quote(tx, transformation.TxIDKey)),
+			fmt.Sprintf("%s BIGINT", quote(tx, transformation.DateKey)),
+			fmt.Sprintf("%s BIGINT", quote(tx, blockNumberColumn)),
+		}
+	} else {
+		definitions = []string{
+			fmt.Sprintf("%s VARCHAR(64) NOT NULL", quote(tx, parentIDColumn)),
+			fmt.Sprintf("%s INTEGER NOT NULL", quote(tx, positionColumn)),
+		}
+	}
+	for _, column := range sortedColumns(table.columns) {
+		definitions = append(definitions, fmt.Sprintf("%s %s", quote(tx, column), sqlType(tx, table.columns[column])))
+	}
+	if table.parent != "" {
+		definitions = append(definitions, fmt.Sprintf("PRIMARY KEY (%s, %s)", quote(tx, parentIDColumn), quote(tx, positionColumn)))
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quote(tx, table.name), strings.Join(definitions, ", "))
+}
+
+// indexName is a hash since table names can exceed the identifier length
+func indexName(table *typedTable, column string) string {
+	return fmt.Sprintf("idx_%x", sha256.Sum256([]byte(table.name+"."+column)))[:24]
+}
+
+func createIndexStatement(tx *gorm.DB, table *typedTable, column string) string {
+	indexedColumn := quote(tx, column)
+	textColumn := table.columns[column] == StringColumn || column == transformation.KeyKey || column == transformation.CollectionKey
+	if tx.Dialector.Name() == MySQLDriver && textColumn {
+		// MySQL can only index a prefix of TEXT columns
+		indexedColumn = fmt.Sprintf("%s(191)", indexedColumn)
+	}
+	return fmt.Sprintf("CREATE INDEX %s ON %s (%s)", quote(tx, indexName(table, column)), quote(tx, table.name), indexedColumn)
+}
+
+func sqlType(tx *gorm.DB, columnType ColumnType) string {
+	dialect := tx.Dialector.Name()
+	switch columnType {
+	case IntegerColumn:
+		return "BIGINT"
+	case NumberColumn:
+		if dialect == PostgresqlDriver {
+			return "DOUBLE PRECISION"
+		}
+		return "DOUBLE"
+	case BooleanColumn:
+		return "BOOLEAN"
+	case JSONColumn:
+		if dialect == PostgresqlDriver {
+			return "JSONB"
+		}
+		return "JSON"
+	}
+	return "TEXT"
+}
+
+// tableColumns returns the columns of a table as they are in the database
+func tableColumns(tx *gorm.DB, tableName string) ([]string, error) {
+	rows, err := tx.Table(tableName).Limit(0).Rows()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the columns of table %s", tableName)
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+func quote(tx *gorm.DB, identifier string) string {
+	builder := &strings.Builder{}
+	tx.Dialector.QuoteTo(builder, identifier)
+	return builder.String()
+}
+
+func sortedColumns(columns map[string]ColumnType) []string {
+	var names []string
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(values []string, required []string) bool {
+	for _, value := range required {
+		if !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,244 @@
+package listener
+
+import (
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+)
+
+func tableRows(t *testing.T, db *gorm.DB, tableName string, orderBy string) []map[string]interface{} {
+	var rows []map[string]interface{}
+	require.NoError(t, db.Table(tableName).Order(orderBy).Find(&rows).Error)
+	return rows
+}
+
+func hasColumn(t *testing.T, db *gorm.DB, tableName string, column string) bool {
+	rows, err := db.Table(tableName).Limit(0).Rows()
+	require.NoError(t, err)
+	defer rows.Close()
+	columns, err := rows.Columns()
+	require.NoError(t, err)
+	return contains(columns, column)
+}
+
+func TestTypedTables(t *testing.T) {
+	for name, db := range sqlTestDatabases(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			t.Run("DeclaredSchema", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				channelID := storage.channelID
+				storage, err := storage.WithTables(TableMapping{
+					Chaincodes: []ChaincodeSchema{
+						{
+							Name:            "assets",
+							ObjectTypeField: "docType",
+							Objects: []ObjectSchema{
+								{
+									ObjectType: "car",
+									TableSchema: TableSchema{
+										Columns: []ColumnSchema{
+											{Name: "make", Type: StringColumn},
+											{Name: "modelYear", Type: IntegerColumn},
+											{Name: "sold", Type: BooleanColumn},
+											{Name: "price", Type: NumberColumn},
+										},
+										Indexes: []string{"make", "_fabric_txid"},
+										Children: []ChildTableSchema{
+											{
+												Field:   "owners",
+												Columns: []ColumnSchema{{Name: "name", Type: StringColumn}},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				})
+				require.NoError(t, err)
+				carTable := channelID + "_assets_car"
+				ownersTable := carTable + "__owners"
+				t.Cleanup(func() {
+					db.Migrator().DropTable(carTable, ownersTable, storage.tables.registryTableName)
+				})
+				assert.True(t, db.Migrator().HasTable(carTable))
+				assert.True(t, db.Migrator().HasTable(ownersTable))
+
+				err = storage.Store(newTestBlock(
+					channelID,
+					0,
+					writeTx("1", "assets",
+						&kvrwset.KVWrite{Key: "car1", Value: []byte(`{"docType":"car","make":"Tesla","modelYear":2020,"sold":true,"price":10.5,"color":"red","owners":[{"name":"a"},{"name":"b"}]}`)},
+						&kvrwset.KVWrite{Key: "car2", Value: []byte(`{"docType":"car","make":"Ford","modelYear":"unknown"}`)},
+						&kvrwset.KVWrite{Key: "person1", Value: []byte(`{"docType":"person","name":"a"}`)},
+					),
+				))
+				require.NoError(t, err)
+				cars := tableRows(t, db, carTable, "_fabric_key")
+				require.Len(t, cars, 2)
+				assert.Equal(t, "car1", cars[0]["_fabric_key"])
+				assert.Equal(t, "Tesla", cars[0]["make"])
+				assert.EqualValues(t, 2020, cars[0]["modelYear"])
+				assert.EqualValues(t, 10.5, cars[0]["price"])
+				assert.NotContains(t, cars[0], "color")
+				assert.Nil(t, cars[1]["modelYear"])
+				owners := tableRows(t, db, ownersTable, "_position")
+				require.Len(t, owners, 2)
+				assert.Equal(t, "b", owners[1]["name"])
+				assert.False(t, db.Migrator().HasTable(channelID+"_assets_person"))
+
+				err = storage.Store(newTestBlock(
+					channelID,
+					1,
+					writeTx("2", "assets",
+						&kvrwset.KVWrite{Key: "car1", Value: []byte(`{"docType":"car","make":"Tesla","owners":[{"name":"c"}]}`)},
+						&kvrwset.KVWrite{Key: "car2", IsDelete: true},
+					),
+				))
+				require.NoError(t, err)
+				cars = tableRows(t, db, carTable, "_fabric_key")
+				require.Len(t, cars, 1)
+				assert.Nil(t, cars[0]["modelYear"])
+				owners = tableRows(t, db, ownersTable, "_position")
+				require.Len(t, owners, 1)
+				assert.Equal(t, "c", owners[0]["name"])
+			})
+			t.Run("InferredSchema", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				channelID := storage.channelID
+				storage, err := storage.WithTables(TableMapping{Infer: true})
+				require.NoError(t, err)
+				tableName := channelID + "_fabcar"
+				itemsTable := tableName + "__items"
+				t.Cleanup(func() {
+					db.Migrator().DropTable(tableName, itemsTable, storage.tables.registryTableName)
+				})
+				err = storage.Store(newTestBlock(
+					channelID,
+					0,
+					writeTx("1", "fabcar", &kvrwset.KVWrite{Key: "car1", Value: []byte(`{"make":"Tesla","year":2020,"items":[{"sku":"x","qty":1}],"tags":["a"]}`)}),
+				))
+				require.NoError(t, err)
+				assert.True(t, hasColumn(t, db, tableName, "make"))
+				assert.True(t, hasColumn(t, db, tableName, "tags"))
+				assert.False(t, hasColumn(t, db, tableName, "items"))
+				assert.True(t, hasColumn(t, db, itemsTable, "qty"))
+
+				// new fields are added with ALTER TABLE, also after a restart
+				restarted, err := newDatabaseStorage(db, channelID)
+				require.NoError(t, err)
+				restarted, err = restarted.WithTables(TableMapping{Infer: true})
+				require.NoError(t, err)
+				err = restarted.StoreBulk([]*cb.Block{newTestBlock(
+					channelID,
+					1,
+					writeTx("2", "fabcar", &kvrwset.KVWrite{Key: "car2", Value: []byte(`{"make":"Ford","owner":"b","items":[{"sku":"y","price":2.5}]}`)}),
+				)})
+				require.NoError(t, err)
+				assert.True(t, hasColumn(t, db, tableName, "owner"))
+				assert.True(t, hasColumn(t, db, itemsTable, "price"))
+				rows := tableRows(t, db, tableName, "_fabric_key")
+				require.Len(t, rows, 2)
+				assert.Equal(t, "b", rows[1]["owner"])
+				assert.Len(t, tableRows(t, db, itemsTable, "_parent_id"), 2)
+			})
+			t.Run("Identifiers", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				channelID := storage.channelID
+				storage, err := storage.WithTables(TableMapping{Infer: true})
+				require.NoError(t, err)
+				chaincodeID := "chaincode" + strings.Repeat("x", 60)
+				tableName := storage.tables.tableName(chaincodeID, "")
+				t.Cleanup(func() {
+					db.Migrator().DropTable(tableName, storage.tables.registryTableName)
+				})
+				assert.Len(t, tableName, maxIdentifierLength)
+				assert.True(t, strings.HasPrefix(tableName, channelID+"_chaincode"))
+				longField := strings.Repeat("f", maxIdentifierLength+1)
+				err = storage.Store(newTestBlock(
+					channelID,
+					0,
+					writeTx("1", chaincodeID, &kvrwset.KVWrite{Key: "k1", Value: []byte(`{"a.b":"x","` + longField + `":"y","make":"Tesla"}`)}),
+				))
+				require.NoError(t, err)
+				assert.True(t, hasColumn(t, db, tableName, "make"))
+				assert.False(t, hasColumn(t, db, tableName, "a.b"))
+				assert.False(t, hasColumn(t, db, tableName, longField))
+				// the fields that aren't columns are still in the channel table
+				assert.Equal(t, "x", storedRecords(t, storage)[chaincodeID+"/k1"]["a.b"])
+			})
+			t.Run("FailedBatch", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				channelID := storage.channelID
+				storage, err := storage.WithTables(TableMapping{Infer: true})
+				require.NoError(t, err)
+				tableName := channelID + "_fabcar"
+				t.Cleanup(func() {
+					db.Migrator().DropTable(tableName, storage.tables.registryTableName)
+				})
+				err = storage.Store(newTestBlock(
+					channelID,
+					0,
+					writeTx("1", "fabcar", &kvrwset.KVWrite{Key: "car1", Value: []byte(`{"make":"Tesla"}`)}),
+				))
+				require.NoError(t, err)
+
+				// the batch adds a column and fails after the documents are written, MySQL commits the
+				// ALTER TABLE implicitly so it must not run in the transaction of the documents
+				require.NoError(t, db.Migrator().DropTable(storage.blocksTableName))
+				block := newTestBlock(
+					channelID,
+					1,
+					writeTx("2", "fabcar", &kvrwset.KVWrite{Key: "car2", Value: []byte(`{"make":"Ford","owner":"b"}`)}),
+				)
+				require.Error(t, storage.Store(block))
+				assert.NotContains(t, storedRecords(t, storage), "fabcar/car2")
+				assert.Len(t, tableRows(t, db, tableName, "_fabric_key"), 1)
+				assert.True(t, hasColumn(t, db, tableName, "owner"))
+
+				// the schema changes are kept, the batch succeeds when stored again
+				require.NoError(t, db.Table(storage.blocksTableName).AutoMigrate(&BlockRecord{}))
+				require.NoError(t, storage.Store(block))
+				assert.Contains(t, storedRecords(t, storage), "fabcar/car2")
+				rows := tableRows(t, db, tableName, "_fabric_key")
+				require.Len(t, rows, 2)
+				assert.Equal(t, "b", rows[1]["owner"])
+
+				// a registry missing a table and its columns, as left by a failed MySQL schema change, is repaired
+				require.NoError(t, db.Table(storage.tables.registryTableName).Where("1 = 1").Delete(&TableRecord{}).Error)
+				require.NoError(t, storage.tables.load(db))
+				require.NoError(t, storage.Store(newTestBlock(
+					channelID,
+					2,
+					writeTx("3", "fabcar", &kvrwset.KVWrite{Key: "car3", Value: []byte(`{"make":"Fiat","owner":"c"}`)}),
+				)))
+				assert.Len(t, tableRows(t, db, tableName, "_fabric_key"), 3)
+			})
+		})
+	}
+}
+
+func TestTableMappingValidation(t *testing.T) {
+	_, err := compileTableMapping(TableMapping{Chaincodes: []ChaincodeSchema{
+		{Name: "cc", TableSchema: TableSchema{Columns: []ColumnSchema{{Name: "a", Type: "date"}}}},
+	}})
+	assert.Error(t, err)
+	_, err = compileTableMapping(TableMapping{Chaincodes: []ChaincodeSchema{
+		{Name: "cc", TableSchema: TableSchema{Columns: []ColumnSchema{{Name: "a", Type: StringColumn}}, Indexes: []string{"b"}}},
+	}})
+	assert.Error(t, err)
+	_, err = compileTableMapping(TableMapping{Chaincodes: []ChaincodeSchema{
+		{Name: "cc", TableSchema: TableSchema{Columns: []ColumnSchema{{Name: "a.b", Type: StringColumn}}}},
+	}})
+	assert.Error(t, err)
+	chaincodes, err := compileTableMapping(TableMapping{Chaincodes: []ChaincodeSchema{
+		{Name: "cc", TableSchema: TableSchema{Columns: []ColumnSchema{{Name: "a", Type: StringColumn}}, Indexes: []string{"a", "_fabric_date"}}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, StringColumn, chaincodes["cc"].root.columns["a"])
+}
@@ -0,0 +1,279 @@
+package listener
+
+import (
+	"encoding/json"
+	"fmt"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/pkg/chaincode"
+	"github.com/kfsoftware/hlf-sync/pkg/mocks"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The suite always runs against SQLite, set HLF_SYNC_TEST_POSTGRES_DSN or HLF_SYNC_TEST_MYSQL_DSN
+// to run it against a local Postgres or MySQL too
+func sqlTestDatabases(t *testing.T) map[string]*gorm.DB {
+	databases := map[string]*gorm.DB{}
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "hlf.db")), &gorm.Config{})
+	require.NoError(t, err)
+	databases["sqlite"] = db
+	if dsn := os.Getenv("HLF_SYNC_TEST_POSTGRES_DSN"); dsn != "" {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		require.NoError(t, err)
+		databases["postgres"] = db
+	}
+	if dsn := os.Getenv("HLF_SYNC_TEST_MYSQL_DSN"); dsn != "" {
+		db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		require.NoError(t, err)
+		databases["mysql"] = db
+	}
+	return databases
+}
+
+func newSQLTestStorage(t *testing.T, db *gorm.DB) DatabaseStorage {
+	channelID := fmt.Sprintf("test%d", time.Now().UnixNano())
+	storage, err := newDatabaseStorage(db, channelID)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Migrator().DropTable(storage.tableName, storage.blocksTableName)
+	})
+	return storage
+}
+
+func writeTx(txID string, chaincodeID string, writes ...*kvrwset.KVWrite) *mocks.TXInfo {
+	return &mocks.TXInfo{
+		TxID:             txID,
+		TxValidationCode: pb.TxValidationCode_VALID,
+		HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+		ChaincodeID:      chaincodeID,
+		Results:          mocks.GetTxResults(chaincodeID, writes),
+	}
+}
+
+func newTestBlock(channelID string, number uint64, txs ...*mocks.TXInfo) *cb.Block {
+	blk := mocks.NewBlock(channelID, txs...)
+	blk.Header.Number = number
+	return blk
+}
+
+func storedRecords(t *testing.T, storage DatabaseStorage) map[string]map[string]interface{} {
+	var records []Record
+	require.NoError(t, storage.db.Table(storage.tableName).Find(&records).Error)
+	result := map[string]map[string]interface{}{}
+	for _, record := range records {
+		var data map[string]interface{}
+		require.NoError(t, json.Unmarshal(record.Data, &data))
+		result[record.Chaincode+"/"+record.LedgerKey] = data
+	}
+	return result
+}
+
+func TestDatabaseStorage(t *testing.T) {
+	for name, db := range sqlTestDatabases(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			t.Run("UpsertAndDelete", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				channelID := storage.channelID
+				err := storage.StoreBulk([]*cb.Block{
+					newTestBlock(
+						channelID,
+						0,
+						writeTx("1", "cc1", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"a"}`)}),
+						writeTx("2", "cc2", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"b"}`)}),
+					),
+					newTestBlock(
+						channelID,
+						1,
+						writeTx("3", "cc1", &kvrwset.KVWrite{Key: "asset2", Value: []byte(`{"owner":"c"}`)}),
+					),
+				})
+				require.NoError(t, err)
+				records := storedRecords(t, storage)
+				assert.Len(t, records, 3)
+				assert.Equal(t, "a", records["cc1/asset1"]["owner"])
+				assert.Equal(t, "b", records["cc2/asset1"]["owner"])
+
+				err = storage.Store(newTestBlock(
+					channelID,
+					2,
+					writeTx("4", "cc1", &kvrwset.KVWrite{Key: "asset1", IsDelete: true}),
+					writeTx("5", "cc1", &kvrwset.KVWrite{Key: "asset2", Value: []byte(`{"owner":"d"}`)}),
+				))
+				require.NoError(t, err)
+				records = storedRecords(t, storage)
+				assert.Len(t, records, 2)
+				assert.NotContains(t, records, "cc1/asset1")
+				assert.Equal(t, "b", records["cc2/asset1"]["owner"])
+				assert.Equal(t, "d", records["cc1/asset2"]["owner"])
+
+				var blocks []BlockRecord
+				require.NoError(t, db.Table(storage.blocksTableName).Order("number").Find(&blocks).Error)
+				assert.Len(t, blocks, 3)
+				assert.Equal(t, 2, blocks[2].TXCount)
+			})
+			t.Run("DeleteInSameBatch", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				channelID := storage.channelID
+				err := storage.StoreBulk([]*cb.Block{
+					newTestBlock(
+						channelID,
+						0,
+						writeTx("1", "cc1", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"a"}`)}),
+					),
+				})
+				require.NoError(t, err)
+				err = storage.StoreBulk([]*cb.Block{
+					newTestBlock(
+						channelID,
+						1,
+						writeTx("2", "cc1", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"b"}`)}),
+						writeTx("3", "cc1", &kvrwset.KVWrite{Key: "asset1", IsDelete: true}),
+					),
+				})
+				require.NoError(t, err)
+				assert.Empty(t, storedRecords(t, storage))
+			})
+			t.Run("RollbackOnError", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				channelID := storage.channelID
+				require.NoError(t, db.Migrator().DropTable(storage.blocksTableName))
+				err := storage.Store(newTestBlock(
+					channelID,
+					0,
+					writeTx("1", "cc1", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"a"}`)}),
+				))
+				assert.Error(t, err)
+				assert.Empty(t, storedRecords(t, storage))
+			})
+			t.Run("SystemChaincodesIgnored", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				err := storage.Store(newTestBlock(
+					storage.channelID,
+					0,
+					writeTx("1", "_lifecycle", &kvrwset.KVWrite{Key: "namespaces/metadata/cc1", Value: []byte{0x0a}}),
+				))
+				require.NoError(t, err)
+				assert.Empty(t, storedRecords(t, storage))
+			})
+			t.Run("Migrate", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				require.NoError(t, db.Table(storage.tableName).Create(&Record{
+					ID:        "asset1",
+					Chaincode: "cc1",
+					Data:      []byte(`{"owner":"a","_fabric_id":"asset1"}`),
+				}).Error)
+				require.NoError(t, storage.Migrate())
+				var records []Record
+				require.NoError(t, db.Table(storage.tableName).Find(&records).Error)
+				require.Len(t, records, 1)
+				documentKey := transformation.DocumentKey{ChannelID: storage.channelID, Namespace: "cc1", Key: "asset1"}
+				assert.Equal(t, documentKey.ID(), records[0].ID)
+				assert.Equal(t, "asset1", records[0].LedgerKey)
+			})
+			t.Run("MigrateAfterSync", func(t *testing.T) {
+				storage := newSQLTestStorage(t, db)
+				require.NoError(t, db.Table(storage.tableName).Create(&Record{
+					ID:        "asset1",
+					Chaincode: "cc1",
+					Data:      []byte(`{"owner":"a","_fabric_id":"asset1"}`),
+				}).Error)
+				// the sync ran before the migration and wrote the key with the canonical ID
+				require.NoError(t, storage.Store(newTestBlock(
+					storage.channelID,
+					0,
+					writeTx("1", "cc1", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"b"}`)}),
+				)))
+				require.NoError(t, storage.Migrate())
+				var records []Record
+				require.NoError(t, db.Table(storage.tableName).Find(&records).Error)
+				require.Len(t, records, 1)
+				documentKey := transformation.DocumentKey{ChannelID: storage.channelID, Namespace: "cc1", Key: "asset1"}
+				assert.Equal(t, documentKey.ID(), records[0].ID)
+				assert.Equal(t, "b", storedRecords(t, storage)["cc1/asset1"]["owner"])
+			})
+		})
+	}
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	dataSource := filepath.Join(t.TempDir(), "hlf-sync.db")
+	storage, err := NewPostgresStorage(SQLiteDriver, dataSource, "mychannel")
+	require.NoError(t, err)
+	_, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	var journalMode string
+	require.NoError(t, storage.db.Raw("PRAGMA journal_mode").Scan(&journalMode).Error)
+	assert.Equal(t, "wal", journalMode)
+
+	err = storage.StoreBulk([]*cb.Block{
+		newTestBlock(
+			"mychannel",
+			0,
+			writeTx("1", "cc1", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"a"}`)}),
+		),
+		newTestBlock(
+			"mychannel",
+			1,
+			writeTx("2", "cc1", &kvrwset.KVWrite{Key: "asset2", Value: []byte(`{"owner":"b"}`)}),
+		),
+	})
+	require.NoError(t, err)
+
+	var owner string
+	err = storage.db.Raw("SELECT json_extract(data, '$.owner') FROM mychannel WHERE ledger_key = ?", "asset2").Scan(&owner).Error
+	require.NoError(t, err)
+	assert.Equal(t, "b", owner)
+
+	reopened, err := NewPostgresStorage(SQLiteDriver, dataSource, "mychannel")
+	require.NoError(t, err)
+	blockNumber, found, err := reopened.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, blockNumber)
+}
+
+func TestCreateIndexes(t *testing.T) {
+	db, err := openSQLite(filepath.Join(t.TempDir(), "hlf-sync.db"), &gorm.Config{})
+	require.NoError(t, err)
+	storage, err := newDatabaseStorage(db, "mychannel")
+	require.NoError(t, err)
+	indexes := []*chaincode.Index{
+		{
+			Name:   "indexOwner",
+			Fields: []chaincode.IndexField{{Name: "docType"}, {Name: "owner.name", Desc: true}},
+		},
+	}
+	require.NoError(t, storage.CreateIndexes("fabcar", indexes))
+	// creating them again is a no-op
+	require.NoError(t, storage.CreateIndexes("fabcar", indexes))
+
+	var definitions []string
+	require.NoError(t, db.Raw("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = 'mychannel' AND name LIKE 'idx_%'").Scan(&definitions).Error)
+	require.Len(t, definitions, 1)
+	assert.Contains(t, definitions[0], `json_extract(data, '$."owner"."name"') DESC`)
+	assert.Contains(t, definitions[0], "WHERE `chaincode` = 'fabcar'")
+
+	var plan []struct {
+		Detail string
+	}
+	require.NoError(t, db.Raw(`EXPLAIN QUERY PLAN SELECT * FROM mychannel WHERE chaincode = 'fabcar' AND collection = '' AND json_extract(data, '$."docType"') = 'car'`).Scan(&plan).Error)
+	require.NotEmpty(t, plan)
+	assert.Contains(t, plan[0].Detail, "USING INDEX idx_")
+
+	err = storage.CreateIndexes("fabcar", []*chaincode.Index{{Name: "bad", Fields: []chaincode.IndexField{{Name: "a'b"}}}})
+	assert.Error(t, err)
+}
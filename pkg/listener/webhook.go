@@ -0,0 +1,634 @@
+package listener
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WebhookPayload is what an endpoint receives
+type WebhookPayload string
+
+const (
+	// WebhookChanges are the writes of the valid transactions, or their Debezium change events
+	WebhookChanges WebhookPayload = "changes"
+	// WebhookTransactions are all the transactions, with their validation code
+	WebhookTransactions WebhookPayload = "transactions"
+	// WebhookEvents are the chaincode events of the valid transactions
+	WebhookEvents WebhookPayload = "events"
+
+	DefaultWebhookBatchSize     = 100
+	DefaultWebhookTimeout       = 10 * time.Second
+	DefaultWebhookMaxPending    = 1000
+	DefaultWebhookOutboxDir     = "hlf-sync-webhook.badgerdb"
+	DefaultWebhookRetryDelay    = time.Second
+	DefaultWebhookMaxRetryDelay = 5 * time.Minute
+
+	// WebhookSignatureHeader is sha256=<hex of the HMAC-SHA256 of <timestamp>.<body>>, keyed with the secret of the endpoint
+	WebhookSignatureHeader = "X-Hlf-Signature"
+	// WebhookTimestampHeader is the Unix time of the POST in seconds
+	WebhookTimestampHeader = "X-Hlf-Timestamp"
+	// WebhookDeliveryHeader identifies a POST, it's the same when the POST is retried
+	WebhookDeliveryHeader = "X-Hlf-Delivery"
+)
+
+var errWebhookStopped = errors.New("webhook delivery stopped")
+
+// WebhookEndpoint is a URL receiving the items of a payload in batches
+type WebhookEndpoint struct {
+	Name    string
+	URL     string
+	Payload WebhookPayload
+	// Secret signs the POSTs, they aren't signed when not set
+	Secret  string
+	Headers map[string]string
+	// Chaincodes and EventNames filter the items, EventNames are patterns like Car* matching the chaincode events
+	Chaincodes []string
+	EventNames []string
+	BatchSize  int
+	Timeout    time.Duration
+}
+
+func (e WebhookEndpoint) acceptsChaincode(chaincodeID string) bool {
+	if len(e.Chaincodes) == 0 {
+		return true
+	}
+	for _, chaincode := range e.Chaincodes {
+		if chaincode == chaincodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (e WebhookEndpoint) acceptsEvent(eventName string) bool {
+	if len(e.EventNames) == 0 {
+		return true
+	}
+	for _, pattern := range e.EventNames {
+		if ok, _ := path.Match(pattern, eventName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookRetry is the backoff of the POSTs that failed, the delay doubles up to MaxDelay
+type WebhookRetry struct {
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+type WebhookConfig struct {
+	Endpoints []WebhookEndpoint
+	// OutboxDir is the badger directory of the POSTs not delivered yet, each sink needs its own.
+	// The outbox is kept in memory when set to :memory:
+	OutboxDir string
+	// MaxPending is the number of POSTs of an endpoint in the outbox before storing waits for their delivery
+	MaxPending int
+	Retry      WebhookRetry
+}
+
+// Validate checks the endpoints and sets the defaults
+func (c *WebhookConfig) Validate() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("endpoints are required")
+	}
+	names := map[string]bool{}
+	for i := range c.Endpoints {
+		endpoint := &c.Endpoints[i]
+		if endpoint.Name == "" || endpoint.URL == "" {
+			return errors.New("every endpoint needs a name and a url")
+		}
+		if names[endpoint.Name] {
+			return errors.Errorf("endpoint %s is duplicated", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+		switch endpoint.Payload {
+		case "":
+			endpoint.Payload = WebhookChanges
+		case WebhookChanges, WebhookTransactions, WebhookEvents:
+		default:
+			return errors.Errorf("payload %s of endpoint %s not supported", endpoint.Payload, endpoint.Name)
+		}
+		if len(endpoint.EventNames) > 0 && endpoint.Payload != WebhookEvents {
+			return errors.Errorf("endpoint %s filters event names but receives %s", endpoint.Name, endpoint.Payload)
+		}
+		for _, pattern := range endpoint.EventNames {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("invalid event name pattern %s of endpoint %s", pattern, endpoint.Name)
+			}
+		}
+		if endpoint.BatchSize == 0 {
+			endpoint.BatchSize = DefaultWebhookBatchSize
+		}
+		if endpoint.Timeout == 0 {
+			endpoint.Timeout = DefaultWebhookTimeout
+		}
+	}
+	if c.OutboxDir == "" {
+		c.OutboxDir = DefaultWebhookOutboxDir
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = DefaultWebhookMaxPending
+	}
+	if c.Retry.Delay == 0 {
+		c.Retry.Delay = DefaultWebhookRetryDelay
+	}
+	if c.Retry.MaxDelay == 0 {
+		c.Retry.MaxDelay = DefaultWebhookMaxRetryDelay
+	}
+	return nil
+}
+
+// webhookBatch is the body of a POST
+type webhookBatch struct {
+	Channel   string            `json:"channel"`
+	Type      WebhookPayload    `json:"type"`
+	FromBlock int               `json:"fromBlock"`
+	ToBlock   int               `json:"toBlock"`
+	Items     []json.RawMessage `json:"items"`
+}
+
+type webhookItem struct {
+	blockNumber int
+	// index is the position of the item among the items of the endpoint in its block
+	index int
+	data  json.RawMessage
+}
+
+// webhookPost is the body of a POST with its delivery ID, the same for the same items of the ledger
+type webhookPost struct {
+	id   string
+	body []byte
+}
+
+// webhookItems returns the items of the endpoint in ledger order, the change events of the writes are used when batch is set
+func webhookItems(endpoint WebhookEndpoint, response *transformation.DocumentExtractionResponse, batch *cdcBatch) ([]webhookItem, error) {
+	var items []webhookItem
+	add := func(blockNumber int, data []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		index := 0
+		if len(items) > 0 && items[len(items)-1].blockNumber == blockNumber {
+			index = items[len(items)-1].index + 1
+		}
+		items = append(items, webhookItem{blockNumber: blockNumber, index: index, data: data})
+		return nil
+	}
+	switch endpoint.Payload {
+	case WebhookChanges:
+		if batch != nil {
+			for _, event := range batch.events {
+				if !endpoint.acceptsChaincode(event.Document.ChaincodeID) {
+					continue
+				}
+				data, err := json.Marshal(event.Envelope)
+				if err = add(event.Envelope.Source.Block, data, err); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+		for _, event := range response.Events {
+			document := event.Document
+			if document.ChaincodeID == "lscc" || document.ChaincodeID == "_lifecycle" ||
+				!endpoint.acceptsChaincode(document.ChaincodeID) {
+				continue
+			}
+			data, err := jsonKafkaEncoder{}.encode("", changeRecord, changeValues(event))
+			if err = add(event.BlockNumber, data, err); err != nil {
+				return nil, err
+			}
+		}
+	case WebhookTransactions:
+		for _, tx := range response.Transactions {
+			if !endpoint.acceptsChaincode(tx.ChaincodeID) {
+				continue
+			}
+			data, err := jsonKafkaEncoder{}.encode("", transactionRecord, transactionValues(tx))
+			if err = add(tx.BlockNumber, data, err); err != nil {
+				return nil, err
+			}
+		}
+	case WebhookEvents:
+		for _, event := range response.ChaincodeEvents {
+			if !endpoint.acceptsChaincode(event.ChaincodeID) || !endpoint.acceptsEvent(event.EventName) {
+				continue
+			}
+			data, err := json.Marshal(newChaincodeEventMessage(event))
+			if err = add(event.BlockNumber, data, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return items, nil
+}
+
+// webhookPosts returns the POSTs of the endpoint, with at most BatchSize items each. The delivery ID is made of
+// the endpoint and the positions of the first and last items in the ledger, so a POST sent again keeps its ID
+func webhookPosts(channelID string, endpoint WebhookEndpoint, response *transformation.DocumentExtractionResponse, batch *cdcBatch) ([]webhookPost, error) {
+	items, err := webhookItems(endpoint, response, batch)
+	if err != nil {
+		return nil, err
+	}
+	var posts []webhookPost
+	for start := 0; start < len(items); start += endpoint.BatchSize {
+		end := start + endpoint.BatchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		body := webhookBatch{
+			Channel:   channelID,
+			Type:      endpoint.Payload,
+			FromBlock: items[start].blockNumber,
+			ToBlock:   items[end-1].blockNumber,
+		}
+		for _, item := range items[start:end] {
+			body.Items = append(body.Items, item.data)
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		first, last := items[start], items[end-1]
+		id := fmt.Sprintf("%s-%s-%d.%d-%d.%d", channelID, endpoint.Name, first.blockNumber, first.index, last.blockNumber, last.index)
+		posts = append(posts, webhookPost{id: id, body: data})
+	}
+	return posts, nil
+}
+
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook POSTs a body to the endpoint, any status but 2xx is an error
+func postWebhook(client *http.Client, endpoint WebhookEndpoint, deliveryID string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range endpoint.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if endpoint.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, webhookSignature(endpoint.Secret, timestamp, body))
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to POST to endpoint %s", endpoint.Name)
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("endpoint %s answered [%d] %s", endpoint.Name, res.StatusCode, resBody)
+	}
+	return nil
+}
+
+// retryWebhook calls post until it succeeds, up to attempts times when attempts is positive. It returns
+// errWebhookStopped when stop is closed while waiting
+func retryWebhook(stop <-chan struct{}, retry WebhookRetry, attempts int, post func() error) error {
+	delay := retry.Delay
+	for attempt := 1; ; attempt++ {
+		err := post()
+		if err == nil {
+			return nil
+		}
+		if attempts > 0 && attempt >= attempts {
+			return err
+		}
+		log.Warnf("Webhook POST failed, retrying in %s: %v", delay, err)
+		select {
+		case <-stop:
+			return errWebhookStopped
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > retry.MaxDelay {
+			delay = retry.MaxDelay
+		}
+	}
+}
+
+// WebhookStorage POSTs the writes, transactions or chaincode events of the blocks to the endpoints in batches.
+// The POSTs are added to a persistent outbox and delivered in order by a worker per endpoint, retrying until they
+// are accepted, so a block is checkpointed once its POSTs are in the outbox and none is lost across restarts
+type WebhookStorage struct {
+	channelID string
+	config    WebhookConfig
+	outbox    *webhookOutbox
+	stop      chan struct{}
+	workers   *sync.WaitGroup
+	opts      []transformation.Option
+	// cdc is the state of the keys when the writes are posted as Debezium change events
+	cdc *cdcState
+}
+
+// NewWebhookStorage opens the outbox and starts delivering the POSTs it holds, the config must be validated
+func NewWebhookStorage(config WebhookConfig, channelID string, opts ...transformation.Option) (WebhookStorage, error) {
+	var names []string
+	for _, endpoint := range config.Endpoints {
+		names = append(names, endpoint.Name)
+	}
+	outbox, err := openWebhookOutbox(config.OutboxDir, channelID, names, config.MaxPending)
+	if err != nil {
+		return WebhookStorage{}, err
+	}
+	w := WebhookStorage{
+		channelID: channelID,
+		config:    config,
+		outbox:    outbox,
+		stop:      make(chan struct{}),
+		workers:   &sync.WaitGroup{},
+		opts:      opts,
+	}
+	for _, endpoint := range config.Endpoints {
+		w.workers.Add(1)
+		go w.deliver(endpoint)
+	}
+	return w, nil
+}
+
+// WithCDC posts the writes as change events of the envelope, keeping the values of the keys in the state directory
+func (w WebhookStorage) WithCDC(config CDCConfig) (WebhookStorage, error) {
+	if config.Envelope == "" {
+		w.cdc = nil
+		return w, nil
+	}
+	cdc, err := openCDCState(config, w.channelID)
+	if err != nil {
+		return w, err
+	}
+	w.cdc = cdc
+	return w, nil
+}
+
+// deliver POSTs the outbox of the endpoint in order until the storage is closed
+func (w WebhookStorage) deliver(endpoint WebhookEndpoint) {
+	defer w.workers.Done()
+	client := &http.Client{Timeout: endpoint.Timeout}
+	for {
+		delivery, err := w.outbox.next(endpoint.Name)
+		if err != nil {
+			log.Errorf("Failed to read the outbox of endpoint %s: %v", endpoint.Name, err)
+		}
+		if delivery == nil {
+			select {
+			case <-w.stop:
+				return
+			case <-w.outbox.notify[endpoint.Name]:
+			case <-time.After(w.config.Retry.Delay):
+			}
+			continue
+		}
+		deliveryID := delivery.id
+		if deliveryID == "" {
+			// added before the delivery IDs were kept in the outbox
+			deliveryID = fmt.Sprintf("%s-%d", w.channelID, delivery.seq)
+		}
+		err = retryWebhook(w.stop, w.config.Retry, 0, func() error {
+			return postWebhook(client, endpoint, deliveryID, delivery.body)
+		})
+		if err == errWebhookStopped {
+			return
+		}
+		err = w.outbox.remove(endpoint.Name, delivery)
+		if err != nil {
+			log.Errorf("Failed to remove delivery %s of endpoint %s from the outbox: %v", deliveryID, endpoint.Name, err)
+		}
+	}
+}
+
+func (w WebhookStorage) storeDocs(response *transformation.DocumentExtractionResponse) error {
+	var batch *cdcBatch
+	if w.cdc != nil {
+		var err error
+		batch, err = w.cdc.events(response)
+		if err != nil {
+			return err
+		}
+	}
+	posts := map[string][]webhookPost{}
+	count := 0
+	for _, endpoint := range w.config.Endpoints {
+		endpointPosts, err := webhookPosts(w.channelID, endpoint, response, batch)
+		if err != nil {
+			return err
+		}
+		posts[endpoint.Name] = endpointPosts
+		count += len(endpointPosts)
+	}
+	blockNumber := -1
+	if len(response.Blocks) > 0 {
+		blockNumber = response.Blocks[len(response.Blocks)-1].Number
+	}
+	err := w.outbox.add(posts, blockNumber)
+	if err != nil {
+		return err
+	}
+	if batch != nil {
+		// the state is committed once the POSTs are in the outbox, a batch added again after a failure gets the
+		// same events and the same delivery IDs
+		err = w.cdc.commit(batch)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Webhook POSTs queued=%d", count)
+	return nil
+}
+
+// Checkpoint returns the last block whose POSTs are in the outbox and, with CDC, whose state of the keys is stored,
+// so the blocks of a sync stopped between the two writes are posted again with the same events and delivery IDs
+func (w WebhookStorage) Checkpoint() (int, bool, error) {
+	blockNumber, found, err := w.outbox.checkpoint()
+	if err != nil || !found || w.cdc == nil {
+		return blockNumber, found, err
+	}
+	cdcBlockNumber, cdcFound, err := w.cdc.checkpoint()
+	if err != nil || !cdcFound {
+		return 0, false, err
+	}
+	if cdcBlockNumber < blockNumber {
+		return cdcBlockNumber, true, nil
+	}
+	return blockNumber, true, nil
+}
+
+// Close stops the delivery of the outbox, the POSTs not delivered are sent when the storage is opened again
+func (w WebhookStorage) Close() error {
+	close(w.stop)
+	w.workers.Wait()
+	if w.cdc != nil {
+		w.cdc.db.Close()
+	}
+	return w.outbox.close()
+}
+
+func (w WebhookStorage) StoreBulk(blocks []*cb.Block) error {
+	response, err := transformation.BlocksToDocuments(blocks, w.opts...)
+	if err != nil {
+		return err
+	}
+	return w.storeDocs(response)
+}
+
+// StoreDocuments stores blocks already decoded
+func (w WebhookStorage) StoreDocuments(response *transformation.DocumentExtractionResponse) error {
+	return w.storeDocs(response)
+}
+
+func (w WebhookStorage) Store(block *cb.Block) error {
+	response, err := transformation.BlockToDocuments(block, w.opts...)
+	if err != nil {
+		return err
+	}
+	return w.storeDocs(response)
+}
+
+// WebhookReplayer POSTs the blocks to endpoints of a webhook sink again, directly and without the outbox and
+// the checkpoint of the sync. The change events only get the values before the writes of the blocks replayed
+type WebhookReplayer struct {
+	channelID string
+	endpoints []WebhookEndpoint
+	retry     WebhookRetry
+	attempts  int
+	cdc       *cdcState
+	opts      []transformation.Option
+}
+
+// NewWebhookReplayer replays to the endpoints with the given names, or to all of them, trying every POST up to
+// attempts times. The config must be validated
+func NewWebhookReplayer(config WebhookStorageConfig, channelID string, names []string, attempts int, opts ...transformation.Option) (*WebhookReplayer, error) {
+	r := &WebhookReplayer{channelID: channelID, retry: config.Retry, attempts: attempts, opts: opts}
+	for _, endpoint := range config.Endpoints {
+		if len(names) == 0 {
+			r.endpoints = append(r.endpoints, endpoint)
+		}
+		for _, name := range names {
+			if name == endpoint.Name {
+				r.endpoints = append(r.endpoints, endpoint)
+			}
+		}
+	}
+	if len(r.endpoints) < len(names) {
+		return nil, errors.Errorf("endpoints %v not found", names)
+	}
+	if config.CDC.Envelope != "" {
+		var err error
+		r.cdc, err = openCDCState(CDCConfig{Envelope: config.CDC.Envelope, StateDir: ":memory:"}, channelID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *WebhookReplayer) StoreBulk(blocks []*cb.Block) error {
+	response, err := transformation.BlocksToDocuments(blocks, r.opts...)
+	if err != nil {
+		return err
+	}
+	var batch *cdcBatch
+	if r.cdc != nil {
+		batch, err = r.cdc.events(response)
+		if err != nil {
+			return err
+		}
+	}
+	for _, endpoint := range r.endpoints {
+		posts, err := webhookPosts(r.channelID, endpoint, response, batch)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Timeout: endpoint.Timeout}
+		for _, post := range posts {
+			post := post
+			err = retryWebhook(nil, r.retry, r.attempts, func() error {
+				return postWebhook(client, endpoint, post.id, post.body)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		log.Infof("Webhook POSTs replayed to %s=%d", endpoint.Name, len(posts))
+	}
+	if batch != nil {
+		return r.cdc.commit(batch)
+	}
+	return nil
+}
+
+func (r *WebhookReplayer) Store(block *cb.Block) error {
+	return r.StoreBulk([]*cb.Block{block})
+}
+
+// Close releases the state of the change events
+func (r *WebhookReplayer) Close() {
+	if r.cdc != nil {
+		r.cdc.db.Close()
+	}
+}
+
+// WebhookStorageConfig is the configuration of the webhook database type
+type WebhookStorageConfig struct {
+	WebhookConfig `mapstructure:",squash"`
+	// CDC posts the writes of the changes endpoints as Debezium change events
+	CDC CDCConfig `mapstructure:"cdc"`
+}
+
+func (c *WebhookStorageConfig) Validate() error {
+	err := c.WebhookConfig.Validate()
+	if err != nil {
+		return err
+	}
+	return c.CDC.Validate()
+}
+
+type webhookFactory struct{}
+
+func (webhookFactory) NewConfig() StorageConfig {
+	return &WebhookStorageConfig{}
+}
+
+func (webhookFactory) NewStorage(config StorageConfig, channelID string, opts ...transformation.Option) (BlockStorage, error) {
+	c := config.(*WebhookStorageConfig)
+	storage, err := NewWebhookStorage(c.WebhookConfig, channelID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	storage, err = storage.WithCDC(c.CDC)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+func init() {
+	Register("webhook", webhookFactory{})
+}
@@ -0,0 +1,241 @@
+package listener
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	webhookOutboxPrefix     = "webhook_outbox/"
+	webhookCheckpointPrefix = "webhook_checkpoint_"
+	webhookSequenceKey      = "webhook_sequence"
+)
+
+var errWebhookOutboxClosed = errors.New("webhook outbox closed")
+
+// webhookDelivery is a POST waiting in the outbox of an endpoint
+type webhookDelivery struct {
+	key  []byte
+	seq  uint64
+	id   string
+	body []byte
+}
+
+// webhookOutbox keeps the POSTs of every endpoint in badger until they are delivered, along with the last block
+// whose POSTs have been added. Adding waits while an endpoint has maxPending POSTs not delivered
+type webhookOutbox struct {
+	db         *badger.DB
+	seq        *badger.Sequence
+	channelID  string
+	maxPending int
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+	closed  bool
+	pending map[string]int
+	notify  map[string]chan struct{}
+}
+
+func openWebhookOutbox(dir string, channelID string, endpoints []string, maxPending int) (*webhookOutbox, error) {
+	opts := badger.DefaultOptions(dir).WithLogger(nil)
+	if dir == ":memory:" {
+		opts = badger.DefaultOptions("").WithInMemory(true).WithLogger(nil)
+	}
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open the webhook outbox in %s", dir)
+	}
+	seq, err := db.GetSequence([]byte(webhookSequenceKey), 100)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	o := &webhookOutbox{
+		db:         db,
+		seq:        seq,
+		channelID:  channelID,
+		maxPending: maxPending,
+		pending:    map[string]int{},
+		notify:     map[string]chan struct{}{},
+	}
+	o.changed = sync.NewCond(&o.mutex)
+	for _, endpoint := range endpoints {
+		o.notify[endpoint] = make(chan struct{}, 1)
+		err = db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Prefix = webhookOutboxKeyPrefix(endpoint)
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				o.pending[endpoint]++
+			}
+			return nil
+		})
+		if err != nil {
+			o.close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func webhookOutboxKeyPrefix(endpoint string) []byte {
+	return []byte(webhookOutboxPrefix + endpoint + "/")
+}
+
+// add stores the POSTs of the endpoints and the last block they come from, in one transaction
+func (o *webhookOutbox) add(posts map[string][]webhookPost, blockNumber int) error {
+	o.mutex.Lock()
+	for endpoint := range posts {
+		for !o.closed && o.pending[endpoint] >= o.maxPending {
+			o.changed.Wait()
+		}
+	}
+	closed := o.closed
+	o.mutex.Unlock()
+	if closed {
+		return errWebhookOutboxClosed
+	}
+	err := o.db.Update(func(txn *badger.Txn) error {
+		for endpoint, endpointPosts := range posts {
+			for _, post := range endpointPosts {
+				seq, err := o.seq.Next()
+				if err != nil {
+					return err
+				}
+				// the sequence is zero padded so the keys sort in the order they are added
+				key := append(webhookOutboxKeyPrefix(endpoint), fmt.Sprintf("%020d/%s", seq, post.id)...)
+				err = txn.Set(key, post.body)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if blockNumber < 0 {
+			return nil
+		}
+		return txn.Set([]byte(webhookCheckpointPrefix+o.channelID), []byte(strconv.Itoa(blockNumber)))
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to store the webhook outbox")
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for endpoint, endpointPosts := range posts {
+		if len(endpointPosts) == 0 {
+			continue
+		}
+		o.pending[endpoint] += len(endpointPosts)
+		select {
+		case o.notify[endpoint] <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// next returns the oldest POST of the endpoint, nil when there is none
+func (o *webhookOutbox) next(endpoint string) (*webhookDelivery, error) {
+	var delivery *webhookDelivery
+	err := o.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 1
+		opts.Prefix = webhookOutboxKeyPrefix(endpoint)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		if !it.Valid() {
+			return nil
+		}
+		item := it.Item()
+		key := item.KeyCopy(nil)
+		parts := strings.SplitN(string(bytes.TrimPrefix(key, opts.Prefix)), "/", 2)
+		seq, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return errors.Errorf("invalid webhook outbox key %q", key)
+		}
+		body, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		delivery = &webhookDelivery{key: key, seq: seq, body: body}
+		if len(parts) == 2 {
+			delivery.id = parts[1]
+		}
+		return nil
+	})
+	return delivery, err
+}
+
+// remove deletes a POST once it's delivered
+func (o *webhookOutbox) remove(endpoint string, delivery *webhookDelivery) error {
+	err := o.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(delivery.key)
+	})
+	if err != nil {
+		return err
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.pending[endpoint]--
+	o.changed.Broadcast()
+	return nil
+}
+
+// wait returns when the outbox of every endpoint is empty
+func (o *webhookOutbox) wait() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for !o.closed {
+		empty := true
+		for _, pending := range o.pending {
+			if pending > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			return nil
+		}
+		o.changed.Wait()
+	}
+	return errWebhookOutboxClosed
+}
+
+// checkpoint returns the last block whose POSTs have been added
+func (o *webhookOutbox) checkpoint() (int, bool, error) {
+	blockNumber := 0
+	found := false
+	err := o.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(webhookCheckpointPrefix + o.channelID))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			blockNumber, err = strconv.Atoi(string(val))
+			if err != nil {
+				return errors.Errorf("invalid webhook checkpoint %q", val)
+			}
+			found = true
+			return nil
+		})
+	})
+	return blockNumber, found, err
+}
+
+func (o *webhookOutbox) close() error {
+	o.mutex.Lock()
+	o.closed = true
+	o.changed.Broadcast()
+	o.mutex.Unlock()
+	o.seq.Release()
+	return o.db.Close()
+}
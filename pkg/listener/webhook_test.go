@@ -0,0 +1,238 @@
+package listener
+
+import (
+	"encoding/json"
+	"github.com/kfsoftware/hlf-sync/pkg/transformation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the batches posted to it, answering with the statuses given in order and then 200
+type webhookReceiver struct {
+	sync.Mutex
+	statuses []int
+	batches  map[string][]webhookBatch
+	headers  map[string][]http.Header
+	failures int
+}
+
+func newWebhookReceiver(t *testing.T, secret string, statuses ...int) (*webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{statuses: statuses, batches: map[string][]webhookBatch{}, headers: map[string][]http.Header{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		receiver.Lock()
+		defer receiver.Unlock()
+		if len(receiver.statuses) > 0 {
+			status := receiver.statuses[0]
+			receiver.statuses = receiver.statuses[1:]
+			receiver.failures++
+			w.WriteHeader(status)
+			return
+		}
+		if signature := r.Header.Get(WebhookSignatureHeader); signature != "" {
+			assert.Equal(t, webhookSignature(secret, r.Header.Get(WebhookTimestampHeader), body), signature)
+		}
+		var batch webhookBatch
+		require.NoError(t, json.Unmarshal(body, &batch))
+		receiver.batches[r.URL.Path] = append(receiver.batches[r.URL.Path], batch)
+		receiver.headers[r.URL.Path] = append(receiver.headers[r.URL.Path], r.Header)
+	}))
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func webhookItemValues(t *testing.T, batches []webhookBatch, field string) []interface{} {
+	var values []interface{}
+	for _, batch := range batches {
+		for _, item := range batch.Items {
+			var value map[string]interface{}
+			require.NoError(t, json.Unmarshal(item, &value))
+			values = append(values, value[field])
+		}
+	}
+	return values
+}
+
+func newTestWebhookConfig(t *testing.T, url string, endpoints ...WebhookEndpoint) WebhookConfig {
+	config := WebhookConfig{OutboxDir: ":memory:", Retry: WebhookRetry{Delay: 10 * time.Millisecond}}
+	for _, endpoint := range endpoints {
+		endpoint.URL = url + "/" + endpoint.Name
+		config.Endpoints = append(config.Endpoints, endpoint)
+	}
+	require.NoError(t, config.Validate())
+	return config
+}
+
+func TestWebhookStorage(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "s3cret", http.StatusServiceUnavailable, http.StatusInternalServerError)
+	config := newTestWebhookConfig(t, server.URL,
+		WebhookEndpoint{Name: "changes", Secret: "s3cret", BatchSize: 2, Chaincodes: []string{"fabcar"}, Headers: map[string]string{"authorization": "Bearer token"}},
+		WebhookEndpoint{Name: "transactions", Payload: WebhookTransactions, Secret: "s3cret"},
+		WebhookEndpoint{Name: "events", Payload: WebhookEvents, EventNames: []string{"Car*"}},
+		WebhookEndpoint{Name: "others", Chaincodes: []string{"marbles"}},
+	)
+	storage, err := NewWebhookStorage(config, "mychannel")
+	require.NoError(t, err)
+	defer storage.Close()
+	_, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, storage.StoreBulk(natsTestBlocks("mychannel")))
+	blockNumber, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 2, blockNumber)
+	require.NoError(t, storage.outbox.wait())
+
+	receiver.Lock()
+	defer receiver.Unlock()
+	assert.Equal(t, 2, receiver.failures)
+	changes := receiver.batches["/changes"]
+	require.Len(t, changes, 2)
+	assert.Equal(t, 0, changes[0].FromBlock)
+	assert.Equal(t, 2, changes[1].ToBlock)
+	assert.Equal(t, WebhookChanges, changes[0].Type)
+	// the write of the invalid transaction is not posted
+	assert.Equal(t, []interface{}{"car1", "car2", "car3", "car4"}, webhookItemValues(t, changes, "key"))
+	assert.Equal(t, []interface{}{"1", "2", "3", "4"}, webhookItemValues(t, receiver.batches["/transactions"], "txId"))
+	events := receiver.batches["/events"]
+	assert.Equal(t, []interface{}{"CarCreated"}, webhookItemValues(t, events, "eventName"))
+	assert.Empty(t, receiver.batches["/others"])
+	for path, headers := range receiver.headers {
+		for _, header := range headers {
+			assert.Equal(t, "application/json", header.Get("Content-Type"))
+			assert.Regexp(t, "^mychannel-"+path[1:]+"-[0-9]+\\.[0-9]+-[0-9]+\\.[0-9]+$", header.Get(WebhookDeliveryHeader))
+			assert.Equal(t, path != "/events", header.Get(WebhookSignatureHeader) != "")
+		}
+	}
+	assert.Equal(t, "Bearer token", receiver.headers["/changes"][0].Get("Authorization"))
+}
+
+func TestWebhookOutbox(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "", http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	config := newTestWebhookConfig(t, server.URL, WebhookEndpoint{Name: "changes"})
+	config.OutboxDir = t.TempDir()
+	config.Retry.Delay = time.Second
+	storage, err := NewWebhookStorage(config, "mychannel")
+	require.NoError(t, err)
+	require.NoError(t, storage.StoreBulk(esTestBlocks("mychannel")))
+	// the sync stops before the POST is delivered
+	require.NoError(t, storage.Close())
+
+	config.Retry.Delay = 10 * time.Millisecond
+	storage, err = NewWebhookStorage(config, "mychannel")
+	require.NoError(t, err)
+	defer storage.Close()
+	blockNumber, found, err := storage.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, blockNumber)
+	require.NoError(t, storage.outbox.wait())
+	receiver.Lock()
+	defer receiver.Unlock()
+	assert.Equal(t, []interface{}{"car1", "car2", "car3"}, webhookItemValues(t, receiver.batches["/changes"], "key"))
+}
+
+func TestWebhookDebezium(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "")
+	config := WebhookStorageConfig{
+		WebhookConfig: newTestWebhookConfig(t, server.URL, WebhookEndpoint{Name: "changes"}),
+		CDC:           CDCConfig{Envelope: DebeziumEnvelope, StateDir: ":memory:"},
+	}
+	storage, err := webhookFactory{}.NewStorage(&config, "mychannel")
+	require.NoError(t, err)
+	defer storage.(WebhookStorage).Close()
+	// the batch added again after the outbox failed gets the same events
+	outbox := storage.(WebhookStorage).outbox
+	outbox.mutex.Lock()
+	outbox.closed = true
+	outbox.mutex.Unlock()
+	assert.Equal(t, errWebhookOutboxClosed, storage.StoreBulk(cdcTestBlocks("mychannel")))
+	outbox.mutex.Lock()
+	outbox.closed = false
+	outbox.mutex.Unlock()
+	require.NoError(t, storage.StoreBulk(cdcTestBlocks("mychannel")))
+	require.NoError(t, outbox.wait())
+	receiver.Lock()
+	defer receiver.Unlock()
+	assert.Equal(t, []interface{}{"c", "c", "d", "u", "d"}, webhookItemValues(t, receiver.batches["/changes"], "op"))
+}
+
+func TestWebhookDebeziumCheckpoint(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "")
+	config := WebhookStorageConfig{
+		WebhookConfig: newTestWebhookConfig(t, server.URL, WebhookEndpoint{Name: "changes"}),
+		CDC:           CDCConfig{Envelope: DebeziumEnvelope, StateDir: t.TempDir()},
+	}
+	config.OutboxDir = t.TempDir()
+	blocks := cdcTestBlocks("mychannel")
+	storage, err := webhookFactory{}.NewStorage(&config, "mychannel")
+	require.NoError(t, err)
+	require.NoError(t, storage.StoreBulk(blocks[:2]))
+	// the sync stops after the POSTs of the last block are in the outbox, before the state of its keys is stored
+	webhook := storage.(WebhookStorage)
+	response, err := transformation.BlocksToDocuments(blocks[2:])
+	require.NoError(t, err)
+	batch, err := webhook.cdc.events(response)
+	require.NoError(t, err)
+	posts, err := webhookPosts("mychannel", config.Endpoints[0], response, batch)
+	require.NoError(t, err)
+	require.NoError(t, webhook.outbox.add(map[string][]webhookPost{"changes": posts}, 2))
+	blockNumber, found, err := webhook.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, blockNumber)
+	require.NoError(t, webhook.Close())
+
+	storage, err = webhookFactory{}.NewStorage(&config, "mychannel")
+	require.NoError(t, err)
+	webhook = storage.(WebhookStorage)
+	defer webhook.Close()
+	blockNumber, found, err = webhook.Checkpoint()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, blockNumber)
+	require.NoError(t, storage.StoreBulk(blocks[2:]))
+	blockNumber, _, err = webhook.Checkpoint()
+	require.NoError(t, err)
+	assert.Equal(t, 2, blockNumber)
+	require.NoError(t, webhook.outbox.wait())
+	receiver.Lock()
+	defer receiver.Unlock()
+	// the block posted again gets the same events and the same delivery ID
+	assert.Equal(t, []interface{}{"c", "c", "d", "u", "d", "u", "d"}, webhookItemValues(t, receiver.batches["/changes"], "op"))
+	headers := receiver.headers["/changes"]
+	require.Len(t, headers, 3)
+	assert.Equal(t, headers[1].Get(WebhookDeliveryHeader), headers[2].Get(WebhookDeliveryHeader))
+}
+
+func TestWebhookReplayer(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "", http.StatusInternalServerError, http.StatusInternalServerError)
+	config := WebhookStorageConfig{WebhookConfig: newTestWebhookConfig(t, server.URL,
+		WebhookEndpoint{Name: "changes"},
+		WebhookEndpoint{Name: "transactions", Payload: WebhookTransactions},
+	)}
+	_, err := NewWebhookReplayer(config, "mychannel", []string{"unknown"}, 2)
+	assert.EqualError(t, err, "endpoints [unknown] not found")
+
+	replayer, err := NewWebhookReplayer(config, "mychannel", []string{"transactions"}, 2)
+	require.NoError(t, err)
+	defer replayer.Close()
+	err = replayer.StoreBulk(esTestBlocks("mychannel"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "endpoint transactions answered [500]")
+	require.NoError(t, replayer.StoreBulk(esTestBlocks("mychannel")))
+	receiver.Lock()
+	defer receiver.Unlock()
+	assert.Empty(t, receiver.batches["/changes"])
+	assert.Equal(t, []interface{}{"1", "2"}, webhookItemValues(t, receiver.batches["/transactions"], "txId"))
+	// a replay keeps the delivery IDs of the sync
+	assert.Equal(t, "mychannel-transactions-0.0-1.0", receiver.headers["/transactions"][0].Get(WebhookDeliveryHeader))
+}
@@ -0,0 +1,195 @@
+package mocks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/common/channelconfig"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/common/policydsl"
+	"math/big"
+	"time"
+)
+
+// CA is the certificate authority of an MSP, the identities it issues are valid for the MSP of MSPConfig
+type CA struct {
+	MSPID  string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func NewCA(mspID string) *CA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca." + mspID, Organization: []string{mspID}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          []byte(mspID),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		panic(err)
+	}
+	return &CA{MSPID: mspID, cert: cert, key: key, serial: 1}
+}
+
+// Identity returns a serialized identity of the MSP, the role of the identity is given by the node OU in ous
+func (ca *CA) Identity(cn string, ous ...string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(ca.serial),
+		Subject:        pkix.Name{CommonName: cn, OrganizationalUnit: ous},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(24 * time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		AuthorityKeyId: ca.cert.SubjectKeyId,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		panic(err)
+	}
+	sIDBytes, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   ca.MSPID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return sIDBytes
+}
+
+// MSPConfig returns the configuration of the MSP trusting the CA, with the client, peer, admin and orderer node OUs
+func (ca *CA) MSPConfig() *msp.MSPConfig {
+	fabricConfig, err := proto.Marshal(&msp.FabricMSPConfig{
+		Name:      ca.MSPID,
+		RootCerts: [][]byte{pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})},
+		CryptoConfig: &msp.FabricCryptoConfig{
+			SignatureHashFamily:            "SHA2",
+			IdentityIdentifierHashFunction: "SHA256",
+		},
+		FabricNodeOus: &msp.FabricNodeOUs{
+			Enable:              true,
+			ClientOuIdentifier:  &msp.FabricOUIdentifier{OrganizationalUnitIdentifier: "client"},
+			PeerOuIdentifier:    &msp.FabricOUIdentifier{OrganizationalUnitIdentifier: "peer"},
+			AdminOuIdentifier:   &msp.FabricOUIdentifier{OrganizationalUnitIdentifier: "admin"},
+			OrdererOuIdentifier: &msp.FabricOUIdentifier{OrganizationalUnitIdentifier: "orderer"},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &msp.MSPConfig{Type: 0, Config: fabricConfig}
+}
+
+func configValue(value *channelconfig.StandardConfigValue) *cb.ConfigValue {
+	valueBytes, err := proto.Marshal(value.Value())
+	if err != nil {
+		panic(err)
+	}
+	return &cb.ConfigValue{Value: valueBytes}
+}
+
+func configPolicy(policyType cb.Policy_PolicyType, value proto.Message) *cb.ConfigPolicy {
+	valueBytes, err := proto.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return &cb.ConfigPolicy{Policy: &cb.Policy{Type: int32(policyType), Value: valueBytes}}
+}
+
+// NewConfig returns the config of a V2_0 channel with an application organization per CA. Every organization has an
+// Endorsement policy signed by its peers, and the application MAJORITY Endorsement and LifecycleEndorsement policies
+func NewConfig(cas ...*CA) *cb.Config {
+	application := &cb.ConfigGroup{
+		Groups: map[string]*cb.ConfigGroup{},
+		Policies: map[string]*cb.ConfigPolicy{
+			"Endorsement":          configPolicy(cb.Policy_IMPLICIT_META, &cb.ImplicitMetaPolicy{SubPolicy: "Endorsement", Rule: cb.ImplicitMetaPolicy_MAJORITY}),
+			"LifecycleEndorsement": configPolicy(cb.Policy_IMPLICIT_META, &cb.ImplicitMetaPolicy{SubPolicy: "Endorsement", Rule: cb.ImplicitMetaPolicy_MAJORITY}),
+		},
+	}
+	for _, ca := range cas {
+		mspValue := channelconfig.MSPValue(ca.MSPConfig())
+		application.Groups[ca.MSPID] = &cb.ConfigGroup{
+			Values: map[string]*cb.ConfigValue{mspValue.Key(): configValue(mspValue)},
+			Policies: map[string]*cb.ConfigPolicy{
+				"Endorsement": configPolicy(cb.Policy_SIGNATURE, policydsl.SignedByMspPeer(ca.MSPID)),
+			},
+		}
+	}
+	channelValues := map[string]*cb.ConfigValue{}
+	for _, value := range []*channelconfig.StandardConfigValue{
+		channelconfig.HashingAlgorithmValue(),
+		channelconfig.BlockDataHashingStructureValue(),
+		channelconfig.OrdererAddressesValue([]string{"orderer0:7050"}),
+		channelconfig.CapabilitiesValue(map[string]bool{"V2_0": true}),
+	} {
+		channelValues[value.Key()] = configValue(value)
+	}
+	return &cb.Config{
+		ChannelGroup: &cb.ConfigGroup{
+			Groups: map[string]*cb.ConfigGroup{channelconfig.ApplicationGroupKey: application},
+			Values: channelValues,
+		},
+	}
+}
+
+// NewConfigBlock returns a block holding the config transaction of the config
+func NewConfigBlock(channelID string, number uint64, config *cb.Config) *cb.Block {
+	configEnvelope, err := proto.Marshal(&cb.ConfigEnvelope{Config: config})
+	if err != nil {
+		panic(err)
+	}
+	timestamp, err := ptypes.TimestampProto(time.Now().UTC())
+	if err != nil {
+		panic(err)
+	}
+	channelHeader, err := proto.Marshal(&cb.ChannelHeader{
+		ChannelId: channelID,
+		Type:      int32(cb.HeaderType_CONFIG),
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		panic(err)
+	}
+	payload, err := proto.Marshal(&cb.Payload{
+		Header: &cb.Header{ChannelHeader: channelHeader},
+		Data:   configEnvelope,
+	})
+	if err != nil {
+		panic(err)
+	}
+	envelope, err := proto.Marshal(&cb.Envelope{Payload: payload})
+	if err != nil {
+		panic(err)
+	}
+	blockMetaData := make([][]byte, 4)
+	blockMetaData[cb.BlockMetadataIndex_TRANSACTIONS_FILTER] = []byte{uint8(pb.TxValidationCode_VALID)}
+	return &cb.Block{
+		Header:   &cb.BlockHeader{Number: number},
+		Metadata: &cb.BlockMetadata{Metadata: blockMetaData},
+		Data:     &cb.BlockData{Data: [][]byte{envelope}},
+	}
+}
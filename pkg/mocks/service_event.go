@@ -1,16 +1,26 @@
 package mocks
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	cb "github.com/hyperledger/fabric-protos-go/common"
 	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
 	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric-ca/lib/attrmgr"
 	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	"math/big"
 	"time"
 )
 
-func NewTxAction(ccID string, results []byte) *pb.TransactionAction {
+func NewTxAction(ccID string, results []byte, event *pb.ChaincodeEvent, endorsers ...[]byte) *pb.TransactionAction {
 
 	chaincodeAction := &pb.ChaincodeAction{
 		ChaincodeId: &pb.ChaincodeID{
@@ -18,6 +28,13 @@ func NewTxAction(ccID string, results []byte) *pb.TransactionAction {
 		},
 		Results: results,
 	}
+	if event != nil {
+		eventBytes, err := proto.Marshal(event)
+		if err != nil {
+			panic(err)
+		}
+		chaincodeAction.Events = eventBytes
+	}
 	extBytes, err := proto.Marshal(chaincodeAction)
 	if err != nil {
 		panic(err)
@@ -29,9 +46,14 @@ func NewTxAction(ccID string, results []byte) *pb.TransactionAction {
 	if err != nil {
 		panic(err)
 	}
+	var endorsements []*pb.Endorsement
+	for _, endorser := range endorsers {
+		endorsements = append(endorsements, &pb.Endorsement{Endorser: endorser})
+	}
 	chActionPayload := &pb.ChaincodeActionPayload{
 		Action: &pb.ChaincodeEndorsedAction{
 			ProposalResponsePayload: prpBytes,
+			Endorsements:            endorsements,
 		},
 	}
 	payloadBytes, err := proto.Marshal(chActionPayload)
@@ -51,6 +73,9 @@ type TXInfo struct {
 	TxValidationCode pb.TxValidationCode
 	HeaderType       cb.HeaderType
 	Results          []byte
+	Creator          []byte
+	Endorsers        [][]byte
+	Event            *pb.ChaincodeEvent
 }
 
 func NewTx(
@@ -58,7 +83,7 @@ func NewTx(
 	txInfo *TXInfo,
 ) *cb.Envelope {
 	tx := &pb.Transaction{
-		Actions: []*pb.TransactionAction{NewTxAction(txInfo.ChaincodeID, txInfo.Results)},
+		Actions: []*pb.TransactionAction{NewTxAction(txInfo.ChaincodeID, txInfo.Results, txInfo.Event, txInfo.Endorsers...)},
 	}
 	txBytes, err := proto.Marshal(tx)
 	if err != nil {
@@ -79,9 +104,18 @@ func NewTx(
 		panic(err)
 	}
 
+	var signatureHeaderBytes []byte
+	if txInfo.Creator != nil {
+		signatureHeaderBytes, err = proto.Marshal(&cb.SignatureHeader{Creator: txInfo.Creator})
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	payload := &cb.Payload{
 		Header: &cb.Header{
-			ChannelHeader: channelHeaderBytes,
+			ChannelHeader:   channelHeaderBytes,
+			SignatureHeader: signatureHeaderBytes,
 		},
 		Data: txBytes,
 	}
@@ -145,3 +179,40 @@ func NewBlock(channelID string, transactions ...*TXInfo) *cb.Block {
 		Data:     &cb.BlockData{Data: data},
 	}
 }
+
+// NewSerializedIdentity builds a msp.SerializedIdentity holding a self signed certificate
+// with the given common name, OUs and fabric-ca attributes
+func NewSerializedIdentity(mspID string, cn string, ous []string, attrs map[string]string) []byte {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		Subject: pkix.Name{
+			CommonName:         cn,
+			OrganizationalUnit: ous,
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(24 * time.Hour),
+	}
+	if attrs != nil {
+		attrsBytes, err := json.Marshal(&attrmgr.Attributes{Attrs: attrs})
+		if err != nil {
+			panic(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: attrmgr.AttrOID, Value: attrsBytes}}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		panic(err)
+	}
+	sIDBytes, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return sIDBytes
+}
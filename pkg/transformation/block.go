@@ -0,0 +1,98 @@
+package transformation
+
+import (
+	"encoding/hex"
+	"github.com/golang/protobuf/ptypes"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/protoutil"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/sdkinternal/pkg/txflags"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// BlockInfo holds the header and metadata of a block
+type BlockInfo struct {
+	ChannelID       string    `json:"channelId"`
+	Number          int       `json:"number"`
+	Hash            string    `json:"hash"`
+	PreviousHash    string    `json:"previousHash"`
+	DataHash        string    `json:"dataHash"`
+	TXCount         int       `json:"txCount"`
+	ValidTXCount    int       `json:"validTxCount"`
+	InvalidTXCount  int       `json:"invalidTxCount"`
+	CommitHash      string    `json:"commitHash,omitempty"`
+	LastConfigIndex int       `json:"lastConfigIndex"`
+	Signer          *Identity `json:"signer,omitempty"`
+	FirstTXDate     int       `json:"firstTxDate,omitempty"`
+	LastTXDate      int       `json:"lastTxDate,omitempty"`
+}
+
+func BlockToInfo(block *cb.Block) (*BlockInfo, error) {
+	info := &BlockInfo{
+		Number:       int(block.Header.Number),
+		Hash:         hex.EncodeToString(protoutil.BlockHeaderHash(block.Header)),
+		PreviousHash: hex.EncodeToString(block.Header.PreviousHash),
+		DataHash:     hex.EncodeToString(block.Header.DataHash),
+		TXCount:      len(block.Data.Data),
+	}
+	txFilter := txflags.ValidationFlags(nil)
+	if block.Metadata != nil && len(block.Metadata.Metadata) > int(cb.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		txFilter = block.Metadata.Metadata[cb.BlockMetadataIndex_TRANSACTIONS_FILTER]
+	}
+	for txIndex, txData := range block.Data.Data {
+		if txIndex >= len(txFilter) || txFilter.IsValid(txIndex) {
+			info.ValidTXCount++
+		} else {
+			info.InvalidTXCount++
+		}
+		env, err := protoutil.GetEnvelopeFromBlock(txData)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := protoutil.UnmarshalPayload(env.Payload)
+		if err != nil {
+			return nil, err
+		}
+		chdr, err := protoutil.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+		if err != nil {
+			return nil, err
+		}
+		info.ChannelID = chdr.ChannelId
+		if chdr.Timestamp == nil {
+			continue
+		}
+		txDate, err := ptypes.Timestamp(chdr.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		txDateMS := int(txDate.UnixNano() / int64(time.Millisecond))
+		if info.FirstTXDate == 0 || txDateMS < info.FirstTXDate {
+			info.FirstTXDate = txDateMS
+		}
+		if txDateMS > info.LastTXDate {
+			info.LastTXDate = txDateMS
+		}
+	}
+	if block.Metadata != nil && len(block.Metadata.Metadata) > int(cb.BlockMetadataIndex_COMMIT_HASH) {
+		commitHash, err := protoutil.GetMetadataFromBlock(block, cb.BlockMetadataIndex_COMMIT_HASH)
+		if err != nil {
+			return nil, err
+		}
+		info.CommitHash = hex.EncodeToString(commitHash.Value)
+	}
+	lastConfigIndex, err := protoutil.GetLastConfigIndexFromBlock(block)
+	if err != nil {
+		log.Debugf("Failed to get last config index of block %d: %v", info.Number, err)
+	}
+	info.LastConfigIndex = int(lastConfigIndex)
+	signatures, err := protoutil.GetMetadataFromBlock(block, cb.BlockMetadataIndex_SIGNATURES)
+	if err != nil {
+		log.Debugf("Failed to get signatures of block %d: %v", info.Number, err)
+	} else if len(signatures.Signatures) > 0 {
+		info.Signer, err = decodeCreator(signatures.Signatures[0].SignatureHeader)
+		if err != nil {
+			log.Debugf("Failed to decode signer of block %d: %v", info.Number, err)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,64 @@
+package transformation
+
+import (
+	"encoding/hex"
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric-protos-go/common"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/protoutil"
+	"github.com/kfsoftware/hlf-sync/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBlockToInfo(t *testing.T) {
+	tx := func(txID string, validationCode pb.TxValidationCode) *mocks.TXInfo {
+		return &mocks.TXInfo{
+			TxID:             txID,
+			TxValidationCode: validationCode,
+			HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+			ChaincodeID:      "fabcar",
+		}
+	}
+	blk := mocks.NewBlock(
+		"mychannel",
+		tx("1", pb.TxValidationCode_VALID),
+		tx("2", pb.TxValidationCode_MVCC_READ_CONFLICT),
+		tx("3", pb.TxValidationCode_VALID),
+	)
+	blk.Header.Number = 7
+	blk.Header.PreviousHash = []byte{1, 2, 3}
+	blk.Header.DataHash = protoutil.BlockDataHash(blk.Data)
+
+	signer := mocks.NewSerializedIdentity("OrdererMSP", "orderer0", []string{"orderer"}, nil)
+	signatureHeader, err := proto.Marshal(&cb.SignatureHeader{Creator: signer})
+	assert.NoError(t, err)
+	ordererMetadata, err := proto.Marshal(&cb.OrdererBlockMetadata{LastConfig: &cb.LastConfig{Index: 5}})
+	assert.NoError(t, err)
+	signatures, err := proto.Marshal(&cb.Metadata{
+		Value:      ordererMetadata,
+		Signatures: []*cb.MetadataSignature{{SignatureHeader: signatureHeader}},
+	})
+	assert.NoError(t, err)
+	commitHash, err := proto.Marshal(&cb.Metadata{Value: []byte{0xca, 0xfe}})
+	assert.NoError(t, err)
+	blk.Metadata.Metadata[cb.BlockMetadataIndex_SIGNATURES] = signatures
+	blk.Metadata.Metadata = append(blk.Metadata.Metadata, commitHash)
+
+	info, err := BlockToInfo(blk)
+	assert.NoError(t, err)
+	assert.Equal(t, "mychannel", info.ChannelID)
+	assert.Equal(t, 7, info.Number)
+	assert.Equal(t, hex.EncodeToString(protoutil.BlockHeaderHash(blk.Header)), info.Hash)
+	assert.Equal(t, "010203", info.PreviousHash)
+	assert.Equal(t, hex.EncodeToString(blk.Header.DataHash), info.DataHash)
+	assert.Equal(t, 3, info.TXCount)
+	assert.Equal(t, 2, info.ValidTXCount)
+	assert.Equal(t, 1, info.InvalidTXCount)
+	assert.Equal(t, "cafe", info.CommitHash)
+	assert.Equal(t, 5, info.LastConfigIndex)
+	assert.Equal(t, "OrdererMSP", info.Signer.MSPID)
+	assert.Equal(t, OrdererRole, info.Signer.Role)
+	assert.NotZero(t, info.FirstTXDate)
+	assert.LessOrEqual(t, info.FirstTXDate, info.LastTXDate)
+}
@@ -0,0 +1,71 @@
+package transformation
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric-ca/lib/attrmgr"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/protoutil"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	ClientRole  = "client"
+	PeerRole    = "peer"
+	AdminRole   = "admin"
+	OrdererRole = "orderer"
+)
+
+// Identity is the decoded form of a msp.SerializedIdentity as found in a
+// transaction creator or in an endorsement
+type Identity struct {
+	MSPID        string            `json:"mspid"`
+	CommonName   string            `json:"cn,omitempty"`
+	OUs          []string          `json:"ous,omitempty"`
+	Role         string            `json:"role,omitempty"`
+	SerialNumber string            `json:"serialNumber,omitempty"`
+	Expiry       int               `json:"expiry,omitempty"`
+	Attributes   map[string]string `json:"attrs,omitempty"`
+}
+
+// DecodeIdentity unmarshals a serialized identity and parses its X.509 certificate.
+// Identities that don't carry a PEM certificate (e.g. idemix) are returned with the MSP ID only
+func DecodeIdentity(serializedIdentity []byte) (*Identity, error) {
+	sID, err := protoutil.UnmarshalSerializedIdentity(serializedIdentity)
+	if err != nil {
+		return nil, err
+	}
+	identity := &Identity{
+		MSPID: sID.Mspid,
+	}
+	block, _ := pem.Decode(sID.IdBytes)
+	if block == nil {
+		return identity, nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse certificate of identity from %s", sID.Mspid)
+	}
+	identity.CommonName = cert.Subject.CommonName
+	identity.OUs = cert.Subject.OrganizationalUnit
+	identity.Role = roleFromOUs(cert.Subject.OrganizationalUnit)
+	identity.SerialNumber = fmt.Sprintf("%x", cert.SerialNumber)
+	identity.Expiry = int(cert.NotAfter.UnixNano() / int64(time.Millisecond))
+	attrs, err := attrmgr.New().GetAttributesFromCert(cert)
+	if err != nil {
+		return nil, err
+	}
+	identity.Attributes = attrs.Attrs
+	return identity, nil
+}
+
+func roleFromOUs(ous []string) string {
+	for _, ou := range ous {
+		switch ou {
+		case ClientRole, PeerRole, AdminRole, OrdererRole:
+			return ou
+		}
+	}
+	return ""
+}
@@ -1,12 +1,15 @@
 package transformation
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	cb "github.com/hyperledger/fabric-protos-go/common"
 	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
 	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/protoutil"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/sdkinternal/pkg/txflags"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"strings"
@@ -17,56 +20,219 @@ type Document struct {
 	TXDate      int
 	TXID        string
 	BlockNumber int
+	// TXIndex is the index of the transaction in the block
+	TXIndex     int
 	ChannelID   string
 	Data        map[string]interface{}
 	ChaincodeID string
-	PrimaryKey  string
+	Collection  string
+	Key         string
+	// PrimaryKey is the canonical ID of the document, see DocumentKey.ID
+	PrimaryKey string
+	Creator    *Identity
 }
-type DocumentExtractionResponse struct {
-	DocumentsToAdd    map[string]*Document
-	DocumentsToRemove map[string]*Document
+
+// Version orders the writes of a document by their position in the ledger, the block number
+// takes the high 32 bits and the index of the transaction in the block the low ones
+func (d *Document) Version() int64 {
+	return int64(d.BlockNumber)<<32 | int64(d.TXIndex)
+}
+
+// DocumentKey identifies a document across channels, chaincodes and collections
+type DocumentKey struct {
+	ChannelID  string
+	Namespace  string
+	Collection string
+	Key        string
+}
+
+// ID returns a deterministic identifier for the key, safe to be used as ID by every backend
+func (k DocumentKey) ID() string {
+	h := sha256.New()
+	for _, part := range []string{k.ChannelID, k.Namespace, k.Collection, k.Key} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (d *Document) DocumentKey() DocumentKey {
+	return DocumentKey{
+		ChannelID:  d.ChannelID,
+		Namespace:  d.ChaincodeID,
+		Collection: d.Collection,
+		Key:        d.Key,
+	}
+}
+
+type Transaction struct {
+	TXID           string
+	TXDate         int
+	BlockNumber    int
+	TXIndex        int
+	ChannelID      string
+	HeaderType     string
+	ValidationCode string
+	ChaincodeID    string
+	Creator        *Identity
+	Endorsers      []*Identity
 }
 
+// ChaincodeEvent is the event set by the chaincode of a valid transaction
+type ChaincodeEvent struct {
+	ChannelID   string
+	ChaincodeID string
+	TXID        string
+	TXDate      int
+	BlockNumber int
+	TXIndex     int
+	EventName   string
+	Payload     []byte
+}
+
+type Operation string
+
 const (
-	PrimaryKey = "_fabric_id"
-	DateKey    = "_fabric_date"
-	TxIDKey    = "_fabric_txid"
+	Upsert Operation = "upsert"
+	Delete Operation = "delete"
 )
 
-func merge(ms ...map[string]*Document) map[string]*Document {
-	res := map[string]*Document{}
-	for _, m := range ms {
-		for k, v := range m {
-			res[k] = v
+// ChangeEvent is a single write of a transaction, the position of the write in the ledger
+// is given by the block number, the index of the transaction in the block and the index
+// of the write in the transaction
+type ChangeEvent struct {
+	Operation   Operation
+	BlockNumber int
+	TXIndex     int
+	WriteIndex  int
+	Document    *Document
+}
+
+type DocumentExtractionResponse struct {
+	// DocumentsToAdd and DocumentsToRemove hold the final state of every document, see Compact
+	DocumentsToAdd    map[DocumentKey]*Document
+	DocumentsToRemove map[DocumentKey]*Document
+	// Events holds every write of the valid transactions in ledger order
+	Events       []*ChangeEvent
+	Transactions []*Transaction
+	Blocks       []*BlockInfo
+	// ChaincodeEvents are the events set by the transactions, in ledger order
+	ChaincodeEvents []*ChaincodeEvent
+}
+
+// Compact reduces the events to the last write of every document
+func Compact(events []*ChangeEvent) (map[DocumentKey]*Document, map[DocumentKey]*Document) {
+	response := &DocumentExtractionResponse{
+		DocumentsToAdd:    map[DocumentKey]*Document{},
+		DocumentsToRemove: map[DocumentKey]*Document{},
+	}
+	for _, event := range events {
+		switch event.Operation {
+		case Upsert:
+			response.add(event.Document)
+		case Delete:
+			response.remove(event.Document)
 		}
 	}
-	return res
+	return response.DocumentsToAdd, response.DocumentsToRemove
+}
+
+func (r *DocumentExtractionResponse) add(document *Document) {
+	key := document.DocumentKey()
+	r.DocumentsToAdd[key] = document
+	delete(r.DocumentsToRemove, key)
+}
+
+func (r *DocumentExtractionResponse) remove(document *Document) {
+	key := document.DocumentKey()
+	r.DocumentsToRemove[key] = document
+	delete(r.DocumentsToAdd, key)
+}
+
+const (
+	PrimaryKey    = "_fabric_id"
+	DateKey       = "_fabric_date"
+	TxIDKey       = "_fabric_txid"
+	CreatorKey    = "_fabric_creator"
+	KeyKey        = "_fabric_key"
+	ChannelKey    = "_fabric_channel"
+	NamespaceKey  = "_fabric_namespace"
+	CollectionKey = "_fabric_collection"
+	// ValueHashKey holds the hash of the value of a private data document
+	ValueHashKey = "_fabric_value_hash"
+)
+
+type options struct {
+	stampCreator      bool
+	privateDataHashes bool
+}
+
+// Option customizes how blocks are transformed into documents
+type Option func(*options)
+
+// WithCreator stamps the decoded transaction creator onto every document under CreatorKey
+func WithCreator(stamp bool) Option {
+	return func(o *options) {
+		o.stampCreator = stamp
+	}
+}
+
+// WithPrivateDataHashes also decodes the writes of the private data collections, whose keys and values
+// are only in the blocks as hashes. Without it the documents only come from the public writes
+func WithPrivateDataHashes(decode bool) Option {
+	return func(o *options) {
+		o.privateDataHashes = decode
+	}
 }
-func BlocksToDocuments(blocks []*cb.Block) (*DocumentExtractionResponse, error) {
+
+func BlocksToDocuments(blocks []*cb.Block, opts ...Option) (*DocumentExtractionResponse, error) {
 	response := &DocumentExtractionResponse{
-		DocumentsToAdd:    map[string]*Document{},
-		DocumentsToRemove: map[string]*Document{},
+		DocumentsToAdd:    map[DocumentKey]*Document{},
+		DocumentsToRemove: map[DocumentKey]*Document{},
 	}
 
 	for _, block := range blocks {
-		r, err := BlockToDocuments(block)
+		r, err := BlockToDocuments(block, opts...)
 		if err != nil {
 			return nil, err
 		}
-		response.DocumentsToAdd = merge(response.DocumentsToAdd, r.DocumentsToAdd)
-		response.DocumentsToRemove = merge(response.DocumentsToRemove, r.DocumentsToRemove)
+		if len(response.Blocks) > 0 && len(r.Blocks) > 0 {
+			previous := response.Blocks[len(response.Blocks)-1]
+			current := r.Blocks[0]
+			if current.Number != previous.Number+1 || current.PreviousHash != previous.Hash {
+				log.Warnf("Block %d doesn't follow block %d", current.Number, previous.Number)
+			}
+		}
+		response.Events = append(response.Events, r.Events...)
+		response.Transactions = append(response.Transactions, r.Transactions...)
+		response.Blocks = append(response.Blocks, r.Blocks...)
+		response.ChaincodeEvents = append(response.ChaincodeEvents, r.ChaincodeEvents...)
 	}
+	response.DocumentsToAdd, response.DocumentsToRemove = Compact(response.Events)
 
 	return response, nil
 }
 
-func BlockToDocuments(block *cb.Block) (*DocumentExtractionResponse, error) {
+func BlockToDocuments(block *cb.Block, opts ...Option) (*DocumentExtractionResponse, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	blockInfo, err := BlockToInfo(block)
+	if err != nil {
+		return nil, err
+	}
 	response := &DocumentExtractionResponse{
-		DocumentsToAdd:    map[string]*Document{},
-		DocumentsToRemove: map[string]*Document{},
+		DocumentsToAdd:    map[DocumentKey]*Document{},
+		DocumentsToRemove: map[DocumentKey]*Document{},
+		Blocks:            []*BlockInfo{blockInfo},
+	}
+	txFilter := txflags.ValidationFlags(nil)
+	if block.Metadata != nil && len(block.Metadata.Metadata) > int(cb.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		txFilter = block.Metadata.Metadata[cb.BlockMetadataIndex_TRANSACTIONS_FILTER]
 	}
 
-	for _, txData := range block.Data.Data {
+	for txIndex, txData := range block.Data.Data {
 		env := &cb.Envelope{}
 		err := proto.Unmarshal(txData, env)
 		if err != nil {
@@ -92,6 +258,26 @@ func BlockToDocuments(block *cb.Block) (*DocumentExtractionResponse, error) {
 			return nil, err
 		}
 		txDateMS := txDate.UnixNano() / int64(time.Millisecond)
+		tx := &Transaction{
+			TXID:        txID,
+			TXDate:      int(txDateMS),
+			BlockNumber: int(block.Header.Number),
+			TXIndex:     txIndex,
+			ChannelID:   chdr.ChannelId,
+			HeaderType:  cb.HeaderType(chdr.Type).String(),
+		}
+		valid := true
+		if txIndex < len(txFilter) {
+			tx.ValidationCode = txFilter.Flag(txIndex).String()
+			valid = txFilter.IsValid(txIndex)
+		}
+		if len(payload.Header.SignatureHeader) > 0 {
+			tx.Creator, err = decodeCreator(payload.Header.SignatureHeader)
+			if err != nil {
+				log.Debugf("Failed to decode creator of tx %s: %v", txID, err)
+			}
+		}
+		response.Transactions = append(response.Transactions, tx)
 		switch cb.HeaderType(chdr.Type) {
 		case cb.HeaderType_MESSAGE:
 			log.Debugf("HeaderType_MESSAGE ignored")
@@ -100,6 +286,7 @@ func BlockToDocuments(block *cb.Block) (*DocumentExtractionResponse, error) {
 		case cb.HeaderType_CONFIG_UPDATE:
 			log.Debugf("HeaderType_CONFIG_UPDATE ignored")
 		case cb.HeaderType_ENDORSER_TRANSACTION:
+			tx.Endorsers = decodeEndorsers(payload.Data)
 			action, err := protoutil.GetActionFromEnvelopeMsg(env)
 			if err != nil {
 				log.Debugf("Failed to get action %v", err)
@@ -109,7 +296,76 @@ func BlockToDocuments(block *cb.Block) (*DocumentExtractionResponse, error) {
 				if err != nil {
 					return nil, err
 				}
-				for _, set := range txRWSet.NsRwSets {
+				if action.ChaincodeId != nil {
+					tx.ChaincodeID = action.ChaincodeId.Name
+				}
+				// the writes and the events of the invalid transactions aren't applied to the world state
+				if len(action.Events) > 0 && valid {
+					ccEvent, err := protoutil.UnmarshalChaincodeEvents(action.Events)
+					if err != nil {
+						log.Debugf("Failed to decode chaincode event of tx %s: %v", txID, err)
+					} else if ccEvent.EventName != "" {
+						response.ChaincodeEvents = append(response.ChaincodeEvents, &ChaincodeEvent{
+							ChannelID:   chdr.ChannelId,
+							ChaincodeID: ccEvent.ChaincodeId,
+							TXID:        txID,
+							TXDate:      int(txDateMS),
+							BlockNumber: int(block.Header.Number),
+							TXIndex:     txIndex,
+							EventName:   ccEvent.EventName,
+							Payload:     ccEvent.Payload,
+						})
+					}
+				}
+				writeIndex := 0
+				addWrite := func(chaincodeID string, collection string, key string, data map[string]interface{}, isDelete bool) {
+					data[TxIDKey] = txID
+					data[DateKey] = txDateMS
+					documentKey := DocumentKey{
+						ChannelID:  chdr.ChannelId,
+						Namespace:  chaincodeID,
+						Collection: collection,
+						Key:        key,
+					}
+					data[PrimaryKey] = documentKey.ID()
+					data[KeyKey] = key
+					data[ChannelKey] = chdr.ChannelId
+					data[NamespaceKey] = chaincodeID
+					data[CollectionKey] = collection
+					if o.stampCreator && tx.Creator != nil {
+						data[CreatorKey] = tx.Creator
+					}
+					document := &Document{
+						ChannelID:   chdr.ChannelId,
+						Data:        data,
+						ChaincodeID: chaincodeID,
+						Collection:  collection,
+						Key:         key,
+						PrimaryKey:  documentKey.ID(),
+						TXID:        txID,
+						TXDate:      int(txDateMS),
+						BlockNumber: int(block.Header.Number),
+						TXIndex:     txIndex,
+						Creator:     tx.Creator,
+					}
+					event := &ChangeEvent{
+						Operation:   Upsert,
+						BlockNumber: int(block.Header.Number),
+						TXIndex:     txIndex,
+						WriteIndex:  writeIndex,
+						Document:    document,
+					}
+					if isDelete {
+						event.Operation = Delete
+					}
+					response.Events = append(response.Events, event)
+					writeIndex++
+				}
+				sets := txRWSet.NsRwSets
+				if !valid {
+					sets = nil
+				}
+				for _, set := range sets {
 					chaincodeID := set.NameSpace
 
 					for _, write := range set.KvRwSet.Writes {
@@ -121,27 +377,25 @@ func BlockToDocuments(block *cb.Block) (*DocumentExtractionResponse, error) {
 								"value": dataStr,
 							}
 						}
-						data[TxIDKey] = txID
-						data[DateKey] = txDateMS
 						compositeKey := "\u0000"
 						key := strings.Trim(write.Key, compositeKey)
 						key = strings.Replace(key, compositeKey, "__", -1)
-						data[PrimaryKey] = key
-						document := &Document{
-							ChannelID:   chdr.ChannelId,
-							Data:        data,
-							ChaincodeID: chaincodeID,
-							PrimaryKey:  key,
-							TXID:        txID,
-							TXDate:      int(txDateMS),
-							BlockNumber: int(block.Header.Number),
+						addWrite(chaincodeID, "", key, data, write.IsDelete)
+					}
+					if !o.privateDataHashes {
+						continue
+					}
+					// the blocks only hold the hashes of the private data, the key of the document
+					// is the hash of the private key and its data the hash of the value
+					for _, collection := range set.CollHashedRwSets {
+						if collection.HashedRwSet == nil {
+							continue
 						}
-						if write.IsDelete {
-							response.DocumentsToRemove[key] = document
-							delete(response.DocumentsToAdd, key)
-						} else {
-							response.DocumentsToAdd[key] = document
-							delete(response.DocumentsToRemove, key)
+						for _, write := range collection.HashedRwSet.HashedWrites {
+							data := map[string]interface{}{
+								ValueHashKey: hex.EncodeToString(write.ValueHash),
+							}
+							addWrite(chaincodeID, collection.CollectionName, hex.EncodeToString(write.KeyHash), data, write.IsDelete)
 						}
 					}
 				}
@@ -155,5 +409,41 @@ func BlockToDocuments(block *cb.Block) (*DocumentExtractionResponse, error) {
 		}
 
 	}
+	response.DocumentsToAdd, response.DocumentsToRemove = Compact(response.Events)
 	return response, nil
 }
+
+func decodeCreator(signatureHeaderBytes []byte) (*Identity, error) {
+	signatureHeader, err := protoutil.UnmarshalSignatureHeader(signatureHeaderBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(signatureHeader.Creator) == 0 {
+		return nil, nil
+	}
+	return DecodeIdentity(signatureHeader.Creator)
+}
+
+func decodeEndorsers(txBytes []byte) []*Identity {
+	var endorsers []*Identity
+	tx, err := protoutil.UnmarshalTransaction(txBytes)
+	if err != nil {
+		log.Debugf("Failed to unmarshal transaction %v", err)
+		return nil
+	}
+	for _, txAction := range tx.Actions {
+		ccActionPayload, err := protoutil.UnmarshalChaincodeActionPayload(txAction.Payload)
+		if err != nil || ccActionPayload.Action == nil {
+			continue
+		}
+		for _, endorsement := range ccActionPayload.Action.Endorsements {
+			endorser, err := DecodeIdentity(endorsement.Endorser)
+			if err != nil {
+				log.Debugf("Failed to decode endorser %v", err)
+				continue
+			}
+			endorsers = append(endorsers, endorser)
+		}
+	}
+	return endorsers
+}
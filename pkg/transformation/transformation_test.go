@@ -5,6 +5,7 @@ import (
 	cb "github.com/hyperledger/fabric-protos-go/common"
 	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
 	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/kfsoftware/hlf-sync/internal/github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
 	"github.com/kfsoftware/hlf-sync/pkg/mocks"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -52,15 +53,287 @@ func TestMapping(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, response.DocumentsToAdd, 1)
 	assert.Len(t, response.DocumentsToRemove, 1)
-	assert.Equal(t, response.DocumentsToAdd[keyInsert].PrimaryKey, "K1")
-	assert.Equal(t, response.DocumentsToAdd[keyInsert].TXID, txID)
-	assert.Equal(t, response.DocumentsToAdd[keyInsert].ChannelID, channelID)
-	data := response.DocumentsToAdd[keyInsert].Data
-	delete(data, PrimaryKey)
-	delete(data, TxIDKey)
-	delete(data, DateKey)
+	insertKey := DocumentKey{ChannelID: channelID, Namespace: chID, Key: keyInsert}
+	deleteKey := DocumentKey{ChannelID: channelID, Namespace: chID, Key: keyDelete}
+	assert.Equal(t, response.DocumentsToAdd[insertKey].Key, "K1")
+	assert.Equal(t, response.DocumentsToAdd[insertKey].PrimaryKey, insertKey.ID())
+	assert.Equal(t, response.DocumentsToAdd[insertKey].TXID, txID)
+	assert.Equal(t, response.DocumentsToAdd[insertKey].ChannelID, channelID)
+	data := response.DocumentsToAdd[insertKey].Data
+	assert.Equal(t, data[PrimaryKey], insertKey.ID())
+	assert.Equal(t, data[KeyKey], keyInsert)
+	assert.Equal(t, data[NamespaceKey], chID)
+	assert.Equal(t, data[ChannelKey], channelID)
+	for _, fabricKey := range []string{PrimaryKey, TxIDKey, DateKey, KeyKey, ChannelKey, NamespaceKey, CollectionKey} {
+		delete(data, fabricKey)
+	}
 	assert.Equal(t, data, k2Data)
-	assert.Equal(t, response.DocumentsToRemove[keyDelete].PrimaryKey, "K2")
-	assert.Equal(t, response.DocumentsToRemove[keyDelete].TXID, txID)
-	assert.Equal(t, response.DocumentsToRemove[keyDelete].ChannelID, channelID)
+	assert.Equal(t, response.DocumentsToRemove[deleteKey].Key, "K2")
+	assert.Equal(t, response.DocumentsToRemove[deleteKey].TXID, txID)
+	assert.Equal(t, response.DocumentsToRemove[deleteKey].ChannelID, channelID)
+}
+
+func TestSameKeyInSeveralChaincodes(t *testing.T) {
+	channelID := "mychannel"
+	tx := func(txID string, chaincodeID string, write *kvrwset.KVWrite) *mocks.TXInfo {
+		return &mocks.TXInfo{
+			TxID:             txID,
+			TxValidationCode: pb.TxValidationCode_VALID,
+			HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+			ChaincodeID:      chaincodeID,
+			Results:          mocks.GetTxResults(chaincodeID, []*kvrwset.KVWrite{write}),
+		}
+	}
+	response, err := BlocksToDocuments([]*cb.Block{
+		mocks.NewBlock(
+			channelID,
+			tx("1", "cc1", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"a"}`)}),
+			tx("2", "cc2", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"b"}`)}),
+			tx("3", "cc3", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"c"}`)}),
+		),
+		mocks.NewBlock(
+			channelID,
+			tx("4", "cc2", &kvrwset.KVWrite{Key: "asset1", IsDelete: true}),
+			tx("5", "cc3", &kvrwset.KVWrite{Key: "asset1", IsDelete: true}),
+		),
+		mocks.NewBlock(
+			channelID,
+			tx("6", "cc3", &kvrwset.KVWrite{Key: "asset1", Value: []byte(`{"owner":"d"}`)}),
+		),
+	})
+	assert.NoError(t, err)
+	cc1Key := DocumentKey{ChannelID: channelID, Namespace: "cc1", Key: "asset1"}
+	cc2Key := DocumentKey{ChannelID: channelID, Namespace: "cc2", Key: "asset1"}
+	cc3Key := DocumentKey{ChannelID: channelID, Namespace: "cc3", Key: "asset1"}
+	assert.NotEqual(t, cc1Key.ID(), cc2Key.ID())
+	assert.Len(t, response.DocumentsToAdd, 2)
+	assert.Equal(t, "1", response.DocumentsToAdd[cc1Key].TXID)
+	assert.Equal(t, "6", response.DocumentsToAdd[cc3Key].TXID)
+	assert.Len(t, response.DocumentsToRemove, 1)
+	assert.Equal(t, "4", response.DocumentsToRemove[cc2Key].TXID)
+}
+
+func TestCreatorAndEndorsers(t *testing.T) {
+	channelID := "mychannel"
+	chID := "fabcar"
+	creator := mocks.NewSerializedIdentity(
+		"Org1MSP",
+		"user1",
+		[]string{"client"},
+		map[string]string{"hf.EnrollmentID": "user1", "department": "sales"},
+	)
+	endorser := mocks.NewSerializedIdentity("Org2MSP", "peer0", []string{"peer"}, nil)
+	results := mocks.GetTxResults(
+		chID,
+		[]*kvrwset.KVWrite{
+			{
+				Key:   "K1",
+				Value: []byte(`{"color":"red"}`),
+			},
+		},
+	)
+	txID := "12"
+	blk := mocks.NewBlock(
+		channelID,
+		&mocks.TXInfo{
+			TxID:             txID,
+			TxValidationCode: pb.TxValidationCode_VALID,
+			HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+			ChaincodeID:      chID,
+			Results:          results,
+			Creator:          creator,
+			Endorsers:        [][]byte{endorser},
+		},
+	)
+	response, err := BlockToDocuments(blk, WithCreator(true))
+	assert.NoError(t, err)
+	assert.Len(t, response.Transactions, 1)
+	tx := response.Transactions[0]
+	assert.Equal(t, txID, tx.TXID)
+	assert.Equal(t, pb.TxValidationCode_VALID.String(), tx.ValidationCode)
+	assert.Equal(t, "Org1MSP", tx.Creator.MSPID)
+	assert.Equal(t, "user1", tx.Creator.CommonName)
+	assert.Equal(t, ClientRole, tx.Creator.Role)
+	assert.Equal(t, "4d2", tx.Creator.SerialNumber)
+	assert.Equal(t, "sales", tx.Creator.Attributes["department"])
+	assert.Equal(t, "user1", tx.Creator.Attributes["hf.EnrollmentID"])
+	assert.Len(t, tx.Endorsers, 1)
+	assert.Equal(t, "Org2MSP", tx.Endorsers[0].MSPID)
+	assert.Equal(t, PeerRole, tx.Endorsers[0].Role)
+	documentKey := DocumentKey{ChannelID: channelID, Namespace: chID, Key: "K1"}
+	assert.Equal(t, tx.Creator, response.DocumentsToAdd[documentKey].Data[CreatorKey])
+
+	response, err = BlockToDocuments(blk)
+	assert.NoError(t, err)
+	assert.NotContains(t, response.DocumentsToAdd[documentKey].Data, CreatorKey)
+	assert.Equal(t, "Org1MSP", response.DocumentsToAdd[documentKey].Creator.MSPID)
+}
+
+func TestChangeEventsOrder(t *testing.T) {
+	channelID := "mychannel"
+	chID := "fabcar"
+	tx := func(txID string, writes ...*kvrwset.KVWrite) *mocks.TXInfo {
+		return &mocks.TXInfo{
+			TxID:             txID,
+			TxValidationCode: pb.TxValidationCode_VALID,
+			HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+			ChaincodeID:      chID,
+			Results:          mocks.GetTxResults(chID, writes),
+		}
+	}
+	blk1 := mocks.NewBlock(
+		channelID,
+		tx("1", &kvrwset.KVWrite{Key: "K1", Value: []byte(`{"v":1}`)}, &kvrwset.KVWrite{Key: "K2", Value: []byte(`{"v":1}`)}),
+		tx("2", &kvrwset.KVWrite{Key: "K1", IsDelete: true}),
+	)
+	blk2 := mocks.NewBlock(
+		channelID,
+		tx("3", &kvrwset.KVWrite{Key: "K1", Value: []byte(`{"v":2}`)}),
+	)
+	blk2.Header.Number = 1
+	response, err := BlocksToDocuments([]*cb.Block{blk1, blk2})
+	assert.NoError(t, err)
+	assert.Len(t, response.Events, 4)
+	type position struct {
+		op          Operation
+		key         string
+		blockNumber int
+		txIndex     int
+		writeIndex  int
+	}
+	var positions []position
+	for _, event := range response.Events {
+		positions = append(positions, position{event.Operation, event.Document.Key, event.BlockNumber, event.TXIndex, event.WriteIndex})
+	}
+	assert.Equal(t, []position{
+		{Upsert, "K1", 0, 0, 0},
+		{Upsert, "K2", 0, 0, 1},
+		{Delete, "K1", 0, 1, 0},
+		{Upsert, "K1", 1, 0, 0},
+	}, positions)
+	k1 := DocumentKey{ChannelID: channelID, Namespace: chID, Key: "K1"}
+	assert.Len(t, response.DocumentsToAdd, 2)
+	assert.Empty(t, response.DocumentsToRemove)
+	assert.Equal(t, "3", response.DocumentsToAdd[k1].TXID)
+	assert.Equal(t, float64(2), response.DocumentsToAdd[k1].Data["v"])
+	k2 := DocumentKey{ChannelID: channelID, Namespace: chID, Key: "K2"}
+	assert.True(t, response.DocumentsToAdd[k1].Version() > response.DocumentsToAdd[k2].Version())
+	deleted := response.Events[2].Document
+	assert.Equal(t, 1, deleted.TXIndex)
+	assert.True(t, deleted.Version() > response.DocumentsToAdd[k2].Version())
+}
+
+func TestChaincodeEvents(t *testing.T) {
+	channelID := "mychannel"
+	chID := "fabcar"
+	tx := func(txID string, event *pb.ChaincodeEvent) *mocks.TXInfo {
+		return &mocks.TXInfo{
+			TxID:             txID,
+			TxValidationCode: pb.TxValidationCode_VALID,
+			HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+			ChaincodeID:      chID,
+			Results:          mocks.GetTxResults(chID, []*kvrwset.KVWrite{{Key: "K1", Value: []byte(`{"v":1}`)}}),
+			Event:            event,
+		}
+	}
+	invalidTx := tx("3", &pb.ChaincodeEvent{ChaincodeId: chID, TxId: "3", EventName: "CarCreated"})
+	invalidTx.TxValidationCode = pb.TxValidationCode_MVCC_READ_CONFLICT
+	blk := mocks.NewBlock(
+		channelID,
+		tx("1", &pb.ChaincodeEvent{ChaincodeId: chID, TxId: "1", EventName: "CarCreated", Payload: []byte(`{"id":"K1"}`)}),
+		tx("2", nil),
+		invalidTx,
+	)
+	response, err := BlocksToDocuments([]*cb.Block{blk})
+	assert.NoError(t, err)
+	// the event of the invalid transaction is left out
+	assert.Len(t, response.ChaincodeEvents, 1)
+	event := response.ChaincodeEvents[0]
+	assert.Equal(t, "1", event.TXID)
+	assert.Equal(t, chID, event.ChaincodeID)
+	assert.Equal(t, channelID, event.ChannelID)
+	assert.Equal(t, "CarCreated", event.EventName)
+	assert.Equal(t, 0, event.TXIndex)
+	assert.Equal(t, []byte(`{"id":"K1"}`), event.Payload)
+	assert.Equal(t, response.Transactions[0].TXDate, event.TXDate)
+}
+
+func TestPrivateDataHashes(t *testing.T) {
+	channelID := "mychannel"
+	chID := "marbles"
+	txRWSet := &rwsetutil.TxRwSet{NsRwSets: []*rwsetutil.NsRwSet{{
+		NameSpace: chID,
+		KvRwSet:   &kvrwset.KVRWSet{Writes: []*kvrwset.KVWrite{{Key: "marble1", Value: []byte(`{"color":"blue"}`)}}},
+		CollHashedRwSets: []*rwsetutil.CollHashedRwSet{{
+			CollectionName: "collectionMarblePrivateDetails",
+			HashedRwSet: &kvrwset.HashedRWSet{HashedWrites: []*kvrwset.KVWriteHash{
+				{KeyHash: []byte{0x01, 0x02}, ValueHash: []byte{0x0a, 0x0b}},
+				{KeyHash: []byte{0x03}, IsDelete: true},
+			}},
+		}},
+	}}}
+	results, err := txRWSet.ToProtoBytes()
+	assert.NoError(t, err)
+	blk := mocks.NewBlock(channelID, &mocks.TXInfo{
+		TxID:             "1",
+		TxValidationCode: pb.TxValidationCode_VALID,
+		HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+		ChaincodeID:      chID,
+		Results:          results,
+	})
+
+	// without the option only the public write is decoded
+	response, err := BlockToDocuments(blk)
+	assert.NoError(t, err)
+	assert.Len(t, response.Events, 1)
+	assert.Equal(t, "", response.Events[0].Document.Data[CollectionKey])
+
+	response, err = BlockToDocuments(blk, WithPrivateDataHashes(true))
+	assert.NoError(t, err)
+	assert.Len(t, response.Events, 3)
+	privateKey := DocumentKey{ChannelID: channelID, Namespace: chID, Collection: "collectionMarblePrivateDetails", Key: "0102"}
+	document := response.DocumentsToAdd[privateKey]
+	if assert.NotNil(t, document) {
+		assert.Equal(t, "collectionMarblePrivateDetails", document.Collection)
+		assert.Equal(t, "collectionMarblePrivateDetails", document.Data[CollectionKey])
+		assert.Equal(t, "0a0b", document.Data[ValueHashKey])
+		assert.Equal(t, privateKey.ID(), document.PrimaryKey)
+		assert.NotEqual(t, DocumentKey{ChannelID: channelID, Namespace: chID, Key: "0102"}.ID(), document.PrimaryKey)
+	}
+	deleteKey := DocumentKey{ChannelID: channelID, Namespace: chID, Collection: "collectionMarblePrivateDetails", Key: "03"}
+	assert.Contains(t, response.DocumentsToRemove, deleteKey)
+	assert.Equal(t, 2, response.Events[2].WriteIndex)
+}
+
+func TestInvalidTransactions(t *testing.T) {
+	channelID := "mychannel"
+	chID := "fabcar"
+	tx := func(txID string, code pb.TxValidationCode, writes ...*kvrwset.KVWrite) *mocks.TXInfo {
+		return &mocks.TXInfo{
+			TxID:             txID,
+			TxValidationCode: code,
+			HeaderType:       cb.HeaderType_ENDORSER_TRANSACTION,
+			ChaincodeID:      chID,
+			Results:          mocks.GetTxResults(chID, writes),
+		}
+	}
+	blk := mocks.NewBlock(
+		channelID,
+		tx("1", pb.TxValidationCode_VALID, &kvrwset.KVWrite{Key: "K1", Value: []byte(`{"v":1}`)}),
+		tx("2", pb.TxValidationCode_MVCC_READ_CONFLICT, &kvrwset.KVWrite{Key: "K1", Value: []byte(`{"v":2}`)}, &kvrwset.KVWrite{Key: "K2", Value: []byte(`{"v":2}`)}),
+		tx("3", pb.TxValidationCode_ENDORSEMENT_POLICY_FAILURE, &kvrwset.KVWrite{Key: "K1", IsDelete: true}),
+		// a replay of the first transaction
+		tx("1", pb.TxValidationCode_DUPLICATE_TXID, &kvrwset.KVWrite{Key: "K1", Value: []byte(`{"v":3}`)}),
+	)
+	response, err := BlocksToDocuments([]*cb.Block{blk})
+	assert.NoError(t, err)
+	assert.Len(t, response.Events, 1)
+	assert.Equal(t, "1", response.Events[0].Document.TXID)
+	k1 := DocumentKey{ChannelID: channelID, Namespace: chID, Key: "K1"}
+	assert.Len(t, response.DocumentsToAdd, 1)
+	assert.Equal(t, float64(1), response.DocumentsToAdd[k1].Data["v"])
+	assert.Empty(t, response.DocumentsToRemove)
+	// the invalid transactions are still decoded
+	assert.Len(t, response.Transactions, 4)
+	assert.Equal(t, "MVCC_READ_CONFLICT", response.Transactions[1].ValidationCode)
 }